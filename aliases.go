@@ -0,0 +1,252 @@
+package comicjerk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AliasesPluginName is the name channel command aliases are stored under in Bot.Data.
+const AliasesPluginName = "Aliases"
+
+// maxAliases is the number of custom aliases a channel can have.
+const maxAliases = 25
+
+func aliasesKey(channel string) string {
+	return "aliases:" + channel
+}
+
+// copyAliases returns a copy of aliases, so that the cached aliases can not be changed by callers.
+func copyAliases(aliases map[string]string) map[string]string {
+	c := make(map[string]string, len(aliases))
+	for alias, commandString := range aliases {
+		c[alias] = commandString
+	}
+	return c
+}
+
+// channelAliases returns the cached aliases of a channel, loading them if they are not cached. The lock must be held.
+func (b *Bot) channelAliases(service Service, channel string) map[string]string {
+	key := service.Name() + "/" + channel
+	aliases, ok := b.aliases[key]
+	if !ok {
+		aliases = map[string]string{}
+		b.Data(service, AliasesPluginName).Get(aliasesKey(channel), &aliases)
+		b.aliases[key] = aliases
+	}
+	return aliases
+}
+
+// ChannelAliases returns the custom command aliases of a channel, mapping each alias to the command it runs.
+// They are looked up for every message, so they are parsed once and cached until they are changed.
+func (b *Bot) ChannelAliases(service Service, channel string) map[string]string {
+	b.aliasMutex.Lock()
+	defer b.aliasMutex.Unlock()
+
+	return copyAliases(b.channelAliases(service, channel))
+}
+
+// SetChannelAlias adds or replaces a custom command alias in a channel.
+// The alias must be a single word that is not already a command, and the command it runs must start with a command registered
+// on the service or in the channel.
+func (b *Bot) SetChannelAlias(service Service, channel, alias, commandString string) error {
+	alias = strings.ToLower(alias)
+	commandString = strings.TrimSpace(commandString)
+
+	if alias == "" || len(strings.Fields(alias)) != 1 || strings.TrimSpace(alias) != alias {
+		return errors.New("An alias must be a single word.")
+	}
+	if b.IsChannelCommand(service, channel, alias) {
+		return fmt.Errorf("%s is already a command.", alias)
+	}
+	if !b.IsChannelCommand(service, channel, commandString) {
+		return fmt.Errorf("%s is not a command.", commandString)
+	}
+
+	b.aliasMutex.Lock()
+	defer b.aliasMutex.Unlock()
+
+	aliases := copyAliases(b.channelAliases(service, channel))
+	if _, ok := aliases[alias]; !ok && len(aliases) >= maxAliases {
+		return fmt.Errorf("A channel can have at most %d aliases.", maxAliases)
+	}
+	aliases[alias] = commandString
+	if err := b.Data(service, AliasesPluginName).Set(aliasesKey(channel), aliases); err != nil {
+		return err
+	}
+	b.aliases[service.Name()+"/"+channel] = aliases
+	return nil
+}
+
+// RemoveChannelAlias removes a custom command alias from a channel, and returns whether it existed.
+func (b *Bot) RemoveChannelAlias(service Service, channel, alias string) (bool, error) {
+	alias = strings.ToLower(alias)
+
+	b.aliasMutex.Lock()
+	defer b.aliasMutex.Unlock()
+
+	aliases := copyAliases(b.channelAliases(service, channel))
+	if _, ok := aliases[alias]; !ok {
+		return false, nil
+	}
+	delete(aliases, alias)
+
+	key := service.Name() + "/" + channel
+	data := b.Data(service, AliasesPluginName)
+	if len(aliases) == 0 {
+		data.Delete(aliasesKey(channel))
+		b.aliases[key] = aliases
+		return true, nil
+	}
+	if err := data.Set(aliasesKey(channel), aliases); err != nil {
+		return true, err
+	}
+	b.aliases[key] = aliases
+	return true, nil
+}
+
+// replaceAlias replaces an alias at the start of a command with the command it runs.
+// The prefix, and anything following the alias, is kept.
+func replaceAlias(prefixes []string, private bool, text string, aliases map[string]string) (string, bool) {
+	text = strings.TrimSpace(text)
+
+	rest, ok := trimPrefix(prefixes, text)
+	if !ok && !private {
+		return text, false
+	}
+	head := text[:len(text)-len(rest)]
+
+	trimmed := strings.TrimLeft(rest, " \t")
+	head += rest[:len(rest)-len(trimmed)]
+
+	fields := strings.Fields(trimmed)
+	if len(fields) == 0 {
+		return text, false
+	}
+	commandString, ok := aliases[strings.ToLower(fields[0])]
+	if !ok {
+		return text, false
+	}
+	return head + commandString + trimmed[len(fields[0]):], true
+}
+
+// aliasMessage rewrites a message that uses a custom alias of its channel, so that it runs the aliased command.
+func (b *Bot) aliasMessage(service Service, message Message) Message {
+	if message.Type() != MessageTypeCreate {
+		return message
+	}
+	aliases := b.ChannelAliases(service, message.Channel())
+	if len(aliases) == 0 {
+		return message
+	}
+
+	prefixes := CommandPrefixes(service, message)
+	private := service.IsPrivate(message)
+
+	content, ok := replaceAlias(prefixes, private, message.Message(), aliases)
+	if !ok {
+		return message
+	}
+
+	// Mention prefixes are replaced in the message, but not in the raw message.
+	rawPrefixes := prefixes
+	if fields := strings.Fields(message.RawMessage()); len(fields) > 0 && strings.HasPrefix(fields[0], "<@") && MentionUserID(fields[0]) == service.UserID() {
+		rawPrefixes = append([]string{fields[0]}, prefixes...)
+	}
+	raw, _ := replaceAlias(rawPrefixes, private, message.RawMessage(), aliases)
+
+	m := &channelMessage{message: message}
+	if cm, ok := message.(*channelMessage); ok {
+		c := *cm
+		m = &c
+	}
+	m.aliased, m.content, m.raw = true, content, raw
+	return m
+}
+
+// aliasHelp returns the help for the custom aliases of the channel of a message.
+func (b *Bot) aliasHelp(service Service, message Message) []string {
+	aliases := b.ChannelAliases(service, message.Channel())
+
+	help := []string{}
+	for alias, commandString := range aliases {
+		help = append(help, CommandHelp(service, alias, "", fmt.Sprintf("Alias of %s%s in this channel.", service.CommandPrefix(), commandString))...)
+	}
+	sort.Strings(help)
+	return help
+}
+
+// AliasArgs are the arguments for the alias add command.
+var AliasArgs = &ArgSpec{
+	Args: []*Arg{
+		{Name: "alias", Type: ArgString},
+		{Name: "command", Type: ArgRest},
+	},
+}
+
+// AliasAddCommand is a command for adding a custom alias to the current channel.
+func AliasAddCommand(bot *Bot, service Service, message Message, args *Args) {
+	alias, commandString := args.String("alias"), args.String("command")
+
+	// Allow the command to be written with a prefix, eg. alias add c !comic.
+	if trimmed, ok := trimPrefix(CommandPrefixes(service, message), commandString); ok {
+		commandString = strings.TrimSpace(trimmed)
+	}
+
+	if err := bot.SetChannelAlias(service, message.Channel(), alias, commandString); err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	prefix := CommandPrefix(service, message)
+	service.SendMessage(message.Channel(), fmt.Sprintf("%s%s is now an alias of %s%s.", prefix, strings.ToLower(alias), prefix, commandString))
+}
+
+// AliasAddHelp is the help text for the alias add command.
+const AliasAddHelp = "Adds an alias for a command in this channel."
+
+// AliasRemoveArgs are the arguments for the alias remove command.
+var AliasRemoveArgs = &ArgSpec{
+	Args: []*Arg{
+		{Name: "alias", Type: ArgString},
+	},
+}
+
+// AliasRemoveCommand is a command for removing a custom alias from the current channel.
+func AliasRemoveCommand(bot *Bot, service Service, message Message, args *Args) {
+	alias := args.String("alias")
+
+	removed, err := bot.RemoveChannelAlias(service, message.Channel(), alias)
+	if err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	if !removed {
+		service.SendMessage(message.Channel(), fmt.Sprintf("%s is not an alias in this channel.", alias))
+		return
+	}
+	service.SendMessage(message.Channel(), fmt.Sprintf("Removed alias %s.", alias))
+}
+
+// AliasRemoveHelp is the help text for the alias remove command.
+const AliasRemoveHelp = "Removes an alias from this channel."
+
+// AliasListCommand is a command that lists the custom aliases of the current channel.
+func AliasListCommand(bot *Bot, service Service, message Message, args string, parts []string) {
+	aliases := bot.ChannelAliases(service, message.Channel())
+	if len(aliases) == 0 {
+		service.SendMessage(message.Channel(), "There are no aliases in this channel.")
+		return
+	}
+
+	prefix := CommandPrefix(service, message)
+	list := []string{}
+	for alias, commandString := range aliases {
+		list = append(list, fmt.Sprintf("%s%s = %s%s", prefix, alias, prefix, commandString))
+	}
+	sort.Strings(list)
+	service.SendMessage(message.Channel(), fmt.Sprintf("Aliases in this channel: %s", strings.Join(list, ", ")))
+}
+
+// AliasListHelp is the help for the alias list command.
+var AliasListHelp = NewCommandHelp("", "Lists the aliases in this channel.")
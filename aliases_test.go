@@ -0,0 +1,135 @@
+package comicjerk
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChannelAliases(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {
+		service.SendMessage(message.Channel(), "pong "+args)
+	}, NewCommandHelp("", "Replies with pong."))
+	bot.RegisterPlugin(service, NewHelpPlugin())
+	bot.Open()
+
+	if err := bot.SetChannelAlias(service, "#channel", "P", "ping"); err != nil {
+		t.Fatal(err)
+	}
+	for _, alias := range []struct {
+		alias, commandString string
+	}{
+		{"two words", "ping"},
+		{"", "ping"},
+		{"ping", "ping"},
+		{"pong", "pong"},
+	} {
+		if err := bot.SetChannelAlias(service, "#channel", alias.alias, alias.commandString); err == nil {
+			t.Errorf("alias %q of %q was added, want an error", alias.alias, alias.commandString)
+		}
+	}
+
+	// Changing the returned aliases does not change the channel's aliases.
+	bot.ChannelAliases(service, "#channel")["p"] = "help"
+
+	if got := send(service, "bob", "!p hello"); got != "pong hello" {
+		t.Errorf("!p hello = %q, want pong hello", got)
+	}
+	if got := send(service, "bob", "!help"); !strings.Contains(got, "!p - Alias of !ping in this channel.") {
+		t.Errorf("help = %q, want it to list the alias", got)
+	}
+
+	if removed, err := bot.RemoveChannelAlias(service, "#channel", "p"); !removed || err != nil {
+		t.Errorf("RemoveChannelAlias = %v, %v, want the alias removed", removed, err)
+	}
+	if removed, _ := bot.RemoveChannelAlias(service, "#channel", "p"); removed {
+		t.Error("RemoveChannelAlias removed an alias twice")
+	}
+	if got := send(service, "bob", "!p hello"); got != "" {
+		t.Errorf("!p hello = %q, want no reply after the alias was removed", got)
+	}
+}
+
+func TestChannelAliasLimit(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {}, nil)
+	bot.Open()
+
+	for n := 0; n < maxAliases; n++ {
+		if err := bot.SetChannelAlias(service, "#channel", fmt.Sprintf("p%d", n), "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bot.SetChannelAlias(service, "#channel", "another", "ping"); err == nil {
+		t.Error("an alias was added past the limit")
+	}
+	// Replacing an alias does not count against the limit.
+	if err := bot.SetChannelAlias(service, "#channel", "p0", "ping"); err != nil {
+		t.Errorf("replacing an alias = %v, want no error", err)
+	}
+}
+
+func TestReplaceAlias(t *testing.T) {
+	aliases := map[string]string{"p": "ping", "c": "comic 5"}
+	for _, test := range []struct {
+		prefixes []string
+		private  bool
+		text     string
+		want     string
+		ok       bool
+	}{
+		{[]string{"!"}, false, "!p hello", "!ping hello", true},
+		{[]string{"!"}, false, "! P  hello", "! ping  hello", true},
+		{[]string{"!"}, false, "!c", "!comic 5", true},
+		{[]string{"!"}, false, "p hello", "p hello", false},
+		{[]string{"!"}, true, "p hello", "ping hello", true},
+		{[]string{"!"}, false, "!pong", "!pong", false},
+		{[]string{"!"}, false, "!", "!", false},
+		{[]string{"!", "@comicjerk "}, false, "@comicjerk p", "@comicjerk ping", true},
+	} {
+		got, ok := replaceAlias(test.prefixes, test.private, test.text, aliases)
+		if got != test.want || ok != test.ok {
+			t.Errorf("replaceAlias(%q) = %q, %v, want %q, %v", test.text, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// rawTestMessage is a TestMessage with a raw message that differs from its content, like a mention on Discord.
+type rawTestMessage struct {
+	*TestMessage
+	raw string
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *rawTestMessage) RawMessage() string {
+	return m.raw
+}
+
+func TestAliasMessageMention(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {}, nil)
+	bot.Open()
+	service.Prefix = "@comicjerk "
+	if err := bot.SetChannelAlias(service, "#channel", "p", "ping"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mention is replaced in the message, but the raw message still starts with it.
+	message := bot.aliasMessage(service, &rawTestMessage{&TestMessage{ChannelID: "#channel", Author: "bob", Content: "@comicjerk p <@alice>"}, "<@comicjerk> p <@alice>"})
+	if message.Message() != "@comicjerk ping <@alice>" || message.RawMessage() != "<@comicjerk> ping <@alice>" {
+		t.Errorf("message = %q, raw %q, want the alias replaced in both", message.Message(), message.RawMessage())
+	}
+
+	// Updates are not rewritten.
+	update := &TestMessage{ChannelID: "#channel", Author: "bob", Content: "@comicjerk p", MessageType: MessageTypeUpdate}
+	if message := bot.aliasMessage(service, update); message != Message(update) {
+		t.Errorf("update = %q, want it unchanged", message.Message())
+	}
+}
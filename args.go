@@ -0,0 +1,394 @@
+package comicjerk
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgType is the type of a command argument.
+type ArgType int
+
+const (
+	// ArgString is a single word, or a quoted string.
+	ArgString ArgType = iota
+	// ArgInt is an integer, optionally limited to the range Min to Max.
+	ArgInt
+	// ArgDuration is a duration such as 90s, 5m, 2h30m, 3d or 1w.
+	ArgDuration
+	// ArgUser is a user, the value is the user id if the user was mentioned, or named on a UserNameService.
+	ArgUser
+	// ArgBool is a flag that takes no value.
+	ArgBool
+	// ArgRest is all the remaining text, it must be the last positional argument.
+	ArgRest
+)
+
+// Arg describes a positional argument or a flag of a command.
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+	// Min and Max limit the value of an ArgInt, they are ignored if Max is not greater than Min.
+	Min, Max int
+}
+
+// ArgSpec describes the arguments of a command.
+type ArgSpec struct {
+	Args  []*Arg
+	Flags []*Arg
+}
+
+// Args are the parsed arguments of a command.
+type Args struct {
+	values map[string]interface{}
+}
+
+// Has returns whether an argument or flag was provided.
+func (a *Args) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+// String returns the value of a string, user or rest argument.
+func (a *Args) String(name string) string {
+	s, _ := a.values[name].(string)
+	return s
+}
+
+// Int returns the value of an int argument.
+func (a *Args) Int(name string) int {
+	i, _ := a.values[name].(int)
+	return i
+}
+
+// Duration returns the value of a duration argument.
+func (a *Args) Duration(name string) time.Duration {
+	d, _ := a.values[name].(time.Duration)
+	return d
+}
+
+// User returns the user id of a user argument.
+func (a *Args) User(name string) string {
+	return a.String(name)
+}
+
+// Bool returns whether a bool flag was provided.
+func (a *Args) Bool(name string) bool {
+	b, _ := a.values[name].(bool)
+	return b
+}
+
+func (arg *Arg) usage() string {
+	name := arg.Name
+	switch arg.Type {
+	case ArgInt:
+		if arg.Max > arg.Min {
+			name = fmt.Sprintf("%s:%d-%d", name, arg.Min, arg.Max)
+		}
+	case ArgRest:
+		name += "..."
+	}
+	return name
+}
+
+// Usage returns a usage string for the spec, eg. <user> [lines:1-10] [--private].
+func (s *ArgSpec) Usage() string {
+	usage := []string{}
+	for _, arg := range s.Args {
+		if arg.Optional {
+			usage = append(usage, "["+arg.usage()+"]")
+		} else {
+			usage = append(usage, "<"+arg.usage()+">")
+		}
+	}
+	for _, flag := range s.Flags {
+		if flag.Type == ArgBool {
+			usage = append(usage, "[--"+flag.Name+"]")
+		} else {
+			usage = append(usage, "[--"+flag.Name+" <"+flag.usage()+">]")
+		}
+	}
+	return strings.Join(usage, " ")
+}
+
+var durationRegex = regexp.MustCompile(`^(\d+)([dw])$`)
+
+// ParseDuration parses a duration, it accepts everything time.ParseDuration does, as well as days (d) and weeks (w).
+func ParseDuration(s string) (time.Duration, error) {
+	if match := durationRegex.FindStringSubmatch(strings.ToLower(s)); match != nil {
+		i, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+		if match[2] == "w" {
+			return time.Duration(i) * time.Hour * 24 * 7, nil
+		}
+		return time.Duration(i) * time.Hour * 24, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (arg *Arg) parse(value string) (interface{}, error) {
+	switch arg.Type {
+	case ArgInt:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", arg.Name)
+		}
+		if arg.Max > arg.Min && (i < arg.Min || i > arg.Max) {
+			return nil, fmt.Errorf("%s must be between %d and %d", arg.Name, arg.Min, arg.Max)
+		}
+		return i, nil
+	case ArgDuration:
+		d, err := ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s must be a duration, eg. 10m", arg.Name)
+		}
+		return d, nil
+	case ArgUser:
+		return MentionUserID(value), nil
+	}
+	return value, nil
+}
+
+// argument is a word of a command's arguments, and the offset in the arguments where it starts.
+type argument struct {
+	text  string
+	start int
+}
+
+// SplitArguments splits a string into words, words can be grouped with double quotes, and quotes can be escaped with a backslash.
+// Single quotes are not special, so apostrophes can be used in words.
+func SplitArguments(s string) ([]string, error) {
+	args, err := splitArguments(s)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = arg.text
+	}
+	return parts, nil
+}
+
+// splitArguments splits a string like SplitArguments, on an unterminated quote the words are returned with the error,
+// the last being the unterminated one.
+func splitArguments(s string) ([]argument, error) {
+	args := []argument{}
+	current := []rune{}
+	start := -1
+	quoted := false
+	escaped := false
+
+	for i, r := range s {
+		if start == -1 && r != ' ' && r != '\t' && r != '\n' {
+			start = i
+		}
+
+		switch {
+		case escaped:
+			current = append(current, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if start != -1 {
+				args = append(args, argument{string(current), start})
+				current = current[:0]
+				start = -1
+			}
+		default:
+			current = append(current, r)
+		}
+	}
+
+	if start != -1 {
+		args = append(args, argument{string(current), start})
+	}
+	if quoted {
+		return args, errors.New("unterminated quote")
+	}
+	return args, nil
+}
+
+// Parse parses arguments according to the spec.
+// An ArgRest argument is the raw text from where it starts, quotes and flags in it are left as they are.
+func (s *ArgSpec) Parse(args string) (*Args, error) {
+	a := &Args{values: make(map[string]interface{})}
+
+	rest := -1
+	for i, arg := range s.Args {
+		if arg.Type == ArgRest {
+			rest = i
+			break
+		}
+	}
+
+	// An unterminated quote is only an error if it is not part of the rest argument.
+	words, splitErr := splitArguments(args)
+	if splitErr != nil && rest == -1 {
+		return nil, splitErr
+	}
+
+	positional := []string{}
+	for i := 0; i < len(words); i++ {
+		word := words[i].text
+		if !strings.HasPrefix(word, "--") || len(word) == 2 {
+			if len(positional) == rest {
+				a.values[s.Args[rest].Name] = strings.TrimSpace(args[words[i].start:])
+				break
+			}
+			positional = append(positional, word)
+			continue
+		}
+
+		name := word[2:]
+		value := ""
+		hasValue := false
+		if j := strings.Index(name, "="); j != -1 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+
+		var flag *Arg
+		for _, f := range s.Flags {
+			if strings.EqualFold(f.Name, name) {
+				flag = f
+				break
+			}
+		}
+		if flag == nil {
+			return nil, fmt.Errorf("unknown flag --%s", name)
+		}
+
+		if flag.Type == ArgBool {
+			a.values[flag.Name] = true
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(words) {
+				return nil, fmt.Errorf("--%s needs a value", flag.Name)
+			}
+			i++
+			value = words[i].text
+		}
+
+		v, err := flag.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		a.values[flag.Name] = v
+	}
+
+	if splitErr != nil && !a.Has(s.Args[rest].Name) {
+		return nil, splitErr
+	}
+
+	for i, arg := range s.Args {
+		if arg.Type == ArgRest {
+			if !a.Has(arg.Name) && !arg.Optional {
+				return nil, fmt.Errorf("missing %s", arg.Name)
+			}
+			return a, nil
+		}
+
+		if i >= len(positional) {
+			if !arg.Optional {
+				return nil, fmt.Errorf("missing %s", arg.Name)
+			}
+			continue
+		}
+
+		v, err := arg.parse(positional[i])
+		if err != nil {
+			return nil, err
+		}
+		a.values[arg.Name] = v
+	}
+
+	if len(positional) > len(s.Args) {
+		return nil, fmt.Errorf("too many arguments")
+	}
+
+	return a, nil
+}
+
+// MentionUserID returns the user id from a mention such as <@id> or <@!id>, or the string unchanged if it is not a mention.
+func MentionUserID(mention string) string {
+	if strings.HasPrefix(mention, "<@") && strings.HasSuffix(mention, ">") {
+		mention = strings.TrimPrefix(mention[2:len(mention)-1], "!")
+	}
+	return mention
+}
+
+// UserMention returns a string that mentions a user on a service.
+func UserMention(service Service, userID string) string {
+	if s, ok := service.(UserNameService); ok {
+		if name, ok := s.UserNameForID(userID); ok {
+			return name
+		}
+	}
+	switch service.Name() {
+	case DiscordServiceName, SlackServiceName:
+		return fmt.Sprintf("<@%s>", userID)
+	}
+	return userID
+}
+
+// RawCommandArguments returns the text following a command in the raw message, so that mentions still contain ids.
+func RawCommandArguments(service Service, command string, message Message) string {
+	raw := strings.TrimSpace(message.RawMessage())
+
+	if trimmed, ok := trimPrefix(CommandPrefixes(service, message), raw); ok {
+		raw = trimmed
+	} else if fields := strings.Fields(raw); len(fields) > 0 && strings.HasPrefix(fields[0], "<@") && MentionUserID(fields[0]) == service.UserID() {
+		// Mention prefixes are replaced in the message, but not in the raw message.
+		raw = raw[len(fields[0]):]
+	}
+
+	raw = strings.TrimSpace(raw)
+	if len(raw) >= len(command) && strings.EqualFold(raw[:len(command)], command) {
+		raw = raw[len(command):]
+	}
+	return strings.TrimSpace(raw)
+}
+
+// ParseArgs parses the arguments of a command message according to a spec.
+// On services where users are named by something other than their user id, user arguments are resolved to user ids.
+func ParseArgs(service Service, command string, message Message, spec *ArgSpec) (*Args, error) {
+	a, err := spec.Parse(RawCommandArguments(service, command, message))
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := service.(UserNameService); ok {
+		for _, args := range [][]*Arg{spec.Args, spec.Flags} {
+			for _, arg := range args {
+				if arg.Type != ArgUser || !a.Has(arg.Name) {
+					continue
+				}
+				if userID, ok := s.UserIDForName(a.String(arg.Name)); ok {
+					a.values[arg.Name] = userID
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// UsageMessage returns the reply sent when a command is used with invalid arguments.
+func UsageMessage(service Service, message Message, command string, spec *ArgSpec, err error) string {
+	ticks := ""
+	if service.Name() == DiscordServiceName {
+		ticks = "`"
+	}
+	usage := strings.TrimSpace(fmt.Sprintf("%s%s %s", CommandPrefix(service, message), command, spec.Usage()))
+	return fmt.Sprintf("Invalid arguments, %s. Usage: %s%s%s", err, ticks, usage, ticks)
+}
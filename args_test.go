@@ -0,0 +1,85 @@
+package comicjerk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitArguments(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`one two  three`, []string{"one", "two", "three"}},
+		{`"one two" three`, []string{"one two", "three"}},
+		{`don't stop`, []string{"don't", "stop"}},
+		{`say \"hi\"`, []string{"say", `"hi"`}},
+		{`empty ""`, []string{"empty", ""}},
+	}
+
+	for _, test := range tests {
+		got, err := SplitArguments(test.in)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SplitArguments(%q) = %q, %v, want %q", test.in, got, err, test.want)
+		}
+	}
+
+	if _, err := SplitArguments(`"unterminated`); err == nil {
+		t.Error("unterminated quote was not an error")
+	}
+}
+
+func TestArgSpecParse(t *testing.T) {
+	spec := &ArgSpec{
+		Args: []*Arg{
+			{Name: "time", Type: ArgDuration},
+			{Name: "message", Type: ArgRest},
+		},
+		Flags: []*Arg{
+			{Name: "private", Type: ArgBool},
+		},
+	}
+
+	args, err := spec.Parse(`--private 10m  don't "forget"   --the milk`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !args.Bool("private") {
+		t.Error("private flag was not set")
+	}
+	if d := args.Duration("time"); d != 10*time.Minute {
+		t.Errorf("time = %v, want 10m", d)
+	}
+	// The rest is the raw text, with its quotes, spacing and flags.
+	if m := args.String("message"); m != `don't "forget"   --the milk` {
+		t.Errorf("message = %q", m)
+	}
+
+	if args, err := spec.Parse(`10m say "hi`); err != nil || args.String("message") != `say "hi` {
+		t.Errorf("unterminated quote in rest = %v, %v", args, err)
+	}
+	if _, err := spec.Parse(`"10m`); err == nil {
+		t.Error("unterminated quote outside rest was not an error")
+	}
+	if _, err := spec.Parse(`10m`); err == nil {
+		t.Error("missing rest was not an error")
+	}
+}
+
+func TestArgSpecParseErrors(t *testing.T) {
+	spec := &ArgSpec{
+		Args: []*Arg{
+			{Name: "lines", Type: ArgInt, Optional: true, Min: 1, Max: 10},
+		},
+	}
+
+	if args, err := spec.Parse(""); err != nil || args.Has("lines") {
+		t.Errorf("empty = %v, %v, want no lines", args, err)
+	}
+	for _, in := range []string{"11", "x", "1 2", "--nope"} {
+		if _, err := spec.Parse(in); err == nil {
+			t.Errorf("Parse(%q) was not an error", in)
+		}
+	}
+}
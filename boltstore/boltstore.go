@@ -0,0 +1,55 @@
+package boltstore
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store is a comicjerk.Store backed by an embedded BoltDB database.
+// Each service has its own bucket, keyed by plugin name.
+type Store struct {
+	db *bolt.DB
+}
+
+// Load returns the data saved for a plugin on a service, or nil if nothing has been saved.
+func (s *Store) Load(service, plugin string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(service))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(plugin)); v != nil {
+			// Values are only valid for the life of the transaction.
+			data = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return data, err
+}
+
+// Save persists the data for a plugin on a service.
+func (s *Store) Save(service, plugin string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(service))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(plugin), data)
+	})
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// New opens, or creates, a BoltDB store at path.
+func New(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
@@ -2,6 +2,7 @@ package comicjerk
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -9,17 +10,34 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"runtime/debug"
+	"sync"
+	"time"
 )
 
 // VersionString is the current version of the bot
 const VersionString string = "0.8"
 
+// DefaultCloseTimeout is the default time Close will wait for in-flight message handlers.
+const DefaultCloseTimeout = 10 * time.Second
+
+// DefaultHandlerTimeout is the default time a plugin has to handle a single message.
+const DefaultHandlerTimeout = 30 * time.Second
+
+// DefaultWorkers is the default number of concurrent message handlers per service.
+const DefaultWorkers = 16
+
+type job struct {
+	ctx     context.Context
+	plugin  Plugin
+	message Message
+}
+
 type serviceEntry struct {
 	Service
 	Plugins         map[string]Plugin
 	messageChannels []chan Message
+	jobs            chan *job
 }
 
 // Bot enables registering of Services and Plugins.
@@ -28,7 +46,41 @@ type Bot struct {
 	ImgurID     string
 	ImgurAlbum  string
 	MashableKey string
-	closeFuncs  []func()
+	// Store persists plugin state, defaults to a FileStore in the working directory.
+	Store Store
+	// CloseTimeout is how long Close will wait for in-flight message handlers before giving up.
+	CloseTimeout time.Duration
+	// HandlerTimeout is how long a plugin has to handle a single message, unless overridden with SetPluginTimeout.
+	HandlerTimeout time.Duration
+	// Workers is the number of concurrent message handlers per service, it must be set before Open.
+	Workers    int
+	closeFuncs []func()
+
+	pluginTimeouts map[string]time.Duration
+	middlewares    []Middleware
+	rateLimiter    *rateLimiter
+	router         *commandRouter
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closing   chan struct{}
+	closeOnce sync.Once
+	listeners sync.WaitGroup
+	workers   sync.WaitGroup
+
+	dataMutex sync.Mutex
+	data      map[string]*Data
+
+	// rolesMutex serialises role changes, which read and then write the granted roles.
+	rolesMutex sync.Mutex
+
+	// prefixes caches the parsed custom prefixes of each channel, nil if a channel has none.
+	prefixMutex sync.Mutex
+	prefixes    map[string]*ChannelPrefixes
+
+	// aliases caches the parsed custom aliases of each channel.
+	aliasMutex sync.Mutex
+	aliases    map[string]map[string]string
 }
 
 // MessageRecover is the default panic handler for the bot.
@@ -40,16 +92,33 @@ func MessageRecover() {
 
 // NewBot will create a new bot.
 func NewBot() *Bot {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Bot{
-		Services: make(map[string]*serviceEntry, 0),
+		Services:       make(map[string]*serviceEntry, 0),
+		Store:          NewFileStore(""),
+		CloseTimeout:   DefaultCloseTimeout,
+		HandlerTimeout: DefaultHandlerTimeout,
+		Workers:        DefaultWorkers,
+		pluginTimeouts: make(map[string]time.Duration),
+		rateLimiter:    newRateLimiter(),
+		router:         newCommandRouter(),
+		ctx:            ctx,
+		cancel:         cancel,
+		closing:        make(chan struct{}),
+		data:           make(map[string]*Data),
+		prefixes:       make(map[string]*ChannelPrefixes),
+		aliases:        make(map[string]map[string]string),
+		middlewares:    []Middleware{IgnoreSelf()},
 	}
 }
 
 func (b *Bot) getData(service Service, plugin Plugin) []byte {
-	if b, err := ioutil.ReadFile(service.Name() + "/" + plugin.Name()); err == nil {
-		return b
+	data, err := b.Store.Load(service.Name(), plugin.Name())
+	if err != nil {
+		log.Printf("Error loading plugin %s %s. %v", service.Name(), plugin.Name(), err)
+		return nil
 	}
-	return nil
+	return data
 }
 
 // RegisterService registers a service with the bot.
@@ -61,6 +130,7 @@ func (b *Bot) RegisterService(service Service) {
 	b.Services[serviceName] = &serviceEntry{
 		Service: service,
 		Plugins: make(map[string]Plugin, 0),
+		jobs:    make(chan *job),
 	}
 	b.RegisterPlugin(service, NewHelpPlugin())
 }
@@ -74,15 +144,97 @@ func (b *Bot) RegisterPlugin(service Service, plugin Plugin) {
 	s.Plugins[plugin.Name()] = plugin
 }
 
+// SetPluginTimeout overrides HandlerTimeout for a plugin.
+func (b *Bot) SetPluginTimeout(plugin string, timeout time.Duration) {
+	b.pluginTimeouts[plugin] = timeout
+}
+
+func (b *Bot) pluginTimeout(plugin Plugin) time.Duration {
+	if timeout, ok := b.pluginTimeouts[plugin.Name()]; ok {
+		return timeout
+	}
+	return b.HandlerTimeout
+}
+
+// handle dispatches a message to a single plugin, with a context bounded by the plugins timeout.
+func (b *Bot) handle(ctx context.Context, service Service, plugin Plugin, message Message) {
+	defer MessageRecover()
+
+	ctx, cancel := context.WithTimeout(ctx, b.pluginTimeout(plugin))
+	defer cancel()
+
+	if s, ok := service.(MessageService); ok {
+		service = s.ForMessage(message)
+	}
+
+	if p, ok := plugin.(ContextPlugin); ok {
+		p.MessageContext(ctx, b, service, message)
+	} else {
+		// Plugins that only implement Message can not be cancelled, so they run in their own goroutine.
+		// If one hangs its worker is released when the context ends, the goroutine is left running.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer MessageRecover()
+			plugin.Message(b, service, message)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("Plugin %s %s timed out handling message.", service.Name(), plugin.Name())
+	}
+}
+
+func (b *Bot) work(service Service, jobs <-chan *job) {
+	defer b.workers.Done()
+
+	for j := range jobs {
+		b.handle(j.ctx, service, j.plugin, j.message)
+	}
+}
+
+// dispatch queues a message for every plugin on a service, it is the innermost Handler.
+func (b *Bot) dispatch(ctx context.Context, service Service, message Message) {
+	entry := b.Services[service.Name()]
+	message = b.aliasMessage(service, b.prefixMessage(service, message))
+	_, owner := b.Route(service, message)
+	for _, plugin := range entry.Plugins {
+		// Command messages are only handled by the plugin that registered the command, and plugins without commands.
+		if owner != "" && plugin.Name() != owner && b.router.hasCommands(service, plugin) {
+			continue
+		}
+		// Blocks while all workers are busy, applying backpressure to the service.
+		select {
+		case <-b.closing:
+			return
+		case entry.jobs <- &job{ctx, plugin, message}:
+		}
+	}
+}
+
 func (b *Bot) listen(service Service, messageChan <-chan Message) {
-	serviceName := service.Name()
+	defer b.listeners.Done()
+
+	handler := b.handler()
 	for {
-		message := <-messageChan
-		log.Printf("<%s> %s: %s\n", message.Channel(), message.UserName(), message.Message())
-		plugins := b.Services[serviceName].Plugins
-		for _, plugin := range plugins {
-			go plugin.Message(b, service, message)
+		var message Message
+		var ok bool
+		select {
+		case <-b.closing:
+			return
+		case message, ok = <-messageChan:
+			if !ok {
+				return
+			}
 		}
+
+		log.Printf("<%s> %s: %s\n", message.Channel(), message.UserName(), message.Message())
+		handler(b.ctx, service, message)
 	}
 }
 
@@ -93,6 +245,12 @@ func (b *Bot) Open() {
 			for _, plugin := range service.Plugins {
 				plugin.Load(b, service.Service, b.getData(service, plugin))
 			}
+			b.registerCommands(service)
+			for i := 0; i < b.Workers; i++ {
+				b.workers.Add(1)
+				go b.work(service.Service, service.jobs)
+			}
+			b.listeners.Add(1)
 			go b.listen(service.Service, messageChan)
 		} else {
 			log.Printf("Error creating service %s: %v\n", service.Name(), err)
@@ -104,36 +262,84 @@ func (b *Bot) Open() {
 func (b *Bot) Save() {
 	for _, service := range b.Services {
 		serviceName := service.Name()
-		if err := os.Mkdir(serviceName, os.ModePerm); err != nil {
-			if !os.IsExist(err) {
-				log.Println("Error creating service directory.")
-			}
-		}
 		for _, plugin := range service.Plugins {
 			if data, err := plugin.Save(); err != nil {
 				log.Printf("Error saving plugin %s %s. %v", serviceName, plugin.Name(), err)
 			} else if data != nil {
-				if err := ioutil.WriteFile(serviceName+"/"+plugin.Name(), data, os.ModePerm); err != nil {
+				if err := b.Store.Save(serviceName, plugin.Name(), data); err != nil {
 					log.Printf("Error saving plugin %s %s. %v", serviceName, plugin.Name(), err)
 				}
 			}
 		}
 	}
+	b.saveData()
 }
 
+// AddCloseFunc adds a function that will be called when the bot is closed.
 func (b *Bot) AddCloseFunc(f func()) {
 	b.closeFuncs = append(b.closeFuncs, f)
 }
 
-// Close will close any resources.
+// Close will stop listening for messages, wait for in-flight message handlers, save the current plugin state and disconnect all services.
+// Calling Close more than once has no effect.
 func (b *Bot) Close() {
+	b.closeOnce.Do(b.close)
+}
+
+func (b *Bot) close() {
+	close(b.closing)
+	b.listeners.Wait()
+
+	for _, service := range b.Services {
+		close(service.jobs)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(b.CloseTimeout):
+		log.Println("Timed out waiting for message handlers.")
+	}
+	b.cancel()
+
+	for _, service := range b.Services {
+		for _, plugin := range service.Plugins {
+			if closer, ok := plugin.(Closer); ok {
+				if err := closer.Close(b, service.Service); err != nil {
+					log.Printf("Error closing plugin %s %s. %v", service.Name(), plugin.Name(), err)
+				}
+			}
+		}
+	}
+
+	b.Save()
+
+	for _, service := range b.Services {
+		if err := service.Close(); err != nil {
+			log.Printf("Error closing service %s. %v", service.Name(), err)
+		}
+	}
+
 	for _, f := range b.closeFuncs {
 		f()
 	}
+	if err := b.Store.Close(); err != nil {
+		log.Println("Error closing store.", err)
+	}
 }
 
 // UploadToImgur uploads image data to Imgur and returns the url to it.
 func (b *Bot) UploadToImgur(re io.Reader, filename string) (string, error) {
+	return b.UploadToImgurContext(context.Background(), re, filename)
+}
+
+// UploadToImgurContext uploads image data to Imgur and returns the url to it, the upload is aborted if ctx is cancelled.
+func (b *Bot) UploadToImgurContext(ctx context.Context, re io.Reader, filename string) (string, error) {
 	if b.ImgurID == "" {
 		return "", errors.New("No Imgur client ID provided.")
 	}
@@ -165,7 +371,7 @@ func (b *Bot) UploadToImgur(re io.Reader, filename string) (string, error) {
 	r.Header.Set("Content-Type", contentType)
 	r.Header.Set("Authorization", "Client-ID "+b.ImgurID)
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,98 @@
+package comicjerk
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closerPlugin counts how many times it is closed.
+type closerPlugin struct {
+	SimplePlugin
+	closed int
+}
+
+func (p *closerPlugin) Close(bot *Bot, service Service) error {
+	p.closed++
+	return nil
+}
+
+func TestBotCloseTwice(t *testing.T) {
+	bot, service, _, closer := newTestBot(t)
+	defer closer()
+
+	// Plugins are often shared between services, they are closed once for each.
+	other := NewTestService()
+	other.ServiceName = "Other"
+	bot.RegisterService(other)
+	p := &closerPlugin{SimplePlugin: *NewSimplePlugin("closer")}
+	bot.RegisterPlugin(service, p)
+	bot.RegisterPlugin(other, p)
+	bot.Open()
+
+	bot.Close()
+	bot.Close()
+
+	if p.closed != 2 {
+		t.Errorf("closed = %d, want 2", p.closed)
+	}
+	if calls := service.Calls("Close"); len(calls) != 1 {
+		t.Errorf("service closed %d times, want 1", len(calls))
+	}
+}
+
+func TestServiceCloseTwice(t *testing.T) {
+	webhook := NewWebhook("127.0.0.1:0")
+	if _, err := webhook.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	services := []Service{
+		NewConsole(strings.NewReader(""), ioutil.Discard, ""),
+		NewDiscord("Bot token"),
+		NewIRC("irc.example.com:6697", "bot", "", nil),
+		NewMatrix("https://matrix.example.com", "@bot:example.com", "token", nil),
+		NewMattermost("https://mattermost.example.com", "token"),
+		NewSlack("token"),
+		NewTelegram("token"),
+		webhook,
+		NewXMPP("bot@example.com", "password", nil),
+	}
+	for _, service := range services {
+		if err := service.Close(); err != nil {
+			t.Errorf("%s: Close = %v", service.Name(), err)
+		}
+		if err := service.Close(); err != nil {
+			t.Errorf("%s: second Close = %v", service.Name(), err)
+		}
+	}
+}
+
+func TestBotHungPluginReleasesWorker(t *testing.T) {
+	bot, service, _, closer := newTestBot(t)
+	defer closer()
+
+	bot.Workers = 1
+	bot.HandlerTimeout = 50 * time.Millisecond
+	bot.CloseTimeout = 50 * time.Millisecond
+
+	hang := make(chan struct{})
+	defer close(hang)
+
+	p := NewSimplePlugin("hang")
+	p.MessageFunc = func(bot *Bot, service Service, message Message) {
+		if message.Message() == "hang" {
+			<-hang
+			return
+		}
+		service.SendMessage(message.Channel(), "done")
+	}
+	bot.RegisterPlugin(service, p)
+	bot.Open()
+
+	service.InjectString("#channel", "bob", "hang")
+	if got := send(service, "bob", "hello"); got != "done" {
+		t.Errorf("reply = %q, want %q", got, "done")
+	}
+}
@@ -0,0 +1,563 @@
+package bridgeplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matannoam/comicjerk"
+)
+
+// maxRelayed is the number of messages remembered so that their edits and deletes can be relayed.
+const maxRelayed = 1000
+
+var bridgeArgs = &comicjerk.ArgSpec{
+	Args: []*comicjerk.Arg{
+		{Name: "name", Type: comicjerk.ArgString},
+		{Name: "service", Type: comicjerk.ArgString, Optional: true},
+		{Name: "channel", Type: comicjerk.ArgString, Optional: true},
+	},
+}
+
+var deleteArgs = &comicjerk.ArgSpec{
+	Args: []*comicjerk.Arg{
+		{Name: "name", Type: comicjerk.ArgString},
+	},
+}
+
+// An Endpoint is a channel on a service.
+type Endpoint struct {
+	Service string
+	Channel string
+}
+
+func (e *Endpoint) String() string {
+	return fmt.Sprintf("%s %s", e.Service, e.Channel)
+}
+
+// A Bridge links channels, messages sent in one of them are relayed to the others.
+type Bridge struct {
+	Name      string
+	Endpoints []*Endpoint
+}
+
+func (b *Bridge) indexOf(endpoint *Endpoint) int {
+	for i, e := range b.Endpoints {
+		if *e == *endpoint {
+			return i
+		}
+	}
+	return -1
+}
+
+// relay is a copy of a message that was relayed to another channel.
+// It is remembered before it is sent, so sent is closed once messageID and failed are set.
+// messageID is empty when the service the copy was sent to can not edit messages.
+type relay struct {
+	endpoint  *Endpoint
+	messageID string
+	failed    bool
+	sent      chan struct{}
+}
+
+// BridgePlugin is a plugin that relays messages between channels on different services.
+// One instance should be registered on every service, so that it can send to all of them.
+// Commands and messages from the bot or other bots are not relayed.
+type BridgePlugin struct {
+	sync.RWMutex
+	// Bridges maps a bridge name to the bridge.
+	Bridges map[string]*Bridge
+
+	// data is where the bridges are stored, once for all services.
+	data *comicjerk.Data
+	// migrate is set when the bridges were saved for each service by an older version, and are being merged.
+	migrate bool
+
+	relayed map[string][]*relay
+	order   []string
+	count   int
+}
+
+// Name returns the name of the plugin.
+func (p *BridgePlugin) Name() string {
+	return "Bridge"
+}
+
+// Commands returns the commands handled by the plugin.
+func (p *BridgePlugin) Commands() []string {
+	return []string{"bridge", "bridge add", "bridge remove", "bridge delete", "bridge list"}
+}
+
+// CommandPermission returns the permission required to use a command, all the bridge commands are for the bot owner.
+func (p *BridgePlugin) CommandPermission(commandString string) comicjerk.Permission {
+	return comicjerk.PermissionOwner
+}
+
+// Help returns a list of help strings that are printed when the user requests them.
+func (p *BridgePlugin) Help(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, detailed bool) []string {
+	if !bot.HasPermission(service, message, comicjerk.PermissionOwner) {
+		return nil
+	}
+
+	if !detailed {
+		return comicjerk.CommandHelp(service, "bridge", "<add|remove|delete|list>", "Links channels across services.")
+	}
+
+	return []string{
+		comicjerk.CommandHelp(service, "bridge add", "<name> [service channel]", "Adds this channel, or a channel on another service, to a bridge.")[0],
+		comicjerk.CommandHelp(service, "bridge remove", "<name> [service channel]", "Removes this channel, or a channel on another service, from a bridge.")[0],
+		comicjerk.CommandHelp(service, "bridge delete", "<name>", "Deletes a bridge.")[0],
+		comicjerk.CommandHelp(service, "bridge list", "", "Lists the bridges.")[0],
+		fmt.Sprintf("Services: %s.", strings.Join(serviceNames(bot), ", ")),
+		"Examples:",
+		comicjerk.CommandHelp(service, "bridge add", "team", "Adds this channel to the team bridge.")[0],
+		comicjerk.CommandHelp(service, "bridge add", "team IRC #team", "Adds #team on IRC to the team bridge.")[0],
+	}
+}
+
+// Message handler.
+func (p *BridgePlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
+	defer comicjerk.MessageRecover()
+	commandString, owner := bot.Route(service, message)
+	if owner == p.Name() {
+		p.manage(bot, service, message, commandString)
+		return
+	}
+	if owner != "" {
+		return
+	}
+
+	if b, ok := message.(comicjerk.BotMessage); ok && b.IsBot() {
+		return
+	}
+
+	p.relay(bot, service, message)
+}
+
+// serviceNames returns the names of the services registered on the bot, sorted alphabetically.
+func serviceNames(bot *comicjerk.Bot) []string {
+	names := []string{}
+	for name := range bot.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findService returns a service registered on the bot by name, ignoring case.
+func findService(bot *comicjerk.Bot, name string) comicjerk.Service {
+	for n, entry := range bot.Services {
+		if strings.EqualFold(n, name) {
+			return entry.Service
+		}
+	}
+	return nil
+}
+
+// relayKey is the key a message is remembered by.
+func relayKey(endpoint *Endpoint, messageID string) string {
+	return endpoint.Service + "\x00" + endpoint.Channel + "\x00" + messageID
+}
+
+// targets returns the other channels bridged with a channel.
+func (p *BridgePlugin) targets(source *Endpoint) []*Endpoint {
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, bridge := range p.Bridges {
+		if bridge.indexOf(source) == -1 {
+			continue
+		}
+		targets := []*Endpoint{}
+		for _, e := range bridge.Endpoints {
+			if *e != *source {
+				targets = append(targets, e)
+			}
+		}
+		return targets
+	}
+	return nil
+}
+
+// remember stores the copies of a relayed message, forgetting the oldest message when there are too many.
+func (p *BridgePlugin) remember(key string, relays []*relay) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.count++
+	if _, ok := p.relayed[key]; !ok {
+		p.order = append(p.order, key)
+	}
+	p.relayed[key] = relays
+	if len(p.order) > maxRelayed {
+		delete(p.relayed, p.order[0])
+		p.order = p.order[1:]
+	}
+}
+
+// relays returns the copies of a relayed message that were sent, waiting for copies that are still being sent.
+func (p *BridgePlugin) relays(key string) []*relay {
+	p.RLock()
+	relays := p.relayed[key]
+	p.RUnlock()
+
+	sent := []*relay{}
+	for _, r := range relays {
+		<-r.sent
+		if !r.failed {
+			sent = append(sent, r)
+		}
+	}
+	return sent
+}
+
+// forget removes a message from the relayed messages.
+func (p *BridgePlugin) forget(key string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.relayed[key]; !ok {
+		return
+	}
+	delete(p.relayed, key)
+	for i, k := range p.order {
+		if k == key {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// relay sends a message, an edit or a delete to the channels bridged with the channel it was sent in.
+func (p *BridgePlugin) relay(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
+	source := &Endpoint{service.Name(), message.Channel()}
+	targets := p.targets(source)
+	if len(targets) == 0 {
+		return
+	}
+
+	key := relayKey(source, message.MessageID())
+
+	switch message.Type() {
+	case comicjerk.MessageTypeCreate:
+		if strings.TrimSpace(message.Message()) == "" {
+			return
+		}
+
+		relays := []*relay{}
+		for _, e := range targets {
+			if target := findService(bot, e.Service); target != nil {
+				relays = append(relays, &relay{endpoint: e, sent: make(chan struct{})})
+			}
+		}
+
+		// The copies are remembered before they are sent, so an edit or delete that arrives while they are being sent
+		// waits for them rather than being dropped.
+		if message.MessageID() != "" {
+			p.remember(key, relays)
+		}
+
+		for _, r := range relays {
+			target := findService(bot, r.endpoint.Service)
+			text := formatMessage(service, target, r.endpoint.Channel, message, false)
+			var err error
+			if editor, ok := target.(comicjerk.EditService); ok {
+				r.messageID, err = editor.SendMessageID(r.endpoint.Channel, text)
+			} else {
+				err = target.SendMessage(r.endpoint.Channel, text)
+			}
+			if err != nil {
+				log.Printf("Error relaying message to %s. %v", r.endpoint, err)
+				r.failed = true
+			}
+			close(r.sent)
+		}
+	case comicjerk.MessageTypeUpdate:
+		for _, r := range p.relays(key) {
+			target := findService(bot, r.endpoint.Service)
+			if target == nil {
+				continue
+			}
+
+			var err error
+			if editor, ok := target.(comicjerk.EditService); ok && r.messageID != "" {
+				err = editor.EditMessage(r.endpoint.Channel, r.messageID, formatMessage(service, target, r.endpoint.Channel, message, false))
+			} else {
+				// Services that can not edit get the edited message as a new message.
+				err = target.SendMessage(r.endpoint.Channel, formatMessage(service, target, r.endpoint.Channel, message, true))
+			}
+			if err != nil {
+				log.Printf("Error relaying edit to %s. %v", r.endpoint, err)
+			}
+		}
+	case comicjerk.MessageTypeDelete:
+		for _, r := range p.relays(key) {
+			if r.messageID == "" {
+				continue
+			}
+			target := findService(bot, r.endpoint.Service)
+			if target == nil {
+				continue
+			}
+			if err := target.DeleteMessage(r.endpoint.Channel, r.messageID); err != nil {
+				log.Printf("Error relaying delete to %s. %v", r.endpoint, err)
+			}
+		}
+		p.forget(key)
+	}
+}
+
+// manage handles the commands for adding, removing, deleting and listing bridges.
+func (p *BridgePlugin) manage(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, commandString string) {
+	if !bot.HasPermission(service, message, comicjerk.PermissionOwner) {
+		service.SendMessage(message.Channel(), comicjerk.PermissionDeniedMessage(service, message))
+		return
+	}
+
+	fields := strings.Fields(commandString)
+	if len(fields) == 1 {
+		service.SendMessage(message.Channel(), fmt.Sprintf("Usage: %sbridge <add|remove|delete|list>", comicjerk.CommandPrefix(service, message)))
+		return
+	}
+
+	if fields[1] == "list" {
+		p.list(service, message)
+		return
+	}
+
+	spec := bridgeArgs
+	if fields[1] == "delete" {
+		spec = deleteArgs
+	}
+	args, err := comicjerk.ParseArgs(service, commandString, message, spec)
+	if err != nil {
+		service.SendMessage(message.Channel(), comicjerk.UsageMessage(service, message, commandString, spec, err))
+		return
+	}
+	name := strings.ToLower(args.String("name"))
+
+	var reply string
+	switch fields[1] {
+	case "add", "remove":
+		var endpoint *Endpoint
+		endpoint, err = p.endpoint(bot, service, message, args)
+		if err != nil {
+			break
+		}
+		if fields[1] == "add" {
+			err = p.add(name, endpoint)
+			reply = fmt.Sprintf("Added %s to bridge %s.", endpoint, name)
+			if err == nil {
+				if joinErr := p.join(bot, service, message, endpoint); joinErr != nil {
+					reply = fmt.Sprintf("%s Joining %s failed, messages will be relayed once the bot is in the channel. %v", reply, endpoint, joinErr)
+				}
+			}
+		} else {
+			err = p.remove(name, endpoint)
+			reply = fmt.Sprintf("Removed %s from bridge %s.", endpoint, name)
+		}
+	case "delete":
+		err = p.delete(name)
+		reply = fmt.Sprintf("Deleted bridge %s.", name)
+	}
+
+	if err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	service.SendMessage(message.Channel(), reply)
+}
+
+// endpoint returns the channel given in the arguments of a command, or the channel the command was sent in.
+func (p *BridgePlugin) endpoint(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, args *comicjerk.Args) (*Endpoint, error) {
+	if !args.Has("service") {
+		return &Endpoint{service.Name(), message.Channel()}, nil
+	}
+	if !args.Has("channel") {
+		return nil, errors.New("A service needs a channel.")
+	}
+
+	target := findService(bot, args.String("service"))
+	if target == nil {
+		return nil, fmt.Errorf("%s is not a service, use one of %s.", args.String("service"), strings.Join(serviceNames(bot), ", "))
+	}
+
+	channel := args.String("channel")
+	// Discord channel links are sent as <#id>.
+	if strings.HasPrefix(channel, "<#") && strings.HasSuffix(channel, ">") {
+		channel = channel[2 : len(channel)-1]
+	}
+	return &Endpoint{target.Name(), channel}, nil
+}
+
+// join joins the channel of an endpoint added from another channel, so that the bot receives its messages.
+func (p *BridgePlugin) join(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, endpoint *Endpoint) error {
+	if endpoint.Service == service.Name() && endpoint.Channel == message.Channel() {
+		return nil
+	}
+	target := findService(bot, endpoint.Service)
+	if target == nil {
+		return nil
+	}
+	if err := target.Join(endpoint.Channel); err != nil && err != comicjerk.ErrAlreadyJoined {
+		return err
+	}
+	return nil
+}
+
+func (p *BridgePlugin) add(name string, endpoint *Endpoint) error {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, bridge := range p.Bridges {
+		if bridge.indexOf(endpoint) != -1 {
+			return fmt.Errorf("%s is already in bridge %s.", endpoint, bridge.Name)
+		}
+	}
+
+	bridge := p.Bridges[name]
+	if bridge == nil {
+		bridge = &Bridge{Name: name}
+		p.Bridges[name] = bridge
+	}
+	bridge.Endpoints = append(bridge.Endpoints, endpoint)
+	return p.save()
+}
+
+func (p *BridgePlugin) remove(name string, endpoint *Endpoint) error {
+	p.Lock()
+	defer p.Unlock()
+
+	bridge := p.Bridges[name]
+	if bridge == nil {
+		return fmt.Errorf("%s is not a bridge.", name)
+	}
+	i := bridge.indexOf(endpoint)
+	if i == -1 {
+		return fmt.Errorf("%s is not in bridge %s.", endpoint, name)
+	}
+
+	bridge.Endpoints = append(bridge.Endpoints[:i], bridge.Endpoints[i+1:]...)
+	if len(bridge.Endpoints) == 0 {
+		delete(p.Bridges, name)
+	}
+	return p.save()
+}
+
+func (p *BridgePlugin) delete(name string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.Bridges[name] == nil {
+		return fmt.Errorf("%s is not a bridge.", name)
+	}
+	delete(p.Bridges, name)
+	return p.save()
+}
+
+func (p *BridgePlugin) list(service comicjerk.Service, message comicjerk.Message) {
+	p.RLock()
+	defer p.RUnlock()
+
+	if len(p.Bridges) == 0 {
+		service.SendMessage(message.Channel(), "There are no bridges.")
+		return
+	}
+
+	names := []string{}
+	for name := range p.Bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		endpoints := []string{}
+		for _, e := range p.Bridges[name].Endpoints {
+			endpoints = append(endpoints, e.String())
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, strings.Join(endpoints, ", ")))
+	}
+
+	if service.SupportsMultiline() {
+		service.SendMessage(message.Channel(), strings.Join(lines, "\n"))
+	} else {
+		service.SendMessage(message.Channel(), strings.Join(lines, "; "))
+	}
+}
+
+// Load will load plugin state from a byte array.
+// The plugin is shared by every service, so the bridges are stored once in the bot's shared data. Older versions saved
+// them for each service, those are merged the first time the plugin is loaded without shared data.
+func (p *BridgePlugin) Load(bot *comicjerk.Bot, service comicjerk.Service, data []byte) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.data == nil {
+		p.data = bot.SharedData(p.Name())
+		bridges := map[string]*Bridge{}
+		if p.data.Get("bridges", &bridges) {
+			p.Bridges = bridges
+		} else {
+			p.migrate = true
+		}
+	}
+	if !p.migrate || data == nil {
+		return nil
+	}
+
+	loaded := &BridgePlugin{}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		log.Println("Error loading data", err)
+	}
+	for name, bridge := range loaded.Bridges {
+		existing := p.Bridges[name]
+		if existing == nil {
+			p.Bridges[name] = bridge
+			continue
+		}
+		for _, e := range bridge.Endpoints {
+			if existing.indexOf(e) == -1 {
+				existing.Endpoints = append(existing.Endpoints, e)
+			}
+		}
+	}
+	return p.save()
+}
+
+// save stores the bridges in the shared data. The lock must be held.
+func (p *BridgePlugin) save() error {
+	if p.data == nil {
+		return nil
+	}
+	return p.data.Set("bridges", p.Bridges)
+}
+
+// Save will save plugin state to a byte array.
+// The bridges are stored in the bot's shared data as they change, so nothing is saved for each service.
+func (p *BridgePlugin) Save() ([]byte, error) {
+	return nil, nil
+}
+
+// Stats will return the stats for a plugin.
+func (p *BridgePlugin) Stats(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) []string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return []string{
+		fmt.Sprintf("Bridges: \t%d\n", len(p.Bridges)),
+		fmt.Sprintf("Relayed messages: \t%d\n", p.count),
+	}
+}
+
+// New will create a new bridge plugin.
+func New() comicjerk.Plugin {
+	return &BridgePlugin{
+		Bridges: map[string]*Bridge{},
+		relayed: map[string][]*relay{},
+	}
+}
@@ -0,0 +1,178 @@
+package bridgeplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matannoam/comicjerk"
+)
+
+func TestBridgeAddJoins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgeplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	service.BotOwner = true
+	other := testService("Other")
+	bot.RegisterService(service)
+	bot.RegisterService(other)
+	bot.RegisterPlugin(service, New())
+	bot.Open()
+	defer bot.Close()
+
+	service.InjectString("#team", "bob", "!bridge add team")
+	service.WaitForCalls("SendMessage", 1, time.Second)
+	if calls := service.Calls("Join"); len(calls) != 0 {
+		t.Errorf("joins = %v, want the current channel not to be joined", calls)
+	}
+
+	service.InjectString("#team", "bob", "!bridge add team Other #other")
+	calls := service.WaitForCalls("SendMessage", 2, time.Second)
+	if len(calls) != 2 || !strings.HasPrefix(calls[1].Message, "Added") {
+		t.Fatalf("calls = %v, want the channel to be added", calls)
+	}
+	if joins := other.Calls("Join"); len(joins) != 1 || joins[0].Target != "#other" {
+		t.Errorf("joins = %v, want #other to be joined", joins)
+	}
+}
+
+func TestBridgeTelegramEntitiesWithPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgeplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	telegram := testService(comicjerk.TelegramServiceName)
+	irc := testService(comicjerk.IRCServiceName)
+	bot.RegisterService(telegram)
+	bot.RegisterService(irc)
+	p := New().(*BridgePlugin)
+	p.Bridges["team"] = &Bridge{Name: "team", Endpoints: []*Endpoint{{comicjerk.TelegramServiceName, "-100"}, {comicjerk.IRCServiceName, "#team"}}}
+	bot.RegisterPlugin(telegram, p)
+	bot.RegisterPlugin(irc, p)
+	bot.Open()
+	defer bot.Close()
+
+	// Custom prefixes wrap the message during dispatch, the entities must still be found.
+	bot.SetChannelPrefixes(telegram, "-100", &comicjerk.ChannelPrefixes{Prefixes: []string{"?"}})
+	telegram.Inject(&comicjerk.TelegramMessage{
+		TelegramMessage: &comicjerk.TelegramAPIMessage{
+			MessageID: 1,
+			From:      &comicjerk.TelegramUser{ID: 42, Username: "bob"},
+			Chat:      &comicjerk.TelegramChat{ID: -100, Type: "group"},
+			Text:      "very bold",
+			Entities:  []*comicjerk.TelegramEntity{{Type: "bold", Offset: 5, Length: 4}},
+		},
+		MessageType: comicjerk.MessageTypeCreate,
+		Content:     "very bold",
+	})
+
+	calls := irc.WaitForCalls("SendMessage", 1, time.Second)
+	if len(calls) != 1 || !strings.Contains(calls[0].Message, "very \x02bold\x02") {
+		t.Errorf("calls = %v, want the bold text relayed", calls)
+	}
+}
+
+func TestBridgeStoredOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgeplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Older versions saved the bridges for each service, they are merged.
+	store := comicjerk.NewFileStore(dir)
+	store.Save(comicjerk.TestServiceName, "Bridge", []byte(`{"Bridges":{"team":{"Name":"team","Endpoints":[{"Service":"Test","Channel":"#team"}]}}}`))
+	store.Save("Other", "Bridge", []byte(`{"Bridges":{"team":{"Name":"team","Endpoints":[{"Service":"Other","Channel":"#other"}]}}}`))
+
+	open := func() (*comicjerk.Bot, *comicjerk.TestService, *BridgePlugin) {
+		bot := comicjerk.NewBot()
+		bot.Store = store
+		service := comicjerk.NewTestService()
+		service.BotOwner = true
+		other := testService("Other")
+		bot.RegisterService(service)
+		bot.RegisterService(other)
+		p := New().(*BridgePlugin)
+		bot.RegisterPlugin(service, p)
+		bot.RegisterPlugin(other, p)
+		bot.Open()
+		return bot, service, p
+	}
+
+	bot, service, p := open()
+	p.RLock()
+	endpoints := len(p.Bridges["team"].Endpoints)
+	p.RUnlock()
+	if endpoints != 2 {
+		t.Errorf("endpoints = %d, want the bridges of both services merged", endpoints)
+	}
+
+	// A deleted bridge must not come back from either service's old file.
+	service.InjectString("#team", "bob", "!bridge delete team")
+	service.WaitForCalls("SendMessage", 1, time.Second)
+	bot.Close()
+
+	bot, _, p = open()
+	defer bot.Close()
+	p.RLock()
+	bridges := len(p.Bridges)
+	p.RUnlock()
+	if bridges != 0 {
+		t.Errorf("bridges = %d, want the deleted bridge to stay deleted", bridges)
+	}
+}
+
+// slowService is a service that holds sent messages until it is released.
+type slowService struct {
+	*comicjerk.TestService
+	release chan struct{}
+}
+
+func (s *slowService) SendMessageID(channel, message string) (string, error) {
+	<-s.release
+	return s.TestService.SendMessageID(channel, message)
+}
+
+func TestBridgeEditWhileSending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgeplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	other := &slowService{TestService: testService("Other"), release: make(chan struct{})}
+	bot.RegisterService(service)
+	bot.RegisterService(other)
+	p := New().(*BridgePlugin)
+	p.Bridges["team"] = &Bridge{Name: "team", Endpoints: []*Endpoint{{comicjerk.TestServiceName, "#team"}, {"Other", "#other"}}}
+	bot.RegisterPlugin(service, p)
+	bot.RegisterPlugin(other, p)
+	bot.Open()
+	defer bot.Close()
+
+	service.Inject(&comicjerk.TestMessage{ChannelID: "#team", Author: "bob", Content: "helo", ID: "1"})
+	time.Sleep(50 * time.Millisecond)
+	service.Inject(&comicjerk.TestMessage{ChannelID: "#team", Author: "bob", Content: "hello", ID: "1", MessageType: comicjerk.MessageTypeUpdate})
+	time.Sleep(50 * time.Millisecond)
+	close(other.release)
+
+	// The edit arrived before the copy was sent, it waits for the copy and edits it.
+	if edits := other.WaitForCalls("EditMessage", 1, time.Second); len(edits) != 1 || edits[0].MessageID != "1" || !strings.Contains(edits[0].Message, "hello") {
+		t.Errorf("edits = %v, want the copy to be edited", edits)
+	}
+}
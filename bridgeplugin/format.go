@@ -0,0 +1,366 @@
+package bridgeplugin
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/matannoam/comicjerk"
+)
+
+// IRC formatting codes are used as the common format when a message is relayed between services.
+const (
+	ircBold      = '\x02'
+	ircReset     = '\x0f'
+	ircItalic    = '\x1d'
+	ircStrike    = '\x1e'
+	ircUnderline = '\x1f'
+)
+
+// markup is a markdown style that is converted to an IRC formatting code.
+type markup struct {
+	regex *regexp.Regexp
+	code  rune
+}
+
+// discordMarkup is in the order it is applied, so that ** is found before *.
+var discordMarkup = []*markup{
+	{regexp.MustCompile(`\*\*(.+?)\*\*`), ircBold},
+	{regexp.MustCompile(`__(.+?)__`), ircUnderline},
+	{regexp.MustCompile(`~~(.+?)~~`), ircStrike},
+	{regexp.MustCompile(`\*(.+?)\*`), ircItalic},
+	{regexp.MustCompile(`\b_(.+?)_\b`), ircItalic},
+}
+
+// markdownMarkup is used for Mattermost, Matrix and webhooks, where __ is bold rather than underline.
+var markdownMarkup = []*markup{
+	{regexp.MustCompile(`\*\*(.+?)\*\*`), ircBold},
+	{regexp.MustCompile(`__(.+?)__`), ircBold},
+	{regexp.MustCompile(`~~(.+?)~~`), ircStrike},
+	{regexp.MustCompile(`\*(.+?)\*`), ircItalic},
+	{regexp.MustCompile(`\b_(.+?)_\b`), ircItalic},
+}
+
+// slackMarkup is also used for XMPP message styling, which uses the same markers.
+var slackMarkup = []*markup{
+	{regexp.MustCompile(`\*(.+?)\*`), ircBold},
+	{regexp.MustCompile(`\b_(.+?)_\b`), ircItalic},
+	{regexp.MustCompile(`~(.+?)~`), ircStrike},
+}
+
+// discordMarkers, markdownMarkers and slackMarkers are the markdown that replace IRC formatting codes, only Discord has underline.
+var discordMarkers = map[rune]string{
+	ircBold:      "**",
+	ircItalic:    "*",
+	ircUnderline: "__",
+	ircStrike:    "~~",
+}
+
+var markdownMarkers = map[rune]string{
+	ircBold:      "**",
+	ircItalic:    "*",
+	ircUnderline: "",
+	ircStrike:    "~~",
+}
+
+var slackMarkers = map[rune]string{
+	ircBold:      "*",
+	ircItalic:    "_",
+	ircUnderline: "",
+	ircStrike:    "~",
+}
+
+// codeRegex matches code blocks and inline code, which are never reformatted.
+var codeRegex = regexp.MustCompile("```[\\s\\S]*?```|`[^`\n]*`")
+
+var ircColorRegex = regexp.MustCompile("\x03([0-9]{1,2}(,[0-9]{1,2})?)?")
+
+var ircCodesRegex = regexp.MustCompile("[\x02\x0f\x1d\x1e\x1f]")
+
+// slackEntityRegex matches Slack's escaped mentions, channels and links, eg. <@U123|bob>, <#C123|general> or <http://example.com|example>.
+var slackEntityRegex = regexp.MustCompile(`<([@#!]?)([^>|]+)(\|([^>]*))?>`)
+
+var slackUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+var discordNameEscaper = strings.NewReplacer("*", "\\*", "_", "\\_", "~", "\\~", "`", "\\`")
+
+// ansiCodes are the terminal escape codes that turn IRC formatting codes on and off in the console.
+var ansiCodes = map[rune][2]string{
+	ircBold:      {"\x1b[1m", "\x1b[22m"},
+	ircItalic:    {"\x1b[3m", "\x1b[23m"},
+	ircUnderline: {"\x1b[4m", "\x1b[24m"},
+	ircStrike:    {"\x1b[9m", "\x1b[29m"},
+}
+
+const ansiReset = "\x1b[0m"
+
+// telegramEntities are the Telegram message entities that are converted to the common format.
+var telegramEntities = map[string][2]string{
+	"bold":          {string(ircBold), string(ircBold)},
+	"italic":        {string(ircItalic), string(ircItalic)},
+	"underline":     {string(ircUnderline), string(ircUnderline)},
+	"strikethrough": {string(ircStrike), string(ircStrike)},
+	"code":          {"`", "`"},
+	"pre":           {"```\n", "\n```"},
+}
+
+var massMentionRegex = regexp.MustCompile(`@(everyone|here)`)
+
+var mattermostMassMentionRegex = regexp.MustCompile(`@(channel|all|here)\b`)
+
+var matrixMassMentionRegex = regexp.MustCompile(`@room\b`)
+
+var mentionRegex = regexp.MustCompile(`@([\p{L}\p{N}_\-.]+)`)
+
+// outsideCode applies f to the parts of text that are not code.
+func outsideCode(text string, f func(string) string) string {
+	buf := &bytes.Buffer{}
+	last := 0
+	for _, loc := range codeRegex.FindAllStringIndex(text, -1) {
+		buf.WriteString(f(text[last:loc[0]]))
+		buf.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	buf.WriteString(f(text[last:]))
+	return buf.String()
+}
+
+func applyMarkup(text string, markup []*markup) string {
+	return outsideCode(text, func(s string) string {
+		for _, m := range markup {
+			s = m.regex.ReplaceAllString(s, fmt.Sprintf("%c$1%c", m.code, m.code))
+		}
+		return s
+	})
+}
+
+// unescapeSlack replaces Slack's escaped mentions, channels and links with plain text.
+func unescapeSlack(text string) string {
+	text = slackEntityRegex.ReplaceAllStringFunc(text, func(entity string) string {
+		match := slackEntityRegex.FindStringSubmatch(entity)
+		kind, value, label := match[1], match[2], match[4]
+		switch kind {
+		case "@", "#":
+			if label != "" {
+				return kind + label
+			}
+			return kind + value
+		case "!":
+			return "@" + value
+		}
+		if label != "" && label != value {
+			return fmt.Sprintf("%s (%s)", label, value)
+		}
+		return value
+	})
+	return slackUnescaper.Replace(text)
+}
+
+// unescapeTelegram adds the formatting of a Telegram message, which is sent as entities alongside the text.
+// Entity offsets are in UTF-16 code units.
+func unescapeTelegram(message *comicjerk.TelegramMessage) string {
+	m := message.TelegramMessage
+	if len(m.Entities) == 0 || m.Text != message.Message() {
+		return message.Message()
+	}
+
+	text := utf16.Encode([]rune(m.Text))
+	opens := make([]string, len(text)+1)
+	closes := make([]string, len(text)+1)
+	for _, e := range m.Entities {
+		codes, ok := telegramEntities[e.Type]
+		if !ok || e.Offset < 0 || e.Length <= 0 || e.Offset+e.Length > len(text) {
+			continue
+		}
+		opens[e.Offset] += codes[0]
+		closes[e.Offset+e.Length] = codes[1] + closes[e.Offset+e.Length]
+	}
+
+	converted := []uint16{}
+	for i := 0; i <= len(text); i++ {
+		converted = append(converted, utf16.Encode([]rune(closes[i]+opens[i]))...)
+		if i < len(text) {
+			converted = append(converted, text[i])
+		}
+	}
+	return string(utf16.Decode(converted))
+}
+
+// toCommon converts a message from a service's formatting to IRC formatting codes.
+func toCommon(service comicjerk.Service, message comicjerk.Message) string {
+	text := message.Message()
+	switch service.Name() {
+	case comicjerk.DiscordServiceName:
+		return applyMarkup(text, discordMarkup)
+	case comicjerk.SlackServiceName:
+		return applyMarkup(unescapeSlack(text), slackMarkup)
+	case comicjerk.XMPPServiceName:
+		return applyMarkup(text, slackMarkup)
+	case comicjerk.MattermostServiceName, comicjerk.MatrixServiceName, comicjerk.WebhookServiceName:
+		return applyMarkup(text, markdownMarkup)
+	case comicjerk.TelegramServiceName:
+		if m, ok := comicjerk.UnwrapMessage(message).(*comicjerk.TelegramMessage); ok {
+			return unescapeTelegram(m)
+		}
+	}
+	return text
+}
+
+// replaceCodes replaces IRC formatting codes with markdown, closing any styles left open at a reset or the end of the message.
+func replaceCodes(text string, markers map[rune]string) string {
+	buf := &bytes.Buffer{}
+	open := []rune{}
+
+	for _, r := range text {
+		switch r {
+		case ircReset:
+			for i := len(open) - 1; i >= 0; i-- {
+				buf.WriteString(markers[open[i]])
+			}
+			open = open[:0]
+		case ircBold, ircItalic, ircUnderline, ircStrike:
+			i := strings.IndexRune(string(open), r)
+			if i == -1 {
+				open = append(open, r)
+				buf.WriteString(markers[r])
+				continue
+			}
+			// Styles opened after the one being closed are closed and reopened, so the markdown stays nested.
+			for j := len(open) - 1; j >= i; j-- {
+				buf.WriteString(markers[open[j]])
+			}
+			reopen := append([]rune{}, open[i+1:]...)
+			open = append(open[:i], reopen...)
+			for _, o := range reopen {
+				buf.WriteString(markers[o])
+			}
+		default:
+			buf.WriteRune(r)
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString(markers[open[i]])
+	}
+	return buf.String()
+}
+
+// replaceANSI replaces IRC formatting codes with terminal escape codes.
+func replaceANSI(text string) string {
+	buf := &bytes.Buffer{}
+	open := map[rune]bool{}
+
+	for _, r := range text {
+		switch r {
+		case ircReset:
+			if len(open) > 0 {
+				buf.WriteString(ansiReset)
+				open = map[rune]bool{}
+			}
+		case ircBold, ircItalic, ircUnderline, ircStrike:
+			if open[r] {
+				buf.WriteString(ansiCodes[r][1])
+				delete(open, r)
+			} else {
+				buf.WriteString(ansiCodes[r][0])
+				open[r] = true
+			}
+		default:
+			buf.WriteRune(r)
+		}
+	}
+
+	if len(open) > 0 {
+		buf.WriteString(ansiReset)
+	}
+	return buf.String()
+}
+
+// fromCommon converts a message with IRC formatting codes to a service's formatting.
+func fromCommon(service comicjerk.Service, channel, text string) string {
+	switch service.Name() {
+	case comicjerk.IRCServiceName:
+		return text
+	case comicjerk.DiscordServiceName:
+		text = replaceCodes(ircColorRegex.ReplaceAllString(text, ""), discordMarkers)
+		text = massMentionRegex.ReplaceAllString(text, "@\u200b$1")
+		if discord, ok := service.(*comicjerk.Discord); ok {
+			text = discordMentions(discord, channel, text)
+		}
+		return text
+	case comicjerk.SlackServiceName:
+		return replaceCodes(slackEscaper.Replace(ircColorRegex.ReplaceAllString(text, "")), slackMarkers)
+	case comicjerk.XMPPServiceName:
+		return replaceCodes(ircColorRegex.ReplaceAllString(text, ""), slackMarkers)
+	case comicjerk.MattermostServiceName:
+		text = replaceCodes(ircColorRegex.ReplaceAllString(text, ""), markdownMarkers)
+		return mattermostMassMentionRegex.ReplaceAllString(text, "@\u200b$1")
+	case comicjerk.MatrixServiceName:
+		text = replaceCodes(ircColorRegex.ReplaceAllString(text, ""), markdownMarkers)
+		return matrixMassMentionRegex.ReplaceAllString(text, "@\u200broom")
+	case comicjerk.TelegramServiceName, comicjerk.WebhookServiceName:
+		// Messages are sent as plain text, markdown keeps the formatting readable.
+		return replaceCodes(ircColorRegex.ReplaceAllString(text, ""), markdownMarkers)
+	case comicjerk.ConsoleServiceName:
+		return replaceANSI(ircColorRegex.ReplaceAllString(text, ""))
+	}
+	return ircCodesRegex.ReplaceAllString(ircColorRegex.ReplaceAllString(text, ""), "")
+}
+
+// discordMentions replaces @name with a mention of the member of the channel's guild with that user name or nickname.
+func discordMentions(discord *comicjerk.Discord, channel, text string) string {
+	c, err := discord.Channel(channel)
+	if err != nil || c == nil {
+		return text
+	}
+	g, err := discord.Guild(c.GuildID)
+	if err != nil || g == nil {
+		return text
+	}
+
+	return outsideCode(text, func(s string) string {
+		return mentionRegex.ReplaceAllStringFunc(s, func(mention string) string {
+			name := mention[1:]
+			for _, m := range g.Members {
+				if m.User != nil && (strings.EqualFold(m.User.Username, name) || (m.Nick != "" && strings.EqualFold(m.Nick, name))) {
+					return fmt.Sprintf("<@%s>", m.User.ID)
+				}
+			}
+			return mention
+		})
+	})
+}
+
+// authorName returns the name a message is relayed with.
+func authorName(service comicjerk.Service, message comicjerk.Message) string {
+	if discord, ok := service.(*comicjerk.Discord); ok {
+		return discord.Nickname(message)
+	}
+	return message.UserName()
+}
+
+// formatMessage returns the text a message is relayed to a channel with, including the name of its author.
+func formatMessage(source, target comicjerk.Service, channel string, message comicjerk.Message, edited bool) string {
+	text := fromCommon(target, channel, toCommon(source, message))
+	if edited {
+		text += " (edited)"
+	}
+
+	name := authorName(source, message)
+	switch target.Name() {
+	case comicjerk.DiscordServiceName:
+		return fmt.Sprintf("**%s**: %s", discordNameEscaper.Replace(name), text)
+	case comicjerk.SlackServiceName:
+		return fmt.Sprintf("*%s*: %s", slackEscaper.Replace(name), text)
+	case comicjerk.IRCServiceName:
+		// A zero width space stops the name from highlighting a user with the same nick.
+		if r := []rune(name); len(r) > 1 {
+			name = string(r[:1]) + "\u200b" + string(r[1:])
+		}
+	}
+	return fmt.Sprintf("<%s> %s", name, text)
+}
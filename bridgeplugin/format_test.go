@@ -0,0 +1,58 @@
+package bridgeplugin
+
+import (
+	"testing"
+
+	"github.com/matannoam/comicjerk"
+)
+
+func testService(name string) *comicjerk.TestService {
+	service := comicjerk.NewTestService()
+	service.ServiceName = name
+	return service
+}
+
+func TestFormatServices(t *testing.T) {
+	tests := []struct {
+		source, target string
+		text, want     string
+	}{
+		{comicjerk.DiscordServiceName, comicjerk.MattermostServiceName, "**bold** and __under__", "**bold** and under"},
+		{comicjerk.MattermostServiceName, comicjerk.DiscordServiceName, "__bold__ and ~~gone~~", "**bold** and ~~gone~~"},
+		{comicjerk.MatrixServiceName, comicjerk.SlackServiceName, "**bold** *italic*", "*bold* _italic_"},
+		{comicjerk.XMPPServiceName, comicjerk.DiscordServiceName, "*bold* _italic_ ~gone~", "**bold** *italic* ~~gone~~"},
+		{comicjerk.IRCServiceName, comicjerk.XMPPServiceName, "\x02bold\x02 \x1ditalic\x1d", "*bold* _italic_"},
+		{comicjerk.IRCServiceName, comicjerk.TelegramServiceName, "\x02bold\x02", "**bold**"},
+		{comicjerk.IRCServiceName, comicjerk.WebhookServiceName, "\x02bold", "**bold**"},
+		{comicjerk.IRCServiceName, comicjerk.ConsoleServiceName, "\x02bold\x02 \x1funder", "\x1b[1mbold\x1b[22m \x1b[4munder\x1b[0m"},
+		{comicjerk.IRCServiceName, comicjerk.MattermostServiceName, "hi @channel", "hi @\u200bchannel"},
+		{comicjerk.IRCServiceName, comicjerk.MatrixServiceName, "hi @room", "hi @\u200broom"},
+	}
+
+	for _, test := range tests {
+		message := &comicjerk.TestMessage{Content: test.text}
+		if got := fromCommon(testService(test.target), "#channel", toCommon(testService(test.source), message)); got != test.want {
+			t.Errorf("%s to %s: %q = %q, want %q", test.source, test.target, test.text, got, test.want)
+		}
+	}
+}
+
+func TestFormatTelegramEntities(t *testing.T) {
+	text := "héllo 😀 bold code"
+	message := &comicjerk.TelegramMessage{
+		TelegramMessage: &comicjerk.TelegramAPIMessage{
+			Text: text,
+			Entities: []*comicjerk.TelegramEntity{
+				// The emoji is two UTF-16 code units.
+				{Type: "bold", Offset: 9, Length: 4},
+				{Type: "code", Offset: 14, Length: 4},
+				{Type: "mention", Offset: 0, Length: 5},
+			},
+		},
+		Content: text,
+	}
+
+	if got, want := toCommon(testService(comicjerk.TelegramServiceName), message), "héllo 😀 \x02bold\x02 `code`"; got != want {
+		t.Errorf("toCommon = %q, want %q", got, want)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/matannoam/comicjerk"
@@ -13,7 +14,9 @@ import (
 
 type carbonitexPlugin struct {
 	comicjerk.SimplePlugin
-	key string
+	key       string
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 func (p *carbonitexPlugin) carbonitexPluginLoadFunc(bot *comicjerk.Bot, service comicjerk.Service, data []byte) error {
@@ -27,7 +30,11 @@ func (p *carbonitexPlugin) carbonitexPluginLoadFunc(bot *comicjerk.Bot, service
 
 func (p *carbonitexPlugin) Run(bot *comicjerk.Bot, service comicjerk.Service) {
 	for {
-		<-time.After(5 * time.Minute)
+		select {
+		case <-p.closing:
+			return
+		case <-time.After(5 * time.Minute):
+		}
 
 		resp, err := http.PostForm("https://www.carbonitex.net/discord/data/botdata.php", url.Values{"key": {p.key}, "servercount": {fmt.Sprintf("%d", service.ChannelCount())}})
 
@@ -39,9 +46,20 @@ func (p *carbonitexPlugin) Run(bot *comicjerk.Bot, service comicjerk.Service) {
 			}
 		}
 
-		<-time.After(55 * time.Minute)
+		select {
+		case <-p.closing:
+			return
+		case <-time.After(55 * time.Minute):
+		}
 	}
+}
 
+// Close will stop reporting the server count, it is safe to call once for every service the plugin is registered on.
+func (p *carbonitexPlugin) Close(bot *comicjerk.Bot, service comicjerk.Service) error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
 }
 
 // New will create a new carbonitex plugin.
@@ -50,6 +68,7 @@ func New(key string) comicjerk.Plugin {
 	p := &carbonitexPlugin{
 		SimplePlugin: *comicjerk.NewSimplePlugin("Carbonitex"),
 		key:          key,
+		closing:      make(chan struct{}),
 	}
 	p.LoadFunc = p.carbonitexPluginLoadFunc
 	return p
@@ -0,0 +1,16 @@
+package carbonitexplugin
+
+import (
+	"testing"
+
+	"github.com/matannoam/comicjerk"
+)
+
+func TestCloseSharedPlugin(t *testing.T) {
+	p := New("key").(comicjerk.Closer)
+	bot := comicjerk.NewBot()
+
+	// Closing a plugin registered on several services must not panic.
+	p.Close(bot, comicjerk.NewTestService())
+	p.Close(bot, comicjerk.NewTestService())
+}
@@ -2,20 +2,31 @@ package chartplugin
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image/color"
 	"log"
 	"math/rand"
 	"strings"
+	"time"
 
 	"github.com/gonum/plot"
 	"github.com/gonum/plot/plotter"
 	"github.com/gonum/plot/plotutil"
 	"github.com/gonum/plot/vg"
 	"github.com/matannoam/comicjerk"
-	"github.com/iopred/discordgo"
 )
 
+// chartRateLimit limits how often a user can create charts, as each one is rendered and possibly uploaded.
+var chartRateLimit = &comicjerk.RateLimit{Burst: 3, Interval: 30 * time.Second}
+
+var chartArgs = &comicjerk.ArgSpec{
+	Args: []*comicjerk.Arg{
+		{Name: "direction", Type: comicjerk.ArgString},
+		{Name: "labels", Type: comicjerk.ArgRest},
+	},
+}
+
 type chartPlugin struct {
 	comicjerk.SimplePlugin
 }
@@ -47,13 +58,13 @@ func (p *chartPlugin) random(list []string) string {
 	return list[rand.Intn(len(list))]
 }
 
-func (p *chartPlugin) randomChart(service comicjerk.Service) string {
+func (p *chartPlugin) randomChart(service comicjerk.Service, message comicjerk.Message) string {
 	ticks := ""
 	if service.Name() == comicjerk.DiscordServiceName {
 		ticks = "`"
 	}
 
-	return fmt.Sprintf("%s%schart %s %s, %s%s", ticks, service.CommandPrefix(), p.random(randomDirection), p.random(randomY), p.random(randomX), ticks)
+	return fmt.Sprintf("%s%schart %s %s, %s%s", ticks, comicjerk.CommandPrefix(service, message), p.random(randomDirection), p.random(randomY), p.random(randomX), ticks)
 }
 
 func (p *chartPlugin) helpFunc(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, detailed bool) []string {
@@ -69,21 +80,21 @@ func (p *chartPlugin) helpFunc(bot *comicjerk.Bot, service comicjerk.Service, me
 	return help
 }
 
-func (p *chartPlugin) messageFunc(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
-	if service.IsMe(message) {
-		return
-	}
+func (p *chartPlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
+	p.MessageContext(context.Background(), bot, service, message)
+}
 
+func (p *chartPlugin) MessageContext(ctx context.Context, bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
 	if comicjerk.MatchesCommand(service, "chart", message) {
-		query, parts := comicjerk.ParseCommand(service, message)
-		if len(parts) == 0 {
-			service.SendMessage(message.Channel(), fmt.Sprintf("Invalid chart eg: %s", p.randomChart(service)))
+		args, err := comicjerk.ParseArgs(service, "chart", message, chartArgs)
+		if err != nil {
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Invalid chart eg: %s", p.randomChart(service, message)))
 			return
 		}
 
 		start, end := 0.5, 0.5
 
-		switch parts[0] {
+		switch strings.ToLower(args.String("direction")) {
 		case "up":
 			start, end = 0, 1
 		case "down":
@@ -91,19 +102,23 @@ func (p *chartPlugin) messageFunc(bot *comicjerk.Bot, service comicjerk.Service,
 		case "flat":
 		case "straight":
 		default:
-			service.SendMessage(message.Channel(), fmt.Sprintf("Invalid chart direction. eg: %s", p.randomChart(service)))
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Invalid chart direction. eg: %s", p.randomChart(service, message)))
 			return
 		}
 
-		axes := strings.Split(query[len(parts[0]):], ",")
+		axes := strings.Split(args.String("labels"), ",")
 		if len(axes) != 2 {
-			service.SendMessage(message.Channel(), fmt.Sprintf("Invalid chart axis labels eg: %s", p.randomChart(service)))
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Invalid chart axis labels eg: %s", p.randomChart(service, message)))
+			return
+		}
+
+		if !bot.CheckRateLimit(service, message, "chart", chartRateLimit) {
 			return
 		}
 
 		pl, err := plot.New()
 		if err != nil {
-			service.SendMessage(message.Channel(), fmt.Sprintf("Error making chart, sorry! eg: %s", p.randomChart(service)))
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Error making chart, sorry! eg: %s", p.randomChart(service, message)))
 			return
 		}
 
@@ -134,7 +149,7 @@ func (p *chartPlugin) messageFunc(bot *comicjerk.Bot, service comicjerk.Service,
 
 		lpLine, lpPoints, err := plotter.NewLinePoints(pts)
 		if err != nil {
-			service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, there was a problem creating your chart.", message.UserName()))
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, there was a problem creating your chart.", message.UserName()))
 		}
 		lpLine.Color = plotutil.Color(rand.Int())
 		lpLine.Width = vg.Points(1 + 0.5*rand.Float64())
@@ -146,36 +161,34 @@ func (p *chartPlugin) messageFunc(bot *comicjerk.Bot, service comicjerk.Service,
 
 		w, err := pl.WriterTo(320, 240, "png")
 		if err != nil {
-			service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, there was a problem creating your chart.", message.UserName()))
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, there was a problem creating your chart.", message.UserName()))
 			return
 		}
 
 		b := &bytes.Buffer{}
 		w.WriteTo(b)
 
-		go func() {
-			if service.Name() == comicjerk.DiscordServiceName {
-				discord := service.(*comicjerk.Discord)
-				p, err := discord.UserChannelPermissions(message.UserID(), message.Channel())
-				if err == nil && p&discordgo.PermissionAttachFiles != 0 {
-					service.SendFile(message.Channel(), "chart.png", b)
-					return
-				}
-			}
-
-			url, err := bot.UploadToImgur(b, "chart.png")
-			if err != nil {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, there was a problem uploading the chart to imgur.", message.UserName()))
-				log.Println("Error uploading chart: ", err)
+		if s, ok := service.(comicjerk.NativeFileService); ok && s.CanSendFile(message) {
+			// The buffer is read through a copy, so it can still be uploaded if sending fails.
+			err := service.SendFile(message.Channel(), "chart.png", bytes.NewReader(b.Bytes()))
+			if err == nil {
 				return
 			}
+			log.Printf("Error sending chart to %s, uploading it instead. %v", service.Name(), err)
+		}
 
-			if service.Name() == comicjerk.DiscordServiceName {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Here's your chart <@%s>: %s", message.UserID(), url))
-			} else {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Here's your chart %s: %s", message.UserName(), url))
-			}
-		}()
+		url, err := bot.UploadToImgurContext(ctx, b, "chart.png")
+		if err != nil {
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, there was a problem uploading the chart to imgur.", message.UserName()))
+			log.Println("Error uploading chart: ", err)
+			return
+		}
+
+		if service.Name() == comicjerk.DiscordServiceName {
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Here's your chart <@%s>: %s", message.UserID(), url))
+		} else {
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Here's your chart %s: %s", message.UserName(), url))
+		}
 	}
 }
 
@@ -184,7 +197,7 @@ func New() comicjerk.Plugin {
 	p := &chartPlugin{
 		SimplePlugin: *comicjerk.NewSimplePlugin("Chart"),
 	}
-	p.MessageFunc = p.messageFunc
 	p.HelpFunc = p.helpFunc
+	p.CommandStrings = []string{"chart"}
 	return p
 }
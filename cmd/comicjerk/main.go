@@ -1,21 +1,28 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"log"
 	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/matannoam/comicjerk"
+	"github.com/matannoam/comicjerk/boltstore"
+	"github.com/matannoam/comicjerk/bridgeplugin"
 	"github.com/matannoam/comicjerk/carbonitexplugin"
 	"github.com/matannoam/comicjerk/chartplugin"
 	"github.com/matannoam/comicjerk/comicplugin"
+	"github.com/matannoam/comicjerk/customcommandplugin"
 	"github.com/matannoam/comicjerk/directmessageinviteplugin"
 	"github.com/matannoam/comicjerk/discordavatarplugin"
 	"github.com/matannoam/comicjerk/inviteplugin"
 	"github.com/matannoam/comicjerk/reminderplugin"
+	"github.com/matannoam/comicjerk/sqlitestore"
 	"github.com/matannoam/comicjerk/statsplugin"
 )
 
@@ -29,12 +36,47 @@ var ircServer string
 var ircUsername string
 var ircPassword string
 var ircChannels string
+var ircTLS bool
+var ircTLSCert string
+var ircTLSKey string
+var ircSASL string
+var ircSASLUsername string
+var ircSASLPassword string
+var ircNickServPassword string
+var ircOwners string
+var matrixHomeserver string
+var matrixUserID string
+var matrixToken string
+var matrixRooms string
+var matrixOwnerUserID string
+var telegramToken string
+var telegramURL string
+var telegramOwnerUserID string
+var mattermostURL string
+var mattermostToken string
+var mattermostOwnerUserID string
+var xmppJID string
+var xmppPassword string
+var xmppServer string
+var xmppRooms string
+var xmppNick string
+var xmppOwnerUserID string
 var slackToken string
 var slackOwnerUserID string
+var webhookAddr string
+var webhookSecret string
+var webhookCallbackURL string
+var webhookOwnerUserID string
+var console bool
+var consoleDir string
 var imgurID string
 var imgurAlbum string
 var mashableKey string
 var carbonitexKey string
+var store string
+var dataDir string
+var ignoreBots bool
+var ignoreUsers string
 
 func init() {
 	flag.StringVar(&discordToken, "discordtoken", "", "Discord token.")
@@ -47,12 +89,47 @@ func init() {
 	flag.StringVar(&ircUsername, "ircusername", "", "IRC user name.")
 	flag.StringVar(&ircPassword, "ircpassword", "", "IRC password.")
 	flag.StringVar(&ircChannels, "ircchannels", "", "Comma separated list of IRC channels.")
+	flag.BoolVar(&ircTLS, "irctls", false, "Connect to the IRC server with TLS.")
+	flag.StringVar(&ircTLSCert, "irctlscert", "", "IRC TLS client certificate file.")
+	flag.StringVar(&ircTLSKey, "irctlskey", "", "IRC TLS client key file.")
+	flag.StringVar(&ircSASL, "ircsasl", "", "IRC SASL mechanism, PLAIN or EXTERNAL.")
+	flag.StringVar(&ircSASLUsername, "ircsaslusername", "", "IRC SASL account name.")
+	flag.StringVar(&ircSASLPassword, "ircsaslpassword", "", "IRC SASL password.")
+	flag.StringVar(&ircNickServPassword, "ircnickservpassword", "", "IRC NickServ password.")
+	flag.StringVar(&ircOwners, "ircowners", "", "Comma separated list of IRC owner services accounts and hostmasks, eg. *!*@example.com.")
+	flag.StringVar(&matrixHomeserver, "matrixhomeserver", "", "Matrix homeserver url.")
+	flag.StringVar(&matrixUserID, "matrixuserid", "", "Matrix user id, eg. @comicjerk:example.com.")
+	flag.StringVar(&matrixToken, "matrixtoken", "", "Matrix access token.")
+	flag.StringVar(&matrixRooms, "matrixrooms", "", "Comma separated list of Matrix rooms.")
+	flag.StringVar(&matrixOwnerUserID, "matrixowneruserid", "", "Matrix owner user id.")
+	flag.StringVar(&telegramToken, "telegramtoken", "", "Telegram bot token.")
+	flag.StringVar(&telegramURL, "telegramurl", comicjerk.DefaultTelegramURL, "Telegram Bot API url.")
+	flag.StringVar(&telegramOwnerUserID, "telegramowneruserid", "", "Telegram owner user id.")
+	flag.StringVar(&mattermostURL, "mattermosturl", "", "Mattermost server url.")
+	flag.StringVar(&mattermostToken, "mattermosttoken", "", "Mattermost access token.")
+	flag.StringVar(&mattermostOwnerUserID, "mattermostowneruserid", "", "Mattermost owner user id.")
+	flag.StringVar(&xmppJID, "xmppjid", "", "XMPP JID.")
+	flag.StringVar(&xmppPassword, "xmpppassword", "", "XMPP password.")
+	flag.StringVar(&xmppServer, "xmppserver", "", "XMPP server address, eg. xmpp.example.com:5222.")
+	flag.StringVar(&xmppRooms, "xmpprooms", "", "Comma separated list of XMPP rooms.")
+	flag.StringVar(&xmppNick, "xmppnick", "", "XMPP room nick.")
+	flag.StringVar(&xmppOwnerUserID, "xmppowneruserid", "", "XMPP owner JID.")
 	flag.StringVar(&slackToken, "slacktoken", "", "Slack token.")
 	flag.StringVar(&slackOwnerUserID, "slackowneruserid", "", "Slack owner user id.")
+	flag.StringVar(&webhookAddr, "webhookaddr", "", "Address the webhook service listens on, eg. :8080.")
+	flag.StringVar(&webhookSecret, "webhooksecret", "", "Shared secret webhook requests are signed with.")
+	flag.StringVar(&webhookCallbackURL, "webhookcallbackurl", "", "Url webhook replies are POSTed to, instead of being returned in the response.")
+	flag.StringVar(&webhookOwnerUserID, "webhookowneruserid", "", "Webhook owner user id.")
+	flag.BoolVar(&console, "console", false, "Run on the console, reading messages from stdin.")
+	flag.StringVar(&consoleDir, "consoledir", "console", "Directory files sent on the console are saved in.")
 	flag.StringVar(&imgurID, "imgurid", "", "Imgur client id.")
 	flag.StringVar(&imgurAlbum, "imguralbum", "", "Imgur album id.")
 	flag.StringVar(&mashableKey, "mashablekey", "", "Mashable key.")
 	flag.StringVar(&carbonitexKey, "carbonitexkey", "", "Carbonitex key for discord server count tracking.")
+	flag.StringVar(&store, "store", "file", "Plugin state store, one of file, bolt or sqlite.")
+	flag.StringVar(&dataDir, "datadir", "", "Directory plugin state is saved in.")
+	flag.BoolVar(&ignoreBots, "ignorebots", false, "Ignore messages from other bots.")
+	flag.StringVar(&ignoreUsers, "ignoreusers", "", "Comma separated list of user ids to ignore, on IRC accounts or ident@host.")
 	flag.Parse()
 
 	rand.Seed(time.Now().UnixNano())
@@ -67,18 +144,61 @@ func main() {
 	bot.ImgurAlbum = imgurAlbum
 	bot.MashableKey = mashableKey
 
+	switch store {
+	case "bolt":
+		s, err := boltstore.New(filepath.Join(dataDir, "comicjerk.bolt"))
+		if err != nil {
+			log.Fatalln("Error opening bolt store:", err)
+		}
+		bot.Store = s
+	case "sqlite":
+		s, err := sqlitestore.New(filepath.Join(dataDir, "comicjerk.sqlite"))
+		if err != nil {
+			log.Fatalln("Error opening sqlite store:", err)
+		}
+		bot.Store = s
+	case "file":
+		bot.Store = comicjerk.NewFileStore(dataDir)
+	default:
+		log.Fatalln("Unknown store:", store)
+	}
+
+	if ignoreBots {
+		bot.Use(comicjerk.IgnoreBots())
+	}
+	if ignoreUsers != "" {
+		bot.Use(comicjerk.IgnoreUsers(strings.Split(ignoreUsers, ",")...))
+	}
+
 	// Generally CommandPlugins don't hold state, so we share one instance of the command plugin for all services.
 	cp := comicjerk.NewCommandPlugin()
-	cp.AddCommand("invite", inviteplugin.InviteCommand, inviteplugin.InviteHelp)
-	cp.AddCommand("join", inviteplugin.InviteCommand, nil)
-	cp.AddCommand("stats", statsplugin.StatsCommand, statsplugin.StatsHelp)
-	cp.AddCommand("info", statsplugin.StatsCommand, nil)
-	cp.AddCommand("stat", statsplugin.StatsCommand, nil)
+	cp.AddCommand("invite", inviteplugin.InviteCommand, inviteplugin.InviteHelp).Aliases = []string{"join"}
+	cp.AddCommand("stats", statsplugin.StatsCommand, statsplugin.StatsHelp).Aliases = []string{"info", "stat"}
+	cp.AddArgsCommand("grant", comicjerk.RoleArgs, comicjerk.GrantCommand, comicjerk.GrantHelp).Permission = comicjerk.PermissionModerator
+	cp.AddArgsCommand("revoke", comicjerk.RoleArgs, comicjerk.RevokeCommand, comicjerk.RevokeHelp).Permission = comicjerk.PermissionModerator
+	cp.AddArgsCommand("roles", comicjerk.RolesArgs, comicjerk.RolesCommand, comicjerk.RolesHelp)
+
+	prefix := cp.AddGroup("prefix")
+	prefix.Description = "Manages the command prefixes in this channel."
+	prefix.AddArgsCommand("add", comicjerk.PrefixArgs, comicjerk.PrefixAddCommand, comicjerk.PrefixAddHelp).Permission = comicjerk.PermissionModerator
+	prefix.AddArgsCommand("remove", comicjerk.PrefixArgs, comicjerk.PrefixRemoveCommand, comicjerk.PrefixRemoveHelp).Permission = comicjerk.PermissionModerator
+	prefix.AddArgsCommand("set", comicjerk.PrefixArgs, comicjerk.PrefixSetCommand, comicjerk.PrefixSetHelp).Permission = comicjerk.PermissionModerator
+	prefix.AddCommand("reset", comicjerk.PrefixResetCommand, comicjerk.PrefixResetHelp).Permission = comicjerk.PermissionModerator
+	prefix.AddCommand("list", comicjerk.PrefixListCommand, comicjerk.PrefixListHelp)
+
+	cp.AddArgsCommand("suggestions", comicjerk.SuggestionsArgs, comicjerk.SuggestionsCommand, comicjerk.SuggestionsHelp).Permission = comicjerk.PermissionModerator
+
+	alias := cp.AddGroup("alias")
+	alias.Description = "Manages the command aliases in this channel."
+	alias.AddArgsCommand("add", comicjerk.AliasArgs, comicjerk.AliasAddCommand, comicjerk.AliasAddHelp).Permission = comicjerk.PermissionModerator
+	alias.AddArgsCommand("remove", comicjerk.AliasRemoveArgs, comicjerk.AliasRemoveCommand, comicjerk.AliasRemoveHelp).Permission = comicjerk.PermissionModerator
+	alias.AddCommand("list", comicjerk.AliasListCommand, comicjerk.AliasListHelp)
 	cp.AddCommand("quit", func(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, args string, parts []string) {
-		if service.IsBotOwner(message) {
-			q <- true
-		}
-	}, nil)
+		q <- true
+	}, nil).Permission = comicjerk.PermissionOwner
+
+	// The bridge plugin relays messages between services, so one instance is shared by all of them.
+	bp := bridgeplugin.New()
 
 	if (discordEmail != "" && discordPassword != "") || discordToken != "" {
 		var discord *comicjerk.Discord
@@ -97,6 +217,8 @@ func main() {
 		bot.RegisterPlugin(discord, comicplugin.New())
 		bot.RegisterPlugin(discord, directmessageinviteplugin.New())
 		bot.RegisterPlugin(discord, reminderplugin.New())
+		bot.RegisterPlugin(discord, customcommandplugin.New())
+		bot.RegisterPlugin(discord, bp)
 		bot.RegisterPlugin(discord, discordavatarplugin.New())
 		if carbonitexKey != "" {
 			bot.RegisterPlugin(discord, carbonitexplugin.New(carbonitexKey))
@@ -106,12 +228,29 @@ func main() {
 	// Register the IRC service if we have an IRC server and Username.
 	if ircServer != "" && ircUsername != "" {
 		irc := comicjerk.NewIRC(ircServer, ircUsername, ircPassword, strings.Split(ircChannels, ","))
+		irc.TLS = ircTLS
+		if ircTLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(ircTLSCert, ircTLSKey)
+			if err != nil {
+				log.Fatalln("Error loading IRC client certificate:", err)
+			}
+			irc.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		irc.SASLMechanism = strings.ToUpper(ircSASL)
+		irc.SASLUsername = ircSASLUsername
+		irc.SASLPassword = ircSASLPassword
+		irc.NickServPassword = ircNickServPassword
+		if ircOwners != "" {
+			irc.Owners = strings.Split(ircOwners, ",")
+		}
 		bot.RegisterService(irc)
 
 		bot.RegisterPlugin(irc, cp)
 		bot.RegisterPlugin(irc, chartplugin.New())
 		bot.RegisterPlugin(irc, comicplugin.New())
 		bot.RegisterPlugin(irc, reminderplugin.New())
+		bot.RegisterPlugin(irc, customcommandplugin.New())
+		bot.RegisterPlugin(irc, bp)
 	}
 
 	if slackToken != "" {
@@ -120,12 +259,101 @@ func main() {
 		bot.RegisterService(slack)
 
 		bot.RegisterPlugin(slack, cp)
+		bot.RegisterPlugin(slack, customcommandplugin.New())
+		bot.RegisterPlugin(slack, bp)
+	}
+
+	if matrixHomeserver != "" && matrixUserID != "" && matrixToken != "" {
+		matrix := comicjerk.NewMatrix(matrixHomeserver, matrixUserID, matrixToken, strings.Split(matrixRooms, ","))
+		matrix.OwnerUserID = matrixOwnerUserID
+		bot.RegisterService(matrix)
+
+		bot.RegisterPlugin(matrix, cp)
+		bot.RegisterPlugin(matrix, chartplugin.New())
+		bot.RegisterPlugin(matrix, comicplugin.New())
+		bot.RegisterPlugin(matrix, reminderplugin.New())
+		bot.RegisterPlugin(matrix, customcommandplugin.New())
+		bot.RegisterPlugin(matrix, bp)
+	}
+
+	if telegramToken != "" {
+		telegram := comicjerk.NewTelegram(telegramToken)
+		telegram.BaseURL = telegramURL
+		telegram.OwnerUserID = telegramOwnerUserID
+		bot.RegisterService(telegram)
+
+		bot.RegisterPlugin(telegram, cp)
+		bot.RegisterPlugin(telegram, chartplugin.New())
+		bot.RegisterPlugin(telegram, comicplugin.New())
+		bot.RegisterPlugin(telegram, reminderplugin.New())
+		bot.RegisterPlugin(telegram, customcommandplugin.New())
+		bot.RegisterPlugin(telegram, bp)
+	}
+
+	if mattermostURL != "" && mattermostToken != "" {
+		mattermost := comicjerk.NewMattermost(mattermostURL, mattermostToken)
+		mattermost.OwnerUserID = mattermostOwnerUserID
+		bot.RegisterService(mattermost)
+
+		bot.RegisterPlugin(mattermost, cp)
+		bot.RegisterPlugin(mattermost, chartplugin.New())
+		bot.RegisterPlugin(mattermost, comicplugin.New())
+		bot.RegisterPlugin(mattermost, reminderplugin.New())
+		bot.RegisterPlugin(mattermost, customcommandplugin.New())
+		bot.RegisterPlugin(mattermost, bp)
+	}
+
+	if xmppJID != "" && xmppPassword != "" {
+		rooms := []string{}
+		if xmppRooms != "" {
+			rooms = strings.Split(xmppRooms, ",")
+		}
+		xmpp := comicjerk.NewXMPP(xmppJID, xmppPassword, rooms)
+		xmpp.Server = xmppServer
+		if xmppNick != "" {
+			xmpp.Nick = xmppNick
+		}
+		xmpp.OwnerUserID = xmppOwnerUserID
+		bot.RegisterService(xmpp)
+
+		bot.RegisterPlugin(xmpp, cp)
+		bot.RegisterPlugin(xmpp, chartplugin.New())
+		bot.RegisterPlugin(xmpp, comicplugin.New())
+		bot.RegisterPlugin(xmpp, reminderplugin.New())
+		bot.RegisterPlugin(xmpp, customcommandplugin.New())
+		bot.RegisterPlugin(xmpp, bp)
+	}
+
+	if webhookAddr != "" {
+		webhook := comicjerk.NewWebhook(webhookAddr)
+		webhook.Secret = webhookSecret
+		webhook.CallbackURL = webhookCallbackURL
+		webhook.OwnerUserID = webhookOwnerUserID
+		bot.RegisterService(webhook)
+
+		bot.RegisterPlugin(webhook, cp)
+		bot.RegisterPlugin(webhook, chartplugin.New())
+		bot.RegisterPlugin(webhook, comicplugin.New())
+		bot.RegisterPlugin(webhook, reminderplugin.New())
+		bot.RegisterPlugin(webhook, customcommandplugin.New())
+	}
+
+	if console {
+		c := comicjerk.NewConsole(os.Stdin, os.Stdout, consoleDir)
+		bot.RegisterService(c)
+
+		bot.RegisterPlugin(c, cp)
+		bot.RegisterPlugin(c, chartplugin.New())
+		bot.RegisterPlugin(c, comicplugin.New())
+		bot.RegisterPlugin(c, reminderplugin.New())
+		bot.RegisterPlugin(c, customcommandplugin.New())
+		bot.RegisterPlugin(c, bp)
 	}
 
 	// Start all our services.
 	bot.Open()
 
-	// Wait for a termination signal, while saving the bot state every minute. Save on close.
+	// Wait for a termination signal, while saving the bot state every minute. Close will save the final state.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 
@@ -143,6 +371,5 @@ out:
 		}
 	}
 
-	bot.Save()
 	bot.Close()
 }
@@ -2,6 +2,7 @@ package comicplugin
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"image/png"
@@ -11,34 +12,47 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/matannoam/comicjerk"
 	"github.com/matannoam/comicgen"
-	"github.com/iopred/discordgo"
 )
 
+// comicRateLimit limits how often a user can create comics, as each one is rendered and possibly uploaded.
+var comicRateLimit = &comicjerk.RateLimit{Burst: 3, Interval: 30 * time.Second}
+
+var comicArgs = &comicjerk.ArgSpec{
+	Args: []*comicjerk.Arg{
+		{Name: "lines", Type: comicjerk.ArgInt, Optional: true, Min: 1, Max: 10},
+	},
+}
+
+var customComicArgs = &comicjerk.ArgSpec{
+	Args: []*comicjerk.Arg{
+		{Name: "script", Type: comicjerk.ArgRest},
+	},
+}
+
 type comicPlugin struct {
 	sync.Mutex
 
 	comicjerk.SimplePlugin
-	log    map[string][]comicjerk.Message
-	Comics int
+	log map[string][]comicjerk.Message
 }
 
+// Load imports the comic count saved by earlier versions into the plugin's Data.
 func (p *comicPlugin) Load(bot *comicjerk.Bot, service comicjerk.Service, data []byte) error {
-	if data != nil {
-		if err := json.Unmarshal(data, p); err != nil {
-			log.Println("Error loading data", err)
-		}
+	legacy := struct{ Comics int }{}
+	if data == nil || json.Unmarshal(data, &legacy) != nil {
+		return nil
 	}
 
+	if d := bot.Data(service, p.Name()); !d.Get("comics", new(int)) {
+		d.Set("comics", legacy.Comics)
+	}
 	return nil
 }
 
-func (p *comicPlugin) Save() ([]byte, error) {
-	return json.Marshal(p)
-}
-
 func (p *comicPlugin) Help(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, detailed bool) []string {
 	help := comicjerk.CommandHelp(service, "comic", "[1-10]", "Creates a comic from recent messages, or a number of messages if provided.")
 
@@ -88,69 +102,75 @@ func makeScriptFromMessages(service comicjerk.Service, message comicjerk.Message
 	}
 }
 
-func (p *comicPlugin) makeComic(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, script *comicgen.Script) {
-	p.Comics++
+// makeComic renders and sends a comic, it must be called without holding the plugin lock.
+func (p *comicPlugin) makeComic(ctx context.Context, bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, script *comicgen.Script) {
+	p.Lock()
+	comics := 0
+	d := bot.Data(service, p.Name())
+	d.Get("comics", &comics)
+	d.Set("comics", comics+1)
+	p.Unlock()
+
 	comic := comicgen.NewComicGen("comic", service.Name() != comicjerk.DiscordServiceName)
 	image, err := comic.MakeComic(script)
 	if err != nil {
-		service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, there was an error creating the comic. %s", message.UserName(), err))
-	} else {
-		go func() {
-			b := &bytes.Buffer{}
-			err = png.Encode(b, image)
-			if err != nil {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, there was a problem creating your comic.", message.UserName()))
-				return
-			}
-
-			if service.Name() == comicjerk.DiscordServiceName {
-				discord := service.(*comicjerk.Discord)
-				p, err := discord.UserChannelPermissions(message.UserID(), message.Channel())
-				if err == nil && p&discordgo.PermissionAttachFiles != 0 {
-					service.SendFile(message.Channel(), "comic.png", b)
-					return
-				}
-			}
+		comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, there was an error creating the comic. %s", message.UserName(), err))
+		return
+	}
 
-			url, err := bot.UploadToImgur(b, "comic.png")
-			if err != nil {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, there was a problem uploading the comic to imgur.", message.UserName()))
-				log.Println("Error uploading comic: ", err)
-				return
-			}
+	b := &bytes.Buffer{}
+	err = png.Encode(b, image)
+	if err != nil {
+		comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, there was a problem creating your comic.", message.UserName()))
+		return
+	}
 
-			if service.Name() == comicjerk.DiscordServiceName {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Here's your comic <@%s>: %s", message.UserID(), url))
-			} else {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Here's your comic %s: %s", message.UserName(), url))
-			}
-		}()
+	if s, ok := service.(comicjerk.NativeFileService); ok && s.CanSendFile(message) {
+		// The buffer is read through a copy, so it can still be uploaded if sending fails.
+		err := service.SendFile(message.Channel(), "comic.png", bytes.NewReader(b.Bytes()))
+		if err == nil {
+			return
+		}
+		log.Printf("Error sending comic to %s, uploading it instead. %v", service.Name(), err)
 	}
-}
 
-func (p *comicPlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
-	if service.IsMe(message) {
+	url, err := bot.UploadToImgurContext(ctx, b, "comic.png")
+	if err != nil {
+		comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, there was a problem uploading the comic to imgur.", message.UserName()))
+		log.Println("Error uploading comic: ", err)
 		return
 	}
 
-	p.Lock()
-	defer p.Unlock()
-
-	log, ok := p.log[message.Channel()]
-	if !ok {
-		log = []comicjerk.Message{}
+	if service.Name() == comicjerk.DiscordServiceName {
+		comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Here's your comic <@%s>: %s", message.UserID(), url))
+	} else {
+		comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Here's your comic %s: %s", message.UserName(), url))
 	}
+}
 
+func (p *comicPlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
+	p.MessageContext(context.Background(), bot, service, message)
+}
+
+func (p *comicPlugin) MessageContext(ctx context.Context, bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
 	if comicjerk.MatchesCommand(service, "customcomic", message) {
+		args, err := comicjerk.ParseArgs(service, "customcomic", message, customComicArgs)
+		if err != nil {
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, you didn't add any text.", message.UserName()))
+			return
+		}
+
+		if !bot.CheckRateLimit(service, message, "comic", comicRateLimit) {
+			return
+		}
+
 		ty := comicgen.ComicTypeChat
 
 		service.Typing(message.Channel())
 
-		str, _ := comicjerk.ParseCommand(service, message)
-
 		messages := []*comicgen.Message{}
 
-		splits := strings.Split(str, "|")
+		splits := strings.Split(args.String("script"), "|")
 		for _, line := range splits {
 			line := strings.Trim(line, " ")
 
@@ -181,29 +201,49 @@ func (p *comicPlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, mes
 		}
 
 		if len(messages) == 0 {
-			service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, you didn't add any text.", message.UserName()))
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, you didn't add any text.", message.UserName()))
 			return
 		}
 
-		p.makeComic(bot, service, message, &comicgen.Script{
+		p.makeComic(ctx, bot, service, message, &comicgen.Script{
 			Messages: messages,
 			Author:   fmt.Sprintf(service.UserName()),
 			Type:     ty,
 		})
-	} else if comicjerk.MatchesCommand(service, "comic", message) {
-		if len(log) == 0 {
-			service.SendMessage(message.Channel(), fmt.Sprintf("Sorry %s, I don't have enough messages to make a comic yet.", message.UserName()))
+		return
+	}
+
+	var args *comicjerk.Args
+	if comicjerk.MatchesCommand(service, "comic", message) {
+		var err error
+		if args, err = comicjerk.ParseArgs(service, "comic", message, comicArgs); err != nil {
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), comicjerk.UsageMessage(service, message, "comic", comicArgs, err))
 			return
 		}
+	}
 
-		service.Typing(message.Channel())
+	p.Lock()
 
-		lines := 0
-		linesString, parts := comicjerk.ParseCommand(service, message)
-		if len(parts) > 0 {
-			lines, _ = strconv.Atoi(linesString)
+	log, ok := p.log[message.Channel()]
+	if !ok {
+		log = []comicjerk.Message{}
+	}
+
+	if args != nil {
+		if len(log) == 0 {
+			p.Unlock()
+			comicjerk.SendMessageContext(ctx, service, message.Channel(), fmt.Sprintf("Sorry %s, I don't have enough messages to make a comic yet.", message.UserName()))
+			return
+		}
+
+		if !bot.CheckRateLimit(service, message, "comic", comicRateLimit) {
+			p.Unlock()
+			return
 		}
 
+		service.Typing(message.Channel())
+
+		lines := args.Int("lines")
 		if lines <= 0 {
 			lines = 1 + int(math.Floor((math.Pow(2*rand.Float64()-1, 3)/2+0.5)*float64(5)))
 		}
@@ -212,11 +252,18 @@ func (p *comicPlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, mes
 			lines = len(log)
 		}
 
-		p.makeComic(bot, service, message, makeScriptFromMessages(service, message, log[len(log)-lines:]))
+		script := makeScriptFromMessages(service, message, log[len(log)-lines:])
+		p.Unlock()
+
+		p.makeComic(ctx, bot, service, message, script)
 	} else {
+		defer p.Unlock()
+
 		// Don't append commands.
-		if strings.HasPrefix(strings.ToLower(strings.Trim(message.Message(), " ")), strings.ToLower(service.CommandPrefix())) {
-			return
+		for _, prefix := range comicjerk.CommandPrefixes(service, message) {
+			if strings.HasPrefix(strings.ToLower(strings.Trim(message.Message(), " ")), strings.ToLower(prefix)) {
+				return
+			}
 		}
 
 		switch message.Type() {
@@ -249,9 +296,16 @@ func (p *comicPlugin) Name() string {
 	return "Comic"
 }
 
+// Commands returns the commands handled by the plugin.
+func (p *comicPlugin) Commands() []string {
+	return []string{"comic", "customcomic"}
+}
+
 // Stats will return the stats for a plugin.
 func (p *comicPlugin) Stats(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) []string {
-	return []string{fmt.Sprintf("Comics created: \t%d\n", p.Comics)}
+	comics := 0
+	bot.Data(service, p.Name()).Get("comics", &comics)
+	return []string{fmt.Sprintf("Comics created: \t%d\n", comics)}
 }
 
 // New will create a new comic plugin.
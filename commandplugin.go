@@ -2,6 +2,7 @@ package comicjerk
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -13,6 +14,9 @@ type CommandHelpFunc func(bot *Bot, service Service, message Message) (string, s
 // CommandMessageFunc is the function signature for bot message commands.
 type CommandMessageFunc func(bot *Bot, service Service, message Message, args string, parts []string)
 
+// CommandArgsFunc is the function signature for bot message commands with declared arguments.
+type CommandArgsFunc func(bot *Bot, service Service, message Message, args *Args)
+
 // NewCommandHelp creates a new Command Help function.
 func NewCommandHelp(args, help string) CommandHelpFunc {
 	return func(bot *Bot, service Service, message Message) (string, string) {
@@ -23,12 +27,12 @@ func NewCommandHelp(args, help string) CommandHelpFunc {
 // MatchesCommandString returns true if a message matches a command.
 // Commands will be matched ignoring case with a prefix if they are not private messages.
 func MatchesCommandString(service Service, commandString string, private bool, message string) bool {
-	lowerMessage := strings.ToLower(strings.TrimSpace(message))
-	lowerPrefix := strings.ToLower(service.CommandPrefix())
+	return matchesCommandPrefixes([]string{service.CommandPrefix()}, commandString, private, message)
+}
 
-	if strings.HasPrefix(lowerMessage, lowerPrefix) {
-		lowerMessage = lowerMessage[len(lowerPrefix):]
-	} else if !private {
+func matchesCommandPrefixes(prefixes []string, commandString string, private bool, message string) bool {
+	lowerMessage, ok := trimPrefix(prefixes, strings.ToLower(strings.TrimSpace(message)))
+	if !ok && !private {
 		return false
 	}
 
@@ -44,38 +48,50 @@ func MatchesCommand(service Service, commandString string, message Message) bool
 	if message.Type() != MessageTypeCreate {
 		return false
 	}
-	return MatchesCommandString(service, commandString, service.IsPrivate(message), message.Message())
+	return matchesCommandPrefixes(CommandPrefixes(service, message), commandString, service.IsPrivate(message), message.Message())
 }
 
-// ParseCommandString will strip all prefixes from a message string, and return that string, and a space separated tokenized version of that string.
+// ParseCommandString will strip all prefixes from a message string, and return that string, and a whitespace separated tokenized version of that string.
 func ParseCommandString(service Service, message string) (string, []string) {
-	message = strings.TrimSpace(message)
-
-	lowerMessage := strings.ToLower(message)
-	lowerPrefix := strings.ToLower(service.CommandPrefix())
+	return parseCommandPrefixes([]string{service.CommandPrefix()}, message)
+}
 
-	if strings.HasPrefix(lowerMessage, lowerPrefix) {
-		message = message[len(lowerPrefix):]
-	}
+func parseCommandPrefixes(prefixes []string, message string) (string, []string) {
+	message, _ = trimPrefix(prefixes, strings.TrimSpace(message))
 	message = strings.TrimSpace(message)
 
-	parts := strings.Split(message, " ")
+	parts := strings.Fields(message)
 	if len(parts) > 1 {
-		rest := parts[1:]
-		return strings.Join(rest, " "), parts[1:]
+		return strings.TrimSpace(message[len(parts[0]):]), parts[1:]
 	}
 	return "", []string{}
 }
 
 // ParseCommand parses a message.
 func ParseCommand(service Service, message Message) (string, []string) {
-	return ParseCommandString(service, message.Message())
+	return parseCommandPrefixes(CommandPrefixes(service, message), message.Message())
+}
+
+// ParseSubcommand parses a message for a command with subcommands, eg. "reminder list".
+// The args and parts returned do not include the subcommand names.
+func ParseSubcommand(service Service, commandString string, message Message) (string, []string) {
+	args, parts := ParseCommand(service, message)
+	depth := len(strings.Fields(commandString)) - 1
+	if depth > len(parts) {
+		depth = len(parts)
+	}
+	for _, part := range parts[:depth] {
+		args = strings.TrimSpace(args[len(part):])
+	}
+	return args, parts[depth:]
 }
 
 // CommandHelp is a helper message that creates help text for a command.
 // eg. CommandHelp(service, "foo", "<bar>", "Foo bar baz") will return:
 //     !foo <bar> - Foo bar baz
 // The string is automatatically styled in Discord.
+// Help handlers are called with a service whose CommandPrefix is the preferred prefix of the channel, so the help
+// shows the prefix that works there. Elsewhere use CommandPrefix(service, message) to build command examples.
 func CommandHelp(service Service, command, arguments, help string) []string {
 	ticks := ""
 	if service.Name() == DiscordServiceName {
@@ -88,69 +104,327 @@ func CommandHelp(service Service, command, arguments, help string) []string {
 	return []string{fmt.Sprintf("%s%s%s%s - %s", ticks, service.CommandPrefix(), command, ticks, help)}
 }
 
-type command struct {
-	message CommandMessageFunc
-	help    CommandHelpFunc
+// Command is a command registered on a CommandPlugin.
+type Command struct {
+	message     CommandMessageFunc
+	argsMessage CommandArgsFunc
+	spec        *ArgSpec
+	help        CommandHelpFunc
+
+	// Permission is the permission required to run the command, defaults to PermissionEveryone.
+	Permission Permission
+	// RateLimits are the cooldowns applied to the command.
+	RateLimits []*RateLimit
+	// Aliases are other names the command can be used with, they are listed in help next to the command.
+	Aliases []string
+}
+
+// CommandGroup is a group of commands that share a name, eg. "reminder list" and "reminder cancel".
+// Groups can be nested to create deeper subcommands.
+type CommandGroup struct {
+	path     string
+	commands map[string]*Command
+	groups   map[string]*CommandGroup
+
+	// Description is shown in the help for the group.
+	Description string
+}
+
+func newCommandGroup(path string) *CommandGroup {
+	return &CommandGroup{
+		path:     path,
+		commands: make(map[string]*Command),
+		groups:   make(map[string]*CommandGroup),
+	}
+}
+
+// commandPath returns the full command string of a command or group in this group.
+func (g *CommandGroup) commandPath(name string) string {
+	if g.path == "" {
+		return name
+	}
+	return g.path + " " + name
+}
+
+// AddCommand adds a command, the returned Command can be used to set a required permission and rate limits.
+func (g *CommandGroup) AddCommand(commandString string, message CommandMessageFunc, help CommandHelpFunc) *Command {
+	c := &Command{
+		message: message,
+		help:    help,
+	}
+	g.commands[strings.ToLower(commandString)] = c
+	return c
+}
+
+// AddArgsCommand adds a command with declared arguments.
+// Messages with invalid arguments are replied to with a usage message, and the command help is generated from the spec.
+func (g *CommandGroup) AddArgsCommand(commandString string, spec *ArgSpec, message CommandArgsFunc, help string) *Command {
+	c := &Command{
+		argsMessage: message,
+		spec:        spec,
+		help:        NewCommandHelp(spec.Usage(), help),
+	}
+	g.commands[strings.ToLower(commandString)] = c
+	return c
+}
+
+// AddGroup adds a group of subcommands, or returns the existing group with that name.
+func (g *CommandGroup) AddGroup(name string) *CommandGroup {
+	name = strings.ToLower(name)
+	if group, ok := g.groups[name]; ok {
+		return group
+	}
+	group := newCommandGroup(g.commandPath(name))
+	g.groups[name] = group
+	return group
+}
+
+// lookup returns the command and the group with a full command string, eg. "reminder list".
+// A command can share its name with a group, so both may be returned.
+// If the command string is an alias, the full command string of the command it is an alias of is also returned.
+func (g *CommandGroup) lookup(commandString string) (string, *Command, *CommandGroup) {
+	fields := strings.Fields(strings.ToLower(commandString))
+	if len(fields) == 0 {
+		return "", nil, g
+	}
+	parent := g
+	for _, field := range fields[:len(fields)-1] {
+		if parent = parent.groups[field]; parent == nil {
+			return "", nil, nil
+		}
+	}
+	name := fields[len(fields)-1]
+	if command, ok := parent.commands[name]; ok {
+		return parent.commandPath(name), command, parent.groups[name]
+	}
+	// Aliases are checked in name order, duplicate aliases are rejected when the commands are registered.
+	for _, n := range parent.names() {
+		for _, alias := range parent.commands[n].Aliases {
+			if strings.EqualFold(alias, name) {
+				return parent.commandPath(n), parent.commands[n], nil
+			}
+		}
+	}
+	return "", nil, parent.groups[name]
+}
+
+// names returns the sorted names of the commands in this group.
+func (g *CommandGroup) names() []string {
+	names := make([]string, 0, len(g.commands))
+	for name := range g.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandStrings returns the full command strings of all the commands and groups in this group, including nested groups.
+// A group that shares its name with a command is only included once.
+func (g *CommandGroup) commandStrings() []string {
+	commandStrings := []string{}
+	for _, name := range g.names() {
+		commandStrings = append(commandStrings, g.commandPath(name))
+		for _, alias := range g.commands[name].Aliases {
+			commandStrings = append(commandStrings, g.commandPath(alias))
+		}
+	}
+	for name, group := range g.groups {
+		if _, ok := g.commands[name]; !ok {
+			commandStrings = append(commandStrings, group.path)
+		}
+		commandStrings = append(commandStrings, group.commandStrings()...)
+	}
+	return commandStrings
+}
+
+// topics returns the full command strings of this group and all nested groups.
+func (g *CommandGroup) topics() []string {
+	topics := []string{}
+	for _, group := range g.groups {
+		topics = append(topics, group.path)
+		topics = append(topics, group.topics()...)
+	}
+	return topics
+}
+
+// help returns the help for the commands in this group that the sender of a message can use.
+// Nested groups are summarised in one line each, unless recursive is true.
+func (g *CommandGroup) help(bot *Bot, service Service, message Message, recursive bool) []string {
+	help := []string{}
+	for name, command := range g.commands {
+		if command.help != nil && bot.HasPermission(service, message, command.Permission) {
+			arguments, h := command.help(bot, service, message)
+			if len(command.Aliases) > 0 {
+				h = fmt.Sprintf("%s Aliases: %s", h, strings.Join(command.Aliases, ", "))
+			}
+			help = append(help, CommandHelp(service, g.commandPath(name), arguments, h)...)
+		}
+	}
+	for _, group := range g.groups {
+		if recursive {
+			help = append(help, group.help(bot, service, message, true)...)
+			continue
+		}
+		if subcommands := group.subcommands(bot, service, message); len(subcommands) > 0 {
+			description := group.Description
+			if description == "" {
+				description = fmt.Sprintf("See %shelp %s for details.", service.CommandPrefix(), group.path)
+			}
+			help = append(help, CommandHelp(service, group.path, "<"+strings.Join(subcommands, "|")+">", description)...)
+		}
+	}
+	return help
+}
+
+// subcommands returns the sorted names of the commands and groups in this group that the sender of a message can use.
+func (g *CommandGroup) subcommands(bot *Bot, service Service, message Message) []string {
+	subcommands := []string{}
+	for name, command := range g.commands {
+		if command.help != nil && bot.HasPermission(service, message, command.Permission) {
+			subcommands = append(subcommands, name)
+		}
+	}
+	for name, group := range g.groups {
+		if _, ok := g.commands[name]; !ok && len(group.subcommands(bot, service, message)) > 0 {
+			subcommands = append(subcommands, name)
+		}
+	}
+	sort.Strings(subcommands)
+	return subcommands
 }
 
 // CommandPlugin is a plugin that can have commands registered and will handle messages matching that command by calling functions.
+// Commands can be grouped into subcommands with AddGroup.
+// Plugins with their own state can embed a CommandPlugin created with NewNamedCommandPlugin to handle their commands.
 type CommandPlugin struct {
-	commands map[string]*command
+	*CommandGroup
+	name string
 }
 
 // Name returns the name of the plugin.
 func (p *CommandPlugin) Name() string {
+	if p.name != "" {
+		return p.name
+	}
 	return "Command"
 }
 
 // Load will load plugin state from a byte array.
+// Commands keep their state in bot.Data, so there is nothing to load.
 func (p *CommandPlugin) Load(bot *Bot, service Service, data []byte) error {
-	// TODO: Add a generic data store backed by json.
 	return nil
 }
 
 // Save will save plugin state to a byte array.
+// Commands keep their state in bot.Data, so there is nothing to save.
 func (p *CommandPlugin) Save() ([]byte, error) {
-	// TODO: Add a generic data store backed by json.
 	return nil, nil
 }
 
+// Commands returns the command strings to register with the bot's command router.
+// Commands must be added before the bot is opened.
+func (p *CommandPlugin) Commands() []string {
+	return p.commandStrings()
+}
+
 // Help returns a list of help strings that are printed when the user requests them.
 func (p *CommandPlugin) Help(bot *Bot, service Service, message Message, detailed bool) []string {
 	if detailed {
 		return nil
 	}
-	help := []string{}
-	for commandString, command := range p.commands {
-		if command.help != nil {
-			arguments, h := command.help(bot, service, message)
-			help = append(help, CommandHelp(service, commandString, arguments, h)...)
+	return p.help(bot, withPrefix(service, message), message, false)
+}
+
+// HelpTopics returns the command groups that the sender of a message can use.
+func (p *CommandPlugin) HelpTopics(bot *Bot, service Service, message Message) []string {
+	topics := []string{}
+	for _, topic := range p.topics() {
+		if _, _, group := p.lookup(topic); group != nil && len(group.subcommands(bot, service, message)) > 0 {
+			topics = append(topics, topic)
 		}
 	}
+	return topics
+}
+
+// TopicHelp returns the help for all the commands in a command group.
+func (p *CommandPlugin) TopicHelp(bot *Bot, service Service, message Message, topic string) []string {
+	_, _, group := p.lookup(topic)
+	if group == nil || group == p.CommandGroup {
+		return nil
+	}
+	help := group.help(bot, withPrefix(service, message), message, true)
+	sort.Strings(help)
 	return help
 }
 
 // Message handler.
-// Iterates over the registered commands and executes them if the message matches.
+// Runs the command that the bot routes the message to.
 func (p *CommandPlugin) Message(bot *Bot, service Service, message Message) {
 	defer MessageRecover()
-	if !service.IsMe(message) {
-		for commandString, command := range p.commands {
-			if MatchesCommand(service, commandString, message) {
-				args, parts := ParseCommand(service, message)
-				command.message(bot, service, message, args, parts)
-				return
+	commandString, owner := bot.Route(service, message)
+	if owner == "" {
+		// Only the bots own command plugin suggests commands, so suggestions are not repeated by named command plugins.
+		if p.name == "" {
+			bot.suggest(service, message)
+		}
+		return
+	}
+	if owner != p.Name() {
+		return
+	}
+
+	// Aliases share permissions and rate limits with their command, but arguments follow what was typed.
+	name, command, group := p.lookup(commandString)
+	if command == nil && group != nil {
+		help := group.help(bot, withPrefix(service, message), message, false)
+		if len(help) == 0 {
+			return
+		}
+		sort.Strings(help)
+		if service.SupportsMultiline() {
+			service.SendMessage(message.Channel(), strings.Join(help, "\n"))
+		} else {
+			for _, h := range help {
+				if err := service.SendMessage(message.Channel(), h); err != nil {
+					break
+				}
 			}
 		}
+		return
+	}
+	if command == nil {
+		return
+	}
+
+	if !bot.HasPermission(service, message, command.Permission) {
+		service.SendMessage(message.Channel(), PermissionDeniedMessage(service, message))
+		return
+	}
+	if command.spec != nil {
+		args, err := ParseArgs(service, commandString, message, command.spec)
+		if err != nil {
+			service.SendMessage(message.Channel(), UsageMessage(service, message, commandString, command.spec, err))
+			return
+		}
+		if !bot.CheckRateLimit(service, message, name, command.RateLimits...) {
+			return
+		}
+		command.argsMessage(bot, service, message, args)
+		return
+	}
+	if !bot.CheckRateLimit(service, message, name, command.RateLimits...) {
+		return
 	}
+	args, parts := ParseSubcommand(service, commandString, message)
+	command.message(bot, service, message, args, parts)
 }
 
-// AddCommand adds a command.
-func (p *CommandPlugin) AddCommand(commandString string, message CommandMessageFunc, help CommandHelpFunc) {
-	p.commands[commandString] = &command{
-		message: message,
-		help:    help,
+// CommandPermission returns the permission required to use a command, groups can be used by everyone.
+func (p *CommandPlugin) CommandPermission(commandString string) Permission {
+	if _, command, _ := p.lookup(commandString); command != nil {
+		return command.Permission
 	}
+	return PermissionEveryone
 }
 
 // Stats will return the stats for a plugin.
@@ -160,5 +434,10 @@ func (p *CommandPlugin) Stats(bot *Bot, service Service, message Message) []stri
 
 // NewCommandPlugin will create a new command plugin.
 func NewCommandPlugin() *CommandPlugin {
-	return &CommandPlugin{make(map[string]*command)}
+	return &CommandPlugin{CommandGroup: newCommandGroup("")}
+}
+
+// NewNamedCommandPlugin will create a new command plugin with a name other than Command.
+func NewNamedCommandPlugin(name string) *CommandPlugin {
+	return &CommandPlugin{CommandGroup: newCommandGroup(""), name: name}
 }
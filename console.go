@@ -0,0 +1,463 @@
+package comicjerk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConsoleServiceName is the service name for the Console service.
+const ConsoleServiceName string = "Console"
+
+// maxConsoleHistory is the number of messages kept for each console channel.
+const maxConsoleHistory = 100
+
+// ConsoleMessage is a message typed into the console.
+type ConsoleMessage struct {
+	ChannelID   string
+	User        string
+	Content     string
+	ID          string
+	MessageType MessageType
+}
+
+// Channel returns the channel id for this message.
+func (m *ConsoleMessage) Channel() string {
+	return m.ChannelID
+}
+
+// UserName returns the user name for this message.
+func (m *ConsoleMessage) UserName() string {
+	return m.User
+}
+
+// UserID returns the user id for this message.
+func (m *ConsoleMessage) UserID() string {
+	return m.User
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *ConsoleMessage) UserAvatar() string {
+	return ""
+}
+
+// Message returns the message content for this message.
+func (m *ConsoleMessage) Message() string {
+	return m.Content
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *ConsoleMessage) RawMessage() string {
+	return m.Content
+}
+
+// MessageID returns the message ID for this message.
+func (m *ConsoleMessage) MessageID() string {
+	return m.ID
+}
+
+// Type returns the type of message.
+func (m *ConsoleMessage) Type() MessageType {
+	return m.MessageType
+}
+
+// Console is a Service provider that reads messages from a terminal and writes replies to it, for trying plugins without a chat network.
+// Lines starting with / change the fake channel and user that messages are sent as, type /help for a list.
+// Channels starting with @ are private chats with the bot.
+type Console struct {
+	sync.Mutex
+	in          io.Reader
+	out         io.Writer
+	messageChan chan Message
+	closing     chan struct{}
+	closeOnce   sync.Once
+
+	channel    string
+	user       string
+	lastID     int
+	last       map[string]*ConsoleMessage
+	channels   map[string]bool
+	moderators map[string]bool
+	owners     map[string]bool
+	history    map[string][]Message
+
+	// FileDir is the directory files sent with SendFile are saved in.
+	FileDir string
+	// Prefix is the command prefix, it defaults to !.
+	Prefix  string
+	BotName string
+}
+
+// NewConsole creates a new Console service, reading from in and writing to out.
+func NewConsole(in io.Reader, out io.Writer, fileDir string) *Console {
+	return &Console{
+		in:          in,
+		out:         out,
+		messageChan: make(chan Message, 200),
+		closing:     make(chan struct{}),
+		channel:     "#general",
+		user:        "user",
+		last:        make(map[string]*ConsoleMessage),
+		channels:    map[string]bool{"#general": true},
+		moderators:  make(map[string]bool),
+		owners:      make(map[string]bool),
+		history:     make(map[string][]Message),
+		FileDir:     fileDir,
+		Prefix:      "!",
+		BotName:     "comicjerk",
+	}
+}
+
+// printf writes a line to the console, continuation lines of multiline messages are indented.
+func (c *Console) printf(format string, a ...interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	text := strings.Replace(fmt.Sprintf(format, a...), "\n", "\n    ", -1)
+	fmt.Fprintln(c.out, text)
+}
+
+func (c *Console) nextID() string {
+	c.lastID++
+	return strconv.Itoa(c.lastID)
+}
+
+// consoleHelp lists the slash-commands of the console.
+var consoleHelp = []string{
+	"/channel <name> - Switches channel, channels starting with @ are private chats with the bot.",
+	"/user <name> - Switches the user messages are sent as.",
+	"/mod - Makes the current user a moderator, or stops them being one.",
+	"/owner - Makes the current user a bot owner, or stops them being one.",
+	"/edit <message> - Edits your last message in this channel.",
+	"/delete - Deletes your last message in this channel.",
+	"/whoami - Shows the current channel and user.",
+	"Start a message with // to send a message starting with /.",
+}
+
+// command handles a slash-command, it returns a message to send if the command was an edit or delete.
+func (c *Console) command(line string) *ConsoleMessage {
+	fields := strings.Fields(line)
+	name := strings.ToLower(fields[0])
+	arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+
+	c.Lock()
+	defer c.Unlock()
+
+	var reply string
+	var message *ConsoleMessage
+
+	switch name {
+	case "/channel":
+		if arg == "" {
+			reply = "Usage: /channel <name>"
+			break
+		}
+		c.channel = arg
+		c.channels[arg] = true
+		reply = fmt.Sprintf("Now in %s as %s.", c.channel, c.user)
+	case "/user":
+		if arg == "" {
+			reply = "Usage: /user <name>"
+			break
+		}
+		c.user = arg
+		reply = fmt.Sprintf("Now in %s as %s.", c.channel, c.user)
+	case "/mod":
+		c.moderators[c.user] = !c.moderators[c.user]
+		reply = fmt.Sprintf("Moderator: %t", c.moderators[c.user])
+	case "/owner":
+		c.owners[c.user] = !c.owners[c.user]
+		reply = fmt.Sprintf("Bot owner: %t", c.owners[c.user])
+	case "/edit", "/delete":
+		last := c.last[c.channel+"\x00"+c.user]
+		if last == nil {
+			reply = "You have not sent a message in this channel."
+			break
+		}
+		if name == "/delete" {
+			delete(c.last, c.channel+"\x00"+c.user)
+			c.replaceHistory(last, nil)
+			message = &ConsoleMessage{ChannelID: last.ChannelID, User: last.User, ID: last.ID, MessageType: MessageTypeDelete}
+			break
+		}
+		if arg == "" {
+			reply = "Usage: /edit <message>"
+			break
+		}
+		// Messages are shared with plugins, so the edit is a copy.
+		edited := *last
+		edited.Content = arg
+		c.last[c.channel+"\x00"+c.user] = &edited
+		c.replaceHistory(last, &edited)
+		message = &ConsoleMessage{ChannelID: last.ChannelID, User: last.User, Content: arg, ID: last.ID, MessageType: MessageTypeUpdate}
+	case "/whoami":
+		reply = fmt.Sprintf("In %s as %s, moderator: %t, bot owner: %t.", c.channel, c.user, c.moderators[c.user], c.owners[c.user])
+	default:
+		reply = strings.Join(consoleHelp, "\n    ")
+	}
+
+	if reply != "" {
+		fmt.Fprintln(c.out, reply)
+	}
+	return message
+}
+
+// replaceHistory replaces a message in the history of its channel, or removes it if replacement is nil.
+func (c *Console) replaceHistory(message, replacement *ConsoleMessage) {
+	history := c.history[message.ChannelID]
+	for i, m := range history {
+		if m == Message(message) {
+			if replacement == nil {
+				c.history[message.ChannelID] = append(history[:i:i], history[i+1:]...)
+			} else {
+				history[i] = replacement
+			}
+			return
+		}
+	}
+}
+
+// message creates a message from a line typed into the console.
+func (c *Console) message(content string) *ConsoleMessage {
+	c.Lock()
+	defer c.Unlock()
+
+	m := &ConsoleMessage{
+		ChannelID:   c.channel,
+		User:        c.user,
+		Content:     content,
+		ID:          c.nextID(),
+		MessageType: MessageTypeCreate,
+	}
+	c.last[c.channel+"\x00"+c.user] = m
+
+	history := append(c.history[c.channel], m)
+	if len(history) > maxConsoleHistory {
+		history = history[1:]
+	}
+	c.history[c.channel] = history
+	return m
+}
+
+// read reads lines until the input ends or the service is closed, the bot stops listening when the message channel is closed.
+func (c *Console) read() {
+	defer close(c.messageChan)
+
+	scanner := bufio.NewScanner(c.in)
+	for scanner.Scan() {
+		select {
+		case <-c.closing:
+			return
+		default:
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var m *ConsoleMessage
+		if strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "//") {
+			m = c.command(line)
+		} else {
+			m = c.message(strings.TrimPrefix(line, "/"))
+		}
+		if m == nil {
+			continue
+		}
+
+		select {
+		case c.messageChan <- m:
+		case <-c.closing:
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		c.printf("Error reading console: %v", err)
+	}
+}
+
+// Name returns the name of the service.
+func (c *Console) Name() string {
+	return ConsoleServiceName
+}
+
+// Open opens the service and returns a channel which all messages will be sent on.
+func (c *Console) Open() (<-chan Message, error) {
+	c.printf("Console ready, in %s as %s. Type /help for console commands.", c.channel, c.user)
+	go c.read()
+	return c.messageChan, nil
+}
+
+// Close closes the service. A read from a terminal can not be interrupted, so the console stops reading at the next line.
+func (c *Console) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+	return nil
+}
+
+// IsMe returns whether or not a message was sent by the bot.
+func (c *Console) IsMe(message Message) bool {
+	return message.UserID() == c.BotName
+}
+
+// SendMessage sends a message.
+func (c *Console) SendMessage(channel, message string) error {
+	_, err := c.SendMessageID(channel, message)
+	return err
+}
+
+// SendMessageID sends a message and returns its id.
+func (c *Console) SendMessageID(channel, message string) (string, error) {
+	c.Lock()
+	id := c.nextID()
+	c.Unlock()
+
+	c.printf("[%s] (%s) %s: %s", channel, id, c.BotName, message)
+	return id, nil
+}
+
+// EditMessage edits a message.
+func (c *Console) EditMessage(channel, messageID, message string) error {
+	c.printf("[%s] (%s edited) %s: %s", channel, messageID, c.BotName, message)
+	return nil
+}
+
+// DeleteMessage deletes a message.
+func (c *Console) DeleteMessage(channel, messageID string) error {
+	c.printf("[%s] (%s deleted)", channel, messageID)
+	return nil
+}
+
+// CanSendFile returns true, files are saved to FileDir.
+func (c *Console) CanSendFile(message Message) bool {
+	return true
+}
+
+// SendFile saves a file to FileDir.
+func (c *Console) SendFile(channel, name string, r io.Reader) error {
+	if err := os.MkdirAll(c.FileDir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.FileDir, filepath.Base(name))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+
+	c.printf("[%s] %s sent a file: %s", channel, c.BotName, path)
+	return nil
+}
+
+// BanUser bans a user.
+func (c *Console) BanUser(channel, userID string, duration int) error {
+	c.printf("[%s] %s banned %s for %d.", channel, c.BotName, userID, duration)
+	return nil
+}
+
+// UnbanUser unbans a user.
+func (c *Console) UnbanUser(channel, userID string) error {
+	c.printf("[%s] %s unbanned %s.", channel, c.BotName, userID)
+	return nil
+}
+
+// UserName returns the bots name.
+func (c *Console) UserName() string {
+	return c.BotName
+}
+
+// UserID returns the bots user id.
+func (c *Console) UserID() string {
+	return c.BotName
+}
+
+// Join joins a channel.
+func (c *Console) Join(join string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.channels[join] {
+		return ErrAlreadyJoined
+	}
+	c.channels[join] = true
+	return nil
+}
+
+// Typing sets that the bot is typing.
+func (c *Console) Typing(channel string) error {
+	return nil
+}
+
+// PrivateMessage will send a private message to a user.
+func (c *Console) PrivateMessage(userID, message string) error {
+	return c.SendMessage("@"+userID, message)
+}
+
+// SupportsPrivateMessages returns whether the service supports private messages.
+func (c *Console) SupportsPrivateMessages() bool {
+	return true
+}
+
+// SupportsMultiline returns whether the service supports multiline messages.
+func (c *Console) SupportsMultiline() bool {
+	return true
+}
+
+// CommandPrefix returns the command prefix for the service.
+func (c *Console) CommandPrefix() string {
+	return c.Prefix
+}
+
+// IsBotOwner returns whether or not a message sender was the owner of the bot.
+func (c *Console) IsBotOwner(message Message) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.owners[message.UserID()]
+}
+
+// IsPrivate returns whether or not a message was private.
+func (c *Console) IsPrivate(message Message) bool {
+	return strings.HasPrefix(message.Channel(), "@")
+}
+
+// IsModerator returns whether or not the sender of a message is a moderator.
+func (c *Console) IsModerator(message Message) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.moderators[message.UserID()]
+}
+
+// ChannelCount returns the number of channels the bot is in.
+func (c *Console) ChannelCount() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.channels)
+}
+
+// SupportsMessageHistory returns if the service supports message history.
+func (c *Console) SupportsMessageHistory() bool {
+	return true
+}
+
+// MessageHistory returns the message history for a channel.
+func (c *Console) MessageHistory(channel string) []Message {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]Message{}, c.history[channel]...)
+}
@@ -0,0 +1,172 @@
+package comicjerk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// consoleTest is a console reading from a pipe, with its output kept in a buffer.
+type consoleTest struct {
+	*Console
+	messages <-chan Message
+	in       *io.PipeWriter
+	out      *bytes.Buffer
+	dir      string
+}
+
+func openConsole(t *testing.T) *consoleTest {
+	dir, err := ioutil.TempDir("", "comicjerk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	out := &bytes.Buffer{}
+	c := NewConsole(r, out, dir)
+	messages, err := c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &consoleTest{c, messages, w, out, dir}
+}
+
+func (c *consoleTest) close() {
+	c.Close()
+	c.in.Close()
+	os.RemoveAll(c.dir)
+}
+
+// typeLines types lines into the console, each is read before the next is typed.
+func (c *consoleTest) typeLines(lines ...string) {
+	for _, line := range lines {
+		fmt.Fprintln(c.in, line)
+	}
+}
+
+// output returns what the console has written.
+func (c *consoleTest) output() string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.out.String()
+}
+
+func (c *consoleTest) next(t *testing.T) *ConsoleMessage {
+	select {
+	case m, ok := <-c.messages:
+		if !ok {
+			t.Fatal("the console stopped reading")
+		}
+		return m.(*ConsoleMessage)
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+func TestConsoleCommands(t *testing.T) {
+	c := openConsole(t)
+	defer c.close()
+
+	c.typeLines("hello")
+	if m := c.next(t); m.Channel() != "#general" || m.UserName() != "user" || m.Message() != "hello" || m.Type() != MessageTypeCreate {
+		t.Errorf("message = %s %q in %s from %s, want hello in #general from user", m.Type(), m.Message(), m.Channel(), m.UserName())
+	}
+
+	c.typeLines("/channel #random", "/user bob", "/mod", "hi")
+	hi := c.next(t)
+	if hi.Channel() != "#random" || hi.UserName() != "bob" {
+		t.Errorf("message in %s from %s, want #random from bob", hi.Channel(), hi.UserName())
+	}
+	if !c.IsModerator(hi) || c.IsPrivate(hi) {
+		t.Errorf("moderator %v private %v, want a moderator in a public channel", c.IsModerator(hi), c.IsPrivate(hi))
+	}
+
+	// Edits and deletes are of the user's last message in the channel.
+	c.typeLines("/edit hi there")
+	if m := c.next(t); m.Type() != MessageTypeUpdate || m.MessageID() != hi.MessageID() || m.Message() != "hi there" {
+		t.Errorf("edit = %s %s %q, want an update of %s", m.Type(), m.MessageID(), m.Message(), hi.MessageID())
+	}
+	if history := c.MessageHistory("#random"); len(history) != 1 || history[0].Message() != "hi there" {
+		t.Errorf("history = %v, want the edited message", history)
+	}
+	c.typeLines("/delete")
+	if m := c.next(t); m.Type() != MessageTypeDelete || m.MessageID() != hi.MessageID() {
+		t.Errorf("delete = %s %s, want a delete of %s", m.Type(), m.MessageID(), hi.MessageID())
+	}
+	if history := c.MessageHistory("#random"); len(history) != 0 {
+		t.Errorf("history = %v, want the message deleted", history)
+	}
+
+	c.typeLines("//slash")
+	if m := c.next(t); m.Message() != "/slash" {
+		t.Errorf("message = %q, want /slash", m.Message())
+	}
+
+	c.typeLines("/channel @bob", "psst")
+	if m := c.next(t); !c.IsPrivate(m) {
+		t.Error("a message in @bob is not private")
+	}
+
+	if output := c.output(); !strings.Contains(output, "Now in #random as bob.") || !strings.Contains(output, "Moderator: true") {
+		t.Errorf("output = %q, want the commands to reply", output)
+	}
+}
+
+func TestConsoleSendFile(t *testing.T) {
+	c := openConsole(t)
+	defer c.close()
+
+	// Only the base name is used, so a file can not be written outside FileDir.
+	if err := c.SendFile("#general", "../chart.png", strings.NewReader("image")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(c.dir, "chart.png")
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "image" {
+		t.Errorf("file = %q, %v, want image", data, err)
+	}
+	if output := c.output(); !strings.Contains(output, path) {
+		t.Errorf("output = %q, want the file's path", output)
+	}
+}
+
+func TestConsoleEOF(t *testing.T) {
+	c := openConsole(t)
+	defer c.close()
+
+	// The message channel is closed when the input ends, so the bot stops listening.
+	c.in.Close()
+	select {
+	case _, ok := <-c.messages:
+		if ok {
+			t.Error("received a message, want the channel closed")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the console did not stop reading at the end of its input")
+	}
+}
+
+func TestConsoleClose(t *testing.T) {
+	c := openConsole(t)
+	defer c.close()
+
+	c.Close()
+	go c.typeLines("hello")
+
+	// Lines typed after Close are not sent.
+	select {
+	case m, ok := <-c.messages:
+		if ok {
+			t.Errorf("received %q, want the channel closed", m.Message())
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the console did not stop reading after close")
+	}
+}
@@ -0,0 +1,378 @@
+package customcommandplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matannoam/comicjerk"
+)
+
+// maxCommands is the number of custom commands a channel can have.
+const maxCommands = 100
+
+// maxResponseLength is the longest response a custom command can have.
+const maxResponseLength = 1000
+
+// customCommandRateLimit stops custom commands from being used to flood a channel.
+var customCommandRateLimit = &comicjerk.RateLimit{Burst: 3, Interval: 10 * time.Second, PerChannel: true, Silent: true}
+
+// managementCommands are the command names used to manage custom commands.
+var managementCommands = []string{"customcommand", "cc"}
+
+var nameRegex = regexp.MustCompile(`^[a-z0-9_\-]+$`)
+
+var templateRegex = regexp.MustCompile(`\{(user|channel|args|random:[^}]*)\}`)
+
+// A CustomCommand is a text command created by a moderator.
+type CustomCommand struct {
+	Name     string
+	Response string
+	Creator  string
+	Created  time.Time
+	Uses     int
+}
+
+// CustomCommandPlugin is a plugin that lets moderators create text commands in their channels.
+type CustomCommandPlugin struct {
+	sync.RWMutex
+	// Channels maps a channel to the custom commands in that channel.
+	Channels map[string]map[string]*CustomCommand
+}
+
+// Name returns the name of the plugin.
+func (p *CustomCommandPlugin) Name() string {
+	return "CustomCommand"
+}
+
+// Commands returns the commands used to manage custom commands.
+// Custom commands are registered in the channel they were added to, so they do not shadow commands in other channels.
+func (p *CustomCommandPlugin) Commands() []string {
+	commands := []string{}
+	for _, name := range managementCommands {
+		commands = append(commands, name, name+" add", name+" edit", name+" delete", name+" list")
+	}
+	return commands
+}
+
+// CommandPermission returns the permission required to use a command, changing custom commands is for moderators.
+func (p *CustomCommandPlugin) CommandPermission(commandString string) comicjerk.Permission {
+	fields := strings.Fields(commandString)
+	if len(fields) == 2 && fields[1] != "list" {
+		for _, name := range managementCommands {
+			if fields[0] == name {
+				return comicjerk.PermissionModerator
+			}
+		}
+	}
+	return comicjerk.PermissionEveryone
+}
+
+// Help returns a list of help strings that are printed when the user requests them.
+func (p *CustomCommandPlugin) Help(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, detailed bool) []string {
+	moderator := bot.HasPermission(service, message, comicjerk.PermissionModerator)
+
+	help := []string{}
+	if detailed {
+		if !moderator {
+			return nil
+		}
+		return []string{
+			comicjerk.CommandHelp(service, "customcommand add", "<name> <response>", "Adds a custom command to this channel.")[0],
+			comicjerk.CommandHelp(service, "customcommand edit", "<name> <response>", "Changes the response of a custom command.")[0],
+			comicjerk.CommandHelp(service, "customcommand delete", "<name>", "Deletes a custom command.")[0],
+			comicjerk.CommandHelp(service, "customcommand list", "", "Lists the custom commands in this channel.")[0],
+			"Responses can contain {user}, {channel}, {args} and {random:a|b|c}. cc can be used instead of customcommand.",
+			"Examples:",
+			comicjerk.CommandHelp(service, "customcommand add", "rules", "Be nice to each other, {user}.")[0],
+			comicjerk.CommandHelp(service, "customcommand add", "flip", "{user} flipped {random:heads|tails}.")[0],
+		}
+	}
+
+	if moderator {
+		help = append(help, comicjerk.CommandHelp(service, "customcommand", "<add|edit|delete|list>", "Manages the custom commands in this channel.")...)
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	for name, command := range p.Channels[message.Channel()] {
+		help = append(help, comicjerk.CommandHelp(service, name, "", fmt.Sprintf("Custom command added by %s.", command.Creator))...)
+	}
+	return help
+}
+
+// Message handler.
+func (p *CustomCommandPlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
+	defer comicjerk.MessageRecover()
+	commandString, owner := bot.Route(service, message)
+	if owner != p.Name() {
+		return
+	}
+
+	fields := strings.Fields(commandString)
+	for _, name := range managementCommands {
+		if fields[0] == name {
+			p.manage(bot, service, message, commandString)
+			return
+		}
+	}
+
+	p.RLock()
+	exists := p.Channels[message.Channel()][commandString] != nil
+	p.RUnlock()
+	if !exists {
+		return
+	}
+
+	if !bot.CheckRateLimit(service, message, commandString, customCommandRateLimit) {
+		return
+	}
+
+	// The command may have been edited or deleted while the rate limit was checked.
+	p.Lock()
+	command := p.Channels[message.Channel()][commandString]
+	if command == nil {
+		p.Unlock()
+		return
+	}
+	command.Uses++
+	response := command.Response
+	p.Unlock()
+
+	service.SendMessage(message.Channel(), expand(service, message, response, comicjerk.RawCommandArguments(service, commandString, message)))
+}
+
+// expand replaces the template variables in a response.
+func expand(service comicjerk.Service, message comicjerk.Message, response, args string) string {
+	return templateRegex.ReplaceAllStringFunc(response, func(variable string) string {
+		variable = variable[1 : len(variable)-1]
+		switch variable {
+		case "user":
+			return message.UserName()
+		case "channel":
+			if service.Name() == comicjerk.DiscordServiceName {
+				return fmt.Sprintf("<#%s>", message.Channel())
+			}
+			return message.Channel()
+		case "args":
+			return args
+		}
+		choices := strings.Split(strings.TrimPrefix(variable, "random:"), "|")
+		return choices[rand.Intn(len(choices))]
+	})
+}
+
+// manage handles the commands for adding, editing, deleting and listing custom commands.
+func (p *CustomCommandPlugin) manage(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, commandString string) {
+	fields := strings.Fields(commandString)
+	if len(fields) == 1 {
+		service.SendMessage(message.Channel(), fmt.Sprintf("Usage: %s%s <add|edit|delete|list>", comicjerk.CommandPrefix(service, message), fields[0]))
+		return
+	}
+
+	if fields[1] == "list" {
+		p.list(service, message)
+		return
+	}
+
+	if !bot.HasPermission(service, message, comicjerk.PermissionModerator) {
+		service.SendMessage(message.Channel(), comicjerk.PermissionDeniedMessage(service, message))
+		return
+	}
+
+	args := comicjerk.RawCommandArguments(service, commandString, message)
+	name, response := args, ""
+	if i := strings.IndexAny(args, " \t\n"); i != -1 {
+		name, response = args[:i], strings.TrimSpace(args[i:])
+	}
+	name = strings.ToLower(name)
+
+	if name == "" {
+		usage := "<name> <response>"
+		if fields[1] == "delete" {
+			usage = "<name>"
+		}
+		service.SendMessage(message.Channel(), fmt.Sprintf("Usage: %s%s %s %s", comicjerk.CommandPrefix(service, message), fields[0], fields[1], usage))
+		return
+	}
+
+	var err error
+	var reply string
+	switch fields[1] {
+	case "add":
+		err = p.add(bot, service, message, name, response)
+		reply = fmt.Sprintf("Added %s%s.", comicjerk.CommandPrefix(service, message), name)
+	case "edit":
+		err = p.edit(message, name, response)
+		reply = fmt.Sprintf("Changed %s%s.", comicjerk.CommandPrefix(service, message), name)
+	case "delete":
+		err = p.delete(bot, service, message, name)
+		reply = fmt.Sprintf("Deleted %s%s.", comicjerk.CommandPrefix(service, message), name)
+	}
+
+	if err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	service.SendMessage(message.Channel(), reply)
+}
+
+func validateResponse(response string) error {
+	if response == "" {
+		return errors.New("A custom command needs a response.")
+	}
+	if len(response) > maxResponseLength {
+		return fmt.Errorf("A response can be at most %d characters.", maxResponseLength)
+	}
+	return nil
+}
+
+func (p *CustomCommandPlugin) add(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, name, response string) error {
+	if !nameRegex.MatchString(name) {
+		return errors.New("A command name can only contain letters, numbers, - and _.")
+	}
+	if err := validateResponse(response); err != nil {
+		return err
+	}
+	if bot.IsCommand(service, name) {
+		return fmt.Errorf("%s is already a command.", name)
+	}
+	for _, m := range managementCommands {
+		if name == m {
+			return fmt.Errorf("%s is already a command.", name)
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	channel := p.Channels[message.Channel()]
+	if channel == nil {
+		channel = map[string]*CustomCommand{}
+		p.Channels[message.Channel()] = channel
+	}
+	if channel[name] != nil {
+		return fmt.Errorf("%s already exists, use edit to change it.", name)
+	}
+	if len(channel) >= maxCommands {
+		return fmt.Errorf("A channel can have at most %d custom commands.", maxCommands)
+	}
+
+	if err := bot.RegisterChannelCommand(service, message.Channel(), p, name); err != nil {
+		return err
+	}
+
+	channel[name] = &CustomCommand{
+		Name:     name,
+		Response: response,
+		Creator:  message.UserName(),
+		Created:  time.Now(),
+	}
+	return nil
+}
+
+func (p *CustomCommandPlugin) edit(message comicjerk.Message, name, response string) error {
+	if err := validateResponse(response); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	command := p.Channels[message.Channel()][name]
+	if command == nil {
+		return fmt.Errorf("%s is not a custom command in this channel.", name)
+	}
+	command.Response = response
+	return nil
+}
+
+func (p *CustomCommandPlugin) delete(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, name string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	channel := p.Channels[message.Channel()]
+	if channel[name] == nil {
+		return fmt.Errorf("%s is not a custom command in this channel.", name)
+	}
+	delete(channel, name)
+	if len(channel) == 0 {
+		delete(p.Channels, message.Channel())
+	}
+	bot.UnregisterChannelCommand(service, message.Channel(), p, name)
+	return nil
+}
+
+func (p *CustomCommandPlugin) list(service comicjerk.Service, message comicjerk.Message) {
+	p.RLock()
+	defer p.RUnlock()
+
+	channel := p.Channels[message.Channel()]
+	if len(channel) == 0 {
+		service.SendMessage(message.Channel(), "There are no custom commands in this channel.")
+		return
+	}
+
+	names := []string{}
+	for name := range channel {
+		names = append(names, comicjerk.CommandPrefix(service, message)+name)
+	}
+	sort.Strings(names)
+	service.SendMessage(message.Channel(), fmt.Sprintf("Custom commands in this channel: %s", strings.Join(names, ", ")))
+}
+
+// Load will load plugin state from a byte array.
+func (p *CustomCommandPlugin) Load(bot *comicjerk.Bot, service comicjerk.Service, data []byte) error {
+	if data != nil {
+		if err := json.Unmarshal(data, p); err != nil {
+			log.Println("Error loading data", err)
+		}
+	}
+	if p.Channels == nil {
+		p.Channels = map[string]map[string]*CustomCommand{}
+	}
+
+	for channel, commands := range p.Channels {
+		for name := range commands {
+			if err := bot.RegisterChannelCommand(service, channel, p, name); err != nil {
+				log.Printf("Error registering custom command %s in %s. %v", name, channel, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Save will save plugin state to a byte array.
+func (p *CustomCommandPlugin) Save() ([]byte, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return json.Marshal(p)
+}
+
+// Stats will return the stats for a plugin.
+func (p *CustomCommandPlugin) Stats(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) []string {
+	p.RLock()
+	defer p.RUnlock()
+
+	commands := 0
+	for _, channel := range p.Channels {
+		commands += len(channel)
+	}
+	return []string{fmt.Sprintf("Custom commands: \t%d\n", commands)}
+}
+
+// New will create a new custom command plugin.
+func New() comicjerk.Plugin {
+	return &CustomCommandPlugin{
+		Channels: map[string]map[string]*CustomCommand{},
+	}
+}
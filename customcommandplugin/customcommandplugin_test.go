@@ -0,0 +1,100 @@
+package customcommandplugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matannoam/comicjerk"
+)
+
+func TestCustomCommandChannels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "customcommandplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	service.Moderator = true
+	bot.RegisterService(service)
+	bot.RegisterPlugin(service, New())
+	bot.Open()
+	defer bot.Close()
+
+	service.InjectString("#a", "bob", "!cc add rules Be nice in #a.")
+	service.WaitForCalls("SendMessage", 1, time.Second)
+
+	// The command only exists in the channel it was added to.
+	service.InjectString("#b", "bob", "!rules")
+	service.InjectString("#a", "bob", "!rules")
+	calls := service.WaitForCalls("SendMessage", 2, time.Second)
+	if len(calls) != 2 || calls[1].Target != "#a" || calls[1].Message != "Be nice in #a." {
+		t.Fatalf("calls = %v, want only #a to reply", calls)
+	}
+	if owner := bot.ChannelCommandOwner(service, "#b", "rules"); owner != "" {
+		t.Errorf("owner in #b = %q, want none", owner)
+	}
+
+	// Another channel can add a command with the same name.
+	service.InjectString("#b", "bob", "!cc add rules Be nice in #b.")
+	service.WaitForCalls("SendMessage", 3, time.Second)
+	service.InjectString("#b", "bob", "!rules")
+	calls = service.WaitForCalls("SendMessage", 4, time.Second)
+	if len(calls) != 4 || calls[3].Message != "Be nice in #b." {
+		t.Fatalf("calls = %v, want the #b response", calls)
+	}
+
+	// Deleting it in one channel leaves the other.
+	service.InjectString("#b", "bob", "!cc delete rules")
+	service.WaitForCalls("SendMessage", 5, time.Second)
+	if owner := bot.ChannelCommandOwner(service, "#b", "rules"); owner != "" {
+		t.Errorf("owner in #b = %q, want none after delete", owner)
+	}
+	if owner := bot.ChannelCommandOwner(service, "#a", "rules"); owner != "CustomCommand" {
+		t.Errorf("owner in #a = %q, want CustomCommand", owner)
+	}
+}
+
+func TestCustomCommandEditWhileUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "customcommandplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	service.Moderator = true
+	bot.RegisterService(service)
+	p := New().(*CustomCommandPlugin)
+	bot.RegisterPlugin(service, p)
+	bot.Open()
+	defer bot.Close()
+
+	service.InjectString("#a", "bob", "!cc add rules Be nice.")
+	service.WaitForCalls("SendMessage", 1, time.Second)
+
+	message := &comicjerk.TestMessage{ChannelID: "#a", Author: "bob", AuthorID: "bob", Content: "!rules", MessageType: comicjerk.MessageTypeCreate}
+
+	// Run with -race to check responses are not read while they are edited.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p.Message(bot, service, message)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			p.edit(message, "rules", fmt.Sprintf("Be nice %d.", i))
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,182 @@
+package comicjerk
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+)
+
+// sharedDataService is the service name SharedData is stored under.
+const sharedDataService = "Shared"
+
+// dataSuffix is appended to the plugin name when persisting Data, so it never collides with a plugins own Save.
+const dataSuffix = ".data"
+
+// Data is a JSON backed key/value store for a plugin on a service.
+// It allows commands registered on a CommandPlugin to keep state without implementing their own Plugin.
+type Data struct {
+	sync.RWMutex
+	service string
+	plugin  string
+	values  map[string]json.RawMessage
+	dirty   bool
+	// version is incremented by every change, so a save only marks the data clean if nothing changed since.
+	version int
+}
+
+func newData(service, plugin string, data []byte) *Data {
+	d := &Data{
+		service: service,
+		plugin:  plugin,
+		values:  make(map[string]json.RawMessage),
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &d.values); err != nil {
+			log.Println("Error loading data", err)
+		}
+	}
+	return d
+}
+
+// Get unmarshals the value stored at key into value, and returns whether the key was found.
+func (d *Data) Get(key string, value interface{}) bool {
+	d.RLock()
+	defer d.RUnlock()
+
+	raw, ok := d.values[key]
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		log.Printf("Error unmarshalling data %s %s %s. %v", d.service, d.plugin, key, err)
+		return false
+	}
+	return true
+}
+
+// Set marshals value and stores it at key.
+func (d *Data) Set(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.values[key] = raw
+	d.dirty = true
+	d.version++
+	return nil
+}
+
+// Delete removes key.
+func (d *Data) Delete(key string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.values[key]; ok {
+		delete(d.values, key)
+		d.dirty = true
+		d.version++
+	}
+}
+
+// Keys returns all the stored keys, sorted.
+func (d *Data) Keys() []string {
+	d.RLock()
+	defer d.RUnlock()
+
+	keys := make([]string, 0, len(d.values))
+	for key := range d.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save returns the serialized data if it has changed since the last save.
+// The data stays dirty until saved is called, which should only be done once the data has been stored.
+func (d *Data) save() (data []byte, saved func(), err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.dirty {
+		return nil, nil, nil
+	}
+	if data, err = json.Marshal(d.values); err != nil {
+		return nil, nil, err
+	}
+
+	version := d.version
+	return data, func() {
+		d.Lock()
+		defer d.Unlock()
+
+		if d.version == version {
+			d.dirty = false
+		}
+	}, nil
+}
+
+// ChannelKey returns a key scoped to the channel of a message.
+func ChannelKey(message Message, key string) string {
+	return channelKey(message.Channel(), key)
+}
+
+func channelKey(channel, key string) string {
+	return "channel:" + channel + ":" + key
+}
+
+// UserKey returns a key scoped to the sender of a message.
+func UserKey(message Message, key string) string {
+	return "user:" + message.UserID() + ":" + key
+}
+
+// Data returns the key/value store for a plugin on a service, loading it from the bot's Store if needed.
+func (b *Bot) Data(service Service, plugin string) *Data {
+	return b.loadData(service.Name(), plugin)
+}
+
+// SharedData returns the key/value store for a plugin that is shared by every service, such as a plugin registered on
+// all of them, so its state is stored once rather than for each service.
+func (b *Bot) SharedData(plugin string) *Data {
+	return b.loadData(sharedDataService, plugin)
+}
+
+func (b *Bot) loadData(service, plugin string) *Data {
+	b.dataMutex.Lock()
+	defer b.dataMutex.Unlock()
+
+	key := service + "/" + plugin
+	if d, ok := b.data[key]; ok {
+		return d
+	}
+
+	data, err := b.Store.Load(service, plugin+dataSuffix)
+	if err != nil {
+		log.Printf("Error loading data %s %s. %v", service, plugin, err)
+	}
+
+	d := newData(service, plugin, data)
+	b.data[key] = d
+	return d
+}
+
+func (b *Bot) saveData() {
+	b.dataMutex.Lock()
+	defer b.dataMutex.Unlock()
+
+	for _, d := range b.data {
+		if data, saved, err := d.save(); err != nil {
+			log.Printf("Error saving data %s %s. %v", d.service, d.plugin, err)
+		} else if data != nil {
+			if err := b.Store.Save(d.service, d.plugin+dataSuffix, data); err != nil {
+				log.Printf("Error saving data %s %s. %v", d.service, d.plugin, err)
+			} else {
+				saved()
+			}
+		}
+	}
+}
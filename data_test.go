@@ -0,0 +1,82 @@
+package comicjerk
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingStore is a Store that fails to save until it is told not to.
+type failingStore struct {
+	fail  bool
+	saved map[string][]byte
+}
+
+func (s *failingStore) Load(service, plugin string) ([]byte, error) {
+	return s.saved[service+"/"+plugin], nil
+}
+
+func (s *failingStore) Save(service, plugin string, data []byte) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	s.saved[service+"/"+plugin] = data
+	return nil
+}
+
+func (s *failingStore) Close() error {
+	return nil
+}
+
+func TestDataGetSet(t *testing.T) {
+	d := newData("Test", "plugin", []byte(`{"a":1}`))
+
+	a := 0
+	if !d.Get("a", &a) || a != 1 {
+		t.Errorf("Get(a) = %d, want 1", a)
+	}
+	if d.Get("b", &a) {
+		t.Error("Get(b) found a missing key")
+	}
+
+	d.Set("b", "two")
+	d.Delete("a")
+	if keys := d.Keys(); len(keys) != 1 || keys[0] != "b" {
+		t.Errorf("Keys = %v, want [b]", keys)
+	}
+}
+
+func TestDataSaveRetriesAfterError(t *testing.T) {
+	store := &failingStore{fail: true, saved: map[string][]byte{}}
+	bot := NewBot()
+	bot.Store = store
+	service := NewTestService()
+
+	bot.Data(service, "plugin").Set("key", "value")
+	bot.Save()
+	if len(store.saved) != 0 {
+		t.Fatalf("saved = %v, want nothing while the store fails", store.saved)
+	}
+
+	store.fail = false
+	bot.Save()
+	if got := string(store.saved["Test/plugin"+dataSuffix]); got != `{"key":"value"}` {
+		t.Errorf("saved = %q, want the data that failed to save before", got)
+	}
+}
+
+func TestDataSaveKeepsLaterChanges(t *testing.T) {
+	d := newData("Test", "plugin", nil)
+	d.Set("a", 1)
+
+	data, saved, err := d.save()
+	if data == nil || err != nil {
+		t.Fatalf("save = %q, %v, want data", data, err)
+	}
+
+	// A change made while the data is being stored must not be marked as saved.
+	d.Set("b", 2)
+	saved()
+	if data, _, _ := d.save(); data == nil {
+		t.Error("save after a concurrent change returned nothing")
+	}
+}
@@ -23,7 +23,7 @@ func directMessageInviteLoadFunc(bot *comicjerk.Bot, service comicjerk.Service,
 }
 
 func directMessageInviteMessageFunc(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
-	if service.Name() == comicjerk.DiscordServiceName && !service.IsMe(message) && service.IsPrivate(message) {
+	if service.Name() == comicjerk.DiscordServiceName && service.IsPrivate(message) {
 		discord := service.(*comicjerk.Discord)
 
 		messageMessage := message.Message()
@@ -1,10 +1,16 @@
 package comicjerk
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/iopred/discordgo"
 )
@@ -70,10 +76,20 @@ func (m *DiscordMessage) Type() MessageType {
 	return m.MessageType
 }
 
+// IsBot returns whether the message was sent by a bot account.
+func (m *DiscordMessage) IsBot() bool {
+	if m.DiscordgoMessage.Author == nil {
+		return false
+	}
+	return m.DiscordgoMessage.Author.Bot
+}
+
 // Discord is a Service provider for Discord.
 type Discord struct {
 	args        []interface{}
 	messageChan chan Message
+	outbox      *Outbox
+	closeOnce   sync.Once
 
 	Shards int
 
@@ -86,12 +102,31 @@ type Discord struct {
 
 // NewDiscord creates a new discord service.
 func NewDiscord(args ...interface{}) *Discord {
+	outbox := NewOutbox(5, time.Second, 100)
+	outbox.RetryAfter = discordRetryAfter
 	return &Discord{
 		args:        args,
 		messageChan: make(chan Message, 200),
+		outbox:      outbox,
 	}
 }
 
+// discordRetryAfter returns how long to wait if err is a rate limit response.
+func discordRetryAfter(err error) (time.Duration, bool) {
+	restErr, ok := err.(*discordgo.RESTError)
+	if !ok || restErr.Response == nil || restErr.Response.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	rateLimit := struct {
+		RetryAfter int64 `json:"retry_after"`
+	}{}
+	if err := json.Unmarshal(restErr.ResponseBody, &rateLimit); err == nil && rateLimit.RetryAfter > 0 {
+		return time.Duration(rateLimit.RetryAfter) * time.Millisecond, true
+	}
+	return time.Second, true
+}
+
 var channelIDRegex = regexp.MustCompile("<#[0-9]*>")
 
 func (d *Discord) replaceChannelNames(message *discordgo.Message) {
@@ -193,6 +228,21 @@ func (d *Discord) Open() (<-chan Message, error) {
 	return d.messageChan, nil
 }
 
+// Close closes all the sessions.
+func (d *Discord) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		d.outbox.Close()
+
+		for _, s := range d.Sessions {
+			if e := s.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
 // IsMe returns whether or not a message was sent by the bot.
 func (d *Discord) IsMe(message Message) bool {
 	if d.Session.State.User == nil {
@@ -208,8 +258,48 @@ func (d *Discord) SendMessage(channel, message string) error {
 		return nil
 	}
 
-	if _, err := d.Session.ChannelMessageSend(channel, message); err != nil {
+	return d.send(channel, message, false)
+}
+
+func (d *Discord) send(channel, message string, private bool) error {
+	_, err := d.sendID(channel, message, private)
+	return err
+}
+
+func (d *Discord) sendID(channel, message string, private bool) (string, error) {
+	var id string
+	err := d.outbox.Send(private, func() error {
+		m, err := d.Session.ChannelMessageSend(channel, message)
+		if err == nil && m != nil {
+			id = m.ID
+		}
+		return err
+	})
+	if err != nil {
 		log.Println("Error sending discord message: ", err)
+		return "", err
+	}
+	return id, nil
+}
+
+// SendMessageID sends a message and returns its id.
+func (d *Discord) SendMessageID(channel, message string) (string, error) {
+	if channel == "" {
+		log.Println("Empty channel could not send message", message)
+		return "", nil
+	}
+
+	return d.sendID(channel, message, false)
+}
+
+// EditMessage edits a message the bot has sent.
+func (d *Discord) EditMessage(channel, messageID, message string) error {
+	err := d.outbox.Send(false, func() error {
+		_, err := d.Session.ChannelMessageEdit(channel, messageID, message)
+		return err
+	})
+	if err != nil {
+		log.Println("Error editing discord message: ", err)
 		return err
 	}
 	return nil
@@ -220,9 +310,25 @@ func (d *Discord) DeleteMessage(channel, messageID string) error {
 	return d.Session.ChannelMessageDelete(channel, messageID)
 }
 
+// CanSendFile returns whether the sender of a message may attach files in its channel.
+func (d *Discord) CanSendFile(message Message) bool {
+	p, err := d.UserChannelPermissions(message.UserID(), message.Channel())
+	return err == nil && p&discordgo.PermissionAttachFiles != 0
+}
+
 // SendFile sends a file.
 func (d *Discord) SendFile(channel, name string, r io.Reader) error {
-	if _, err := d.Session.ChannelFileSend(channel, name, r); err != nil {
+	// The file is buffered so it can be resent if we are rate limited.
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	err = d.outbox.Send(false, func() error {
+		_, err := d.Session.ChannelFileSend(channel, name, bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
 		log.Println("Error sending discord message: ", err)
 		return err
 	}
@@ -256,8 +362,12 @@ func (d *Discord) UserID() string {
 }
 
 // Join accept an invite or return an error.
-// If AlreadyJoinedError is return, @me has already accepted that invite.
+// If AlreadyJoinedError is return, @me has already accepted that invite, or join is the id of a channel the bot can see.
 func (d *Discord) Join(join string) error {
+	if c, err := d.Channel(join); err == nil && c != nil {
+		return ErrAlreadyJoined
+	}
+
 	if i, err := d.Session.Invite(join); err == nil {
 		if _, err := d.Guild(i.Guild.ID); err == nil {
 			return ErrAlreadyJoined
@@ -281,7 +391,12 @@ func (d *Discord) PrivateMessage(userID, message string) error {
 	if err != nil {
 		return err
 	}
-	return d.SendMessage(c.ID, message)
+	return d.send(c.ID, message, true)
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (d *Discord) Outbox() *Outbox {
+	return d.outbox
 }
 
 // SupportsPrivateMessages returns whether the service supports private messages.
@@ -11,7 +11,7 @@ import (
 var userIDRegex = regexp.MustCompile("<@!?([0-9]*)>")
 
 func avatarMessageFunc(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
-	if service.Name() == comicjerk.DiscordServiceName && !service.IsMe(message) {
+	if service.Name() == comicjerk.DiscordServiceName {
 		if comicjerk.MatchesCommand(service, "avatar", message) {
 			query := strings.Join(strings.Split(message.RawMessage(), " ")[1:], " ")
 
@@ -45,5 +45,6 @@ func New() comicjerk.Plugin {
 	p := comicjerk.NewSimplePlugin("discordavatar")
 	p.MessageFunc = avatarMessageFunc
 	p.HelpFunc = avatarHelpFunc
+	p.CommandStrings = []string{"avatar"}
 	return p
 }
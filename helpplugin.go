@@ -3,21 +3,24 @@ package comicjerk
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"sort"
 	"strings"
 )
 
 type helpPlugin struct {
-	Private map[string]bool
+	SimplePlugin
 }
 
 func (p *helpPlugin) Name() string {
 	return "Help"
 }
 
+func (p *helpPlugin) Commands() []string {
+	return []string{"help", "command", "setprivatehelp", "setpublichelp"}
+}
+
 func (p *helpPlugin) Help(bot *Bot, service Service, message Message, detailed bool) []string {
-	privs := service.SupportsPrivateMessages() && !service.IsPrivate(message) && (service.IsBotOwner(message) || service.IsModerator(message))
+	privs := service.SupportsPrivateMessages() && !service.IsPrivate(message) && bot.HasPermission(service, message, PermissionModerator)
 	if detailed && !privs {
 		return nil
 	}
@@ -27,7 +30,27 @@ func (p *helpPlugin) Help(bot *Bot, service Service, message Message, detailed b
 		ticks = "`"
 	}
 
-	commands := []string{}
+	commands := p.topics(bot, service, message, privs)
+
+	help := []string{}
+
+	if len(commands) > 0 {
+		help = append(help, CommandHelp(service, "help", "[topic]", fmt.Sprintf("Returns help for a specific topic. Available topics: %s%s%s", ticks, strings.Join(commands, ", "), ticks))[0])
+	}
+
+	if detailed {
+		help = append(help, []string{
+			CommandHelp(service, "setprivatehelp", "", "Sets help text to be sent through private messages in this channel.")[0],
+			CommandHelp(service, "setpublichelp", "", "Sets the default help behavior for this channel.")[0],
+		}...)
+	}
+
+	return help
+}
+
+// topics returns the sorted help topics, which are the plugins with detailed help and any topics the plugins provide.
+func (p *helpPlugin) topics(bot *Bot, service Service, message Message, privs bool) []string {
+	topics := []string{}
 
 	for _, plugin := range bot.Services[service.Name()].Plugins {
 		hasDetailed := false
@@ -40,124 +63,130 @@ func (p *helpPlugin) Help(bot *Bot, service Service, message Message, detailed b
 		}
 
 		if hasDetailed {
-			commands = append(commands, strings.ToLower(plugin.Name()))
+			topics = append(topics, strings.ToLower(plugin.Name()))
 		}
-	}
-
-	sort.Strings(commands)
 
-	help := []string{}
-
-	if len(commands) > 0 {
-		help = append(help, CommandHelp(service, "help", "[topic]", fmt.Sprintf("Returns help for a specific topic. Available topics: %s%s%s", ticks, strings.Join(commands, ", "), ticks))[0])
+		if t, ok := plugin.(HelpTopicsPlugin); ok {
+			topics = append(topics, t.HelpTopics(bot, service, message)...)
+		}
 	}
 
-	if detailed {
-		help = append(help, []string{
-			CommandHelp(service, "setprivatehelp", "", "Sets help text to be sent through private messages in this channel.")[0],
-			CommandHelp(service, "setpublichelp", "", "Sets the default help behavior for this channel.")[0],
-		}...)
+	// A plugin can have a command group with its own name.
+	sort.Strings(topics)
+	unique := topics[:0]
+	for i, topic := range topics {
+		if i == 0 || topic != topics[i-1] {
+			unique = append(unique, topic)
+		}
 	}
-
-	return help
+	return unique
 }
 
 func (p *helpPlugin) Message(bot *Bot, service Service, message Message) {
-	if !service.IsMe(message) {
-		if MatchesCommand(service, "help", message) || MatchesCommand(service, "command", message) {
-			_, parts := ParseCommand(service, message)
-
-			help := []string{}
-
-			for _, plugin := range bot.Services[service.Name()].Plugins {
-				var h []string
-				if len(parts) == 0 {
-					h = plugin.Help(bot, service, message, false)
-				} else if len(parts) == 1 && strings.ToLower(parts[0]) == strings.ToLower(plugin.Name()) {
-					h = plugin.Help(bot, service, message, true)
-				}
-				if h != nil && len(h) > 0 {
-					help = append(help, h...)
-				}
-			}
+	if MatchesCommand(service, "help", message) || MatchesCommand(service, "command", message) {
+		_, parts := ParseCommand(service, message)
+
+		help := []string{}
 
+		topic := strings.ToLower(strings.Join(parts, " "))
+
+		// Help is generated with the active prefix of the channel.
+		helpService := withPrefix(service, message)
+
+		for _, plugin := range bot.Services[service.Name()].Plugins {
+			var h []string
 			if len(parts) == 0 {
-				sort.Strings(help)
-				if service.SupportsPrivateMessages() {
-					help = append([]string{fmt.Sprintf("All commands can be used in private messages without the `%s` prefix.", service.CommandPrefix())}, help...)
-				}
+				h = plugin.Help(bot, helpService, message, false)
+			} else if topic == strings.ToLower(plugin.Name()) {
+				h = plugin.Help(bot, helpService, message, true)
+			} else if t, ok := plugin.(HelpTopicsPlugin); ok {
+				h = t.TopicHelp(bot, helpService, message, topic)
+			}
+			if h != nil && len(h) > 0 {
+				help = append(help, h...)
 			}
+		}
 
-			if len(parts) != 0 && len(help) == 0 {
-				help = []string{fmt.Sprintf("Unknown topic: %s", parts[0])}
+		if len(parts) == 0 {
+			help = append(help, bot.aliasHelp(helpService, message)...)
+			sort.Strings(help)
+			if service.SupportsPrivateMessages() {
+				help = append([]string{fmt.Sprintf("All commands can be used in private messages without the `%s` prefix.", helpService.CommandPrefix())}, help...)
 			}
+		}
 
-			if p.Private[message.Channel()] {
-				service.SendMessage(message.Channel(), "Help has been sent via private message.")
-				if service.SupportsMultiline() {
-					service.PrivateMessage(message.UserID(), strings.Join(help, "\n"))
-				} else {
-					for _, h := range help {
-						if err := service.PrivateMessage(message.UserID(), h); err != nil {
-							break
-						}
-					}
+		if len(parts) != 0 && len(help) == 0 {
+			help = []string{fmt.Sprintf("Unknown topic: %s", topic)}
+			if bot.SuggestionsEnabled(service, message.Channel()) {
+				privs := service.SupportsPrivateMessages() && !service.IsPrivate(message) && bot.HasPermission(service, message, PermissionModerator)
+				if suggestion := Suggest(topic, p.topics(bot, service, message, privs)); suggestion != "" {
+					help[0] += fmt.Sprintf(". Did you mean %s?", suggestion)
 				}
+			}
+		}
+
+		private := false
+		bot.Data(service, p.Name()).Get(ChannelKey(message, "private"), &private)
+		if private {
+			service.SendMessage(message.Channel(), "Help has been sent via private message.")
+			if service.SupportsMultiline() {
+				service.PrivateMessage(message.UserID(), strings.Join(help, "\n"))
 			} else {
-				if service.SupportsMultiline() {
-					service.SendMessage(message.Channel(), strings.Join(help, "\n"))
-				} else {
-					for _, h := range help {
-						if err := service.SendMessage(message.Channel(), h); err != nil {
-							break
-						}
+				for _, h := range help {
+					if err := service.PrivateMessage(message.UserID(), h); err != nil {
+						break
 					}
 				}
 			}
-		} else if MatchesCommand(service, "setprivatehelp", message) && service.SupportsPrivateMessages() && !service.IsPrivate(message) {
-			if !service.IsBotOwner(message) && !service.IsModerator(message) {
-				return
+		} else {
+			if service.SupportsMultiline() {
+				service.SendMessage(message.Channel(), strings.Join(help, "\n"))
+			} else {
+				for _, h := range help {
+					if err := service.SendMessage(message.Channel(), h); err != nil {
+						break
+					}
+				}
 			}
+		}
+	} else if MatchesCommand(service, "setprivatehelp", message) && service.SupportsPrivateMessages() && !service.IsPrivate(message) {
+		if !bot.HasPermission(service, message, PermissionModerator) {
+			service.SendMessage(message.Channel(), PermissionDeniedMessage(service, message))
+			return
+		}
 
-			p.Private[message.Channel()] = true
+		bot.Data(service, p.Name()).Set(ChannelKey(message, "private"), true)
 
-			service.PrivateMessage(message.UserID(), fmt.Sprintf("Help text in <#%s> will be sent through private messages.", message.Channel()))
-		} else if MatchesCommand(service, "setpublichelp", message) && service.SupportsPrivateMessages() && !service.IsPrivate(message) {
-			if !service.IsBotOwner(message) && !service.IsModerator(message) {
-				return
-			}
+		service.PrivateMessage(message.UserID(), fmt.Sprintf("Help text in <#%s> will be sent through private messages.", message.Channel()))
+	} else if MatchesCommand(service, "setpublichelp", message) && service.SupportsPrivateMessages() && !service.IsPrivate(message) {
+		if !bot.HasPermission(service, message, PermissionModerator) {
+			service.SendMessage(message.Channel(), PermissionDeniedMessage(service, message))
+			return
+		}
 
-			p.Private[message.Channel()] = false
+		bot.Data(service, p.Name()).Set(ChannelKey(message, "private"), false)
 
-			service.PrivateMessage(message.UserID(), fmt.Sprintf("Help text in <#%s> will be sent publically.", message.Channel()))
-		}
+		service.PrivateMessage(message.UserID(), fmt.Sprintf("Help text in <#%s> will be sent publically.", message.Channel()))
 	}
 }
 
-// Load will load plugin state from a byte array.
+// Load imports the private help channels saved by earlier versions into the plugin's Data.
 func (p *helpPlugin) Load(bot *Bot, service Service, data []byte) error {
-	if data != nil {
-		if err := json.Unmarshal(data, p); err != nil {
-			log.Println("Error loading data", err)
-		}
+	legacy := struct{ Private map[string]bool }{}
+	if data == nil || json.Unmarshal(data, &legacy) != nil {
+		return nil
 	}
-	return nil
-}
-
-// Save will save plugin state to a byte array.
-func (p *helpPlugin) Save() ([]byte, error) {
-	return json.Marshal(p)
-}
 
-// Stats will return the stats for a plugin.
-func (p *helpPlugin) Stats(bot *Bot, service Service, message Message) []string {
+	d := bot.Data(service, p.Name())
+	for channel, private := range legacy.Private {
+		if key := channelKey(channel, "private"); !d.Get(key, new(bool)) {
+			d.Set(key, private)
+		}
+	}
 	return nil
 }
 
 // NeHelpPlugin will create a new help plugin.
 func NewHelpPlugin() Plugin {
-	p := &helpPlugin{
-		Private: make(map[string]bool),
-	}
-	return p
+	return &helpPlugin{}
 }
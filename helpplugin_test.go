@@ -0,0 +1,41 @@
+package comicjerk
+
+import (
+	"testing"
+)
+
+func TestHelpPluginPrivateHelp(t *testing.T) {
+	bot, service, _, closer := newTestBot(t)
+	defer closer()
+	service.Moderator = true
+	bot.Open()
+
+	service.InjectString("#channel", "bob", "!setprivatehelp")
+	if calls := service.WaitForCalls("PrivateMessage", 1, testTimeout); len(calls) != 1 {
+		t.Fatalf("calls = %v, want a private confirmation", calls)
+	}
+
+	if got := send(service, "bob", "!help"); got != "Help has been sent via private message." {
+		t.Errorf("help = %q, want it sent privately", got)
+	}
+	if calls := service.WaitForCalls("PrivateMessage", 2, testTimeout); len(calls) != 2 || calls[1].Target != "bob" {
+		t.Errorf("calls = %v, want help sent to bob", calls)
+	}
+}
+
+func TestHelpPluginLoadsLegacyState(t *testing.T) {
+	bot := NewBot()
+	bot.Store = &failingStore{saved: map[string][]byte{}}
+	service := NewTestService()
+
+	p := NewHelpPlugin()
+	p.Load(bot, service, []byte(`{"Private":{"#channel":true}}`))
+
+	private := false
+	if !bot.Data(service, p.Name()).Get(channelKey("#channel", "private"), &private) || !private {
+		t.Error("legacy private help setting was not imported")
+	}
+	if data, err := p.Save(); data != nil || err != nil {
+		t.Errorf("Save = %q, %v, want the plugin to rely on Data", data, err)
+	}
+}
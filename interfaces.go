@@ -1,6 +1,7 @@
 package comicjerk
 
 import (
+	"context"
 	"errors"
 	"io"
 )
@@ -29,6 +30,52 @@ type Message interface {
 	Type() MessageType
 }
 
+// BotMessage is an optional interface for messages from services that can tell if the sender is a bot.
+type BotMessage interface {
+	IsBot() bool
+}
+
+// EditService is an optional interface for services that can edit messages the bot has sent.
+// SendMessageID sends a message like SendMessage, and returns the id needed to edit or delete it later.
+type EditService interface {
+	SendMessageID(channel, message string) (string, error)
+	EditMessage(channel, messageID, message string) error
+}
+
+// MessageService is an optional interface for services that tie replies to the message they answer.
+// While a plugin handles a message it is given the service returned by ForMessage instead of the service itself.
+type MessageService interface {
+	ForMessage(message Message) Service
+}
+
+// NativeFileService is an optional interface for services that can send files themselves, so plugins do not need to
+// upload images elsewhere and send a link. CanSendFile returns whether a file can be sent in reply to a message, eg.
+// whether attachments are allowed in its channel.
+type NativeFileService interface {
+	CanSendFile(message Message) bool
+}
+
+// UserNameService is an optional interface for services where users are named by something other than their user id,
+// such as IRC nicks. UserIDForName returns the user id of a user name, and UserNameForID the name of a user id.
+type UserNameService interface {
+	UserIDForName(name string) (string, bool)
+	UserNameForID(userID string) (string, bool)
+}
+
+// ContextService is an optional interface for services that queue outgoing messages, and can give up on a message when its context is done.
+type ContextService interface {
+	SendMessageContext(ctx context.Context, channel, message string) error
+}
+
+// SendMessageContext sends a message with a context if the service supports it, and with SendMessage otherwise.
+// ContextPlugins should use it so a reply queued behind a rate limit does not outlive the handler.
+func SendMessageContext(ctx context.Context, service Service, channel, message string) error {
+	if s, ok := service.(ContextService); ok {
+		return s.SendMessageContext(ctx, channel, message)
+	}
+	return service.SendMessage(channel, message)
+}
+
 // ErrAlreadyJoined is an error dispatched on Join if the bot is already joined to the request.
 var ErrAlreadyJoined = errors.New("Already joined.")
 
@@ -38,6 +85,7 @@ type Service interface {
 	UserName() string
 	UserID() string
 	Open() (<-chan Message, error)
+	Close() error
 	IsMe(message Message) bool
 	SendMessage(channel, message string) error
 	DeleteMessage(channel, messageID string) error
@@ -82,3 +130,23 @@ type Plugin interface {
 	Message(*Bot, Service, Message)
 	Stats(*Bot, Service, Message) []string
 }
+
+// ContextPlugin is an optional interface for plugins that handle messages with a context.
+// The context is cancelled when the plugins handler timeout expires or the bot closes.
+// Plugins that only implement Message are still dispatched, but can not be cancelled, a handler that outlives its timeout
+// no longer holds a worker but keeps running in the background.
+type ContextPlugin interface {
+	MessageContext(context.Context, *Bot, Service, Message)
+}
+
+// Closer is an optional interface for plugins that need to release resources or stop goroutines when the bot closes.
+// Close is called once for every service the plugin is registered on.
+type Closer interface {
+	Close(*Bot, Service) error
+}
+
+// HelpTopicsPlugin is an optional interface for plugins that provide help topics other than their name, such as command groups.
+type HelpTopicsPlugin interface {
+	HelpTopics(*Bot, Service, Message) []string
+	TopicHelp(*Bot, Service, Message, string) []string
+}
@@ -1,15 +1,47 @@
 package comicjerk
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
-
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
 	"github.com/fluffle/goirc/client"
 )
 
 // IRCServiceName is the service name for the IRC service.
 const IRCServiceName string = "IRC"
 
+// IRCSASLPlain is the SASL mechanism that logs in with SASLUsername and SASLPassword.
+const IRCSASLPlain = "PLAIN"
+
+// IRCSASLExternal is the SASL mechanism that logs in with the TLS client certificate.
+const IRCSASLExternal = "EXTERNAL"
+
+// ircMaxBackoff is the longest the IRC service waits between reconnects.
+const ircMaxBackoff = time.Minute
+
+// ircReclaimInterval is how often the IRC service tries to change back to its nick while it is in use.
+const ircReclaimInterval = 30 * time.Second
+
+// ircCapabilities are the capabilities requested from the server when it supports them, they keep track of accounts and user modes.
+var ircCapabilities = []string{"account-notify", "account-tag", "extended-join", "multi-prefix", "userhost-in-names"}
+
+// ircWhoToken marks the WHOX replies to the WHO sent when joining a channel.
+const ircWhoToken = "152"
+
+// ircModeratorModes are the channel user modes of moderators: owner, admin, op and halfop.
+const ircModeratorModes = "qaoh"
+
 // IRCMessage is a Message wrapper around client.Line.
 type IRCMessage client.Line
 
@@ -24,9 +56,12 @@ func (m *IRCMessage) UserName() string {
 	return m.Nick
 }
 
-// UserID returns the user id for this message.
+// UserID returns the user id for this message, the sender's services account when it is known, otherwise their ident@host.
 func (m *IRCMessage) UserID() string {
-	return m.Nick
+	if account := m.Tags["account"]; account != "" && account != "*" {
+		return account
+	}
+	return m.Ident + "@" + m.Host
 }
 
 // UserAvatar returns the avatar url for this message.
@@ -57,38 +92,628 @@ func (m *IRCMessage) Type() MessageType {
 
 // IRC is a Service provider for IRC.
 type IRC struct {
+	sync.Mutex
 	host        string
 	nick        string
 	password    string
 	channels    []string
 	Conn        *client.Conn
 	messageChan chan Message
+	closing     chan struct{}
+	outbox      *Outbox
+	closeOnce   sync.Once
+
+	backoff      time.Duration
+	registered   bool
+	sasl         bool
+	nickAttempts int
+	reclaiming   bool
+
+	caps         map[string]bool
+	whox         bool
+	prefixModes  string
+	prefixes     string
+	chanModes    []string
+	users        map[string]*ircUser
+	channelModes map[string]map[string]string
+
+	// TLS connects to the server with TLS.
+	TLS bool
+	// TLSConfig is used when TLS is set, add Certificates to it to log in with a client certificate.
+	// ServerName defaults to the server's host, the config is copied rather than changed.
+	TLSConfig *tls.Config
+	// SASLMechanism is the SASL mechanism used to log in, IRCSASLPlain or IRCSASLExternal. SASL is not used when empty.
+	SASLMechanism string
+	// SASLUsername is the account name used by IRCSASLPlain, it defaults to the nick.
+	SASLUsername string
+	// SASLPassword is the password used by IRCSASLPlain.
+	SASLPassword string
+	// NickServPassword is used to identify with NickServ when SASL is not used, and to ghost whoever is using the nick.
+	NickServPassword string
+	// Owners are the services accounts and hostmasks, eg. *!*@example.com, of the bot's owners.
+	Owners []string
+}
+
+// ircUser is what is known about a user the bot shares a channel with.
+type ircUser struct {
+	nick     string
+	userhost string
+	account  string
+	seen     time.Time
 }
 
 // NewIRC creates a new IRC service.
 func NewIRC(host, nick, password string, channels []string) *IRC {
-	return &IRC{
+	i := &IRC{
 		host:        host,
 		nick:        nick,
 		password:    password,
-		channels:    channels,
 		messageChan: make(chan Message, 200),
+		closing:     make(chan struct{}),
+		outbox:      NewOutbox(5, 2*time.Second, 100),
+		backoff:     time.Second,
 	}
+	i.reset()
+	for _, c := range channels {
+		if c != "" {
+			i.channels = append(i.channels, c)
+		}
+	}
+	return i
+}
+
+// reset forgets everything known about the server, its channels and users.
+func (i *IRC) reset() {
+	i.caps = make(map[string]bool)
+	i.whox = false
+	i.prefixModes, i.prefixes = "ov", "@+"
+	i.chanModes = []string{"beI", "k", "l", "imnpst"}
+	i.users = make(map[string]*ircUser)
+	i.channelModes = make(map[string]map[string]string)
 }
 
 func (i *IRC) onMessage(conn *client.Conn, line *client.Line) {
 	m := IRCMessage(*line)
-	i.messageChan <- &m
+
+	i.Lock()
+	// Senders who are not in any of the bot's channels are not kept, the bot does not see them quit.
+	if _, ok := i.users[strings.ToLower(line.Nick)]; ok {
+		u := i.user(line.Nick)
+		u.userhost = line.Ident + "@" + line.Host
+		if account, ok := line.Tags["account"]; ok {
+			u.account = account
+		} else if u.account != "" {
+			// Without account-tag the account is known from joins and account-notify.
+			m.Tags = map[string]string{"account": u.account}
+			for k, v := range line.Tags {
+				m.Tags[k] = v
+			}
+		}
+	}
+	i.Unlock()
+
+	select {
+	case i.messageChan <- &m:
+	case <-i.closing:
+	}
+}
+
+func (i *IRC) onCap(conn *client.Conn, line *client.Line) {
+	if len(line.Args) < 2 {
+		return
+	}
+
+	// goirc negotiates the capabilities and SASL before it registers, this only keeps track of them.
+	switch line.Args[1] {
+	case "LS":
+		i.Lock()
+		for _, c := range strings.Fields(line.Text()) {
+			i.caps[strings.SplitN(c, "=", 2)[0]] = false
+		}
+		_, offered := i.caps["sasl"]
+		i.Unlock()
+
+		// Replies that continue on another line have a * before the capabilities.
+		if len(line.Args) > 3 && line.Args[2] == "*" {
+			return
+		}
+		if i.SASLMechanism != "" && !offered {
+			log.Printf("Error logging in to IRC %s. The server does not support SASL.", i.host)
+		}
+	case "ACK":
+		i.Lock()
+		for _, c := range strings.Fields(line.Text()) {
+			i.caps[c] = true
+		}
+		i.Unlock()
+	case "NAK":
+		log.Printf("Error requesting IRC capabilities %s. %s", i.host, line.Text())
+	}
+}
+
+func (i *IRC) onSASLSuccess(conn *client.Conn, line *client.Line) {
+	i.Lock()
+	i.sasl = true
+	i.Unlock()
+}
+
+func (i *IRC) onSASLFailure(conn *client.Conn, line *client.Line) {
+	log.Printf("Error logging in to IRC %s. %s", i.host, line.Text())
 }
 
 func (i *IRC) onConnect(conn *client.Conn, line *client.Line) {
-	for _, c := range i.channels {
+	i.Lock()
+	i.registered = true
+	i.backoff = time.Second
+	sasl := i.sasl
+	channels := append([]string{}, i.channels...)
+	i.Unlock()
+
+	if !sasl && i.NickServPassword != "" {
+		conn.Privmsg("NickServ", "IDENTIFY "+i.nick+" "+i.NickServPassword)
+	}
+
+	if !strings.EqualFold(conn.Me().Nick, i.nick) {
+		if sasl || i.NickServPassword != "" {
+			conn.Privmsg("NickServ", strings.TrimSpace("GHOST "+i.nick+" "+i.NickServPassword))
+		}
+		go i.reclaimNick()
+	}
+
+	for _, c := range channels {
 		conn.Join(c)
 	}
 }
 
 func (i *IRC) onDisconnect(conn *client.Conn, line *client.Line) {
-	conn.ConnectTo(i.host)
+	select {
+	case <-i.closing:
+		return
+	default:
+	}
+
+	i.Lock()
+	i.registered = false
+	i.Unlock()
+
+	go func() {
+		if i.wait() {
+			i.connect()
+		}
+	}()
+}
+
+// onNickFree tries to change back to the bot's nick as soon as whoever had it changes nick or quits.
+func (i *IRC) onNickFree(conn *client.Conn, line *client.Line) {
+	if strings.EqualFold(line.Nick, i.nick) && !strings.EqualFold(conn.Me().Nick, i.nick) {
+		conn.Nick(i.nick)
+	}
+}
+
+// newNick returns the nick to try when nick is in use.
+func (i *IRC) newNick(nick string) string {
+	i.Lock()
+	defer i.Unlock()
+
+	// Failing to reclaim the nick should not change it again.
+	if i.registered {
+		return i.Conn.Me().Nick
+	}
+
+	// Servers may truncate long nicks, so fall back to short random ones.
+	i.nickAttempts++
+	if i.nickAttempts <= 2 {
+		return nick + "_"
+	}
+	return fmt.Sprintf("%.5s%04d", i.nick, rand.Intn(10000))
+}
+
+// reclaimNick periodically tries to change back to the bot's nick, until it succeeds or the connection is lost.
+func (i *IRC) reclaimNick() {
+	i.Lock()
+	if i.reclaiming {
+		i.Unlock()
+		return
+	}
+	i.reclaiming = true
+	i.Unlock()
+
+	defer func() {
+		i.Lock()
+		i.reclaiming = false
+		i.Unlock()
+	}()
+
+	for {
+		select {
+		case <-i.closing:
+			return
+		case <-time.After(ircReclaimInterval):
+		}
+
+		i.Lock()
+		registered := i.registered
+		i.Unlock()
+		if !registered || strings.EqualFold(i.Conn.Me().Nick, i.nick) {
+			return
+		}
+		i.Conn.Nick(i.nick)
+	}
+}
+
+// user returns the user with a nick, adding it if it is not known. The lock must be held.
+func (i *IRC) user(nick string) *ircUser {
+	key := strings.ToLower(nick)
+	u := i.users[key]
+	if u == nil {
+		u = &ircUser{}
+		i.users[key] = u
+	}
+	u.nick, u.seen = nick, time.Now()
+	return u
+}
+
+// forget removes a user from a channel, and forgets them if they are not in any other channel. The lock must be held.
+func (i *IRC) forget(channel, nick string) {
+	nick = strings.ToLower(nick)
+	delete(i.channelModes[strings.ToLower(channel)], nick)
+	for _, nicks := range i.channelModes {
+		if _, ok := nicks[nick]; ok {
+			return
+		}
+	}
+	delete(i.users, nick)
+}
+
+// isMe returns whether a nick is the bot's current nick.
+func (i *IRC) isMe(conn *client.Conn, nick string) bool {
+	return strings.EqualFold(conn.Me().Nick, nick)
+}
+
+func (i *IRC) onISupport(conn *client.Conn, line *client.Line) {
+	if len(line.Args) < 2 {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	// The first argument is the bot's nick and the last is a description.
+	for _, token := range line.Args[1 : len(line.Args)-1] {
+		kv := strings.SplitN(token, "=", 2)
+		switch {
+		case kv[0] == "WHOX":
+			i.whox = true
+		case kv[0] == "PREFIX" && len(kv) == 2:
+			// eg. PREFIX=(qaohv)~&@%+
+			if n := strings.Index(kv[1], ")"); strings.HasPrefix(kv[1], "(") && n != -1 && n-1 == len(kv[1])-n-1 {
+				i.prefixModes, i.prefixes = kv[1][1:n], kv[1][n+1:]
+			}
+		case kv[0] == "CHANMODES" && len(kv) == 2:
+			if modes := strings.Split(kv[1], ","); len(modes) >= 4 {
+				i.chanModes = modes
+			}
+		}
+	}
+}
+
+func (i *IRC) onNames(conn *client.Conn, line *client.Line) {
+	if len(line.Args) < 4 {
+		return
+	}
+	channel := strings.ToLower(line.Args[2])
+
+	i.Lock()
+	defer i.Unlock()
+
+	nicks := i.channelModes[channel]
+	if nicks == nil {
+		nicks = make(map[string]string)
+		i.channelModes[channel] = nicks
+	}
+	for _, name := range strings.Fields(line.Text()) {
+		modes := ""
+		for len(name) > 0 {
+			n := strings.IndexByte(i.prefixes, name[0])
+			if n == -1 || n >= len(i.prefixModes) {
+				break
+			}
+			modes += i.prefixModes[n : n+1]
+			name = name[1:]
+		}
+
+		// With userhost-in-names names are nick!ident@host.
+		nick := name
+		if n := strings.Index(name, "!"); n != -1 {
+			nick = name[:n]
+			i.user(nick).userhost = name[n+1:]
+		} else {
+			i.user(nick)
+		}
+		nicks[strings.ToLower(nick)] = modes
+	}
+}
+
+func (i *IRC) onWho(conn *client.Conn, line *client.Line) {
+	// Replies to WHO <channel> %tuhna are: nick token ident host nick account.
+	if len(line.Args) < 6 || line.Args[1] != ircWhoToken {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	u := i.user(line.Args[4])
+	u.userhost = line.Args[2] + "@" + line.Args[3]
+	if account := line.Args[5]; account != "0" {
+		u.account = account
+	} else {
+		u.account = ""
+	}
+}
+
+func (i *IRC) onJoin(conn *client.Conn, line *client.Line) {
+	if len(line.Args) == 0 {
+		return
+	}
+	channel := strings.ToLower(line.Args[0])
+
+	i.Lock()
+	if i.isMe(conn, line.Nick) {
+		i.channelModes[channel] = make(map[string]string)
+	} else if nicks := i.channelModes[channel]; nicks != nil {
+		nicks[strings.ToLower(line.Nick)] = ""
+	}
+	u := i.user(line.Nick)
+	u.userhost = line.Ident + "@" + line.Host
+	// With extended-join the account follows the channel, * when not logged in.
+	if i.caps["extended-join"] && len(line.Args) > 1 {
+		u.account = strings.TrimPrefix(line.Args[1], "*")
+	}
+	whox := i.whox
+	i.Unlock()
+
+	// Accounts of the users already in the channel are found with WHOX.
+	if whox && i.isMe(conn, line.Nick) {
+		conn.Raw("WHO " + line.Args[0] + " %tuhna," + ircWhoToken)
+	}
+}
+
+func (i *IRC) onPart(conn *client.Conn, line *client.Line) {
+	if len(line.Args) == 0 {
+		return
+	}
+	i.leave(conn, line.Args[0], line.Nick)
+}
+
+func (i *IRC) onKick(conn *client.Conn, line *client.Line) {
+	if len(line.Args) < 2 {
+		return
+	}
+	i.leave(conn, line.Args[0], line.Args[1])
+}
+
+// leave removes a user from a channel, or forgets the channel when it was the bot that left.
+func (i *IRC) leave(conn *client.Conn, channel, nick string) {
+	i.Lock()
+	defer i.Unlock()
+
+	if !i.isMe(conn, nick) {
+		i.forget(channel, nick)
+		return
+	}
+
+	nicks := i.channelModes[strings.ToLower(channel)]
+	delete(i.channelModes, strings.ToLower(channel))
+	for n := range nicks {
+		i.forget(channel, n)
+	}
+}
+
+func (i *IRC) onQuit(conn *client.Conn, line *client.Line) {
+	i.Lock()
+	nick := strings.ToLower(line.Nick)
+	for _, nicks := range i.channelModes {
+		delete(nicks, nick)
+	}
+	delete(i.users, nick)
+	i.Unlock()
+
+	i.onNickFree(conn, line)
+}
+
+func (i *IRC) onNick(conn *client.Conn, line *client.Line) {
+	if len(line.Args) == 0 {
+		return
+	}
+	old, nick := strings.ToLower(line.Nick), strings.ToLower(line.Args[0])
+
+	i.Lock()
+	for _, nicks := range i.channelModes {
+		if modes, ok := nicks[old]; ok {
+			delete(nicks, old)
+			nicks[nick] = modes
+		}
+	}
+	if u := i.users[old]; u != nil {
+		delete(i.users, old)
+		i.users[nick] = u
+		u.nick, u.seen = line.Args[0], time.Now()
+	}
+	i.Unlock()
+
+	i.onNickFree(conn, line)
+}
+
+func (i *IRC) onAccount(conn *client.Conn, line *client.Line) {
+	if len(line.Args) == 0 {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	if u := i.users[strings.ToLower(line.Nick)]; u != nil {
+		u.account = strings.TrimPrefix(line.Args[0], "*")
+	}
+}
+
+func (i *IRC) onMode(conn *client.Conn, line *client.Line) {
+	if len(line.Args) < 2 {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	nicks := i.channelModes[strings.ToLower(line.Args[0])]
+	if nicks == nil {
+		return
+	}
+
+	// eg. MODE #channel +ov-l nick nick, user modes and the first three groups of CHANMODES take an argument.
+	add, args := true, line.Args[2:]
+	for _, mode := range line.Args[1] {
+		m := string(mode)
+		arg := ""
+		switch {
+		case m == "+" || m == "-":
+			add = m == "+"
+			continue
+		case strings.Contains(i.prefixModes, m), strings.Contains(i.chanModes[0], m), strings.Contains(i.chanModes[1], m), add && strings.Contains(i.chanModes[2], m):
+			if len(args) == 0 {
+				continue
+			}
+			arg, args = args[0], args[1:]
+		}
+
+		if !strings.Contains(i.prefixModes, m) {
+			continue
+		}
+		nick := strings.ToLower(arg)
+		modes, ok := nicks[nick]
+		if !ok {
+			continue
+		}
+		modes = strings.Replace(modes, m, "", -1)
+		if add {
+			modes += m
+		}
+		nicks[nick] = modes
+	}
+}
+
+// nickFor returns the nick of a user id, user ids that are not known are assumed to be nicks.
+func (i *IRC) nickFor(userID string) string {
+	if nick, ok := i.UserNameForID(userID); ok {
+		return nick
+	}
+	return userID
+}
+
+// UserNameForID returns the nick of a user in one of the bot's channels, by services account or ident@host.
+func (i *IRC) UserNameForID(userID string) (string, bool) {
+	i.Lock()
+	defer i.Unlock()
+
+	// Several nicks can share an account or host, the most recently seen one is used.
+	var user *ircUser
+	for _, u := range i.users {
+		if u.account != userID && u.userhost != userID {
+			continue
+		}
+		if user == nil || u.seen.After(user.seen) || (u.seen.Equal(user.seen) && u.nick < user.nick) {
+			user = u
+		}
+	}
+	if user == nil {
+		return "", false
+	}
+	return user.nick, true
+}
+
+// UserIDForName returns the user id of a nick in one of the bot's channels, their services account when they are logged
+// in, otherwise their ident@host.
+func (i *IRC) UserIDForName(name string) (string, bool) {
+	i.Lock()
+	defer i.Unlock()
+
+	u := i.users[strings.ToLower(name)]
+	switch {
+	case u == nil:
+		return "", false
+	case u.account != "":
+		return u.account, true
+	case u.userhost != "":
+		return u.userhost, true
+	}
+	return "", false
+}
+
+// ircMatch returns whether a hostmask, which may contain * and ? wildcards, matches nick!ident@host.
+func ircMatch(mask, hostmask string) bool {
+	pattern := regexp.QuoteMeta(mask)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	matched, _ := regexp.MatchString("(?i)^"+pattern+"$", hostmask)
+	return matched
+}
+
+// connect connects to the server, retrying with backoff until it succeeds or the service is closed.
+func (i *IRC) connect() {
+	for {
+		i.Lock()
+		i.registered = false
+		i.sasl = false
+		i.nickAttempts = 0
+		i.reset()
+		i.Unlock()
+
+		err := i.Conn.ConnectTo(i.host, i.password)
+		if err == nil {
+			return
+		}
+		log.Printf("Error connecting to IRC %s. %v", i.host, err)
+		if !i.wait() {
+			return
+		}
+	}
+}
+
+// wait waits before reconnecting, doubling the wait each time until a connection is registered.
+// It returns false if the service was closed.
+func (i *IRC) wait() bool {
+	i.Lock()
+	backoff := i.backoff
+	if i.backoff *= 2; i.backoff > ircMaxBackoff {
+		i.backoff = ircMaxBackoff
+	}
+	i.Unlock()
+
+	log.Printf("Reconnecting to IRC %s in %v.", i.host, backoff)
+	select {
+	case <-i.closing:
+		return false
+	case <-time.After(backoff):
+		return true
+	}
+}
+
+// tlsConfig returns the TLS configuration for the connection.
+// TLSConfig is copied rather than changed, so that it can be shared with other connections.
+func (i *IRC) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if i.TLSConfig != nil {
+		config = cloneTLSConfig(i.TLSConfig)
+	}
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(i.host)
+		if err != nil {
+			host = i.host
+		}
+		config.ServerName = host
+	}
+	return config
 }
 
 // Name returns the name of the service.
@@ -101,16 +726,64 @@ func (i *IRC) Open() (<-chan Message, error) {
 	i.Conn = client.SimpleClient(i.nick, i.nick, i.nick)
 	i.Conn.Config().Version = i.nick
 	i.Conn.Config().QuitMessage = ""
+	i.Conn.Config().NewNick = i.newNick
+	// Capabilities and SASL are negotiated before NICK and USER, so the server waits for CAP END to register.
+	i.Conn.Config().EnableCapabilityNegotiation = true
+	i.Conn.Config().Capabilites = ircCapabilities
+	switch i.SASLMechanism {
+	case "":
+	case IRCSASLPlain:
+		username := i.SASLUsername
+		if username == "" {
+			username = i.nick
+		}
+		i.Conn.Config().Sasl = sasl.NewPlainClient("", username, i.SASLPassword)
+	case IRCSASLExternal:
+		i.Conn.Config().Sasl = sasl.NewExternalClient("")
+	default:
+		return nil, fmt.Errorf("unsupported IRC SASL mechanism %s", i.SASLMechanism)
+	}
+	if i.TLS {
+		i.Conn.Config().SSL = true
+		i.Conn.Config().SSLConfig = i.tlsConfig()
+	}
 
+	i.Conn.HandleFunc(client.CAP, i.onCap)
+	i.Conn.HandleFunc("903", i.onSASLSuccess)
+	for _, n := range []string{"902", "904", "905", "906", "907"} {
+		i.Conn.HandleFunc(n, i.onSASLFailure)
+	}
 	i.Conn.HandleFunc("connected", i.onConnect)
 	i.Conn.HandleFunc("disconnected", i.onDisconnect)
+	i.Conn.HandleFunc("005", i.onISupport)
+	i.Conn.HandleFunc("353", i.onNames)
+	i.Conn.HandleFunc("354", i.onWho)
+	i.Conn.HandleFunc(client.JOIN, i.onJoin)
+	i.Conn.HandleFunc(client.PART, i.onPart)
+	i.Conn.HandleFunc(client.KICK, i.onKick)
+	i.Conn.HandleFunc(client.QUIT, i.onQuit)
+	i.Conn.HandleFunc(client.NICK, i.onNick)
+	i.Conn.HandleFunc("ACCOUNT", i.onAccount)
+	i.Conn.HandleFunc(client.MODE, i.onMode)
 	i.Conn.HandleFunc(client.PRIVMSG, i.onMessage)
 
-	go i.Conn.ConnectTo(i.host, i.password)
+	go i.connect()
 
 	return i.messageChan, nil
 }
 
+// Close quits from the server, the connection will not be reopened.
+func (i *IRC) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.closing)
+		i.outbox.Close()
+		if i.Conn != nil && i.Conn.Connected() {
+			i.Conn.Quit()
+		}
+	})
+	return nil
+}
+
 // IsMe returns whether or not a message was sent by the bot.
 func (i *IRC) IsMe(message Message) bool {
 	return message.UserName() == i.UserName()
@@ -118,8 +791,15 @@ func (i *IRC) IsMe(message Message) bool {
 
 // SendMessage sends a message.
 func (i *IRC) SendMessage(channel, message string) error {
-	i.Conn.Privmsg(channel, message)
-	return nil
+	return i.SendMessageContext(context.Background(), channel, message)
+}
+
+// SendMessageContext sends a message, giving up if the context is done before it leaves the outbox.
+func (i *IRC) SendMessageContext(ctx context.Context, channel, message string) error {
+	return i.outbox.SendContext(ctx, false, func() error {
+		i.Conn.Privmsg(channel, message)
+		return nil
+	})
 }
 
 // DeleteMessage deletes a message.
@@ -134,7 +814,7 @@ func (i *IRC) SendFile(channel, name string, r io.Reader) error {
 
 // BanUser bans a user.
 func (i *IRC) BanUser(channel, userID string, duration int) error {
-	i.Conn.Kick(channel, userID)
+	i.Conn.Kick(channel, i.nickFor(userID))
 	return nil
 }
 
@@ -153,8 +833,21 @@ func (i *IRC) UserID() string {
 	return i.Conn.Me().Nick
 }
 
-// Join will join a channel.
+// Join will join a channel, it is joined again after reconnecting.
 func (i *IRC) Join(join string) error {
+	i.Lock()
+	found := false
+	for _, c := range i.channels {
+		if strings.EqualFold(c, join) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		i.channels = append(i.channels, join)
+	}
+	i.Unlock()
+
 	i.Conn.Join(join)
 	return nil
 }
@@ -166,7 +859,15 @@ func (i *IRC) Typing(channel string) error {
 
 // PrivateMessage will send a private message to a user.
 func (i *IRC) PrivateMessage(userID, message string) error {
-	return i.SendMessage(userID, message)
+	return i.outbox.Send(true, func() error {
+		i.Conn.Privmsg(i.nickFor(userID), message)
+		return nil
+	})
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (i *IRC) Outbox() *Outbox {
+	return i.outbox
 }
 
 // SupportsPrivateMessages returns whether the service supports private messages.
@@ -184,8 +885,29 @@ func (i *IRC) CommandPrefix() string {
 	return "!"
 }
 
-// IsBotOwner returns whether or not a message sender was the owner of the bot.
+// IsBotOwner returns whether or not a message sender was the owner of the bot, by services account or hostmask.
 func (i *IRC) IsBotOwner(message Message) bool {
+	userID := message.UserID()
+	userhost := userID
+	if m, ok := UnwrapMessage(message).(*IRCMessage); ok {
+		userhost = m.Ident + "@" + m.Host
+	} else if !strings.Contains(userID, "@") {
+		i.Lock()
+		if u := i.users[strings.ToLower(message.UserName())]; u != nil {
+			userhost = u.userhost
+		}
+		i.Unlock()
+	}
+
+	for _, owner := range i.Owners {
+		if strings.ContainsAny(owner, "!@") {
+			if ircMatch(owner, message.UserName()+"!"+userhost) {
+				return true
+			}
+		} else if strings.EqualFold(owner, userID) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -194,13 +916,23 @@ func (i *IRC) IsPrivate(message Message) bool {
 	return message.UserName() == message.Channel()
 }
 
-// IsModerator returns whether or not the sender of a message is a moderator.
+// IsModerator returns whether or not the sender of a message is an op or halfop in the channel.
 func (i *IRC) IsModerator(message Message) bool {
-	return false
+	return strings.ContainsAny(i.UserModes(message.Channel(), message.UserName()), ircModeratorModes)
+}
+
+// UserModes returns the channel user modes of a nick in a channel, eg. "o" for an op or "v" when voiced.
+func (i *IRC) UserModes(channel, nick string) string {
+	i.Lock()
+	defer i.Unlock()
+
+	return i.channelModes[strings.ToLower(channel)][strings.ToLower(nick)]
 }
 
 // ChannelCount returns the number of channels the bot is in.
 func (i *IRC) ChannelCount() int {
+	i.Lock()
+	defer i.Unlock()
 	return len(i.channels)
 }
 
@@ -0,0 +1,304 @@
+package comicjerk
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluffle/goirc/client"
+)
+
+// ircServer is a fake IRC server that negotiates capabilities and SASL PLAIN, and records the lines it receives.
+type ircServer struct {
+	listener net.Listener
+	lines    chan string
+	conns    chan net.Conn
+}
+
+func newIRCServer(t *testing.T) *ircServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ircServer{listener: listener, lines: make(chan string, 100), conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ircServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	send := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	nick, user := "", false
+	negotiating, registered := false, false
+	register := func() {
+		if registered || negotiating || nick == "" || !user {
+			return
+		}
+		registered = true
+		send(":server 001 %s :Welcome", nick)
+	}
+
+	// Like a real server, registration completes as soon as NICK and USER are received, unless CAP LS came first.
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.lines <- line
+
+		fields := strings.SplitN(line, " ", 2)
+		arg := ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch fields[0] {
+		case "NICK":
+			nick = arg
+			register()
+		case "USER":
+			user = true
+			register()
+		case "CAP":
+			switch {
+			case strings.HasPrefix(arg, "LS"):
+				// Only clients that ask for version 302 get the list split over several lines.
+				negotiating = true
+				if arg == "LS 302" {
+					send(":server CAP * LS * :sasl=PLAIN multi-prefix")
+					send(":server CAP * LS :account-notify unknown-cap")
+				} else {
+					send(":server CAP * LS :sasl multi-prefix account-notify unknown-cap")
+				}
+			case strings.HasPrefix(arg, "REQ :"):
+				send(":server CAP * ACK :%s", strings.TrimPrefix(arg, "REQ :"))
+			case arg == "END":
+				negotiating = false
+				register()
+			}
+		case "AUTHENTICATE":
+			switch arg {
+			case "PLAIN":
+				send("AUTHENTICATE +")
+			default:
+				data, _ := base64.StdEncoding.DecodeString(arg)
+				if string(data) == "\x00bot\x00hunter2" {
+					send(":server 903 * :SASL authentication successful")
+				} else {
+					send(":server 904 * :SASL authentication failed")
+				}
+			}
+		}
+	}
+}
+
+// waitForLine returns the next line the server receives that starts with prefix.
+func (s *ircServer) waitForLine(t *testing.T, prefix string) string {
+	deadline := time.After(3 * time.Second)
+	for {
+		select {
+		case line := <-s.lines:
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for %s", prefix)
+			return ""
+		}
+	}
+}
+
+func TestIRCCapabilitiesAndSASL(t *testing.T) {
+	server := newIRCServer(t)
+	defer server.listener.Close()
+
+	i := NewIRC(server.listener.Addr().String(), "bot", "", nil)
+	i.SASLMechanism = IRCSASLPlain
+	i.SASLPassword = "hunter2"
+	if _, err := i.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	// CAP LS must come before NICK and USER, or the server registers the connection before SASL.
+	if first := server.waitForLine(t, ""); !strings.HasPrefix(first, "CAP LS") {
+		t.Errorf("first line = %q, want CAP LS", first)
+	}
+	// Only capabilities the server offers are requested.
+	req := strings.Fields(strings.TrimPrefix(server.waitForLine(t, "CAP REQ :"), "CAP REQ :"))
+	sort.Strings(req)
+	if strings.Join(req, " ") != "account-notify multi-prefix sasl" {
+		t.Errorf("requested %v, want the supported capabilities and sasl", req)
+	}
+	server.waitForLine(t, "AUTHENTICATE PLAIN")
+	if payload := server.waitForLine(t, "AUTHENTICATE "); payload != "AUTHENTICATE "+base64.StdEncoding.EncodeToString([]byte("\x00bot\x00hunter2")) {
+		t.Errorf("payload = %q, want the nick and password", payload)
+	}
+	server.waitForLine(t, "CAP END")
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		i.Lock()
+		registered, sasl, multiPrefix := i.registered, i.sasl, i.caps["multi-prefix"]
+		i.Unlock()
+		if registered {
+			if !sasl || !multiPrefix {
+				t.Errorf("sasl %v multi-prefix %v, want both after registering", sasl, multiPrefix)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for registration")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIRCBackoff(t *testing.T) {
+	i := NewIRC("irc.example.com:6697", "bot", "", nil)
+	close(i.closing)
+
+	// The wait doubles each time, up to ircMaxBackoff, and a closed service does not wait at all.
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, ircMaxBackoff, ircMaxBackoff} {
+		if i.wait() {
+			t.Fatal("wait returned true after close")
+		}
+		if i.backoff != want {
+			t.Errorf("backoff = %v, want %v", i.backoff, want)
+		}
+	}
+}
+
+func TestIRCReconnect(t *testing.T) {
+	server := newIRCServer(t)
+	defer server.listener.Close()
+
+	i := NewIRC(server.listener.Addr().String(), "bot", "", []string{"#channel"})
+	if _, err := i.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	conn := <-server.conns
+	server.waitForLine(t, "JOIN #channel")
+	i.Lock()
+	i.backoff = 100 * time.Millisecond
+	i.Unlock()
+	conn.Close()
+
+	// The bot reconnects after the backoff, and joins its channels again.
+	select {
+	case <-server.conns:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the bot did not reconnect")
+	}
+	server.waitForLine(t, "JOIN #channel")
+
+	i.Lock()
+	backoff := i.backoff
+	i.Unlock()
+	if backoff != time.Second {
+		t.Errorf("backoff = %v, want it reset to 1s after registering", backoff)
+	}
+}
+
+func TestIRCTLSConfig(t *testing.T) {
+	i := NewIRC("irc.example.com:6697", "bot", "", nil)
+	i.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	config := i.tlsConfig()
+	if config.ServerName != "irc.example.com" || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("config = %q %v, want irc.example.com and the caller's MinVersion", config.ServerName, config.MinVersion)
+	}
+	if config == i.TLSConfig || i.TLSConfig.ServerName != "" {
+		t.Error("the caller's config was changed")
+	}
+}
+
+func TestIRCUserArguments(t *testing.T) {
+	i := NewIRC("irc.example.com:6697", "bot", "", nil)
+	i.user("Alice").userhost = "alice@example.com"
+	bob := i.user("Bob")
+	bob.userhost, bob.account = "bob@example.com", "bobaccount"
+
+	// Nicks are resolved to accounts, or ident@host when the user is not logged in, and unknown nicks are kept.
+	for nick, want := range map[string]string{"Bob": "bobaccount", "alice": "alice@example.com", "carol": "carol"} {
+		message := &IRCMessage{Nick: "dave", Cmd: "PRIVMSG", Args: []string{"#channel", "!grant " + nick + " trusted"}}
+		args, err := ParseArgs(i, "grant", message, RoleArgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user := args.User("user"); user != want {
+			t.Errorf("user %s = %s, want %s", nick, user, want)
+		}
+	}
+
+	if mention := UserMention(i, "bobaccount"); mention != "Bob" {
+		t.Errorf("mention = %s, want Bob", mention)
+	}
+}
+
+func TestIRCUserNames(t *testing.T) {
+	i := NewIRC("irc.example.com:6697", "bot", "", []string{"#channel"})
+	i.channelModes["#channel"] = map[string]string{"alice": "", "alice_": ""}
+	i.user("Alice").account = "alice"
+	i.user("Alice_").account = "alice"
+	i.users["alice_"].seen = i.users["alice"].seen.Add(-time.Second)
+
+	// The nick is kept as it was written, and the most recently seen nick of an account is used.
+	if nick, ok := i.UserNameForID("alice"); !ok || nick != "Alice" {
+		t.Errorf("nick = %s, want Alice", nick)
+	}
+	i.onNick(nil, &client.Line{Nick: "Alice_", Args: []string{"ALICE_"}})
+	if nick, ok := i.UserNameForID("alice"); !ok || nick != "ALICE_" {
+		t.Errorf("nick = %s, want ALICE_ after the nick change", nick)
+	}
+
+	// Users the bot does not share a channel with are not kept after they message it.
+	i.onMessage(nil, &client.Line{Nick: "Carol", Ident: "carol", Host: "example.com", Cmd: "PRIVMSG", Args: []string{"bot", "hello"}})
+	<-i.messageChan
+	if _, ok := i.UserIDForName("carol"); ok {
+		t.Error("a private message sender was kept")
+	}
+}
+
+func TestIRCMessageClose(t *testing.T) {
+	i := NewIRC("irc.example.com:6697", "bot", "", nil)
+	// Nothing reads the messages, so the message blocks until the service is closed.
+	i.messageChan = make(chan Message)
+
+	done := make(chan struct{})
+	go func() {
+		i.onMessage(nil, &client.Line{Nick: "alice", Ident: "alice", Host: "example.com", Cmd: "PRIVMSG", Args: []string{"bot", "hello"}})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	i.Close()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("onMessage did not return after close")
+	}
+}
@@ -0,0 +1,835 @@
+package comicjerk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MatrixServiceName is the service name for the Matrix service.
+const MatrixServiceName string = "Matrix"
+
+// matrixModeratorLevel is the power level at which a user is a moderator, it is the level Matrix clients give moderators.
+const matrixModeratorLevel = 50
+
+// maxMatrixHistory is the number of messages kept for each room.
+const maxMatrixHistory = 100
+
+// matrixSyncTimeout is how long the homeserver holds a sync request open while waiting for events.
+const matrixSyncTimeout = 30 * time.Second
+
+// matrixMaxBackoff is the longest the service waits before retrying a failed sync.
+const matrixMaxBackoff = time.Minute
+
+// MatrixEvent is a room event from the Matrix client-server API.
+type MatrixEvent struct {
+	Type     string          `json:"type"`
+	EventID  string          `json:"event_id"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key,omitempty"`
+	Redacts  string          `json:"redacts,omitempty"`
+	Content  json.RawMessage `json:"content"`
+	RoomID   string          `json:"room_id,omitempty"`
+}
+
+// matrixRelation is the m.relates_to of an event, edits have the rel_type m.replace.
+type matrixRelation struct {
+	RelType string `json:"rel_type,omitempty"`
+	EventID string `json:"event_id,omitempty"`
+}
+
+// matrixMessageContent is the content of an m.room.message event.
+type matrixMessageContent struct {
+	MsgType    string                `json:"msgtype"`
+	Body       string                `json:"body"`
+	URL        string                `json:"url,omitempty"`
+	Info       *matrixFileInfo       `json:"info,omitempty"`
+	NewContent *matrixMessageContent `json:"m.new_content,omitempty"`
+	RelatesTo  *matrixRelation       `json:"m.relates_to,omitempty"`
+}
+
+type matrixFileInfo struct {
+	MimeType string `json:"mimetype,omitempty"`
+	Size     int    `json:"size,omitempty"`
+}
+
+type matrixMemberContent struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname,omitempty"`
+	IsDirect    bool   `json:"is_direct,omitempty"`
+}
+
+type matrixPowerLevels struct {
+	Users        map[string]int `json:"users"`
+	UsersDefault int            `json:"users_default"`
+}
+
+// MatrixMessage is a Message wrapper around a Matrix room event.
+type MatrixMessage struct {
+	Event       *MatrixEvent
+	Content     *matrixMessageContent
+	DisplayName string
+	MessageType MessageType
+}
+
+// Channel returns the channel id for this message.
+func (m *MatrixMessage) Channel() string {
+	return m.Event.RoomID
+}
+
+// UserName returns the user name for this message.
+func (m *MatrixMessage) UserName() string {
+	if m.DisplayName != "" {
+		return m.DisplayName
+	}
+	return m.Event.Sender
+}
+
+// UserID returns the user id for this message.
+func (m *MatrixMessage) UserID() string {
+	return m.Event.Sender
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *MatrixMessage) UserAvatar() string {
+	return ""
+}
+
+// Message returns the message content for this message.
+func (m *MatrixMessage) Message() string {
+	if m.Content == nil {
+		return ""
+	}
+	if m.Content.NewContent != nil {
+		return m.Content.NewContent.Body
+	}
+	return m.Content.Body
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *MatrixMessage) RawMessage() string {
+	return m.Message()
+}
+
+// MessageID returns the message ID for this message.
+// Edits and redactions return the id of the message they change.
+func (m *MatrixMessage) MessageID() string {
+	switch m.MessageType {
+	case MessageTypeUpdate:
+		return m.Content.RelatesTo.EventID
+	case MessageTypeDelete:
+		return m.Event.Redacts
+	}
+	return m.Event.EventID
+}
+
+// Type returns the type of message.
+func (m *MatrixMessage) Type() MessageType {
+	return m.MessageType
+}
+
+// IsBot returns whether the message was sent as a notice, which is how bots send messages on Matrix.
+func (m *MatrixMessage) IsBot() bool {
+	return m.Content != nil && m.Content.MsgType == "m.notice"
+}
+
+// MatrixError is an error response from a Matrix homeserver.
+type MatrixError struct {
+	StatusCode   int
+	ErrCode      string `json:"errcode"`
+	Err          string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+func (e *MatrixError) Error() string {
+	return fmt.Sprintf("Matrix error %d %s: %s", e.StatusCode, e.ErrCode, e.Err)
+}
+
+// matrixRetryAfter returns how long to wait if err is a rate limit response.
+func matrixRetryAfter(err error) (time.Duration, bool) {
+	matrixErr, ok := err.(*MatrixError)
+	if !ok || matrixErr.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if matrixErr.RetryAfterMs > 0 {
+		return time.Duration(matrixErr.RetryAfterMs) * time.Millisecond, true
+	}
+	return time.Second, true
+}
+
+// matrixRoom is the state the service keeps for a joined room.
+type matrixRoom struct {
+	members     map[string]string
+	powerLevels *matrixPowerLevels
+	direct      bool
+	history     []Message
+}
+
+// Matrix is a Service provider for Matrix.
+type Matrix struct {
+	sync.RWMutex
+	homeserver  string
+	userID      string
+	accessToken string
+	joins       []string
+	messageChan chan Message
+	ctx         context.Context
+	cancel      context.CancelFunc
+	outbox      *Outbox
+	closeOnce   sync.Once
+
+	since string
+	txnID int64
+	rooms map[string]*matrixRoom
+	// direct maps a user id to the room used for private messages with them.
+	direct map[string]string
+
+	// Client is the HTTP client used for requests to the homeserver.
+	Client      *http.Client
+	OwnerUserID string
+}
+
+// NewMatrix creates a new Matrix service for a user on a homeserver, eg. https://matrix.example.com.
+// The bot joins rooms, given by id or alias, when it is opened.
+func NewMatrix(homeserver, userID, accessToken string, rooms []string) *Matrix {
+	ctx, cancel := context.WithCancel(context.Background())
+	outbox := NewOutbox(5, time.Second, 100)
+	outbox.RetryAfter = matrixRetryAfter
+	return &Matrix{
+		homeserver:  strings.TrimSuffix(homeserver, "/"),
+		userID:      userID,
+		accessToken: accessToken,
+		joins:       rooms,
+		messageChan: make(chan Message, 200),
+		ctx:         ctx,
+		cancel:      cancel,
+		outbox:      outbox,
+		rooms:       make(map[string]*matrixRoom),
+		direct:      make(map[string]string),
+		Client:      http.DefaultClient,
+	}
+}
+
+// matrixPathEscape escapes a room id, alias or event id for use in a url path.
+func matrixPathEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// request makes a request to the homeserver and decodes the JSON response into result, if result is not nil.
+func (m *Matrix) request(method, path string, query url.Values, contentType string, body io.Reader, result interface{}) error {
+	u := m.homeserver + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.accessToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := m.Client.Do(req.WithContext(m.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		matrixErr := &MatrixError{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, matrixErr)
+		return matrixErr
+	}
+
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// requestJSON makes a request with a JSON body.
+func (m *Matrix) requestJSON(method, path string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return m.request(method, path, nil, "application/json", bytes.NewReader(data), result)
+}
+
+// nextTxnID returns a transaction id, which makes retried sends idempotent.
+func (m *Matrix) nextTxnID() string {
+	m.Lock()
+	defer m.Unlock()
+
+	m.txnID++
+	return fmt.Sprintf("comicjerk%d.%d", time.Now().UnixNano(), m.txnID)
+}
+
+type matrixSyncResponse struct {
+	NextBatch   string `json:"next_batch"`
+	AccountData struct {
+		Events []*MatrixEvent `json:"events"`
+	} `json:"account_data"`
+	Rooms struct {
+		Join map[string]struct {
+			State struct {
+				Events []*MatrixEvent `json:"events"`
+			} `json:"state"`
+			Timeline struct {
+				Events []*MatrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState struct {
+				Events []*MatrixEvent `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+		Leave map[string]json.RawMessage `json:"leave"`
+	} `json:"rooms"`
+}
+
+// matrixSyncFilter limits the initial sync, the bot only needs recent messages for history.
+var matrixSyncFilter = fmt.Sprintf(`{"room":{"timeline":{"limit":%d}}}`, maxMatrixHistory)
+
+func (m *Matrix) sync() error {
+	query := url.Values{}
+	query.Set("filter", matrixSyncFilter)
+	if m.since != "" {
+		query.Set("since", m.since)
+		query.Set("timeout", strconv.Itoa(int(matrixSyncTimeout/time.Millisecond)))
+	}
+
+	resp := &matrixSyncResponse{}
+	if err := m.request("GET", "/_matrix/client/r0/sync", query, "", nil, resp); err != nil {
+		return err
+	}
+
+	// Messages from before the bot started are kept for history, but not dispatched.
+	initial := m.since == ""
+	m.since = resp.NextBatch
+
+	for _, event := range resp.AccountData.Events {
+		if event.Type == "m.direct" {
+			m.onDirect(event)
+		}
+	}
+
+	for roomID, room := range resp.Rooms.Join {
+		for _, event := range room.State.Events {
+			event.RoomID = roomID
+			m.onState(event)
+		}
+		for _, event := range room.Timeline.Events {
+			event.RoomID = roomID
+			if event.StateKey != nil {
+				m.onState(event)
+				continue
+			}
+			if message := m.message(event); message != nil && !initial {
+				select {
+				case m.messageChan <- message:
+				case <-m.ctx.Done():
+					return m.ctx.Err()
+				}
+			}
+		}
+	}
+
+	for roomID, room := range resp.Rooms.Invite {
+		m.onInvite(roomID, room.InviteState.Events)
+	}
+
+	m.Lock()
+	left := false
+	for roomID := range resp.Rooms.Leave {
+		delete(m.rooms, roomID)
+		for userID, direct := range m.direct {
+			if direct == roomID {
+				delete(m.direct, userID)
+				left = true
+			}
+		}
+	}
+	m.Unlock()
+
+	if left {
+		m.saveDirect()
+	}
+	return nil
+}
+
+// onInvite accepts an invite to a direct chat, other invites are left for the invite plugins.
+func (m *Matrix) onInvite(roomID string, events []*MatrixEvent) {
+	for _, event := range events {
+		if event.Type != "m.room.member" || event.StateKey == nil || *event.StateKey != m.userID {
+			continue
+		}
+		content := &matrixMemberContent{}
+		if err := json.Unmarshal(event.Content, content); err != nil || content.Membership != "invite" || !content.IsDirect {
+			continue
+		}
+
+		if err := m.Join(roomID); err != nil && err != ErrAlreadyJoined {
+			log.Printf("Error accepting matrix invite to %s from %s. %v", roomID, event.Sender, err)
+			return
+		}
+
+		m.Lock()
+		m.room(roomID).direct = true
+		m.direct[event.Sender] = roomID
+		m.Unlock()
+
+		m.saveDirect()
+		return
+	}
+}
+
+// saveDirect saves the direct chats to the bot's m.direct account data, so they are known after a restart.
+func (m *Matrix) saveDirect() {
+	m.RLock()
+	direct := map[string][]string{}
+	for userID, roomID := range m.direct {
+		direct[userID] = []string{roomID}
+	}
+	m.RUnlock()
+
+	path := fmt.Sprintf("/_matrix/client/r0/user/%s/account_data/m.direct", matrixPathEscape(m.userID))
+	if err := m.requestJSON("PUT", path, direct, nil); err != nil {
+		log.Printf("Error saving matrix direct chats. %v", err)
+	}
+}
+
+func (m *Matrix) run() {
+	backoff := time.Second
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		default:
+		}
+
+		if err := m.sync(); err != nil {
+			if m.ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error syncing with matrix, retrying in %v. %v", backoff, err)
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > matrixMaxBackoff {
+				backoff = matrixMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// room returns the state of a room, creating it if needed, the lock must be held.
+func (m *Matrix) room(roomID string) *matrixRoom {
+	room := m.rooms[roomID]
+	if room == nil {
+		room = &matrixRoom{members: make(map[string]string)}
+		m.rooms[roomID] = room
+	}
+	return room
+}
+
+func (m *Matrix) onDirect(event *MatrixEvent) {
+	direct := map[string][]string{}
+	if err := json.Unmarshal(event.Content, &direct); err != nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for userID, rooms := range direct {
+		for _, roomID := range rooms {
+			m.room(roomID).direct = true
+			m.direct[userID] = roomID
+		}
+	}
+}
+
+func (m *Matrix) onState(event *MatrixEvent) {
+	m.Lock()
+	defer m.Unlock()
+
+	room := m.room(event.RoomID)
+	switch event.Type {
+	case "m.room.member":
+		content := &matrixMemberContent{}
+		if err := json.Unmarshal(event.Content, content); err != nil {
+			return
+		}
+		if content.Membership == "join" {
+			room.members[*event.StateKey] = content.DisplayName
+		} else {
+			delete(room.members, *event.StateKey)
+		}
+		if content.IsDirect {
+			room.direct = true
+		}
+	case "m.room.power_levels":
+		levels := &matrixPowerLevels{}
+		if err := json.Unmarshal(event.Content, levels); err == nil {
+			room.powerLevels = levels
+		}
+	}
+}
+
+// message returns the Message for a timeline event, or nil if it is not a message, edit or redaction.
+func (m *Matrix) message(event *MatrixEvent) *MatrixMessage {
+	message := &MatrixMessage{Event: event, MessageType: MessageTypeCreate}
+
+	switch event.Type {
+	case "m.room.message":
+		content := &matrixMessageContent{}
+		if err := json.Unmarshal(event.Content, content); err != nil {
+			return nil
+		}
+		message.Content = content
+		if content.RelatesTo != nil && content.RelatesTo.RelType == "m.replace" && content.NewContent != nil {
+			message.MessageType = MessageTypeUpdate
+		}
+	case "m.room.redaction":
+		// Newer room versions move redacts into the content.
+		if event.Redacts == "" {
+			content := &struct {
+				Redacts string `json:"redacts"`
+			}{}
+			json.Unmarshal(event.Content, content)
+			event.Redacts = content.Redacts
+		}
+		message.MessageType = MessageTypeDelete
+	default:
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	room := m.room(event.RoomID)
+	message.DisplayName = room.members[event.Sender]
+
+	switch message.MessageType {
+	case MessageTypeCreate:
+		if room.history = append(room.history, message); len(room.history) > maxMatrixHistory {
+			room.history = room.history[1:]
+		}
+	case MessageTypeUpdate, MessageTypeDelete:
+		for i, h := range room.history {
+			if h.MessageID() != message.MessageID() {
+				continue
+			}
+			if message.MessageType == MessageTypeDelete {
+				room.history = append(room.history[:i:i], room.history[i+1:]...)
+			} else {
+				room.history[i] = &MatrixMessage{Event: h.(*MatrixMessage).Event, Content: message.Content.NewContent, DisplayName: message.DisplayName, MessageType: MessageTypeCreate}
+			}
+			break
+		}
+	}
+
+	return message
+}
+
+// Name returns the name of the service.
+func (m *Matrix) Name() string {
+	return MatrixServiceName
+}
+
+// Open opens the service and returns a channel which all messages will be sent on.
+func (m *Matrix) Open() (<-chan Message, error) {
+	// The first sync loads the rooms, so that state is known before messages arrive.
+	if err := m.sync(); err != nil {
+		return nil, err
+	}
+	for _, room := range m.joins {
+		if room == "" {
+			continue
+		}
+		if err := m.Join(room); err != nil && err != ErrAlreadyJoined {
+			log.Printf("Error joining matrix room %s. %v", room, err)
+		}
+	}
+	go m.run()
+	return m.messageChan, nil
+}
+
+// Close closes the service.
+func (m *Matrix) Close() error {
+	m.closeOnce.Do(func() {
+		m.cancel()
+		m.outbox.Close()
+	})
+	return nil
+}
+
+// IsMe returns whether or not a message was sent by the bot.
+func (m *Matrix) IsMe(message Message) bool {
+	return message.UserID() == m.userID
+}
+
+// send sends the content of a message event to a room and returns the event id.
+func (m *Matrix) send(roomID string, content interface{}, private bool) (string, error) {
+	var eventID string
+	err := m.outbox.Send(private, func() error {
+		resp := &struct {
+			EventID string `json:"event_id"`
+		}{}
+		path := fmt.Sprintf("/_matrix/client/r0/rooms/%s/send/m.room.message/%s", matrixPathEscape(roomID), matrixPathEscape(m.nextTxnID()))
+		if err := m.requestJSON("PUT", path, content, resp); err != nil {
+			return err
+		}
+		eventID = resp.EventID
+		return nil
+	})
+	if err != nil {
+		log.Println("Error sending matrix message: ", err)
+		return "", err
+	}
+	return eventID, nil
+}
+
+// SendMessage sends a message.
+func (m *Matrix) SendMessage(channel, message string) error {
+	_, err := m.SendMessageID(channel, message)
+	return err
+}
+
+// SendMessageID sends a message and returns its id.
+func (m *Matrix) SendMessageID(channel, message string) (string, error) {
+	return m.send(channel, &matrixMessageContent{MsgType: "m.notice", Body: message}, false)
+}
+
+// EditMessage edits a message.
+func (m *Matrix) EditMessage(channel, messageID, message string) error {
+	_, err := m.send(channel, &matrixMessageContent{
+		MsgType:    "m.notice",
+		Body:       "* " + message,
+		NewContent: &matrixMessageContent{MsgType: "m.notice", Body: message},
+		RelatesTo:  &matrixRelation{RelType: "m.replace", EventID: messageID},
+	}, false)
+	return err
+}
+
+// DeleteMessage deletes a message.
+func (m *Matrix) DeleteMessage(channel, messageID string) error {
+	path := fmt.Sprintf("/_matrix/client/r0/rooms/%s/redact/%s/%s", matrixPathEscape(channel), matrixPathEscape(messageID), matrixPathEscape(m.nextTxnID()))
+	return m.requestJSON("PUT", path, struct{}{}, nil)
+}
+
+// CanSendFile returns true, files are uploaded to the homeserver.
+func (m *Matrix) CanSendFile(message Message) bool {
+	return true
+}
+
+// SendFile uploads a file to the homeserver's media repository and sends it, images are sent so that clients show them inline.
+func (m *Matrix) SendFile(channel, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	contentType := http.DetectContentType(data)
+
+	resp := &struct {
+		ContentURI string `json:"content_uri"`
+	}{}
+	query := url.Values{}
+	query.Set("filename", name)
+	if err := m.request("POST", "/_matrix/media/r0/upload", query, contentType, bytes.NewReader(data), resp); err != nil {
+		return err
+	}
+
+	msgType := "m.file"
+	if strings.HasPrefix(contentType, "image/") {
+		msgType = "m.image"
+	}
+	_, err = m.send(channel, &matrixMessageContent{
+		MsgType: msgType,
+		Body:    name,
+		URL:     resp.ContentURI,
+		Info:    &matrixFileInfo{MimeType: contentType, Size: len(data)},
+	}, false)
+	return err
+}
+
+// BanUser bans a user.
+func (m *Matrix) BanUser(channel, userID string, duration int) error {
+	return m.requestJSON("POST", fmt.Sprintf("/_matrix/client/r0/rooms/%s/ban", matrixPathEscape(channel)), map[string]string{"user_id": userID}, nil)
+}
+
+// UnbanUser unbans a user.
+func (m *Matrix) UnbanUser(channel, userID string) error {
+	return m.requestJSON("POST", fmt.Sprintf("/_matrix/client/r0/rooms/%s/unban", matrixPathEscape(channel)), map[string]string{"user_id": userID}, nil)
+}
+
+// UserName returns the bots name, which is the localpart of its user id.
+func (m *Matrix) UserName() string {
+	name := strings.TrimPrefix(m.userID, "@")
+	if i := strings.Index(name, ":"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// UserID returns the bots user id.
+func (m *Matrix) UserID() string {
+	return m.userID
+}
+
+// Join joins a room by id or alias.
+func (m *Matrix) Join(join string) error {
+	m.RLock()
+	_, joined := m.rooms[join]
+	m.RUnlock()
+	if joined {
+		return ErrAlreadyJoined
+	}
+
+	resp := &struct {
+		RoomID string `json:"room_id"`
+	}{}
+	if err := m.requestJSON("POST", "/_matrix/client/r0/join/"+matrixPathEscape(join), struct{}{}, resp); err != nil {
+		return err
+	}
+
+	m.Lock()
+	m.room(resp.RoomID)
+	m.Unlock()
+	return nil
+}
+
+// Typing sets that the bot is typing.
+func (m *Matrix) Typing(channel string) error {
+	path := fmt.Sprintf("/_matrix/client/r0/rooms/%s/typing/%s", matrixPathEscape(channel), matrixPathEscape(m.userID))
+	return m.requestJSON("PUT", path, map[string]interface{}{"typing": true, "timeout": 5000}, nil)
+}
+
+// PrivateMessage will send a private message to a user, creating a direct chat with them if there is none.
+func (m *Matrix) PrivateMessage(userID, message string) error {
+	m.RLock()
+	roomID := m.direct[userID]
+	m.RUnlock()
+
+	if roomID == "" {
+		resp := &struct {
+			RoomID string `json:"room_id"`
+		}{}
+		err := m.requestJSON("POST", "/_matrix/client/r0/createRoom", map[string]interface{}{
+			"is_direct": true,
+			"invite":    []string{userID},
+			"preset":    "trusted_private_chat",
+		}, resp)
+		if err != nil {
+			return err
+		}
+		roomID = resp.RoomID
+
+		m.Lock()
+		m.room(roomID).direct = true
+		m.direct[userID] = roomID
+		m.Unlock()
+
+		m.saveDirect()
+	}
+
+	_, err := m.send(roomID, &matrixMessageContent{MsgType: "m.notice", Body: message}, true)
+	return err
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (m *Matrix) Outbox() *Outbox {
+	return m.outbox
+}
+
+// SupportsPrivateMessages returns whether the service supports private messages.
+func (m *Matrix) SupportsPrivateMessages() bool {
+	return true
+}
+
+// SupportsMultiline returns whether the service supports multiline messages.
+func (m *Matrix) SupportsMultiline() bool {
+	return true
+}
+
+// CommandPrefix returns the command prefix for the service.
+func (m *Matrix) CommandPrefix() string {
+	return "!"
+}
+
+// IsBotOwner returns whether or not a message sender was the owner of the bot.
+func (m *Matrix) IsBotOwner(message Message) bool {
+	return message.UserID() == m.OwnerUserID
+}
+
+// IsPrivate returns whether or not a message was private, which is a message in a direct chat.
+func (m *Matrix) IsPrivate(message Message) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	room := m.rooms[message.Channel()]
+	return room != nil && room.direct
+}
+
+// IsModerator returns whether or not the sender of a message is a moderator, which is a power level of at least 50 in the room.
+func (m *Matrix) IsModerator(message Message) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	room := m.rooms[message.Channel()]
+	if room == nil || room.powerLevels == nil {
+		return false
+	}
+	level, ok := room.powerLevels.Users[message.UserID()]
+	if !ok {
+		level = room.powerLevels.UsersDefault
+	}
+	return level >= matrixModeratorLevel
+}
+
+// ChannelCount returns the number of channels the bot is in.
+func (m *Matrix) ChannelCount() int {
+	m.RLock()
+	defer m.RUnlock()
+
+	return len(m.rooms)
+}
+
+// SupportsMessageHistory returns if the service supports message history.
+func (m *Matrix) SupportsMessageHistory() bool {
+	return true
+}
+
+// MessageHistory returns the message history for a channel.
+func (m *Matrix) MessageHistory(channel string) []Message {
+	m.RLock()
+	defer m.RUnlock()
+
+	room := m.rooms[channel]
+	if room == nil {
+		return nil
+	}
+	return append([]Message{}, room.history...)
+}
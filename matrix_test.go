@@ -0,0 +1,171 @@
+package comicjerk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// matrixHomeserver is a stub homeserver that returns queued sync responses and records the other requests.
+type matrixHomeserver struct {
+	sync.Mutex
+	syncs    []string
+	requests []string
+	bodies   map[string]string
+}
+
+func (h *matrixHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if r.URL.Path == "/_matrix/client/r0/sync" {
+		h.Lock()
+		if len(h.syncs) > 0 {
+			resp := h.syncs[0]
+			h.syncs = h.syncs[1:]
+			h.Unlock()
+			w.Write([]byte(resp))
+			return
+		}
+		h.Unlock()
+
+		// Long polling with nothing to return.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(20 * time.Millisecond):
+		}
+		w.Write([]byte(`{"next_batch":"idle"}`))
+		return
+	}
+
+	h.Lock()
+	h.requests = append(h.requests, r.Method+" "+r.URL.EscapedPath())
+	h.bodies[r.URL.EscapedPath()] = string(body)
+	h.Unlock()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_matrix/client/r0/join/"):
+		w.Write([]byte(`{"room_id":"!dm:example.com"}`))
+	case strings.Contains(r.URL.Path, "/send/"):
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	default:
+		w.Write([]byte(`{}`))
+	}
+}
+
+func (h *matrixHomeserver) request(prefix string) (string, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, r := range h.requests {
+		if strings.HasPrefix(r, prefix) {
+			return h.bodies[strings.SplitN(r, " ", 2)[1]], true
+		}
+	}
+	return "", false
+}
+
+func (h *matrixHomeserver) waitForRequest(prefix string) (string, bool) {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		body, ok := h.request(prefix)
+		if ok || time.Now().After(deadline) {
+			return body, ok
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+const matrixInviteSync = `{"next_batch":"1","rooms":{"invite":{"!dm:example.com":{"invite_state":{"events":[
+	{"type":"m.room.member","sender":"@alice:example.com","state_key":"@bot:example.com","content":{"membership":"invite","is_direct":true}}
+]}}}}}`
+
+const matrixMessageSync = `{"next_batch":"2","rooms":{"join":{"!dm:example.com":{"timeline":{"events":[
+	{"type":"m.room.message","event_id":"$1","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"hello"}}
+]}}}}}`
+
+const matrixLeaveSync = `{"next_batch":"3","rooms":{"leave":{"!dm:example.com":{}}}}`
+
+func TestMatrixDirectInvite(t *testing.T) {
+	homeserver := &matrixHomeserver{
+		syncs:  []string{matrixInviteSync, matrixMessageSync},
+		bodies: map[string]string{},
+	}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	m := NewMatrix(server.URL, "@bot:example.com", "token", nil)
+	messages, err := m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if _, ok := homeserver.request("POST /_matrix/client/r0/join/%21dm%3Aexample.com"); !ok {
+		t.Fatal("want the direct invite to be accepted")
+	}
+	body, ok := homeserver.request("PUT /_matrix/client/r0/user/%40bot%3Aexample.com/account_data/m.direct")
+	direct := map[string][]string{}
+	json.Unmarshal([]byte(body), &direct)
+	if !ok || len(direct["@alice:example.com"]) != 1 || direct["@alice:example.com"][0] != "!dm:example.com" {
+		t.Errorf("m.direct = %q, want the room to be saved as a direct chat with alice", body)
+	}
+
+	select {
+	case message := <-messages:
+		if message.Message() != "hello" || !m.IsPrivate(message) {
+			t.Errorf("message = %q private %v, want a private hello", message.Message(), m.IsPrivate(message))
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the direct message")
+	}
+
+	// Leaving the room forgets the direct chat, so the next private message creates a new one.
+	homeserver.Lock()
+	homeserver.syncs = append(homeserver.syncs, matrixLeaveSync)
+	homeserver.requests = nil
+	homeserver.Unlock()
+
+	body, ok = homeserver.waitForRequest("PUT /_matrix/client/r0/user/%40bot%3Aexample.com/account_data/m.direct")
+	if !ok || body != "{}" {
+		t.Errorf("m.direct = %q, want the left room to be removed", body)
+	}
+	m.RLock()
+	roomID := m.direct["@alice:example.com"]
+	m.RUnlock()
+	if roomID != "" {
+		t.Errorf("direct room = %s, want none after leaving", roomID)
+	}
+}
+
+func TestMatrixSyncClose(t *testing.T) {
+	homeserver := &matrixHomeserver{
+		syncs:  []string{matrixMessageSync},
+		bodies: map[string]string{},
+	}
+	server := httptest.NewServer(homeserver)
+	defer server.Close()
+
+	m := NewMatrix(server.URL, "@bot:example.com", "token", nil)
+	// Nothing reads the messages, so the sync blocks sending them until the service is closed.
+	m.messageChan = make(chan Message)
+	m.since = "1"
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.sync()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	m.Close()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("sync did not return after close")
+	}
+}
@@ -0,0 +1,794 @@
+package comicjerk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MattermostServiceName is the service name for the Mattermost service.
+const MattermostServiceName string = "Mattermost"
+
+// mattermostMaxBackoff is the longest the service waits before reconnecting the websocket.
+const mattermostMaxBackoff = time.Minute
+
+// mattermostPingInterval is how often the websocket is pinged, it is closed if nothing is read for twice as long.
+const mattermostPingInterval = 30 * time.Second
+
+// mattermostRoleCacheTime is how long a user's roles in a channel are cached.
+const mattermostRoleCacheTime = 5 * time.Minute
+
+// maxMattermostHistory is the number of posts requested for a channel's history.
+const maxMattermostHistory = 100
+
+// MattermostPost is a post from the Mattermost API.
+type MattermostPost struct {
+	ID        string                 `json:"id,omitempty"`
+	CreateAt  int64                  `json:"create_at,omitempty"`
+	UpdateAt  int64                  `json:"update_at,omitempty"`
+	DeleteAt  int64                  `json:"delete_at,omitempty"`
+	UserID    string                 `json:"user_id,omitempty"`
+	ChannelID string                 `json:"channel_id"`
+	RootID    string                 `json:"root_id,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	Type      string                 `json:"type,omitempty"`
+	Props     map[string]interface{} `json:"props,omitempty"`
+	FileIDs   []string               `json:"file_ids,omitempty"`
+}
+
+// MattermostUser is a user from the Mattermost API.
+type MattermostUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Roles    string `json:"roles"`
+}
+
+// MattermostChannel is a channel from the Mattermost API.
+type MattermostChannel struct {
+	ID     string `json:"id"`
+	TeamID string `json:"team_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+}
+
+// MattermostMessage is a Message wrapper around MattermostPost.
+type MattermostMessage struct {
+	Post        *MattermostPost
+	MessageType MessageType
+	Username    string
+}
+
+// Channel returns the channel id for this message.
+func (m *MattermostMessage) Channel() string {
+	return m.Post.ChannelID
+}
+
+// UserName returns the user name for this message.
+func (m *MattermostMessage) UserName() string {
+	return m.Username
+}
+
+// UserID returns the user id for this message.
+func (m *MattermostMessage) UserID() string {
+	return m.Post.UserID
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *MattermostMessage) UserAvatar() string {
+	return ""
+}
+
+// Message returns the message content for this message.
+func (m *MattermostMessage) Message() string {
+	return m.Post.Message
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *MattermostMessage) RawMessage() string {
+	return m.Post.Message
+}
+
+// MessageID returns the message ID for this message.
+func (m *MattermostMessage) MessageID() string {
+	return m.Post.ID
+}
+
+// Type returns the type of message.
+func (m *MattermostMessage) Type() MessageType {
+	return m.MessageType
+}
+
+// IsBot returns whether the message was posted by a bot or webhook.
+func (m *MattermostMessage) IsBot() bool {
+	return m.Post.Props["from_bot"] == "true" || m.Post.Props["from_webhook"] == "true"
+}
+
+// MattermostError is an error response from the Mattermost API.
+type MattermostError struct {
+	StatusCode int    `json:"status_code"`
+	ID         string `json:"id"`
+	Message    string `json:"message"`
+	// RetryAfter is the number of seconds until a rate limit resets.
+	RetryAfter int `json:"-"`
+}
+
+func (e *MattermostError) Error() string {
+	return fmt.Sprintf("Mattermost error %d %s: %s", e.StatusCode, e.ID, e.Message)
+}
+
+// mattermostRetryAfter returns how long to wait if err is a rate limit response.
+func mattermostRetryAfter(err error) (time.Duration, bool) {
+	mattermostErr, ok := err.(*MattermostError)
+	if !ok || mattermostErr.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if mattermostErr.RetryAfter > 0 {
+		return time.Duration(mattermostErr.RetryAfter) * time.Second, true
+	}
+	return time.Second, true
+}
+
+type mattermostEvent struct {
+	Event string                     `json:"event"`
+	Data  map[string]json.RawMessage `json:"data"`
+}
+
+// string returns a string field of the event's data.
+func (e *mattermostEvent) string(key string) string {
+	var s string
+	json.Unmarshal(e.Data[key], &s)
+	return s
+}
+
+type mattermostModerator struct {
+	moderator bool
+	expires   time.Time
+}
+
+// Mattermost is a Service provider for Mattermost.
+type Mattermost struct {
+	sync.RWMutex
+	url         string
+	token       string
+	messageChan chan Message
+	ctx         context.Context
+	cancel      context.CancelFunc
+	outbox      *Outbox
+	closeOnce   sync.Once
+
+	writeLock sync.Mutex
+	ws        *websocket.Conn
+	seq       int64
+
+	channels   map[string]*MattermostChannel
+	users      map[string]string
+	direct     map[string]string
+	moderators map[string]*mattermostModerator
+
+	Me *MattermostUser
+	// Client is the HTTP client used for requests to the API.
+	Client      *http.Client
+	OwnerUserID string
+}
+
+// NewMattermost creates a new Mattermost service for a server, eg. https://mattermost.example.com.
+// The token is a personal access token or a bot account's token.
+func NewMattermost(serverURL, token string) *Mattermost {
+	ctx, cancel := context.WithCancel(context.Background())
+	outbox := NewOutbox(5, time.Second, 100)
+	outbox.RetryAfter = mattermostRetryAfter
+	return &Mattermost{
+		url:         strings.TrimSuffix(serverURL, "/"),
+		token:       token,
+		messageChan: make(chan Message, 200),
+		ctx:         ctx,
+		cancel:      cancel,
+		outbox:      outbox,
+		channels:    make(map[string]*MattermostChannel),
+		users:       make(map[string]string),
+		direct:      make(map[string]string),
+		moderators:  make(map[string]*mattermostModerator),
+		Client:      http.DefaultClient,
+	}
+}
+
+// request makes a request to the API and decodes the JSON response into result, if result is not nil.
+func (m *Mattermost) request(method, path, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, m.url+"/api/v4"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := m.Client.Do(req.WithContext(m.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		mattermostErr := &MattermostError{}
+		json.Unmarshal(data, mattermostErr)
+		mattermostErr.StatusCode = resp.StatusCode
+		mattermostErr.RetryAfter, _ = strconv.Atoi(resp.Header.Get("X-Ratelimit-Reset"))
+		return mattermostErr
+	}
+
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// requestJSON makes a request with a JSON body.
+func (m *Mattermost) requestJSON(method, path string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	return m.request(method, path, "application/json", r, result)
+}
+
+// channel returns a channel, from the cache if it has been seen before.
+func (m *Mattermost) channel(channelID string) (*MattermostChannel, error) {
+	m.RLock()
+	channel := m.channels[channelID]
+	m.RUnlock()
+	if channel != nil {
+		return channel, nil
+	}
+
+	channel = &MattermostChannel{}
+	if err := m.requestJSON("GET", "/channels/"+url.QueryEscape(channelID), nil, channel); err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	m.channels[channelID] = channel
+	m.Unlock()
+	return channel, nil
+}
+
+// username returns the username of a user, from the cache if it has been seen before.
+func (m *Mattermost) username(userID string) string {
+	m.RLock()
+	username, ok := m.users[userID]
+	m.RUnlock()
+	if ok {
+		return username
+	}
+
+	user := &MattermostUser{}
+	if err := m.requestJSON("GET", "/users/"+url.QueryEscape(userID), nil, user); err != nil {
+		log.Printf("Error getting mattermost user %s. %v", userID, err)
+		return ""
+	}
+
+	m.Lock()
+	m.users[userID] = user.Username
+	m.Unlock()
+	return user.Username
+}
+
+func (m *Mattermost) onEvent(event *mattermostEvent) {
+	var messageType MessageType
+	switch event.Event {
+	case "posted":
+		messageType = MessageTypeCreate
+	case "post_edited":
+		messageType = MessageTypeUpdate
+	case "post_deleted":
+		messageType = MessageTypeDelete
+	default:
+		return
+	}
+
+	post := &MattermostPost{}
+	if err := json.Unmarshal([]byte(event.string("post")), post); err != nil {
+		log.Println("Error decoding mattermost post: ", err)
+		return
+	}
+	// System posts such as joins and header changes are not messages.
+	if strings.HasPrefix(post.Type, "system_") {
+		return
+	}
+
+	if name := strings.TrimPrefix(event.string("sender_name"), "@"); name != "" && messageType == MessageTypeCreate {
+		m.Lock()
+		m.users[post.UserID] = name
+		m.Unlock()
+	}
+	if channelType := event.string("channel_type"); channelType != "" {
+		m.Lock()
+		if m.channels[post.ChannelID] == nil {
+			m.channels[post.ChannelID] = &MattermostChannel{ID: post.ChannelID, TeamID: event.string("team_id"), Type: channelType, Name: event.string("channel_name")}
+		}
+		m.Unlock()
+	}
+
+	select {
+	case m.messageChan <- &MattermostMessage{post, messageType, m.username(post.UserID)}:
+	case <-m.ctx.Done():
+	}
+}
+
+func (m *Mattermost) websocketURL() string {
+	u := m.url + "/api/v4/websocket"
+	if strings.HasPrefix(u, "https://") {
+		return "wss://" + strings.TrimPrefix(u, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(u, "http://")
+}
+
+// listen reads events from the websocket until it is closed.
+func (m *Mattermost) listen() error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+m.token)
+	ws, _, err := websocket.DefaultDialer.Dial(m.websocketURL(), header)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	m.writeLock.Lock()
+	m.ws = ws
+	m.writeLock.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(mattermostPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-m.ctx.Done():
+				ws.Close()
+				return
+			case <-ticker.C:
+				ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			}
+		}
+	}()
+
+	ws.SetReadDeadline(time.Now().Add(2 * mattermostPingInterval))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(2 * mattermostPingInterval))
+	})
+
+	for {
+		event := &mattermostEvent{}
+		if err := ws.ReadJSON(event); err != nil {
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(2 * mattermostPingInterval))
+		m.onEvent(event)
+	}
+}
+
+func (m *Mattermost) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := m.listen()
+		if m.ctx.Err() != nil {
+			return
+		}
+		// A connection that stayed up for a while was not a failure to connect.
+		if time.Since(start) > mattermostMaxBackoff {
+			backoff = time.Second
+		}
+
+		log.Printf("Error reading mattermost websocket, reconnecting in %v. %v", backoff, err)
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > mattermostMaxBackoff {
+			backoff = mattermostMaxBackoff
+		}
+	}
+}
+
+// Name returns the name of the service.
+func (m *Mattermost) Name() string {
+	return MattermostServiceName
+}
+
+// Open opens the service and returns a channel which all messages will be sent on.
+func (m *Mattermost) Open() (<-chan Message, error) {
+	m.Me = &MattermostUser{}
+	if err := m.requestJSON("GET", "/users/me", nil, m.Me); err != nil {
+		return nil, err
+	}
+
+	teams := []struct {
+		ID string `json:"id"`
+	}{}
+	if err := m.requestJSON("GET", "/users/me/teams", nil, &teams); err != nil {
+		return nil, err
+	}
+	for _, team := range teams {
+		channels := []*MattermostChannel{}
+		if err := m.requestJSON("GET", fmt.Sprintf("/users/me/teams/%s/channels", url.QueryEscape(team.ID)), nil, &channels); err != nil {
+			return nil, err
+		}
+		m.Lock()
+		for _, channel := range channels {
+			m.channels[channel.ID] = channel
+		}
+		m.Unlock()
+	}
+
+	go m.run()
+	return m.messageChan, nil
+}
+
+// Close closes the websocket, it will not be reopened.
+func (m *Mattermost) Close() error {
+	m.closeOnce.Do(func() {
+		m.cancel()
+		m.outbox.Close()
+	})
+	return nil
+}
+
+// IsMe returns whether or not a message was sent by the bot.
+func (m *Mattermost) IsMe(message Message) bool {
+	return message.UserID() == m.UserID()
+}
+
+func (m *Mattermost) post(ctx context.Context, post *MattermostPost, private bool) (string, error) {
+	created := &MattermostPost{}
+	err := m.outbox.SendContext(ctx, private, func() error {
+		return m.requestJSON("POST", "/posts", post, created)
+	})
+	if err != nil {
+		log.Println("Error sending mattermost message: ", err)
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// SendMessage sends a message.
+func (m *Mattermost) SendMessage(channel, message string) error {
+	_, err := m.post(context.Background(), &MattermostPost{ChannelID: channel, Message: message}, false)
+	return err
+}
+
+// SendMessageContext sends a message, giving up if the context is done before it leaves the outbox.
+func (m *Mattermost) SendMessageContext(ctx context.Context, channel, message string) error {
+	_, err := m.post(ctx, &MattermostPost{ChannelID: channel, Message: message}, false)
+	return err
+}
+
+// SendMessageID sends a message and returns its id.
+func (m *Mattermost) SendMessageID(channel, message string) (string, error) {
+	return m.post(context.Background(), &MattermostPost{ChannelID: channel, Message: message}, false)
+}
+
+// EditMessage edits a message.
+func (m *Mattermost) EditMessage(channel, messageID, message string) error {
+	return m.outbox.Send(false, func() error {
+		return m.requestJSON("PUT", "/posts/"+url.QueryEscape(messageID)+"/patch", map[string]string{"message": message}, nil)
+	})
+}
+
+// DeleteMessage deletes a message.
+func (m *Mattermost) DeleteMessage(channel, messageID string) error {
+	return m.requestJSON("DELETE", "/posts/"+url.QueryEscape(messageID), nil, nil)
+}
+
+// CanSendFile returns true, files are posted as attachments.
+func (m *Mattermost) CanSendFile(message Message) bool {
+	return true
+}
+
+// SendFile uploads a file and posts it as an attachment.
+func (m *Mattermost) SendFile(channel, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	upload := &struct {
+		FileInfos []struct {
+			ID string `json:"id"`
+		} `json:"file_infos"`
+	}{}
+	err = m.outbox.Send(false, func() error {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("channel_id", channel)
+		part, err := writer.CreateFormFile("files", name)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(data); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		return m.request("POST", "/files", writer.FormDataContentType(), body, upload)
+	})
+	if err != nil {
+		log.Println("Error uploading mattermost file: ", err)
+		return err
+	}
+	if len(upload.FileInfos) == 0 {
+		return errors.New("Mattermost did not return the uploaded file.")
+	}
+
+	_, err = m.post(context.Background(), &MattermostPost{ChannelID: channel, FileIDs: []string{upload.FileInfos[0].ID}}, false)
+	return err
+}
+
+// BanUser removes a user from a channel, Mattermost has no bans so they can join it again.
+func (m *Mattermost) BanUser(channel, userID string, duration int) error {
+	return m.requestJSON("DELETE", fmt.Sprintf("/channels/%s/members/%s", url.QueryEscape(channel), url.QueryEscape(userID)), nil, nil)
+}
+
+// UnbanUser adds a user back to a channel.
+func (m *Mattermost) UnbanUser(channel, userID string) error {
+	return m.requestJSON("POST", fmt.Sprintf("/channels/%s/members", url.QueryEscape(channel)), map[string]string{"user_id": userID}, nil)
+}
+
+// UserName returns the bots name.
+func (m *Mattermost) UserName() string {
+	if m.Me == nil {
+		return ""
+	}
+	return m.Me.Username
+}
+
+// UserID returns the bots user id.
+func (m *Mattermost) UserID() string {
+	if m.Me == nil {
+		return ""
+	}
+	return m.Me.ID
+}
+
+// Join joins a channel, given by its id or as team/channel using their names.
+func (m *Mattermost) Join(join string) error {
+	channelID := join
+	if i := strings.Index(join, "/"); i != -1 {
+		channel := &MattermostChannel{}
+		if err := m.requestJSON("GET", fmt.Sprintf("/teams/name/%s/channels/name/%s", url.QueryEscape(join[:i]), url.QueryEscape(join[i+1:])), nil, channel); err != nil {
+			return err
+		}
+		channelID = channel.ID
+	}
+
+	m.RLock()
+	_, joined := m.channels[channelID]
+	m.RUnlock()
+	if joined {
+		return ErrAlreadyJoined
+	}
+
+	if err := m.requestJSON("POST", fmt.Sprintf("/channels/%s/members", url.QueryEscape(channelID)), map[string]string{"user_id": m.UserID()}, nil); err != nil {
+		return err
+	}
+	channel := &MattermostChannel{}
+	if err := m.requestJSON("GET", "/channels/"+url.QueryEscape(channelID), nil, channel); err != nil {
+		return err
+	}
+
+	m.Lock()
+	m.channels[channelID] = channel
+	m.Unlock()
+	return nil
+}
+
+// Typing sets that the bot is typing.
+func (m *Mattermost) Typing(channel string) error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	if m.ws == nil {
+		return errors.New("Not connected to Mattermost.")
+	}
+	m.seq++
+	return m.ws.WriteJSON(map[string]interface{}{
+		"seq":    m.seq,
+		"action": "user_typing",
+		"data":   map[string]string{"channel_id": channel},
+	})
+}
+
+// PrivateMessage will send a private message to a user.
+func (m *Mattermost) PrivateMessage(userID, message string) error {
+	m.RLock()
+	channelID := m.direct[userID]
+	m.RUnlock()
+
+	if channelID == "" {
+		channel := &MattermostChannel{}
+		if err := m.requestJSON("POST", "/channels/direct", []string{m.UserID(), userID}, channel); err != nil {
+			return err
+		}
+		channelID = channel.ID
+
+		m.Lock()
+		m.direct[userID] = channelID
+		m.channels[channelID] = channel
+		m.Unlock()
+	}
+
+	_, err := m.post(context.Background(), &MattermostPost{ChannelID: channelID, Message: message}, true)
+	return err
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (m *Mattermost) Outbox() *Outbox {
+	return m.outbox
+}
+
+// SupportsPrivateMessages returns whether the service supports private messages.
+func (m *Mattermost) SupportsPrivateMessages() bool {
+	return true
+}
+
+// SupportsMultiline returns whether the service supports multiline messages.
+func (m *Mattermost) SupportsMultiline() bool {
+	return true
+}
+
+// CommandPrefix returns the command prefix for the service.
+func (m *Mattermost) CommandPrefix() string {
+	return "!"
+}
+
+// IsBotOwner returns whether or not a message sender was the owner of the bot.
+func (m *Mattermost) IsBotOwner(message Message) bool {
+	return message.UserID() == m.OwnerUserID
+}
+
+// IsPrivate returns whether or not a message was sent in a direct message channel.
+func (m *Mattermost) IsPrivate(message Message) bool {
+	channel, err := m.channel(message.Channel())
+	if err != nil {
+		log.Printf("Error getting mattermost channel %s. %v", message.Channel(), err)
+		return false
+	}
+	return channel.Type == "D"
+}
+
+// hasRole returns whether a space separated list of roles contains a role.
+func hasRole(roles, role string) bool {
+	for _, r := range strings.Fields(roles) {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mattermostMember is a user's membership of a channel or team.
+type mattermostMember struct {
+	Roles       string `json:"roles"`
+	SchemeAdmin bool   `json:"scheme_admin"`
+}
+
+// isModerator looks up whether a user is a channel admin, a team admin of the channel's team or a system admin.
+func (m *Mattermost) isModerator(channelID, userID string) (bool, error) {
+	member := &mattermostMember{}
+	err := m.requestJSON("GET", fmt.Sprintf("/channels/%s/members/%s", url.QueryEscape(channelID), url.QueryEscape(userID)), nil, member)
+	if err != nil {
+		return false, err
+	}
+	if member.SchemeAdmin || hasRole(member.Roles, "channel_admin") {
+		return true, nil
+	}
+
+	channel, err := m.channel(channelID)
+	if err != nil {
+		return false, err
+	}
+	if channel.TeamID != "" {
+		member = &mattermostMember{}
+		err := m.requestJSON("GET", fmt.Sprintf("/teams/%s/members/%s", url.QueryEscape(channel.TeamID), url.QueryEscape(userID)), nil, member)
+		if err != nil {
+			return false, err
+		}
+		if member.SchemeAdmin || hasRole(member.Roles, "team_admin") {
+			return true, nil
+		}
+	}
+
+	user := &MattermostUser{}
+	if err := m.requestJSON("GET", "/users/"+url.QueryEscape(userID), nil, user); err != nil {
+		return false, err
+	}
+	return hasRole(user.Roles, "system_admin"), nil
+}
+
+// IsModerator returns whether or not the sender of a message is an admin of the channel or its team.
+func (m *Mattermost) IsModerator(message Message) bool {
+	key := message.Channel() + ":" + message.UserID()
+
+	m.RLock()
+	cached := m.moderators[key]
+	m.RUnlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.moderator
+	}
+
+	moderator, err := m.isModerator(message.Channel(), message.UserID())
+	if err != nil {
+		log.Printf("Error getting mattermost roles %s. %v", key, err)
+		return false
+	}
+
+	m.Lock()
+	m.moderators[key] = &mattermostModerator{moderator, time.Now().Add(mattermostRoleCacheTime)}
+	m.Unlock()
+
+	return moderator
+}
+
+// ChannelCount returns the number of channels the bot is in.
+func (m *Mattermost) ChannelCount() int {
+	m.RLock()
+	defer m.RUnlock()
+
+	return len(m.channels)
+}
+
+// SupportsMessageHistory returns if the service supports message history.
+func (m *Mattermost) SupportsMessageHistory() bool {
+	return true
+}
+
+// MessageHistory returns the message history for a channel, oldest first.
+func (m *Mattermost) MessageHistory(channel string) []Message {
+	posts := &struct {
+		Order []string                   `json:"order"`
+		Posts map[string]*MattermostPost `json:"posts"`
+	}{}
+	err := m.requestJSON("GET", fmt.Sprintf("/channels/%s/posts?per_page=%d", url.QueryEscape(channel), maxMattermostHistory), nil, posts)
+	if err != nil {
+		log.Printf("Error getting mattermost history %s. %v", channel, err)
+		return nil
+	}
+
+	messages := []Message{}
+	for i := len(posts.Order) - 1; i >= 0; i-- {
+		post := posts.Posts[posts.Order[i]]
+		if post == nil || strings.HasPrefix(post.Type, "system_") {
+			continue
+		}
+		messages = append(messages, &MattermostMessage{post, MessageTypeCreate, m.username(post.UserID)})
+	}
+	return messages
+}
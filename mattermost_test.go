@@ -0,0 +1,286 @@
+package comicjerk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// mattermostServer is a stub Mattermost server that sends queued websocket events and records posts.
+type mattermostServer struct {
+	sync.Mutex
+	events    chan string
+	posts     []*MattermostPost
+	uploads   map[string]string
+	rateLimit int
+}
+
+func newMattermostServer() *mattermostServer {
+	return &mattermostServer{events: make(chan string, 10), uploads: map[string]string{}}
+}
+
+func (s *mattermostServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v4")
+	switch {
+	case path == "/websocket":
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			select {
+			case event := <-s.events:
+				if err := ws.WriteMessage(websocket.TextMessage, []byte(event)); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	case path == "/users/me":
+		w.Write([]byte(`{"id":"bot","username":"comicjerk"}`))
+	case path == "/users/me/teams":
+		w.Write([]byte(`[{"id":"team"}]`))
+	case path == "/users/me/teams/team/channels":
+		w.Write([]byte(`[{"id":"town","team_id":"team","type":"O","name":"town-square"}]`))
+	case path == "/users/alice":
+		w.Write([]byte(`{"id":"alice","username":"alice","roles":"system_user"}`))
+	case path == "/users/bob":
+		w.Write([]byte(`{"id":"bob","username":"bob","roles":"system_user"}`))
+	case path == "/users/carol":
+		w.Write([]byte(`{"id":"carol","username":"carol","roles":"system_admin system_user"}`))
+	case path == "/channels/town/members/alice":
+		w.Write([]byte(`{"roles":"channel_user channel_admin"}`))
+	case strings.HasPrefix(path, "/channels/town/members/"):
+		w.Write([]byte(`{"roles":"channel_user"}`))
+	case strings.HasPrefix(path, "/teams/team/members/"):
+		w.Write([]byte(`{"roles":"team_user"}`))
+	case path == "/channels/town/posts":
+		// Posts are ordered newest first.
+		w.Write([]byte(`{"order":["3","2","1"],"posts":{
+			"1":{"id":"1","channel_id":"town","user_id":"alice","message":"first"},
+			"2":{"id":"2","channel_id":"town","user_id":"bob","message":"joined","type":"system_join_channel"},
+			"3":{"id":"3","channel_id":"town","user_id":"bob","message":"last"}
+		}}`))
+	case path == "/files" && r.Method == "POST":
+		file, header, err := r.FormFile("files")
+		if err != nil || r.FormValue("channel_id") != "town" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		s.Lock()
+		s.uploads["file1"] = header.Filename + ":" + string(data)
+		s.Unlock()
+		w.Write([]byte(`{"file_infos":[{"id":"file1"}]}`))
+	case path == "/posts" && r.Method == "POST":
+		s.Lock()
+		defer s.Unlock()
+		if s.rateLimit > 0 {
+			s.rateLimit--
+			w.Header().Set("X-Ratelimit-Reset", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"id":"api.context.rate_limit","message":"Too many requests"}`))
+			return
+		}
+		post := &MattermostPost{}
+		json.NewDecoder(r.Body).Decode(post)
+		s.posts = append(s.posts, post)
+		post.ID = "post" + strconv.Itoa(len(s.posts))
+		json.NewEncoder(w).Encode(post)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"id":"api.not_found","message":"Not found"}`))
+	}
+}
+
+// sentPosts returns the posts the service has made.
+func (s *mattermostServer) sentPosts() []*MattermostPost {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]*MattermostPost{}, s.posts...)
+}
+
+// mattermostEventJSON returns a websocket event for a post.
+func mattermostEventJSON(event string, post *MattermostPost) string {
+	data, _ := json.Marshal(post)
+	e, _ := json.Marshal(map[string]interface{}{
+		"event": event,
+		"data": map[string]string{
+			"post":         string(data),
+			"channel_type": "O",
+			"sender_name":  "@" + post.UserID,
+			"team_id":      "team",
+		},
+	})
+	return string(e)
+}
+
+func openMattermost(t *testing.T) (*Mattermost, <-chan Message, *mattermostServer, func()) {
+	stub := newMattermostServer()
+	server := httptest.NewServer(stub)
+
+	m := NewMattermost(server.URL, "token")
+	messages, err := m.Open()
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return m, messages, stub, func() {
+		m.Close()
+		server.Close()
+	}
+}
+
+func TestMattermostEvents(t *testing.T) {
+	m, messages, stub, closer := openMattermost(t)
+	defer closer()
+
+	post := &MattermostPost{ID: "p1", ChannelID: "town", UserID: "alice", Message: "hello"}
+	stub.events <- mattermostEventJSON("posted", post)
+	post.Message = "hello!"
+	stub.events <- mattermostEventJSON("post_edited", post)
+	stub.events <- mattermostEventJSON("post_deleted", post)
+	// System posts are not messages.
+	stub.events <- mattermostEventJSON("posted", &MattermostPost{ID: "p2", ChannelID: "town", UserID: "alice", Type: "system_join_channel"})
+
+	want := []struct {
+		messageType MessageType
+		text        string
+	}{
+		{MessageTypeCreate, "hello"},
+		{MessageTypeUpdate, "hello!"},
+		{MessageTypeDelete, "hello!"},
+	}
+	for _, w := range want {
+		select {
+		case message := <-messages:
+			if message.Type() != w.messageType || message.Message() != w.text || message.MessageID() != "p1" || message.Channel() != "town" || message.UserName() != "alice" {
+				t.Errorf("message = %s %q %s in %s from %s, want %s %q p1 in town from alice", message.Type(), message.Message(), message.MessageID(), message.Channel(), message.UserName(), w.messageType, w.text)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for the %s event", w.messageType)
+		}
+	}
+
+	select {
+	case message := <-messages:
+		t.Errorf("message = %q, want system posts to be skipped", message.Message())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if m.IsPrivate(&MattermostMessage{Post: post}) {
+		t.Error("a message in an open channel is private")
+	}
+}
+
+func TestMattermostSendFile(t *testing.T) {
+	m, _, stub, closer := openMattermost(t)
+	defer closer()
+
+	if err := m.SendFile("town", "chart.png", strings.NewReader("image")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is uploaded first, then posted as an attachment.
+	stub.Lock()
+	upload := stub.uploads["file1"]
+	stub.Unlock()
+	if upload != "chart.png:image" {
+		t.Errorf("upload = %q, want chart.png", upload)
+	}
+	posts := stub.sentPosts()
+	if len(posts) != 1 || posts[0].ChannelID != "town" || len(posts[0].FileIDs) != 1 || posts[0].FileIDs[0] != "file1" {
+		t.Errorf("posts = %v, want the file posted to town", posts)
+	}
+}
+
+func TestMattermostModerators(t *testing.T) {
+	m, _, _, closer := openMattermost(t)
+	defer closer()
+
+	// alice is a channel admin, carol a system admin, and bob neither.
+	for user, want := range map[string]bool{"alice": true, "bob": false, "carol": true} {
+		message := &MattermostMessage{Post: &MattermostPost{ChannelID: "town", UserID: user}}
+		if got := m.IsModerator(message); got != want {
+			t.Errorf("IsModerator %s = %v, want %v", user, got, want)
+		}
+	}
+}
+
+func TestMattermostHistory(t *testing.T) {
+	m, _, _, closer := openMattermost(t)
+	defer closer()
+
+	history := m.MessageHistory("town")
+	if len(history) != 2 || history[0].Message() != "first" || history[1].Message() != "last" || history[1].UserName() != "bob" {
+		t.Errorf("history = %v, want first then last, without the system post", history)
+	}
+}
+
+func TestMattermostRateLimit(t *testing.T) {
+	m, _, stub, closer := openMattermost(t)
+	defer closer()
+
+	stub.Lock()
+	stub.rateLimit = 1
+	stub.Unlock()
+
+	// The outbox waits for the rate limit to reset and sends the post again.
+	start := time.Now()
+	id, err := m.SendMessageID("town", "hello")
+	if err != nil || id == "" {
+		t.Fatalf("SendMessageID = %q, %v, want the post to be retried", id, err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("waited %v, want the second from X-Ratelimit-Reset", waited)
+	}
+	if posts := stub.sentPosts(); len(posts) != 1 || posts[0].Message != "hello" {
+		t.Errorf("posts = %v, want one hello", posts)
+	}
+}
+
+func TestMattermostEventClose(t *testing.T) {
+	server := httptest.NewServer(newMattermostServer())
+	defer server.Close()
+
+	m := NewMattermost(server.URL, "token")
+	// Nothing reads the messages, so the event blocks until the service is closed.
+	m.messageChan = make(chan Message)
+	event := &mattermostEvent{}
+	if err := json.Unmarshal([]byte(mattermostEventJSON("posted", &MattermostPost{ID: "p1", ChannelID: "town", UserID: "alice", Message: "hello"})), event); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.onEvent(event)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	m.Close()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("onEvent did not return after close")
+	}
+}
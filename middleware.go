@@ -0,0 +1,67 @@
+package comicjerk
+
+import "context"
+
+// Handler handles a message received on a service.
+type Handler func(ctx context.Context, service Service, message Message)
+
+// Middleware wraps a Handler, it is run for every message before any plugin sees it.
+// A middleware can drop a message by not calling next, rewrite it by calling next with a different Message,
+// or annotate it by calling next with a context created by context.WithValue. Annotations are visible to ContextPlugins.
+type Middleware func(next Handler) Handler
+
+// Use adds middlewares to the bot, they are run in the order they are added, after IgnoreSelf which every bot starts with.
+// Use must be called before Open.
+func (b *Bot) Use(middlewares ...Middleware) {
+	b.middlewares = append(b.middlewares, middlewares...)
+}
+
+// handler returns the dispatch handler wrapped in all the middlewares.
+func (b *Bot) handler() Handler {
+	h := Handler(b.dispatch)
+	for i := len(b.middlewares) - 1; i >= 0; i-- {
+		h = b.middlewares[i](h)
+	}
+	return h
+}
+
+// IgnoreSelf is a middleware that drops messages sent by the bot, NewBot installs it so plugins never see their own messages.
+func IgnoreSelf() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, service Service, message Message) {
+			if service.IsMe(message) {
+				return
+			}
+			next(ctx, service, message)
+		}
+	}
+}
+
+// IgnoreBots is a middleware that drops messages sent by bots, on services that can identify them.
+func IgnoreBots() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, service Service, message Message) {
+			if m, ok := message.(BotMessage); ok && m.IsBot() {
+				return
+			}
+			next(ctx, service, message)
+		}
+	}
+}
+
+// IgnoreUsers is a middleware that drops messages sent by any of the provided user ids.
+func IgnoreUsers(userIDs ...string) Middleware {
+	ignored := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		ignored[userID] = true
+	}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, service Service, message Message) {
+			if ignored[message.UserID()] {
+				return
+			}
+			next(ctx, service, message)
+		}
+	}
+}
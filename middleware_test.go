@@ -0,0 +1,106 @@
+package comicjerk
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// middlewareKey is the context key the annotating middleware in the tests uses.
+type middlewareKey struct{}
+
+// echoPlugin replies to every message it receives with the message and its annotation.
+type echoPlugin struct {
+	SimplePlugin
+	sync.Mutex
+	received []string
+}
+
+func (p *echoPlugin) MessageContext(ctx context.Context, bot *Bot, service Service, message Message) {
+	p.Lock()
+	p.received = append(p.received, message.Message())
+	p.Unlock()
+
+	annotation, _ := ctx.Value(middlewareKey{}).(string)
+	service.SendMessage(message.Channel(), strings.TrimSpace(message.Message()+" "+annotation))
+}
+
+func newMiddlewareBot(t *testing.T, middlewares ...Middleware) (*TestService, *echoPlugin, func()) {
+	bot, service, _, closer := newTestBot(t)
+	p := &echoPlugin{SimplePlugin: *NewSimplePlugin("echo")}
+	bot.RegisterPlugin(service, p)
+	bot.Use(middlewares...)
+	bot.Open()
+	return service, p, closer
+}
+
+func TestMiddlewareIgnore(t *testing.T) {
+	service, p, closer := newMiddlewareBot(t, IgnoreBots(), IgnoreUsers("mallory"))
+	defer closer()
+
+	// The bot's own messages, and messages from bots and ignored users, never reach the plugin.
+	service.Inject(&TestMessage{ChannelID: "#channel", Author: "comicjerk", Content: "from the bot"})
+	service.Inject(&TestMessage{ChannelID: "#channel", Author: "robot", Content: "from a bot", Bot: true})
+	service.Inject(&TestMessage{ChannelID: "#channel", Author: "mallory", Content: "from mallory"})
+	if got := send(service, "bob", "from bob"); got != "from bob" {
+		t.Errorf("reply = %q, want from bob", got)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if len(p.received) != 1 {
+		t.Errorf("received %q, want only the message from bob", p.received)
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	order := []string{}
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, service Service, message Message) {
+				order = append(order, name)
+				next(ctx, service, message)
+			}
+		}
+	}
+	drop := func(next Handler) Handler {
+		return func(ctx context.Context, service Service, message Message) {
+			if message.Message() != "secret" {
+				next(ctx, service, message)
+			}
+		}
+	}
+	rewrite := func(next Handler) Handler {
+		return func(ctx context.Context, service Service, message Message) {
+			m := *message.(*TestMessage)
+			m.Content = strings.Replace(m.Content, "colour", "color", -1)
+			next(ctx, service, &m)
+		}
+	}
+	annotate := func(next Handler) Handler {
+		return func(ctx context.Context, service Service, message Message) {
+			next(context.WithValue(ctx, middlewareKey{}, "annotated"), service, message)
+		}
+	}
+
+	service, p, closer := newMiddlewareBot(t, record("first"), drop, rewrite, annotate, record("last"))
+	defer closer()
+
+	service.InjectString("#channel", "bob", "secret")
+	// Rewritten content and annotations reach the plugin.
+	if got := send(service, "bob", "what colour"); got != "what color annotated" {
+		t.Errorf("reply = %q, want the rewritten and annotated message", got)
+	}
+
+	p.Lock()
+	if len(p.received) != 1 {
+		t.Errorf("received %q, want the dropped message to never reach the plugin", p.received)
+	}
+	p.Unlock()
+
+	// Middlewares run in the order they were added, and the dropped message stopped after the first.
+	if strings.Join(order, " ") != "first first last" {
+		t.Errorf("order = %v, want first first last", order)
+	}
+}
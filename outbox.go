@@ -0,0 +1,225 @@
+package comicjerk
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrOutboxFull is returned when a message is dropped because too many messages are already queued.
+var ErrOutboxFull = errors.New("Outgoing message queue is full.")
+
+// ErrOutboxClosed is returned when a message is sent after the outbox has been closed.
+var ErrOutboxClosed = errors.New("Outgoing message queue is closed.")
+
+// maxOutboxRetries is the number of times a message is retried after a rate limit response.
+const maxOutboxRetries = 3
+
+// OutboxService is an optional interface for services that queue their outgoing messages.
+type OutboxService interface {
+	Outbox() *Outbox
+}
+
+type outgoing struct {
+	ctx    context.Context
+	send   func() error
+	result chan error
+}
+
+// Outbox is a rate limited queue of outgoing messages for a service.
+// Up to Burst messages are sent immediately, after which one message is sent every Interval.
+// Private messages are sent before channel messages.
+type Outbox struct {
+	sync.Mutex
+
+	Burst    int
+	Interval time.Duration
+	// RetryAfter detects rate limit errors returned by the service.
+	// If it returns true, the outbox pauses for the returned duration and retries the message.
+	RetryAfter func(error) (time.Duration, bool)
+
+	private chan *outgoing
+	public  chan *outgoing
+	closing chan struct{}
+	once    sync.Once
+
+	tokens  float64
+	last    time.Time
+	paused  time.Time
+	dropped int
+}
+
+// NewOutbox creates and starts a new outbox that can queue up to size messages.
+func NewOutbox(burst int, interval time.Duration, size int) *Outbox {
+	o := &Outbox{
+		Burst:    burst,
+		Interval: interval,
+		private:  make(chan *outgoing, size),
+		public:   make(chan *outgoing, size),
+		closing:  make(chan struct{}),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+	go o.run()
+	return o
+}
+
+// Send queues a send function and blocks until it has been called, returning its error.
+// If the queue is full, ErrOutboxFull is returned immediately.
+func (o *Outbox) Send(private bool, send func() error) error {
+	return o.SendContext(context.Background(), private, send)
+}
+
+// SendContext is like Send, but stops waiting when the context is done and returns its error.
+// A message whose context is done before it reaches the front of the queue is never sent.
+func (o *Outbox) SendContext(ctx context.Context, private bool, send func() error) error {
+	m := &outgoing{
+		ctx:    ctx,
+		send:   send,
+		result: make(chan error, 1),
+	}
+
+	queue := o.public
+	if private {
+		queue = o.private
+	}
+
+	select {
+	case <-o.closing:
+		return ErrOutboxClosed
+	case queue <- m:
+	default:
+		o.Lock()
+		o.dropped++
+		o.Unlock()
+		log.Println("Dropping outgoing message, queue is full.")
+		return ErrOutboxFull
+	}
+
+	select {
+	case err := <-m.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-o.closing:
+		return ErrOutboxClosed
+	}
+}
+
+// Backoff pauses sending for a duration, services should call this when they are told they are being rate limited.
+func (o *Outbox) Backoff(duration time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+
+	if until := time.Now().Add(duration); until.After(o.paused) {
+		o.paused = until
+	}
+	o.tokens = 0
+}
+
+// Pending returns the number of messages waiting to be sent.
+func (o *Outbox) Pending() int {
+	return len(o.private) + len(o.public)
+}
+
+// Dropped returns the number of messages that were dropped because the queue was full.
+func (o *Outbox) Dropped() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.dropped
+}
+
+// Close stops sending messages, any queued messages are discarded.
+func (o *Outbox) Close() {
+	o.once.Do(func() {
+		close(o.closing)
+	})
+}
+
+// delay takes a token, and returns how long to wait before sending.
+func (o *Outbox) delay() time.Duration {
+	o.Lock()
+	defer o.Unlock()
+
+	now := time.Now()
+	if o.Interval > 0 {
+		o.tokens += float64(now.Sub(o.last)) / float64(o.Interval)
+		if burst := float64(o.Burst); o.tokens > burst {
+			o.tokens = burst
+		}
+	}
+	o.last = now
+
+	var wait time.Duration
+	if o.tokens < 1 {
+		wait = time.Duration((1 - o.tokens) * float64(o.Interval))
+	}
+	if paused := o.paused.Sub(now); paused > wait {
+		wait = paused
+	}
+	o.tokens--
+	return wait
+}
+
+// wait blocks until the next message can be sent.
+// It returns ErrOutboxClosed if the outbox closed while waiting, or the context's error if the message was abandoned.
+func (o *Outbox) wait(ctx context.Context) error {
+	if d := o.delay(); d > 0 {
+		select {
+		case <-o.closing:
+			return ErrOutboxClosed
+		case <-ctx.Done():
+			// The message is not sent, so it gives its token back.
+			o.Lock()
+			o.tokens++
+			o.Unlock()
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) run() {
+	for {
+		var m *outgoing
+		select {
+		case m = <-o.private:
+		default:
+			select {
+			case <-o.closing:
+				return
+			case m = <-o.private:
+			case m = <-o.public:
+			}
+		}
+
+		// Nobody is waiting for messages whose context is done, so they don't use up the rate limit.
+		if err := m.ctx.Err(); err != nil {
+			m.result <- err
+			continue
+		}
+
+		for retry := 0; ; retry++ {
+			if err := o.wait(m.ctx); err == ErrOutboxClosed {
+				return
+			} else if err != nil {
+				m.result <- err
+				break
+			}
+
+			err := m.send()
+			if o.RetryAfter != nil && retry < maxOutboxRetries {
+				if d, ok := o.RetryAfter(err); ok {
+					o.Backoff(d)
+					continue
+				}
+			}
+			m.result <- err
+			break
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package comicjerk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOutboxSendContext(t *testing.T) {
+	o := NewOutbox(1, time.Hour, 10)
+	defer o.Close()
+
+	if err := o.Send(false, func() error { return nil }); err != nil {
+		t.Fatalf("Send = %v, want nil", err)
+	}
+
+	// The outbox is out of tokens, so the next message waits until the context is done.
+	sent := false
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := o.SendContext(ctx, false, func() error {
+		sent = true
+		return nil
+	}); err != context.DeadlineExceeded {
+		t.Errorf("SendContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A message whose context is done is never sent, even once the outbox has a token.
+	o.Lock()
+	o.tokens = 1
+	o.Unlock()
+	if err := o.Send(false, func() error { return nil }); err != nil {
+		t.Errorf("Send = %v, want nil", err)
+	}
+	if sent {
+		t.Error("cancelled message was sent")
+	}
+}
@@ -0,0 +1,180 @@
+package comicjerk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Permission is the permission required to run a command.
+// Any value other than the predefined permissions is a named role, which can be granted to users per channel.
+type Permission string
+
+const (
+	// PermissionEveryone allows anyone to run a command.
+	PermissionEveryone Permission = ""
+	// PermissionModerator allows moderators, and users granted the moderator role, to run a command.
+	PermissionModerator Permission = "moderator"
+	// PermissionOwner allows only the bot owner to run a command.
+	PermissionOwner Permission = "owner"
+)
+
+// PermissionsPluginName is the name the permission registry is stored under in Bot.Data.
+const PermissionsPluginName = "Permissions"
+
+func rolesKey(channel, userID string) string {
+	return "roles:" + channel + ":" + userID
+}
+
+// Roles returns the roles granted to a user in a channel.
+func (b *Bot) Roles(service Service, channel, userID string) []string {
+	roles := []string{}
+	b.Data(service, PermissionsPluginName).Get(rolesKey(channel, userID), &roles)
+	return roles
+}
+
+// GrantRole grants a role to a user in a channel.
+func (b *Bot) GrantRole(service Service, channel, userID string, role Permission) error {
+	if role == PermissionEveryone || role == PermissionOwner {
+		return fmt.Errorf("The %s role can not be granted.", role)
+	}
+
+	b.rolesMutex.Lock()
+	defer b.rolesMutex.Unlock()
+
+	roles := b.Roles(service, channel, userID)
+	for _, r := range roles {
+		if r == string(role) {
+			return nil
+		}
+	}
+	roles = append(roles, string(role))
+	sort.Strings(roles)
+	return b.Data(service, PermissionsPluginName).Set(rolesKey(channel, userID), roles)
+}
+
+// RevokeRole revokes a role from a user in a channel, and returns whether the user had the role.
+func (b *Bot) RevokeRole(service Service, channel, userID string, role Permission) (bool, error) {
+	b.rolesMutex.Lock()
+	defer b.rolesMutex.Unlock()
+
+	roles := b.Roles(service, channel, userID)
+	for i, r := range roles {
+		if r == string(role) {
+			roles = append(roles[:i], roles[i+1:]...)
+			data := b.Data(service, PermissionsPluginName)
+			if len(roles) == 0 {
+				data.Delete(rolesKey(channel, userID))
+				return true, nil
+			}
+			return true, data.Set(rolesKey(channel, userID), roles)
+		}
+	}
+	return false, nil
+}
+
+// HasRole returns whether the sender of a message has been granted a role in the channel of the message.
+func (b *Bot) HasRole(service Service, message Message, role Permission) bool {
+	for _, r := range b.Roles(service, message.Channel(), message.UserID()) {
+		if r == string(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission returns whether the sender of a message has a permission.
+// The bot owner has every permission, and moderators have every permission except owner.
+func (b *Bot) HasPermission(service Service, message Message, permission Permission) bool {
+	if permission == PermissionEveryone || service.IsBotOwner(message) {
+		return true
+	}
+	if permission == PermissionOwner {
+		return false
+	}
+	if service.IsModerator(message) || b.HasRole(service, message, PermissionModerator) {
+		return true
+	}
+	return b.HasRole(service, message, permission)
+}
+
+// PermissionDeniedMessage returns the reply sent when the sender of a message is not allowed to run a command.
+func PermissionDeniedMessage(service Service, message Message) string {
+	return fmt.Sprintf("Sorry %s, you do not have permission to use that command.", message.UserName())
+}
+
+// RoleArgs are the arguments for the grant and revoke commands.
+var RoleArgs = &ArgSpec{
+	Args: []*Arg{
+		{Name: "user", Type: ArgUser},
+		{Name: "role", Type: ArgString},
+	},
+}
+
+// GrantCommand is a command for granting a role to a user in the current channel.
+func GrantCommand(bot *Bot, service Service, message Message, args *Args) {
+	user, role := args.User("user"), Permission(strings.ToLower(args.String("role")))
+
+	if role == PermissionModerator && !service.IsBotOwner(message) {
+		service.SendMessage(message.Channel(), PermissionDeniedMessage(service, message))
+		return
+	}
+
+	if err := bot.GrantRole(service, message.Channel(), user, role); err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	service.SendMessage(message.Channel(), fmt.Sprintf("Granted %s to %s.", role, UserMention(service, user)))
+}
+
+// GrantHelp is the help text for the grant command.
+const GrantHelp = "Grants a role to a user in this channel."
+
+// RevokeCommand is a command for revoking a role from a user in the current channel.
+func RevokeCommand(bot *Bot, service Service, message Message, args *Args) {
+	user, role := args.User("user"), Permission(strings.ToLower(args.String("role")))
+
+	if role == PermissionModerator && !service.IsBotOwner(message) {
+		service.SendMessage(message.Channel(), PermissionDeniedMessage(service, message))
+		return
+	}
+
+	revoked, err := bot.RevokeRole(service, message.Channel(), user, role)
+	if err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	if !revoked {
+		service.SendMessage(message.Channel(), fmt.Sprintf("%s does not have the %s role.", UserMention(service, user), role))
+		return
+	}
+	service.SendMessage(message.Channel(), fmt.Sprintf("Revoked %s from %s.", role, UserMention(service, user)))
+}
+
+// RevokeHelp is the help text for the revoke command.
+const RevokeHelp = "Revokes a role from a user in this channel."
+
+// RolesArgs are the arguments for the roles command.
+var RolesArgs = &ArgSpec{
+	Args: []*Arg{
+		{Name: "user", Type: ArgUser, Optional: true},
+	},
+}
+
+// RolesCommand is a command that lists the roles of a user in the current channel.
+func RolesCommand(bot *Bot, service Service, message Message, args *Args) {
+	user := message.UserID()
+	if args.Has("user") {
+		user = args.User("user")
+	}
+
+	roles := bot.Roles(service, message.Channel(), user)
+	if len(roles) == 0 {
+		service.SendMessage(message.Channel(), fmt.Sprintf("%s has no roles in this channel.", UserMention(service, user)))
+		return
+	}
+	service.SendMessage(message.Channel(), fmt.Sprintf("%s has the roles: %s", UserMention(service, user), strings.Join(roles, ", ")))
+}
+
+// RolesHelp is the help text for the roles command.
+const RolesHelp = "Lists the roles of a user in this channel."
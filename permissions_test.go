@@ -0,0 +1,34 @@
+package comicjerk
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestGrantRoleConcurrent(t *testing.T) {
+	bot := NewBot()
+	service := NewTestService()
+	bot.RegisterService(service)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bot.GrantRole(service, "#channel", "bob", Permission(fmt.Sprintf("role%02d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	if roles := bot.Roles(service, "#channel", "bob"); len(roles) != 20 {
+		t.Errorf("roles = %v, want 20 roles", roles)
+	}
+
+	if ok, err := bot.RevokeRole(service, "#channel", "bob", "role00"); !ok || err != nil {
+		t.Errorf("RevokeRole = %v, %v, want true, nil", ok, err)
+	}
+	if roles := bot.Roles(service, "#channel", "bob"); len(roles) != 19 {
+		t.Errorf("roles = %v, want 19 roles", roles)
+	}
+}
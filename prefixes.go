@@ -0,0 +1,337 @@
+package comicjerk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PrefixesPluginName is the name channel command prefixes are stored under in Bot.Data.
+const PrefixesPluginName = "Prefixes"
+
+// maxPrefixes is the number of custom prefixes a channel can have.
+const maxPrefixes = 5
+
+// maxPrefixLength is the longest custom prefix allowed.
+const maxPrefixLength = 10
+
+// ChannelPrefixes are the custom command prefixes of a channel.
+type ChannelPrefixes struct {
+	Prefixes []string
+	// Replace disables the service's default prefix in the channel.
+	// Mention prefixes, such as on Discord and Slack, always work.
+	Replace bool
+}
+
+func prefixesKey(channel string) string {
+	return "prefixes:" + channel
+}
+
+// copy returns a copy of the prefixes, so that the cached prefixes can not be changed by callers.
+func (p *ChannelPrefixes) copy() *ChannelPrefixes {
+	if p == nil {
+		return nil
+	}
+	return &ChannelPrefixes{Prefixes: append([]string{}, p.Prefixes...), Replace: p.Replace}
+}
+
+// ChannelPrefixes returns the custom command prefixes of a channel, or nil if the channel uses the service's default prefix.
+// They are looked up for every message, so they are parsed once and cached until they are set.
+func (b *Bot) ChannelPrefixes(service Service, channel string) *ChannelPrefixes {
+	b.prefixMutex.Lock()
+	defer b.prefixMutex.Unlock()
+
+	key := service.Name() + "/" + channel
+	p, ok := b.prefixes[key]
+	if !ok {
+		p = &ChannelPrefixes{}
+		if !b.Data(service, PrefixesPluginName).Get(prefixesKey(channel), p) || len(p.Prefixes) == 0 {
+			p = nil
+		}
+		b.prefixes[key] = p
+	}
+	return p.copy()
+}
+
+// SetChannelPrefixes sets the custom command prefixes of a channel, passing nil restores the service's default prefix.
+func (b *Bot) SetChannelPrefixes(service Service, channel string, prefixes *ChannelPrefixes) error {
+	b.prefixMutex.Lock()
+	defer b.prefixMutex.Unlock()
+
+	key := service.Name() + "/" + channel
+	data := b.Data(service, PrefixesPluginName)
+	if prefixes == nil || len(prefixes.Prefixes) == 0 {
+		data.Delete(prefixesKey(channel))
+		b.prefixes[key] = nil
+		return nil
+	}
+	if err := data.Set(prefixesKey(channel), prefixes); err != nil {
+		return err
+	}
+	b.prefixes[key] = prefixes.copy()
+	return nil
+}
+
+// isMentionPrefix returns whether the default prefix of a service is a mention of the bot.
+func isMentionPrefix(service Service) bool {
+	switch service.Name() {
+	case DiscordServiceName, SlackServiceName:
+		return true
+	}
+	return false
+}
+
+// channelMessage is a message in a channel with custom prefixes or aliases.
+type channelMessage struct {
+	message  Message
+	prefixes []string
+	// content and raw replace the content of the message when an alias was used.
+	aliased      bool
+	content, raw string
+}
+
+// Channel returns the channel id for this message.
+func (m *channelMessage) Channel() string {
+	return m.message.Channel()
+}
+
+// UserName returns the user name for this message.
+func (m *channelMessage) UserName() string {
+	return m.message.UserName()
+}
+
+// UserID returns the user id for this message.
+func (m *channelMessage) UserID() string {
+	return m.message.UserID()
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *channelMessage) UserAvatar() string {
+	return m.message.UserAvatar()
+}
+
+// Message returns the message content for this message.
+func (m *channelMessage) Message() string {
+	if m.aliased {
+		return m.content
+	}
+	return m.message.Message()
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *channelMessage) RawMessage() string {
+	if m.aliased {
+		return m.raw
+	}
+	return m.message.RawMessage()
+}
+
+// MessageID returns the message ID for this message.
+func (m *channelMessage) MessageID() string {
+	return m.message.MessageID()
+}
+
+// Type returns the type of message.
+func (m *channelMessage) Type() MessageType {
+	return m.message.Type()
+}
+
+// IsBot returns whether the message was sent by a bot, if the service can tell.
+func (m *channelMessage) IsBot() bool {
+	b, ok := m.message.(BotMessage)
+	return ok && b.IsBot()
+}
+
+// UnwrapMessage returns the message a message from dispatch wraps, such as one with the custom prefixes of its channel,
+// so that services and plugins can read their own message type.
+func UnwrapMessage(message Message) Message {
+	if m, ok := message.(*channelMessage); ok {
+		return m.message
+	}
+	return message
+}
+
+// prefixMessage wraps a message with the command prefixes of its channel, if the channel has custom prefixes.
+func (b *Bot) prefixMessage(service Service, message Message) Message {
+	p := b.ChannelPrefixes(service, message.Channel())
+	if p == nil {
+		return message
+	}
+
+	prefixes := p.Prefixes
+	if !p.Replace || isMentionPrefix(service) {
+		prefixes = append(prefixes, service.CommandPrefix())
+	}
+	return &channelMessage{message: message, prefixes: prefixes}
+}
+
+// CommandPrefixes returns the prefixes commands can be used with in the channel of a message, the first is the preferred prefix.
+func CommandPrefixes(service Service, message Message) []string {
+	if m, ok := message.(*channelMessage); ok && m.prefixes != nil {
+		return m.prefixes
+	}
+	return []string{service.CommandPrefix()}
+}
+
+// CommandPrefix returns the preferred command prefix in the channel of a message.
+func CommandPrefix(service Service, message Message) string {
+	return CommandPrefixes(service, message)[0]
+}
+
+// trimPrefix removes the longest matching prefix from a message, ignoring case.
+func trimPrefix(prefixes []string, message string) (string, bool) {
+	lowerMessage := strings.ToLower(message)
+
+	longest := -1
+	for _, prefix := range prefixes {
+		if len(prefix) > longest && strings.HasPrefix(lowerMessage, strings.ToLower(prefix)) {
+			longest = len(prefix)
+		}
+	}
+	if longest == -1 {
+		return message, false
+	}
+	return message[longest:], true
+}
+
+// prefixService is a service whose command prefix is the preferred prefix of a channel, so that help shows the active prefix.
+type prefixService struct {
+	Service
+	prefix string
+}
+
+// CommandPrefix returns the command prefix for the channel.
+func (s *prefixService) CommandPrefix() string {
+	return s.prefix
+}
+
+// withPrefix returns a service that uses the preferred command prefix for the channel of a message.
+func withPrefix(service Service, message Message) Service {
+	if prefix := CommandPrefix(service, message); prefix != service.CommandPrefix() {
+		return &prefixService{service, prefix}
+	}
+	return service
+}
+
+// validatePrefix returns an error if a prefix can not be used.
+func validatePrefix(prefix string) error {
+	if strings.TrimSpace(prefix) == "" {
+		return errors.New("A prefix can not be empty.")
+	}
+	if len(prefix) > maxPrefixLength {
+		return fmt.Errorf("A prefix can be at most %d characters.", maxPrefixLength)
+	}
+	if strings.TrimLeft(prefix, " \t") != prefix {
+		return errors.New("A prefix can not start with a space.")
+	}
+	return nil
+}
+
+// prefixList returns a quoted list of prefixes, so that trailing spaces are visible.
+func prefixList(prefixes []string) string {
+	quoted := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		quoted[i] = fmt.Sprintf("%q", prefix)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// PrefixArgs are the arguments for the prefix commands.
+var PrefixArgs = &ArgSpec{
+	Args: []*Arg{
+		{Name: "prefix", Type: ArgString},
+	},
+}
+
+// PrefixAddCommand is a command for adding a command prefix to the current channel.
+func PrefixAddCommand(bot *Bot, service Service, message Message, args *Args) {
+	prefix := args.String("prefix")
+	if err := validatePrefix(prefix); err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+
+	p := bot.ChannelPrefixes(service, message.Channel())
+	if p == nil {
+		p = &ChannelPrefixes{}
+	}
+	for _, existing := range p.Prefixes {
+		if strings.EqualFold(existing, prefix) {
+			service.SendMessage(message.Channel(), fmt.Sprintf("%q is already a prefix in this channel.", prefix))
+			return
+		}
+	}
+	if len(p.Prefixes) >= maxPrefixes {
+		service.SendMessage(message.Channel(), fmt.Sprintf("A channel can have at most %d prefixes.", maxPrefixes))
+		return
+	}
+
+	p.Prefixes = append(p.Prefixes, prefix)
+	if err := bot.SetChannelPrefixes(service, message.Channel(), p); err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	service.SendMessage(message.Channel(), fmt.Sprintf("Added prefix %q.", prefix))
+}
+
+// PrefixAddHelp is the help text for the prefix add command.
+const PrefixAddHelp = "Adds a command prefix in this channel, quote prefixes that end in a space."
+
+// PrefixSetCommand is a command for replacing the command prefixes of the current channel.
+func PrefixSetCommand(bot *Bot, service Service, message Message, args *Args) {
+	prefix := args.String("prefix")
+	if err := validatePrefix(prefix); err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+
+	if err := bot.SetChannelPrefixes(service, message.Channel(), &ChannelPrefixes{Prefixes: []string{prefix}, Replace: true}); err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	service.SendMessage(message.Channel(), fmt.Sprintf("The command prefix in this channel is now %q.", prefix))
+}
+
+// PrefixSetHelp is the help text for the prefix set command.
+const PrefixSetHelp = "Replaces the command prefixes in this channel."
+
+// PrefixRemoveCommand is a command for removing a command prefix from the current channel.
+func PrefixRemoveCommand(bot *Bot, service Service, message Message, args *Args) {
+	prefix := args.String("prefix")
+
+	p := bot.ChannelPrefixes(service, message.Channel())
+	if p != nil {
+		for i, existing := range p.Prefixes {
+			if strings.EqualFold(existing, prefix) {
+				p.Prefixes = append(p.Prefixes[:i], p.Prefixes[i+1:]...)
+				if err := bot.SetChannelPrefixes(service, message.Channel(), p); err != nil {
+					service.SendMessage(message.Channel(), err.Error())
+					return
+				}
+				service.SendMessage(message.Channel(), fmt.Sprintf("Removed prefix %q.", prefix))
+				return
+			}
+		}
+	}
+	service.SendMessage(message.Channel(), fmt.Sprintf("%q is not a prefix in this channel.", prefix))
+}
+
+// PrefixRemoveHelp is the help text for the prefix remove command.
+const PrefixRemoveHelp = "Removes a command prefix from this channel."
+
+// PrefixResetCommand is a command for restoring the default command prefix of the current channel.
+func PrefixResetCommand(bot *Bot, service Service, message Message, args string, parts []string) {
+	bot.SetChannelPrefixes(service, message.Channel(), nil)
+	service.SendMessage(message.Channel(), fmt.Sprintf("The command prefix in this channel is now %q.", service.CommandPrefix()))
+}
+
+// PrefixResetHelp is the help for the prefix reset command.
+var PrefixResetHelp = NewCommandHelp("", "Restores the default command prefix in this channel.")
+
+// PrefixListCommand is a command that lists the command prefixes of the current channel.
+func PrefixListCommand(bot *Bot, service Service, message Message, args string, parts []string) {
+	service.SendMessage(message.Channel(), fmt.Sprintf("Commands in this channel can be used with: %s", prefixList(CommandPrefixes(service, message))))
+}
+
+// PrefixListHelp is the help for the prefix list command.
+var PrefixListHelp = NewCommandHelp("", "Lists the command prefixes in this channel.")
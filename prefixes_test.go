@@ -0,0 +1,39 @@
+package comicjerk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChannelPrefixes(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {
+		service.SendMessage(message.Channel(), "pong")
+	}, NewCommandHelp("", "Replies with pong."))
+	bot.RegisterPlugin(service, NewHelpPlugin())
+	bot.Open()
+
+	if err := bot.SetChannelPrefixes(service, "#channel", &ChannelPrefixes{Prefixes: []string{"?"}, Replace: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the returned prefixes does not change the channel's prefixes.
+	bot.ChannelPrefixes(service, "#channel").Prefixes[0] = "$"
+
+	if got := send(service, "bob", "?ping"); got != "pong" {
+		t.Errorf("?ping = %q, want pong", got)
+	}
+	if got := send(service, "bob", "!ping"); got != "" {
+		t.Errorf("!ping = %q, want no reply after the prefix was replaced", got)
+	}
+	if got := send(service, "bob", "?help"); !strings.Contains(got, "?ping - Replies with pong.") {
+		t.Errorf("help = %q, want it to use the channel prefix", got)
+	}
+
+	bot.SetChannelPrefixes(service, "#channel", nil)
+	if got := send(service, "bob", "!ping"); got != "pong" {
+		t.Errorf("!ping = %q, want pong after the prefix was reset", got)
+	}
+}
@@ -0,0 +1,154 @@
+package comicjerk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit on a command, allowing Burst uses that are refilled one every Interval.
+type RateLimit struct {
+	Burst    int
+	Interval time.Duration
+	// PerChannel limits all users in a channel together, rather than each user separately.
+	PerChannel bool
+	// Silent drops rate limited messages without a reply.
+	Silent bool
+	// Message is the reply sent when rate limited, it is formatted with the user name and the time until the next use.
+	// If empty, a default message is used.
+	Message string
+}
+
+// NewCooldown creates a rate limit that allows each user to use a command once every interval.
+func NewCooldown(interval time.Duration) *RateLimit {
+	return &RateLimit{Burst: 1, Interval: interval}
+}
+
+// NewChannelCooldown creates a rate limit that allows a command to be used once every interval in a channel.
+func NewChannelCooldown(interval time.Duration) *RateLimit {
+	return &RateLimit{Burst: 1, Interval: interval, PerChannel: true}
+}
+
+const defaultRateLimitMessage = "Sorry %s, you're doing that too much. Try again in %s."
+
+// rateLimitPruneInterval is how often full buckets are removed.
+const rateLimitPruneInterval = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets   map[string]*bucket
+	hits      map[string]int
+	lastPrune time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:   make(map[string]*bucket),
+		hits:      make(map[string]int),
+		lastPrune: time.Now(),
+	}
+}
+
+// refill returns the bucket for key, topped up with the tokens earned since it was last used.
+func (r *rateLimiter) refill(key string, limit *RateLimit, now time.Time) *bucket {
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limitBurst(limit), last: now}
+		r.buckets[key] = b
+	}
+
+	if limit.Interval > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(limit.Interval)
+		if burst := limitBurst(limit); b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	return b
+}
+
+func limitBurst(limit *RateLimit) float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
+
+// take removes a token from the bucket of every key, each key is limited by the limit at the same index.
+// Tokens are only taken if every bucket has one, otherwise it returns the first limit that was hit and how long until its next token.
+func (r *rateLimiter) take(service string, keys []string, limits []*RateLimit) (*RateLimit, time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastPrune) > rateLimitPruneInterval {
+		for k, b := range r.buckets {
+			if now.After(b.full) {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastPrune = now
+	}
+
+	buckets := make([]*bucket, len(keys))
+	for i, key := range keys {
+		buckets[i] = r.refill(key, limits[i], now)
+		if buckets[i].tokens < 1 {
+			r.hits[service]++
+			return limits[i], time.Duration((1 - buckets[i].tokens) * float64(limits[i].Interval))
+		}
+	}
+
+	for i, b := range buckets {
+		b.tokens--
+		b.full = now.Add(time.Duration((limitBurst(limits[i]) - b.tokens) * float64(limits[i].Interval)))
+	}
+	return nil, 0
+}
+
+// CheckRateLimit returns whether the sender of a message may use a command, under all the provided limits.
+// A use is only counted against the limits if none of them are hit.
+// If a limit is hit, a reply is sent unless the limit is silent, and the hit is counted in RateLimitHits.
+// The bot owner is never rate limited.
+func (b *Bot) CheckRateLimit(service Service, message Message, command string, limits ...*RateLimit) bool {
+	if len(limits) == 0 || service.IsBotOwner(message) {
+		return true
+	}
+
+	keys := make([]string, len(limits))
+	for i, limit := range limits {
+		// Each limit has its own bucket, so a command can have both a user and a channel limit.
+		keys[i] = fmt.Sprintf("%s:%s:%s:%d", service.Name(), message.Channel(), command, i)
+		if !limit.PerChannel {
+			keys[i] += ":" + message.UserID()
+		}
+	}
+
+	limit, wait := b.rateLimiter.take(service.Name(), keys, limits)
+	if limit == nil {
+		return true
+	}
+
+	if !limit.Silent {
+		m := limit.Message
+		if m == "" {
+			m = defaultRateLimitMessage
+		}
+		service.SendMessage(message.Channel(), fmt.Sprintf(m, message.UserName(), wait/time.Second*time.Second+time.Second))
+	}
+	return false
+}
+
+// RateLimitHits returns the number of times a rate limit has been hit on a service.
+func (b *Bot) RateLimitHits(service Service) int {
+	b.rateLimiter.Lock()
+	defer b.rateLimiter.Unlock()
+
+	return b.rateLimiter.hits[service.Name()]
+}
@@ -0,0 +1,62 @@
+package comicjerk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckRateLimit(t *testing.T) {
+	bot := NewBot()
+	service := NewTestService()
+	message := &TestMessage{ChannelID: "#channel", Author: "bob"}
+
+	limit := &RateLimit{Burst: 2, Interval: time.Hour}
+	for i := 0; i < 2; i++ {
+		if !bot.CheckRateLimit(service, message, "cmd", limit) {
+			t.Fatalf("use %d was rate limited", i)
+		}
+	}
+	if bot.CheckRateLimit(service, message, "cmd", limit) {
+		t.Error("third use was not rate limited")
+	}
+	if calls := service.Calls("SendMessage"); len(calls) != 1 {
+		t.Errorf("replies = %v, want one", calls)
+	}
+	if hits := bot.RateLimitHits(service); hits != 1 {
+		t.Errorf("hits = %d, want 1", hits)
+	}
+
+	// Other users have their own bucket.
+	if !bot.CheckRateLimit(service, &TestMessage{ChannelID: "#channel", Author: "alice"}, "cmd", limit) {
+		t.Error("alice was rate limited")
+	}
+}
+
+func TestCheckRateLimitMultiple(t *testing.T) {
+	bot := NewBot()
+	service := NewTestService()
+	bob := &TestMessage{ChannelID: "#channel", Author: "bob"}
+	alice := &TestMessage{ChannelID: "#channel", Author: "alice"}
+
+	user := &RateLimit{Burst: 1, Interval: time.Hour, Silent: true}
+	channel := &RateLimit{Burst: 2, Interval: time.Hour, PerChannel: true, Silent: true}
+
+	if !bot.CheckRateLimit(service, bob, "cmd", user, channel) {
+		t.Fatal("first use was rate limited")
+	}
+
+	// Bob is limited by the user limit, which must not take a token from the channel limit.
+	for i := 0; i < 3; i++ {
+		if bot.CheckRateLimit(service, bob, "cmd", user, channel) {
+			t.Fatal("second use by bob was not rate limited")
+		}
+	}
+	if !bot.CheckRateLimit(service, alice, "cmd", user, channel) {
+		t.Error("alice was rate limited, the channel limit was charged for rejected uses")
+	}
+
+	// The channel limit is now empty.
+	if bot.CheckRateLimit(service, &TestMessage{ChannelID: "#channel", Author: "carol"}, "cmd", user, channel) {
+		t.Error("carol was not rate limited by the channel limit")
+	}
+}
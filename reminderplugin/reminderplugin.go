@@ -26,11 +26,16 @@ type Reminder struct {
 }
 
 // ReminderPlugin is a plugin that reminds users.
+// Its commands are the reminder command, and the reminder list, cancel and clear subcommands.
 type ReminderPlugin struct {
 	sync.RWMutex
+	*comicjerk.CommandPlugin
 	bot            *comicjerk.Bot
+	service        comicjerk.Service
 	Reminders      []*Reminder
 	TotalReminders int
+	closing        chan struct{}
+	closeOnce      sync.Once
 }
 
 var randomTimes = []string{
@@ -54,67 +59,101 @@ func (p *ReminderPlugin) random(list []string) string {
 	return list[rand.Intn(len(list))]
 }
 
-func (p *ReminderPlugin) randomReminder(service comicjerk.Service) string {
+func (p *ReminderPlugin) randomReminder(service comicjerk.Service, message comicjerk.Message) string {
 	ticks := ""
 	if service.Name() == comicjerk.DiscordServiceName {
 		ticks = "`"
 	}
 
-	return fmt.Sprintf("%s%sreminder %s %s%s", ticks, service.CommandPrefix(), p.random(randomTimes), p.random(randomMessages), ticks)
+	return fmt.Sprintf("%s%sreminder %s %s%s", ticks, comicjerk.CommandPrefix(service, message), p.random(randomTimes), p.random(randomMessages), ticks)
 }
 
+// Help returns the reminder commands, the detailed help also lists the subcommands and some examples.
 func (p *ReminderPlugin) Help(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, detailed bool) []string {
-	help := []string{
-		comicjerk.CommandHelp(service, "reminder", "<time> <reminder>", "Sets a reminder that is sent after the provided time.")[0],
-	}
-	if detailed {
-		help = append(help, []string{
-			"Examples: ",
-			p.randomReminder(service),
-			p.randomReminder(service),
-		}...)
+	if !detailed {
+		return p.CommandPlugin.Help(bot, service, message, false)
 	}
+
+	help := p.TopicHelp(bot, service, message, "reminder")
+	help = append(help, []string{
+		"Examples: ",
+		p.randomReminder(service, message),
+		p.randomReminder(service, message),
+	}...)
 	return help
 }
 
-func (p *ReminderPlugin) parseReminder(parts []string) (time.Time, string, error) {
-	if parts[0] == "tomorrow" {
-		return time.Now().Add(1 * time.Hour * 24), strings.Join(parts[1:], " "), nil
+var reminderArgs = &comicjerk.ArgSpec{
+	Args: []*comicjerk.Arg{
+		{Name: "time", Type: comicjerk.ArgString},
+		{Name: "reminder", Type: comicjerk.ArgRest},
+	},
+}
+
+var cancelArgs = &comicjerk.ArgSpec{
+	Args: []*comicjerk.Arg{
+		{Name: "number", Type: comicjerk.ArgInt},
+	},
+}
+
+// cutWord splits the first word from s.
+func cutWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t\n"); i != -1 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
+
+// parseReminder parses the time of a reminder, which may continue into the reminder text, eg. 10 minutes or next week.
+// It returns the time and the rest of the reminder text.
+func (p *ReminderPlugin) parseReminder(when, text string) (time.Time, string, error) {
+	when = strings.ToLower(when)
+	if when == "tomorrow" {
+		return time.Now().Add(1 * time.Hour * 24), text, nil
 	}
 
-	if parts[0] == "next" {
-		switch parts[1] {
+	unit, rest := cutWord(text)
+	unit = strings.ToLower(unit)
+
+	if when == "next" {
+		switch unit {
 		case "week":
-			return time.Now().Add(1 * time.Hour * 24 * 7), strings.Join(parts[2:], " "), nil
+			return time.Now().Add(1 * time.Hour * 24 * 7), rest, nil
 		case "month":
-			return time.Now().Add(1 * time.Hour * 24 * 7 * 4), strings.Join(parts[2:], " "), nil
+			return time.Now().Add(1 * time.Hour * 24 * 7 * 4), rest, nil
 		case "year":
-			return time.Now().Add(1 * time.Hour * 24 * 365), strings.Join(parts[2:], " "), nil
+			return time.Now().Add(1 * time.Hour * 24 * 365), rest, nil
 		default:
 			return time.Time{}, "", errors.New("Invalid next.")
 		}
 	}
 
-	i, err := strconv.Atoi(parts[0])
+	i, err := strconv.Atoi(when)
 	if err != nil {
-		return time.Time{}, "", err
+		// Durations such as 10m or 2h30m.
+		d, err := comicjerk.ParseDuration(when)
+		if err != nil {
+			return time.Time{}, "", err
+		}
+		return time.Now().Add(d), text, nil
 	}
 
 	switch {
-	case strings.HasPrefix(parts[1], "sec"):
-		return time.Now().Add(time.Duration(i) * time.Second), strings.Join(parts[2:], " "), nil
-	case strings.HasPrefix(parts[1], "min"):
-		return time.Now().Add(time.Duration(i) * time.Minute), strings.Join(parts[2:], " "), nil
-	case strings.HasPrefix(parts[1], "hour"):
-		return time.Now().Add(time.Duration(i) * time.Hour), strings.Join(parts[2:], " "), nil
-	case strings.HasPrefix(parts[1], "day"):
-		return time.Now().Add(time.Duration(i) * time.Hour * 24), strings.Join(parts[2:], " "), nil
-	case strings.HasPrefix(parts[1], "week"):
-		return time.Now().Add(time.Duration(i) * time.Hour * 24 * 7), strings.Join(parts[2:], " "), nil
-	case strings.HasPrefix(parts[1], "month"):
-		return time.Now().Add(time.Duration(i) * time.Hour * 24 * 7 * 4), strings.Join(parts[2:], " "), nil
-	case strings.HasPrefix(parts[1], "year"):
-		return time.Now().Add(time.Duration(i) * time.Hour * 24 * 365), strings.Join(parts[2:], " "), nil
+	case strings.HasPrefix(unit, "sec"):
+		return time.Now().Add(time.Duration(i) * time.Second), rest, nil
+	case strings.HasPrefix(unit, "min"):
+		return time.Now().Add(time.Duration(i) * time.Minute), rest, nil
+	case strings.HasPrefix(unit, "hour"):
+		return time.Now().Add(time.Duration(i) * time.Hour), rest, nil
+	case strings.HasPrefix(unit, "day"):
+		return time.Now().Add(time.Duration(i) * time.Hour * 24), rest, nil
+	case strings.HasPrefix(unit, "week"):
+		return time.Now().Add(time.Duration(i) * time.Hour * 24 * 7), rest, nil
+	case strings.HasPrefix(unit, "month"):
+		return time.Now().Add(time.Duration(i) * time.Hour * 24 * 7 * 4), rest, nil
+	case strings.HasPrefix(unit, "year"):
+		return time.Now().Add(time.Duration(i) * time.Hour * 24 * 365), rest, nil
 	}
 
 	return time.Time{}, "", errors.New("Invalid string.")
@@ -147,57 +186,147 @@ func (p *ReminderPlugin) AddReminder(reminder *Reminder) error {
 	copy(p.Reminders[i+1:], p.Reminders[i:])
 	p.Reminders[i] = reminder
 	p.TotalReminders++
+	p.save()
 
 	return nil
 }
 
-func (p *ReminderPlugin) Message(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) {
-	if !service.IsMe(message) {
-		if comicjerk.MatchesCommand(service, "remind", message) || comicjerk.MatchesCommand(service, "reminder", message) {
-			_, parts := comicjerk.ParseCommand(service, message)
+// save stores the reminders in the plugin's Data, the lock must be held.
+func (p *ReminderPlugin) save() {
+	if p.bot == nil {
+		return
+	}
 
-			if len(parts) < 2 {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Invalid reminder, no time or message. eg: %s", p.randomReminder(service)))
-				return
-			}
+	d := p.bot.Data(p.service, p.Name())
+	if err := d.Set("reminders", p.Reminders); err != nil {
+		log.Println("Error saving reminders", err)
+	}
+	d.Set("total", p.TotalReminders)
+}
+
+// requester returns how the sender of a message is named in their reminders.
+func (p *ReminderPlugin) requester(service comicjerk.Service, message comicjerk.Message) string {
+	if service.Name() == comicjerk.DiscordServiceName {
+		return fmt.Sprintf("<@%s>", message.UserID())
+	}
+	return message.UserName()
+}
 
-			t, r, err := p.parseReminder(parts)
+// requested returns the reminders set by a requester, in the order they will be sent.
+func (p *ReminderPlugin) requested(requester string) []*Reminder {
+	p.RLock()
+	defer p.RUnlock()
 
-			now := time.Now()
+	reminders := []*Reminder{}
+	for _, r := range p.Reminders {
+		if r.Requester == requester {
+			reminders = append(reminders, r)
+		}
+	}
+	return reminders
+}
 
-			if err != nil || t.Before(now) || t.After(now.Add(time.Hour*24*365+time.Hour)) {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Invalid time. eg: %s", strings.Join(randomTimes, ", ")))
-				return
-			}
+// remove removes reminders, and returns how many were removed.
+func (p *ReminderPlugin) remove(reminders ...*Reminder) int {
+	p.Lock()
+	defer p.Unlock()
 
-			if r == "" {
-				service.SendMessage(message.Channel(), fmt.Sprintf("Invalid reminder, no message. eg: %s", p.randomReminder(service)))
-				return
+	removed := 0
+	kept := p.Reminders[:0]
+	for _, r := range p.Reminders {
+		remove := false
+		for _, reminder := range reminders {
+			if r == reminder {
+				remove = true
+				break
 			}
+		}
+		if remove {
+			removed++
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	p.Reminders = kept
+	p.save()
+	return removed
+}
 
-			requester := message.UserName()
-			if service.Name() == comicjerk.DiscordServiceName {
-				requester = fmt.Sprintf("<@%s>", message.UserID())
-			}
+func (p *ReminderPlugin) addCommand(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, args *comicjerk.Args) {
+	t, r, err := p.parseReminder(args.String("time"), args.String("reminder"))
 
-			err = p.AddReminder(&Reminder{
-				StartTime: now,
-				Time:      t,
-				Requester: requester,
-				Target:    message.Channel(),
-				Message:   r,
-				IsPrivate: service.IsPrivate(message),
-			})
-			if err != nil {
-				service.SendMessage(message.Channel(), err.Error())
-				return
-			}
+	now := time.Now()
+
+	if err != nil || t.Before(now) || t.After(now.Add(time.Hour*24*365+time.Hour)) {
+		service.SendMessage(message.Channel(), fmt.Sprintf("Invalid time. eg: %s", strings.Join(randomTimes, ", ")))
+		return
+	}
 
-			service.SendMessage(message.Channel(), fmt.Sprintf("Reminder set for %s.", humanize.Time(t)))
+	if r == "" {
+		service.SendMessage(message.Channel(), fmt.Sprintf("Invalid reminder, no message. eg: %s", p.randomReminder(service, message)))
+		return
+	}
+
+	err = p.AddReminder(&Reminder{
+		StartTime: now,
+		Time:      t,
+		Requester: p.requester(service, message),
+		Target:    message.Channel(),
+		Message:   r,
+		IsPrivate: service.IsPrivate(message),
+	})
+	if err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+
+	service.SendMessage(message.Channel(), fmt.Sprintf("Reminder set for %s.", humanize.Time(t)))
+}
+
+func (p *ReminderPlugin) listCommand(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, args string, parts []string) {
+	reminders := p.requested(p.requester(service, message))
+	if len(reminders) == 0 {
+		service.SendMessage(message.Channel(), fmt.Sprintf("%s, you have no reminders.", message.UserName()))
+		return
+	}
+
+	lines := []string{}
+	for i, r := range reminders {
+		lines = append(lines, fmt.Sprintf("%d. %s: %s", i+1, humanize.Time(r.Time), r.Message))
+	}
+
+	if service.SupportsMultiline() {
+		service.SendMessage(message.Channel(), strings.Join(lines, "\n"))
+	} else {
+		for _, line := range lines {
+			if err := service.SendMessage(message.Channel(), line); err != nil {
+				break
+			}
 		}
 	}
 }
 
+func (p *ReminderPlugin) cancelCommand(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, args *comicjerk.Args) {
+	reminders := p.requested(p.requester(service, message))
+
+	i := args.Int("number")
+	if i < 1 || i > len(reminders) || p.remove(reminders[i-1]) == 0 {
+		service.SendMessage(message.Channel(), fmt.Sprintf("%s, you don't have a reminder %d.", message.UserName(), i))
+		return
+	}
+
+	service.SendMessage(message.Channel(), fmt.Sprintf("Cancelled reminder: %s", reminders[i-1].Message))
+}
+
+func (p *ReminderPlugin) clearCommand(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message, args string, parts []string) {
+	removed := p.remove(p.requested(p.requester(service, message))...)
+	if removed == 1 {
+		service.SendMessage(message.Channel(), "Cancelled 1 reminder.")
+	} else {
+		service.SendMessage(message.Channel(), fmt.Sprintf("Cancelled %d reminders.", removed))
+	}
+}
+
 // SendReminder sends a reminder.
 func (p *ReminderPlugin) SendReminder(service comicjerk.Service, reminder *Reminder) {
 	if reminder.IsPrivate {
@@ -219,51 +348,82 @@ func (p *ReminderPlugin) Run(bot *comicjerk.Bot, service comicjerk.Service) {
 
 				p.SendReminder(service, reminder)
 
-				p.Lock()
-				p.Reminders = p.Reminders[1:]
-				p.Unlock()
+				// Reminders can be added or cancelled while this one is sent, so it is removed by identity.
+				p.remove(reminder)
 
 				continue
 			}
 		}
 
 		p.RUnlock()
-		time.Sleep(500 * time.Millisecond)
+
+		select {
+		case <-p.closing:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
 	}
 }
 
-// Load will load plugin state from a byte array.
+// Close will stop the reminder loop, it is safe to call once for every service the plugin is registered on.
+func (p *ReminderPlugin) Close(bot *comicjerk.Bot, service comicjerk.Service) error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+// Load loads the reminders from the plugin's Data, importing reminders saved by earlier versions, and starts sending them.
 func (p *ReminderPlugin) Load(bot *comicjerk.Bot, service comicjerk.Service, data []byte) error {
-	if data != nil {
-		if err := json.Unmarshal(data, p); err != nil {
+	p.Lock()
+	p.bot, p.service = bot, service
+
+	d := bot.Data(service, p.Name())
+	if d.Get("reminders", &p.Reminders) {
+		d.Get("total", &p.TotalReminders)
+	} else if data != nil {
+		legacy := struct {
+			Reminders      []*Reminder
+			TotalReminders int
+		}{}
+		if err := json.Unmarshal(data, &legacy); err != nil {
 			log.Println("Error loading data", err)
 		}
+		p.Reminders, p.TotalReminders = legacy.Reminders, legacy.TotalReminders
+		p.save()
 	}
 	if len(p.Reminders) > p.TotalReminders {
 		p.TotalReminders = len(p.Reminders)
 	}
+	p.Unlock()
 
 	go p.Run(bot, service)
 	return nil
 }
 
-// Save will save plugin state to a byte array.
-func (p *ReminderPlugin) Save() ([]byte, error) {
-	return json.Marshal(p)
-}
-
 // Stats will return the stats for a plugin.
 func (p *ReminderPlugin) Stats(bot *comicjerk.Bot, service comicjerk.Service, message comicjerk.Message) []string {
-	return []string{fmt.Sprintf("Reminders: \t%d\n", p.TotalReminders)}
-}
+	p.RLock()
+	defer p.RUnlock()
 
-func (p *ReminderPlugin) Name() string {
-	return "Reminder"
+	return []string{fmt.Sprintf("Reminders: \t%d\n", p.TotalReminders)}
 }
 
 // New will create a new Reminder plugin.
 func New() comicjerk.Plugin {
-	return &ReminderPlugin{
-		Reminders: []*Reminder{},
+	p := &ReminderPlugin{
+		CommandPlugin: comicjerk.NewNamedCommandPlugin("Reminder"),
+		Reminders:     []*Reminder{},
+		closing:       make(chan struct{}),
 	}
+
+	p.AddArgsCommand("reminder", reminderArgs, p.addCommand, "Sets a reminder that is sent after the provided time.").Aliases = []string{"remind"}
+
+	reminder := p.AddGroup("reminder")
+	reminder.Description = "Lists and cancels your reminders."
+	reminder.AddCommand("list", p.listCommand, comicjerk.NewCommandHelp("", "Lists your reminders."))
+	reminder.AddArgsCommand("cancel", cancelArgs, p.cancelCommand, "Cancels a reminder, numbered as in reminder list.")
+	reminder.AddCommand("clear", p.clearCommand, comicjerk.NewCommandHelp("", "Cancels all your reminders."))
+
+	return p
 }
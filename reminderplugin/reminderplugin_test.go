@@ -0,0 +1,153 @@
+package reminderplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matannoam/comicjerk"
+)
+
+func TestReminder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reminderplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	bot.RegisterService(service)
+	bot.RegisterPlugin(service, New())
+	bot.Open()
+	defer bot.Close()
+
+	service.InjectString("#channel", "bob", "!reminder 1 second walk the dog")
+	calls := service.WaitForCalls("SendMessage", 2, 5*time.Second)
+	if len(calls) != 2 {
+		t.Fatalf("calls = %d, want the reminder to be set and sent", len(calls))
+	}
+	if !strings.HasPrefix(calls[0].Message, "Reminder set for") {
+		t.Errorf("reply = %q, want the reminder to be set", calls[0].Message)
+	}
+	if want := "bob set a reminder: walk the dog"; !strings.HasSuffix(calls[1].Message, want) || calls[1].Target != "#channel" {
+		t.Errorf("reminder = %q to %s, want %q to #channel", calls[1].Message, calls[1].Target, want)
+	}
+}
+
+func TestReminderInvalidTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reminderplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	bot.RegisterService(service)
+	bot.RegisterPlugin(service, New())
+	bot.Open()
+	defer bot.Close()
+
+	service.InjectString("#channel", "bob", "!reminder 2 fortnights walk the dog")
+	calls := service.WaitForCalls("SendMessage", 1, time.Second)
+	if len(calls) != 1 || !strings.HasPrefix(calls[0].Message, "Invalid time.") {
+		t.Errorf("calls = %v, want an invalid time reply", calls)
+	}
+}
+
+func TestReminderCloseShared(t *testing.T) {
+	p := New().(*ReminderPlugin)
+	bot := comicjerk.NewBot()
+
+	// Closing a plugin registered on several services must not panic.
+	p.Close(bot, comicjerk.NewTestService())
+	p.Close(bot, comicjerk.NewTestService())
+}
+
+func TestReminderRawText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reminderplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	bot.RegisterService(service)
+	bot.RegisterPlugin(service, New())
+	bot.Open()
+	defer bot.Close()
+
+	// Apostrophes and quotes in the reminder are kept as they were written.
+	service.InjectString("#channel", "bob", `!remind 1s don't forget the "milk"`)
+	calls := service.WaitForCalls("SendMessage", 2, 5*time.Second)
+	if len(calls) != 2 {
+		t.Fatalf("calls = %d, want the reminder to be set and sent", len(calls))
+	}
+	if want := `bob set a reminder: don't forget the "milk"`; !strings.HasSuffix(calls[1].Message, want) {
+		t.Errorf("reminder = %q, want %q", calls[1].Message, want)
+	}
+}
+
+func TestReminderSubcommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reminderplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bot := comicjerk.NewBot()
+	bot.Store = comicjerk.NewFileStore(dir)
+	service := comicjerk.NewTestService()
+	bot.RegisterService(service)
+	bot.RegisterPlugin(service, New())
+	bot.RegisterPlugin(service, comicjerk.NewHelpPlugin())
+	bot.Open()
+	defer bot.Close()
+
+	send := func(user, message string) string {
+		n := len(service.Calls("SendMessage"))
+		service.InjectString("#channel", user, message)
+		calls := service.WaitForCalls("SendMessage", n+1, time.Second)
+		if len(calls) <= n {
+			return ""
+		}
+		return calls[n].Message
+	}
+
+	send("bob", "!reminder 1 hour walk the dog")
+	send("bob", "!remind 2 hours feed the cat")
+	send("alice", "!reminder 1 hour water the plants")
+
+	if got := send("bob", "!reminder list"); !strings.Contains(got, "1. ") || !strings.Contains(got, "walk the dog") || !strings.Contains(got, "2. ") || strings.Contains(got, "water the plants") {
+		t.Errorf("list = %q, want bob's two reminders", got)
+	}
+	if got := send("bob", "!reminder cancel 1"); got != "Cancelled reminder: walk the dog" {
+		t.Errorf("cancel = %q", got)
+	}
+	if got := send("bob", "!reminder cancel 5"); got != "bob, you don't have a reminder 5." {
+		t.Errorf("cancel missing = %q", got)
+	}
+	if got := send("bob", "!reminder clear"); got != "Cancelled 1 reminder." {
+		t.Errorf("clear = %q", got)
+	}
+	if got := send("bob", "!reminder list"); got != "bob, you have no reminders." {
+		t.Errorf("list after clear = %q", got)
+	}
+	if got := send("alice", "!reminder list"); !strings.Contains(got, "water the plants") {
+		t.Errorf("alice's list = %q, want her reminder", got)
+	}
+
+	if got := send("bob", "!help reminder"); !strings.Contains(got, "!reminder cancel <number> - ") {
+		t.Errorf("help = %q, want the subcommands", got)
+	}
+	if got := send("bob", "!help"); strings.Count(got, "reminder,") > 1 {
+		t.Errorf("help = %q, want the reminder topic once", got)
+	}
+}
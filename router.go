@@ -0,0 +1,358 @@
+package comicjerk
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CommandsPlugin is an optional interface for plugins that handle commands.
+// The commands are registered with the bot's command router when the bot is opened, and a command message is only
+// dispatched to the plugin that registered the command, not to other plugins that registered commands.
+// Plugins that register no commands still receive every message, including commands owned by other plugins, as they
+// may watch the whole conversation. They must use Route, or check CommandOwner, before acting on a command themselves.
+type CommandsPlugin interface {
+	Commands() []string
+}
+
+// CommandPermissionsPlugin is an optional interface for CommandsPlugins that require a permission for some of their commands.
+// It is used so that unknown commands are not answered with suggestions the sender can not use.
+type CommandPermissionsPlugin interface {
+	CommandPermission(commandString string) Permission
+}
+
+// commandRouter resolves command messages to the plugin that registered the command.
+type commandRouter struct {
+	sync.RWMutex
+	// owners maps service name to command string to plugin name.
+	owners map[string]map[string]string
+	// commands holds the command strings of each service, longest first.
+	commands map[string][]string
+	// channels maps service name to channel to command string to plugin name, for commands that only exist in one channel.
+	channels map[string]map[string]map[string]string
+	// plugins holds the names of the plugins with registered commands on each service.
+	plugins map[string]map[string]int
+}
+
+func newCommandRouter() *commandRouter {
+	return &commandRouter{
+		owners:   make(map[string]map[string]string),
+		commands: make(map[string][]string),
+		channels: make(map[string]map[string]map[string]string),
+		plugins:  make(map[string]map[string]int),
+	}
+}
+
+// normalizeCommand lowercases a command string and collapses its whitespace, eg. "Reminder  List" becomes "reminder list".
+func normalizeCommand(commandString string) string {
+	return strings.ToLower(strings.Join(strings.Fields(commandString), " "))
+}
+
+// RegisterCommand registers a command for a plugin on a service.
+// An error is returned if the command is already registered, even by the same plugin, so duplicate names and aliases are caught.
+func (b *Bot) RegisterCommand(service Service, plugin Plugin, commandString string) error {
+	commandString = normalizeCommand(commandString)
+	if commandString == "" {
+		return fmt.Errorf("Empty command registered by %s.", plugin.Name())
+	}
+
+	r := b.router
+	r.Lock()
+	defer r.Unlock()
+
+	owners := r.serviceOwners(service)
+	if owner, ok := owners[commandString]; ok {
+		return fmt.Errorf("Command %s is already registered by %s.", commandString, owner)
+	}
+
+	owners[commandString] = plugin.Name()
+	r.plugins[service.Name()][plugin.Name()]++
+
+	commands := append(r.commands[service.Name()], commandString)
+	sort.Sort(byLength(commands))
+	r.commands[service.Name()] = commands
+
+	return nil
+}
+
+// UnregisterCommand removes a command registered by a plugin on a service.
+func (b *Bot) UnregisterCommand(service Service, plugin Plugin, commandString string) {
+	commandString = normalizeCommand(commandString)
+
+	r := b.router
+	r.Lock()
+	defer r.Unlock()
+
+	if owner, ok := r.owners[service.Name()][commandString]; !ok || owner != plugin.Name() {
+		return
+	}
+
+	delete(r.owners[service.Name()], commandString)
+	if r.plugins[service.Name()][plugin.Name()]--; r.plugins[service.Name()][plugin.Name()] == 0 {
+		delete(r.plugins[service.Name()], plugin.Name())
+	}
+
+	commands := r.commands[service.Name()]
+	for i, c := range commands {
+		if c == commandString {
+			r.commands[service.Name()] = append(commands[:i:i], commands[i+1:]...)
+			break
+		}
+	}
+}
+
+// RegisterChannelCommand registers a command for a plugin that only exists in one channel of a service, eg. a custom command.
+// An error is returned if the command is already registered on the service or in the channel.
+// Commands registered on the whole service are routed before channel commands, so a later service command shadows a channel command of the same name.
+func (b *Bot) RegisterChannelCommand(service Service, channel string, plugin Plugin, commandString string) error {
+	commandString = normalizeCommand(commandString)
+	if commandString == "" {
+		return fmt.Errorf("Empty command registered by %s.", plugin.Name())
+	}
+
+	r := b.router
+	r.Lock()
+	defer r.Unlock()
+
+	if owner, ok := r.serviceOwners(service)[commandString]; ok {
+		return fmt.Errorf("Command %s is already registered by %s.", commandString, owner)
+	}
+
+	channels := r.channels[service.Name()]
+	if channels == nil {
+		channels = make(map[string]map[string]string)
+		r.channels[service.Name()] = channels
+	}
+	owners := channels[channel]
+	if owners == nil {
+		owners = make(map[string]string)
+		channels[channel] = owners
+	}
+	if owner, ok := owners[commandString]; ok {
+		return fmt.Errorf("Command %s is already registered by %s.", commandString, owner)
+	}
+
+	owners[commandString] = plugin.Name()
+	r.plugins[service.Name()][plugin.Name()]++
+
+	return nil
+}
+
+// UnregisterChannelCommand removes a command registered by a plugin in one channel of a service.
+func (b *Bot) UnregisterChannelCommand(service Service, channel string, plugin Plugin, commandString string) {
+	commandString = normalizeCommand(commandString)
+
+	r := b.router
+	r.Lock()
+	defer r.Unlock()
+
+	owners := r.channels[service.Name()][channel]
+	if owner, ok := owners[commandString]; !ok || owner != plugin.Name() {
+		return
+	}
+
+	delete(owners, commandString)
+	if len(owners) == 0 {
+		delete(r.channels[service.Name()], channel)
+	}
+	if r.plugins[service.Name()][plugin.Name()]--; r.plugins[service.Name()][plugin.Name()] == 0 {
+		delete(r.plugins[service.Name()], plugin.Name())
+	}
+}
+
+// serviceOwners returns the owners of the commands registered on a service, creating them if needed.
+// The router must be locked for writing.
+func (r *commandRouter) serviceOwners(service Service) map[string]string {
+	owners := r.owners[service.Name()]
+	if owners == nil {
+		owners = make(map[string]string)
+		r.owners[service.Name()] = owners
+		r.plugins[service.Name()] = make(map[string]int)
+	}
+	return owners
+}
+
+// channelCommands returns the commands registered in a channel of a service, longest first.
+// The router must be locked.
+func (r *commandRouter) channelCommands(service Service, channel string) []string {
+	owners := r.channels[service.Name()][channel]
+	commands := make([]string, 0, len(owners))
+	for commandString := range owners {
+		commands = append(commands, commandString)
+	}
+	sort.Sort(byLength(commands))
+	return commands
+}
+
+// Route returns the longest registered command that a message matches, and the name of the plugin that registered it.
+// Commands registered on the whole service are matched before the commands registered in the message's channel.
+// If the message does not match a command, both strings are empty.
+func (b *Bot) Route(service Service, message Message) (string, string) {
+	r := b.router
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, commandString := range r.commands[service.Name()] {
+		if MatchesCommand(service, commandString, message) {
+			return commandString, r.owners[service.Name()][commandString]
+		}
+	}
+	for _, commandString := range r.channelCommands(service, message.Channel()) {
+		if MatchesCommand(service, commandString, message) {
+			return commandString, r.channels[service.Name()][message.Channel()][commandString]
+		}
+	}
+	return "", ""
+}
+
+// Commands returns the commands registered on a service, sorted alphabetically.
+// Commands registered in a single channel are not included, see ChannelCommands.
+func (b *Bot) Commands(service Service) []string {
+	r := b.router
+	r.RLock()
+	defer r.RUnlock()
+
+	commands := append([]string{}, r.commands[service.Name()]...)
+	sort.Strings(commands)
+	return commands
+}
+
+// ChannelCommands returns the commands that can be used in a channel of a service, sorted alphabetically.
+func (b *Bot) ChannelCommands(service Service, channel string) []string {
+	r := b.router
+	r.RLock()
+	defer r.RUnlock()
+
+	commands := append(r.channelCommands(service, channel), r.commands[service.Name()]...)
+	sort.Strings(commands)
+	return commands
+}
+
+// ChannelCommandOwner returns the name of the plugin that registered a command on a service or in one of its channels,
+// or an empty string if it is not registered.
+func (b *Bot) ChannelCommandOwner(service Service, channel, commandString string) string {
+	commandString = normalizeCommand(commandString)
+
+	r := b.router
+	r.RLock()
+	defer r.RUnlock()
+
+	if owner, ok := r.owners[service.Name()][commandString]; ok {
+		return owner
+	}
+	return r.channels[service.Name()][channel][commandString]
+}
+
+// CommandOwner returns the name of the plugin that registered a command on a service, or an empty string if it is not registered.
+func (b *Bot) CommandOwner(service Service, commandString string) string {
+	r := b.router
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.owners[service.Name()][normalizeCommand(commandString)]
+}
+
+// IsCommand returns whether a command string starts with a registered command, eg. "comic 5" starts with "comic".
+func (b *Bot) IsCommand(service Service, commandString string) bool {
+	return b.commandOf(service, commandString) != ""
+}
+
+// IsChannelCommand returns whether a command string starts with a command registered on a service or in one of its channels.
+func (b *Bot) IsChannelCommand(service Service, channel, commandString string) bool {
+	return b.channelCommandOf(service, channel, commandString) != ""
+}
+
+// commandOf returns the longest registered command that a command string starts with, or an empty string if there is none.
+func (b *Bot) commandOf(service Service, commandString string) string {
+	r := b.router
+	r.RLock()
+	defer r.RUnlock()
+
+	return prefixCommand(r.commands[service.Name()], normalizeCommand(commandString))
+}
+
+// channelCommandOf is like commandOf, but also looks at the commands registered in a channel.
+func (b *Bot) channelCommandOf(service Service, channel, commandString string) string {
+	commandString = normalizeCommand(commandString)
+
+	r := b.router
+	r.RLock()
+	defer r.RUnlock()
+
+	if c := prefixCommand(r.commands[service.Name()], commandString); c != "" {
+		return c
+	}
+	return prefixCommand(r.channelCommands(service, channel), commandString)
+}
+
+// prefixCommand returns the first of a list of commands that a normalized command string starts with.
+func prefixCommand(commands []string, commandString string) string {
+	for _, c := range commands {
+		if commandString == c || strings.HasPrefix(commandString, c+" ") {
+			return c
+		}
+	}
+	return ""
+}
+
+// CommandPermission returns the permission required to use a registered command on a service.
+// Commands of plugins that are not a CommandPermissionsPlugin can be used by everyone.
+func (b *Bot) CommandPermission(service Service, commandString string) Permission {
+	owner := b.CommandOwner(service, commandString)
+	if p, ok := b.Services[service.Name()].Plugins[owner].(CommandPermissionsPlugin); ok {
+		return p.CommandPermission(normalizeCommand(commandString))
+	}
+	return PermissionEveryone
+}
+
+// hasCommands returns whether a plugin has registered any commands on a service.
+func (r *commandRouter) hasCommands(service Service, plugin Plugin) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.plugins[service.Name()][plugin.Name()] > 0
+}
+
+// registerCommands registers the commands of every CommandsPlugin on a service.
+// Plugins are registered in name order, so when two plugins register the same command the first by name keeps it.
+// Conflicts are logged and the command is skipped.
+func (b *Bot) registerCommands(service *serviceEntry) {
+	names := make([]string, 0, len(service.Plugins))
+	for name := range service.Plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		plugin := service.Plugins[name]
+		p, ok := plugin.(CommandsPlugin)
+		if !ok {
+			continue
+		}
+		for _, commandString := range p.Commands() {
+			if err := b.RegisterCommand(service, plugin, commandString); err != nil {
+				log.Printf("Error registering command %s for %s on %s. %v", commandString, plugin.Name(), service.Name(), err)
+			}
+		}
+	}
+}
+
+// byLength sorts command strings longest first, and alphabetically when they are the same length.
+type byLength []string
+
+func (s byLength) Len() int {
+	return len(s)
+}
+
+func (s byLength) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byLength) Less(i, j int) bool {
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) > len(s[j])
+	}
+	return s[i] < s[j]
+}
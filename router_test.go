@@ -0,0 +1,73 @@
+package comicjerk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegisterCommandDuplicates(t *testing.T) {
+	bot := NewBot()
+	service := NewTestService()
+	bot.RegisterService(service)
+	p := NewSimplePlugin("one")
+
+	if err := bot.RegisterCommand(service, p, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.RegisterCommand(service, p, "Ping"); err == nil {
+		t.Error("registering a command twice was not an error")
+	}
+	if err := bot.RegisterCommand(service, NewSimplePlugin("two"), "ping"); err == nil {
+		t.Error("registering a command of another plugin was not an error")
+	}
+	if owner := bot.CommandOwner(service, "ping"); owner != "one" {
+		t.Errorf("owner = %q, want one", owner)
+	}
+}
+
+func TestCommandPluginDuplicateAlias(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	reply := func(text string) CommandMessageFunc {
+		return func(bot *Bot, service Service, message Message, args string, parts []string) {
+			service.SendMessage(message.Channel(), text)
+		}
+	}
+	cp.AddCommand("alpha", reply("alpha"), nil).Aliases = []string{"x"}
+	cp.AddCommand("beta", reply("beta"), nil).Aliases = []string{"x"}
+	bot.Open()
+
+	// The first command by name keeps the alias, every time.
+	for i := 0; i < 10; i++ {
+		if got := send(service, "bob", "!x"); got != "alpha" {
+			t.Fatalf("x = %q, want alpha", got)
+		}
+	}
+}
+
+func TestCommandlessPluginsReceiveCommands(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {}, nil)
+
+	seen := make(chan string, 1)
+	watcher := NewSimplePlugin("watcher")
+	watcher.MessageFunc = func(bot *Bot, service Service, message Message) {
+		_, owner := bot.Route(service, message)
+		seen <- owner
+	}
+	bot.RegisterPlugin(service, watcher)
+	bot.Open()
+
+	service.InjectString("#channel", "bob", "!ping")
+	select {
+	case owner := <-seen:
+		if owner != "Command" {
+			t.Errorf("owner = %q, want Command", owner)
+		}
+	case <-time.After(testTimeout):
+		t.Error("plugin without commands did not receive the command")
+	}
+}
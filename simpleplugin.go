@@ -8,6 +8,8 @@ type SimplePlugin struct {
 	MessageFunc MessageFunc `json:"-"`
 	HelpFunc    HelpFunc    `json:"-"`
 	StatsFunc   StatsFunc   `json:"-"`
+	// CommandStrings are the commands handled by MessageFunc, they are registered with the bot's command router.
+	CommandStrings []string `json:"-"`
 }
 
 // Name returns the name of the plugin.
@@ -47,6 +49,11 @@ func (p *SimplePlugin) Message(bot *Bot, service Service, message Message) {
 	}
 }
 
+// Commands returns the commands handled by the plugin.
+func (p *SimplePlugin) Commands() []string {
+	return p.CommandStrings
+}
+
 func (p *SimplePlugin) Stats(bot *Bot, service Service, message Message) []string {
 	if p.StatsFunc != nil {
 		return p.StatsFunc(bot, service, message)
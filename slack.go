@@ -1,9 +1,12 @@
 package comicjerk
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/nlopes/slack"
 )
@@ -57,10 +60,18 @@ func (m *SlackMessage) Type() MessageType {
 	return m.MessageType
 }
 
+// IsBot returns whether the message was sent by a bot integration.
+func (m *SlackMessage) IsBot() bool {
+	return m.SlackMessage.BotID != ""
+}
+
 // Slack is a Service provider for Slack.
 type Slack struct {
 	token       string
 	messageChan chan Message
+	closing     chan struct{}
+	outbox      *Outbox
+	closeOnce   sync.Once
 
 	Client *slack.Client
 	RTM    *slack.RTM
@@ -71,17 +82,33 @@ type Slack struct {
 
 // NewSlack creates a new Slack service.
 func NewSlack(token string) *Slack {
+	outbox := NewOutbox(3, time.Second, 100)
+	outbox.RetryAfter = slackRetryAfter
 	return &Slack{
 		token:       token,
 		messageChan: make(chan Message, 200),
+		closing:     make(chan struct{}),
+		outbox:      outbox,
+	}
+}
+
+// slackRetryAfter returns how long to wait if err is a rate limit response.
+func slackRetryAfter(err error) (time.Duration, bool) {
+	if rateLimitErr, ok := err.(*slack.RateLimitedError); ok {
+		return rateLimitErr.RetryAfter, true
 	}
+	return 0, false
 }
 
 func (s *Slack) handle() {
 	for {
 		select {
+		case <-s.closing:
+			return
 		case msg := <-s.RTM.IncomingEvents:
 			switch ev := msg.Data.(type) {
+			case *slack.RateLimitEvent:
+				s.outbox.Backoff(time.Second)
 			case *slack.MessageEvent:
 				switch ev.SubType {
 				case "message_changed":
@@ -119,6 +146,19 @@ func (s *Slack) Open() (<-chan Message, error) {
 	return s.messageChan, nil
 }
 
+// Close disconnects from the RTM api.
+func (s *Slack) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		s.outbox.Close()
+		if s.RTM != nil {
+			err = s.RTM.Disconnect()
+		}
+	})
+	return err
+}
+
 // IsMe returns whether or not a message was sent by the bot.
 func (s *Slack) IsMe(message Message) bool {
 	return message.UserID() == s.Me.UserID
@@ -126,8 +166,15 @@ func (s *Slack) IsMe(message Message) bool {
 
 // SendMessage sends a message.
 func (s *Slack) SendMessage(channel, message string) error {
-	s.RTM.SendMessage(s.RTM.NewOutgoingMessage(message, channel))
-	return nil
+	return s.SendMessageContext(context.Background(), channel, message)
+}
+
+// SendMessageContext sends a message, giving up if the context is done before it leaves the outbox.
+func (s *Slack) SendMessageContext(ctx context.Context, channel, message string) error {
+	return s.outbox.SendContext(ctx, false, func() error {
+		s.RTM.SendMessage(s.RTM.NewOutgoingMessage(message, channel))
+		return nil
+	})
 }
 
 // DeleteMessage deletes a message.
@@ -174,8 +221,15 @@ func (s *Slack) Typing(channel string) error {
 
 // PrivateMessage will send a private message to a user.
 func (s *Slack) PrivateMessage(userID, message string) error {
-	s.RTM.SendMessage(s.RTM.NewOutgoingMessage(message, userID))
-	return nil
+	return s.outbox.Send(true, func() error {
+		s.RTM.SendMessage(s.RTM.NewOutgoingMessage(message, userID))
+		return nil
+	})
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (s *Slack) Outbox() *Outbox {
+	return s.outbox
 }
 
 // SupportsPrivateMessages returns whether the service supports private messages.
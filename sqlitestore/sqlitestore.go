@@ -0,0 +1,54 @@
+package sqlitestore
+
+import (
+	"database/sql"
+
+	// Registers the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const createTable = `CREATE TABLE IF NOT EXISTS plugin_data (
+	service TEXT NOT NULL,
+	plugin TEXT NOT NULL,
+	data BLOB,
+	PRIMARY KEY (service, plugin)
+)`
+
+// Store is a comicjerk.Store backed by a SQLite database.
+type Store struct {
+	db *sql.DB
+}
+
+// Load returns the data saved for a plugin on a service, or nil if nothing has been saved.
+func (s *Store) Load(service, plugin string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM plugin_data WHERE service = ? AND plugin = ?", service, plugin).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save persists the data for a plugin on a service.
+func (s *Store) Save(service, plugin string, data []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO plugin_data (service, plugin, data) VALUES (?, ?, ?)", service, plugin, data)
+	return err
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// New opens, or creates, a SQLite store at path.
+func New(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
@@ -0,0 +1,22 @@
+package sqlitestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matannoam/comicjerk/storetest"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storetest.Run(t, func() (storetest.Store, error) {
+		return New(filepath.Join(dir, "comicjerk.db"))
+	})
+}
@@ -71,6 +71,11 @@ func StatsCommand(bot *comicjerk.Bot, service comicjerk.Service, message comicje
 		fmt.Fprintf(w, "Connected channels: \t%d\n", service.ChannelCount())
 	}
 
+	fmt.Fprintf(w, "Rate limited commands: \t%d\n", bot.RateLimitHits(service))
+	if o, ok := service.(comicjerk.OutboxService); ok {
+		fmt.Fprintf(w, "Queued messages: \t%d (%d dropped)\n", o.Outbox().Pending(), o.Outbox().Dropped())
+	}
+
 	plugins := bot.Services[service.Name()].Plugins
 	names := []string{}
 	for _, plugin := range plugins {
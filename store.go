@@ -0,0 +1,104 @@
+package comicjerk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Store is a persistence backend for plugin state.
+type Store interface {
+	// Load returns the data saved for a plugin on a service, or nil if nothing has been saved.
+	Load(service, plugin string) ([]byte, error)
+	// Save persists the data for a plugin on a service.
+	Save(service, plugin string, data []byte) error
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// FileStore is a Store that saves each plugin to its own file, in a directory per service.
+type FileStore struct {
+	// Dir is the root data directory, the working directory is used if empty.
+	Dir string
+}
+
+// NewFileStore creates a new file store rooted at dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{Dir: dir}
+}
+
+func (s *FileStore) path(service, plugin string) string {
+	return filepath.Join(s.Dir, service, plugin)
+}
+
+// Load returns the data saved for a plugin on a service, or nil if nothing has been saved.
+func (s *FileStore) Load(service, plugin string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(service, plugin))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save persists the data for a plugin on a service.
+// Data is written to a temporary file and renamed over the old file, so a crash can never leave a partial save.
+// The directory is synced after the rename, so the new file survives a crash too.
+func (s *FileStore) Save(service, plugin string, data []byte) error {
+	dir := filepath.Join(s.Dir, service)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+plugin+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), s.path(service, plugin)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory's entries to disk, it is skipped on Windows where directories can not be synced.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// Close releases any resources held by the store.
+func (s *FileStore) Close() error {
+	return nil
+}
@@ -0,0 +1,31 @@
+package comicjerk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matannoam/comicjerk/storetest"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comicjerk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storetest.Run(t, func() (storetest.Store, error) {
+		return NewFileStore(dir), nil
+	})
+
+	// Temporary files are never left behind.
+	files, err := ioutil.ReadDir(filepath.Join(dir, "Test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "plugin" {
+		t.Errorf("files = %v, want only plugin", files)
+	}
+}
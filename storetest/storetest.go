@@ -0,0 +1,60 @@
+// Package storetest checks that a comicjerk.Store behaves like the stores that come with comicjerk.
+package storetest
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Store is the comicjerk.Store interface, repeated so that comicjerk's own tests can use this package.
+type Store interface {
+	Load(service, plugin string) ([]byte, error)
+	Save(service, plugin string, data []byte) error
+	Close() error
+}
+
+// Run tests a store. open must open the same store each time it is called, so that Run can check data survives Close.
+func Run(t *testing.T, open func() (Store, error)) {
+	store, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := store.Load("Test", "plugin"); data != nil || err != nil {
+		t.Errorf("Load before Save = %q, %v, want nil, nil", data, err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		if err := store.Save("Test", "plugin", []byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := store.Load("Test", "plugin"); string(data) != want || err != nil {
+			t.Errorf("Load = %q, %v, want %q, nil", data, err, want)
+		}
+	}
+
+	// Plugins are saved separately for each service.
+	if err := store.Save("Other", "plugin", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Load("Test", "other"); data != nil || err != nil {
+		t.Errorf("Load of another plugin = %q, %v, want nil, nil", data, err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+
+	// Saved data survives closing the store.
+	store, err = open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for service, want := range map[string][]byte{"Test": []byte("second"), "Other": []byte("other")} {
+		if data, err := store.Load(service, "plugin"); !bytes.Equal(data, want) || err != nil {
+			t.Errorf("Load %s after reopening = %q, %v, want %q, nil", service, data, err, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package comicjerk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SuggestionsPluginName is the name suggestion settings are stored under in Bot.Data.
+const SuggestionsPluginName = "Suggestions"
+
+func suggestionsKey(channel string) string {
+	return "disabled:" + channel
+}
+
+// SuggestionsEnabled returns whether unknown commands get a suggestion reply in a channel, they are enabled by default.
+func (b *Bot) SuggestionsEnabled(service Service, channel string) bool {
+	disabled := false
+	b.Data(service, SuggestionsPluginName).Get(suggestionsKey(channel), &disabled)
+	return !disabled
+}
+
+// SetSuggestionsEnabled enables or disables suggestion replies for unknown commands in a channel.
+func (b *Bot) SetSuggestionsEnabled(service Service, channel string, enabled bool) error {
+	data := b.Data(service, SuggestionsPluginName)
+	if enabled {
+		data.Delete(suggestionsKey(channel))
+		return nil
+	}
+	return data.Set(suggestionsKey(channel), true)
+}
+
+// EditDistance returns the Levenshtein distance between two strings.
+func EditDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// Suggest returns the candidate closest to a misspelled word, or an empty string if none are close enough.
+// Candidates with several words are compared to the same number of words at the start of the input.
+func Suggest(input string, candidates []string) string {
+	words := strings.Fields(strings.ToLower(input))
+	if len(words) == 0 {
+		return ""
+	}
+
+	// Longer candidates are tried first, so that subcommands are suggested over their group.
+	sorted := append(byLength{}, candidates...)
+	sort.Sort(sorted)
+
+	best, bestDistance := "", -1
+	for _, candidate := range sorted {
+		candidateWords := strings.Fields(strings.ToLower(candidate))
+		if len(candidateWords) == 0 || len(candidateWords) > len(words) {
+			continue
+		}
+
+		typed := strings.Join(words[:len(candidateWords)], " ")
+		c := strings.Join(candidateWords, " ")
+
+		// Allow roughly one mistake for every three characters.
+		distance := EditDistance(typed, c)
+		if distance == 0 || distance > (len(c)+2)/3 {
+			continue
+		}
+		if bestDistance == -1 || distance < bestDistance {
+			best, bestDistance = c, distance
+		}
+	}
+	return best
+}
+
+// SuggestCommand returns the command or alias closest to an unknown command message, or an empty string if there is none.
+// Only commands the sender of the message has permission to use are suggested.
+func (b *Bot) SuggestCommand(service Service, message Message) string {
+	text, ok := trimPrefix(CommandPrefixes(service, message), strings.TrimSpace(message.Message()))
+	if !ok {
+		return ""
+	}
+
+	candidates := []string{}
+	for _, commandString := range b.ChannelCommands(service, message.Channel()) {
+		if b.HasPermission(service, message, b.CommandPermission(service, commandString)) {
+			candidates = append(candidates, commandString)
+		}
+	}
+	for alias, commandString := range b.ChannelAliases(service, message.Channel()) {
+		if b.HasPermission(service, message, b.CommandPermission(service, b.channelCommandOf(service, message.Channel(), commandString))) {
+			candidates = append(candidates, alias)
+		}
+	}
+	return Suggest(text, candidates)
+}
+
+// suggest replies to an unknown command message with the closest command, if suggestions are enabled in the channel.
+func (b *Bot) suggest(service Service, message Message) {
+	if message.Type() != MessageTypeCreate || !b.SuggestionsEnabled(service, message.Channel()) {
+		return
+	}
+	if suggestion := b.SuggestCommand(service, message); suggestion != "" {
+		service.SendMessage(message.Channel(), fmt.Sprintf("Unknown command. Did you mean %s%s?", CommandPrefix(service, message), suggestion))
+	}
+}
+
+// SuggestionsArgs are the arguments for the suggestions command.
+var SuggestionsArgs = &ArgSpec{
+	Args: []*Arg{
+		{Name: "on|off", Type: ArgString},
+	},
+}
+
+// SuggestionsCommand is a command for turning suggestions for unknown commands on or off in the current channel.
+func SuggestionsCommand(bot *Bot, service Service, message Message, args *Args) {
+	var enabled bool
+	switch strings.ToLower(args.String("on|off")) {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		service.SendMessage(message.Channel(), UsageMessage(service, message, "suggestions", SuggestionsArgs, errors.New("expected on or off")))
+		return
+	}
+
+	if err := bot.SetSuggestionsEnabled(service, message.Channel(), enabled); err != nil {
+		service.SendMessage(message.Channel(), err.Error())
+		return
+	}
+	if enabled {
+		service.SendMessage(message.Channel(), "Unknown commands will get suggestions in this channel.")
+	} else {
+		service.SendMessage(message.Channel(), "Unknown commands will be ignored in this channel.")
+	}
+}
+
+// SuggestionsHelp is the help text for the suggestions command.
+const SuggestionsHelp = "Turns suggestions for unknown commands on or off in this channel."
@@ -0,0 +1,25 @@
+package comicjerk
+
+import (
+	"testing"
+)
+
+func TestSuggestCommandPermissions(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	noop := func(bot *Bot, service Service, message Message, args string, parts []string) {}
+	cp.AddCommand("quit", noop, nil).Permission = PermissionOwner
+	cp.AddCommand("quiz", noop, nil)
+	bot.Open()
+
+	message := &TestMessage{ChannelID: "#channel", Author: "bob", Content: "!quit2"}
+	if got := bot.SuggestCommand(service, message); got != "quiz" {
+		t.Errorf("suggestion = %q, want quiz", got)
+	}
+
+	service.BotOwner = true
+	if got := bot.SuggestCommand(service, message); got != "quit" {
+		t.Errorf("suggestion for the owner = %q, want quit", got)
+	}
+}
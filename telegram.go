@@ -0,0 +1,616 @@
+package comicjerk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TelegramServiceName is the service name for the Telegram service.
+const TelegramServiceName string = "Telegram"
+
+// DefaultTelegramURL is the url of the Telegram Bot API.
+const DefaultTelegramURL = "https://api.telegram.org"
+
+// telegramPollTimeout is how long, in seconds, the Bot API holds a getUpdates request open while waiting for updates.
+const telegramPollTimeout = 30
+
+// telegramMaxBackoff is the longest the service waits before retrying a failed getUpdates.
+const telegramMaxBackoff = time.Minute
+
+// telegramAdminCacheTime is how long a user's admin status in a chat is cached.
+const telegramAdminCacheTime = 5 * time.Minute
+
+// maxTelegramHistory is the number of messages kept for each chat.
+const maxTelegramHistory = 100
+
+// TelegramUser is a user from the Telegram Bot API.
+type TelegramUser struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name,omitempty"`
+	Username  string `json:"username,omitempty"`
+}
+
+// TelegramChat is a chat from the Telegram Bot API.
+type TelegramChat struct {
+	ID    int64  `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title,omitempty"`
+}
+
+// TelegramAPIMessage is a message from the Telegram Bot API.
+type TelegramAPIMessage struct {
+	MessageID int64         `json:"message_id"`
+	From      *TelegramUser `json:"from,omitempty"`
+	Chat      *TelegramChat `json:"chat"`
+	Date      int64         `json:"date"`
+	Text      string        `json:"text,omitempty"`
+	Caption   string        `json:"caption,omitempty"`
+	// Entities are the formatting, mentions and links in the text.
+	Entities []*TelegramEntity `json:"entities,omitempty"`
+}
+
+// TelegramEntity is a part of a message's text, such as bold text or a link. Offset and Length are in UTF-16 code units.
+type TelegramEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+type telegramUpdate struct {
+	UpdateID      int64               `json:"update_id"`
+	Message       *TelegramAPIMessage `json:"message,omitempty"`
+	EditedMessage *TelegramAPIMessage `json:"edited_message,omitempty"`
+}
+
+// TelegramMessage is a Message wrapper around TelegramAPIMessage.
+type TelegramMessage struct {
+	TelegramMessage *TelegramAPIMessage
+	MessageType     MessageType
+	// Content is the text of the message, with the bot's name removed from commands such as /comic@BotName.
+	Content string
+}
+
+// Channel returns the channel id for this message.
+func (m *TelegramMessage) Channel() string {
+	return strconv.FormatInt(m.TelegramMessage.Chat.ID, 10)
+}
+
+// UserName returns the user name for this message.
+func (m *TelegramMessage) UserName() string {
+	from := m.TelegramMessage.From
+	if from == nil {
+		return ""
+	}
+	if from.Username != "" {
+		return from.Username
+	}
+	return strings.TrimSpace(from.FirstName + " " + from.LastName)
+}
+
+// UserID returns the user id for this message.
+func (m *TelegramMessage) UserID() string {
+	if m.TelegramMessage.From == nil {
+		return ""
+	}
+	return strconv.FormatInt(m.TelegramMessage.From.ID, 10)
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *TelegramMessage) UserAvatar() string {
+	return ""
+}
+
+// Message returns the message content for this message.
+func (m *TelegramMessage) Message() string {
+	return m.Content
+}
+
+// RawMessage returns the raw message content for this message.
+// The bot's name is removed here too, so that command arguments can be found in it.
+func (m *TelegramMessage) RawMessage() string {
+	return m.Content
+}
+
+// MessageID returns the message ID for this message.
+func (m *TelegramMessage) MessageID() string {
+	return strconv.FormatInt(m.TelegramMessage.MessageID, 10)
+}
+
+// Type returns the type of message.
+func (m *TelegramMessage) Type() MessageType {
+	return m.MessageType
+}
+
+// IsBot returns whether the message was sent by a bot.
+func (m *TelegramMessage) IsBot() bool {
+	return m.TelegramMessage.From != nil && m.TelegramMessage.From.IsBot
+}
+
+// TelegramError is an error response from the Telegram Bot API.
+type TelegramError struct {
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+func (e *TelegramError) Error() string {
+	return fmt.Sprintf("Telegram error %d: %s", e.ErrorCode, e.Description)
+}
+
+// telegramRetryAfter returns how long to wait if err is a rate limit response.
+func telegramRetryAfter(err error) (time.Duration, bool) {
+	telegramErr, ok := err.(*TelegramError)
+	if !ok || telegramErr.ErrorCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if telegramErr.Parameters.RetryAfter > 0 {
+		return time.Duration(telegramErr.Parameters.RetryAfter) * time.Second, true
+	}
+	return time.Second, true
+}
+
+type telegramAdmin struct {
+	admin   bool
+	expires time.Time
+}
+
+// Telegram is a Service provider for the Telegram Bot API.
+type Telegram struct {
+	sync.RWMutex
+	token       string
+	messageChan chan Message
+	ctx         context.Context
+	cancel      context.CancelFunc
+	outbox      *Outbox
+	closeOnce   sync.Once
+
+	offset  int64
+	chats   map[string]string
+	admins  map[string]*telegramAdmin
+	history map[string][]Message
+
+	Me *TelegramUser
+	// BaseURL is the url of the Bot API, it can be changed before Open to use a local Bot API server.
+	BaseURL string
+	// Client is the HTTP client used for requests to the Bot API.
+	Client      *http.Client
+	OwnerUserID string
+}
+
+// NewTelegram creates a new Telegram service.
+func NewTelegram(token string) *Telegram {
+	ctx, cancel := context.WithCancel(context.Background())
+	outbox := NewOutbox(5, time.Second, 100)
+	outbox.RetryAfter = telegramRetryAfter
+	return &Telegram{
+		token:       token,
+		messageChan: make(chan Message, 200),
+		ctx:         ctx,
+		cancel:      cancel,
+		outbox:      outbox,
+		chats:       make(map[string]string),
+		admins:      make(map[string]*telegramAdmin),
+		history:     make(map[string][]Message),
+		BaseURL:     DefaultTelegramURL,
+		Client:      http.DefaultClient,
+	}
+}
+
+// do makes a request to the Bot API and decodes the result into result, if result is not nil.
+func (t *Telegram) do(method, contentType string, body io.Reader, result interface{}) error {
+	u := fmt.Sprintf("%s/bot%s/%s", strings.TrimSuffix(t.BaseURL, "/"), t.token, method)
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return t.redact(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := t.Client.Do(req.WithContext(t.ctx))
+	if err != nil {
+		return t.redact(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	r := &struct {
+		OK     bool            `json:"ok"`
+		Result json.RawMessage `json:"result"`
+		TelegramError
+	}{}
+	if err := json.Unmarshal(data, r); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Telegram error %d: %s", resp.StatusCode, data)
+		}
+		return err
+	}
+	if !r.OK {
+		return &r.TelegramError
+	}
+
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+// redact removes the token from the url of a request error, as the token is part of every Bot API url and errors are logged.
+func (t *Telegram) redact(err error) error {
+	if urlErr, ok := err.(*url.Error); ok && t.token != "" {
+		urlErr.URL = strings.Replace(urlErr.URL, t.token, "<token>", -1)
+	}
+	return err
+}
+
+// call calls a Bot API method with JSON parameters.
+func (t *Telegram) call(method string, params, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return t.do(method, "application/json", bytes.NewReader(data), result)
+}
+
+// upload calls a Bot API method with a file.
+func (t *Telegram) upload(method string, params map[string]string, field, name string, data []byte, result interface{}) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range params {
+		writer.WriteField(k, v)
+	}
+
+	part, err := writer.CreateFormFile(field, name)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return t.do(method, writer.FormDataContentType(), body, result)
+}
+
+// content returns the text of a message, with the bot's name removed from a command addressed to it.
+func (t *Telegram) content(message *TelegramAPIMessage) string {
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+
+	suffix := "@" + strings.ToLower(t.Me.Username)
+	fields := strings.Fields(text)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "/") && strings.HasSuffix(strings.ToLower(fields[0]), suffix) {
+		i := strings.Index(text, fields[0]) + len(fields[0])
+		text = text[:i-len(suffix)] + text[i:]
+	}
+	return text
+}
+
+func (t *Telegram) onMessage(message *TelegramAPIMessage, messageType MessageType) {
+	if message.Chat == nil {
+		return
+	}
+
+	m := &TelegramMessage{message, messageType, t.content(message)}
+
+	t.Lock()
+	t.chats[m.Channel()] = message.Chat.Type
+	history := t.history[m.Channel()]
+	if messageType == MessageTypeCreate {
+		if history = append(history, m); len(history) > maxTelegramHistory {
+			history = history[1:]
+		}
+	} else {
+		for i, h := range history {
+			if h.MessageID() == m.MessageID() {
+				history[i] = &TelegramMessage{message, MessageTypeCreate, m.Content}
+				break
+			}
+		}
+	}
+	t.history[m.Channel()] = history
+	t.Unlock()
+
+	select {
+	case t.messageChan <- m:
+	case <-t.ctx.Done():
+	}
+}
+
+func (t *Telegram) poll() {
+	backoff := time.Second
+	for {
+		updates := []*telegramUpdate{}
+		err := t.call("getUpdates", map[string]interface{}{
+			"offset":          t.offset,
+			"timeout":         telegramPollTimeout,
+			"allowed_updates": []string{"message", "edited_message"},
+		}, &updates)
+
+		if t.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Error getting telegram updates, retrying in %v. %v", backoff, err)
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > telegramMaxBackoff {
+				backoff = telegramMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		for _, update := range updates {
+			t.offset = update.UpdateID + 1
+			if update.Message != nil {
+				t.onMessage(update.Message, MessageTypeCreate)
+			} else if update.EditedMessage != nil {
+				t.onMessage(update.EditedMessage, MessageTypeUpdate)
+			}
+		}
+	}
+}
+
+// Name returns the name of the service.
+func (t *Telegram) Name() string {
+	return TelegramServiceName
+}
+
+// Open opens the service and returns a channel which all messages will be sent on.
+func (t *Telegram) Open() (<-chan Message, error) {
+	t.Me = &TelegramUser{}
+	if err := t.call("getMe", struct{}{}, t.Me); err != nil {
+		return nil, err
+	}
+
+	go t.poll()
+	return t.messageChan, nil
+}
+
+// Close stops polling for updates.
+func (t *Telegram) Close() error {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		t.outbox.Close()
+	})
+	return nil
+}
+
+// IsMe returns whether or not a message was sent by the bot.
+func (t *Telegram) IsMe(message Message) bool {
+	return message.UserID() == t.UserID()
+}
+
+func (t *Telegram) send(ctx context.Context, chatID, message string, private bool) (string, error) {
+	var id string
+	err := t.outbox.SendContext(ctx, private, func() error {
+		m := &TelegramAPIMessage{}
+		if err := t.call("sendMessage", map[string]string{"chat_id": chatID, "text": message}, m); err != nil {
+			return err
+		}
+		id = strconv.FormatInt(m.MessageID, 10)
+		return nil
+	})
+	if err != nil {
+		log.Println("Error sending telegram message: ", err)
+		return "", err
+	}
+	return id, nil
+}
+
+// SendMessage sends a message.
+func (t *Telegram) SendMessage(channel, message string) error {
+	_, err := t.send(context.Background(), channel, message, false)
+	return err
+}
+
+// SendMessageContext sends a message, giving up if the context is done before it leaves the outbox.
+func (t *Telegram) SendMessageContext(ctx context.Context, channel, message string) error {
+	_, err := t.send(ctx, channel, message, false)
+	return err
+}
+
+// SendMessageID sends a message and returns its id.
+func (t *Telegram) SendMessageID(channel, message string) (string, error) {
+	return t.send(context.Background(), channel, message, false)
+}
+
+// EditMessage edits a message.
+func (t *Telegram) EditMessage(channel, messageID, message string) error {
+	return t.outbox.Send(false, func() error {
+		return t.call("editMessageText", map[string]string{"chat_id": channel, "message_id": messageID, "text": message}, nil)
+	})
+}
+
+// DeleteMessage deletes a message.
+func (t *Telegram) DeleteMessage(channel, messageID string) error {
+	return t.call("deleteMessage", map[string]string{"chat_id": channel, "message_id": messageID}, nil)
+}
+
+// CanSendFile returns true, files are sent with the Bot API.
+func (t *Telegram) CanSendFile(message Message) bool {
+	return true
+}
+
+// SendFile sends a file, images are sent as photos so that they are shown inline.
+func (t *Telegram) SendFile(channel, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	method, field := "sendDocument", "document"
+	switch http.DetectContentType(data) {
+	case "image/png", "image/jpeg":
+		method, field = "sendPhoto", "photo"
+	}
+
+	err = t.outbox.Send(false, func() error {
+		return t.upload(method, map[string]string{"chat_id": channel}, field, name, data, nil)
+	})
+	if err != nil {
+		log.Println("Error sending telegram file: ", err)
+		return err
+	}
+	return nil
+}
+
+// BanUser bans a user, for duration seconds or forever if duration is 0.
+func (t *Telegram) BanUser(channel, userID string, duration int) error {
+	params := map[string]interface{}{"chat_id": channel, "user_id": userID}
+	if duration > 0 {
+		params["until_date"] = time.Now().Add(time.Duration(duration) * time.Second).Unix()
+	}
+	return t.call("banChatMember", params, nil)
+}
+
+// UnbanUser unbans a user.
+func (t *Telegram) UnbanUser(channel, userID string) error {
+	return t.call("unbanChatMember", map[string]interface{}{"chat_id": channel, "user_id": userID, "only_if_banned": true}, nil)
+}
+
+// UserName returns the bots name.
+func (t *Telegram) UserName() string {
+	if t.Me == nil {
+		return ""
+	}
+	return t.Me.Username
+}
+
+// UserID returns the bots user id.
+func (t *Telegram) UserID() string {
+	if t.Me == nil {
+		return ""
+	}
+	return strconv.FormatInt(t.Me.ID, 10)
+}
+
+// Join returns an error, Telegram bots can not join chats themselves.
+func (t *Telegram) Join(join string) error {
+	return errors.New("Telegram bots can not join chats, add the bot to a group instead.")
+}
+
+// Typing sets that the bot is typing.
+func (t *Telegram) Typing(channel string) error {
+	return t.call("sendChatAction", map[string]string{"chat_id": channel, "action": "typing"}, nil)
+}
+
+// PrivateMessage will send a private message to a user.
+// The user must have started a chat with the bot, the id of a private chat is the id of the user.
+func (t *Telegram) PrivateMessage(userID, message string) error {
+	_, err := t.send(context.Background(), userID, message, true)
+	return err
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (t *Telegram) Outbox() *Outbox {
+	return t.outbox
+}
+
+// SupportsPrivateMessages returns whether the service supports private messages.
+func (t *Telegram) SupportsPrivateMessages() bool {
+	return true
+}
+
+// SupportsMultiline returns whether the service supports multiline messages.
+func (t *Telegram) SupportsMultiline() bool {
+	return true
+}
+
+// CommandPrefix returns the command prefix for the service, which is the prefix of Telegram's slash commands.
+func (t *Telegram) CommandPrefix() string {
+	return "/"
+}
+
+// IsBotOwner returns whether or not a message sender was the owner of the bot.
+func (t *Telegram) IsBotOwner(message Message) bool {
+	return message.UserID() == t.OwnerUserID
+}
+
+// IsPrivate returns whether or not a message was sent in a private chat.
+func (t *Telegram) IsPrivate(message Message) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.chats[message.Channel()] == "private"
+}
+
+// IsModerator returns whether or not the sender of a message is an admin of the chat.
+func (t *Telegram) IsModerator(message Message) bool {
+	if t.IsPrivate(message) {
+		return false
+	}
+
+	key := message.Channel() + ":" + message.UserID()
+
+	t.RLock()
+	cached := t.admins[key]
+	t.RUnlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.admin
+	}
+
+	member := &struct {
+		Status string `json:"status"`
+	}{}
+	if err := t.call("getChatMember", map[string]string{"chat_id": message.Channel(), "user_id": message.UserID()}, member); err != nil {
+		log.Printf("Error getting telegram chat member %s. %v", key, err)
+		return false
+	}
+
+	admin := member.Status == "creator" || member.Status == "administrator"
+
+	t.Lock()
+	t.admins[key] = &telegramAdmin{admin, time.Now().Add(telegramAdminCacheTime)}
+	t.Unlock()
+
+	return admin
+}
+
+// ChannelCount returns the number of chats the bot has seen messages in.
+func (t *Telegram) ChannelCount() int {
+	t.RLock()
+	defer t.RUnlock()
+
+	return len(t.chats)
+}
+
+// SupportsMessageHistory returns if the service supports message history.
+func (t *Telegram) SupportsMessageHistory() bool {
+	return true
+}
+
+// MessageHistory returns the message history for a channel.
+func (t *Telegram) MessageHistory(channel string) []Message {
+	t.RLock()
+	defer t.RUnlock()
+
+	return append([]Message{}, t.history[channel]...)
+}
@@ -0,0 +1,121 @@
+package comicjerk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const telegramTestToken = "123456:secret-token"
+
+// telegramBotAPI is a fake Bot API that returns queued updates and records the other calls.
+type telegramBotAPI struct {
+	sync.Mutex
+	updates []string
+	calls   map[string][]string
+}
+
+func (b *telegramBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/bot" + telegramTestToken + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"ok":false,"error_code":401,"description":"Unauthorized"}`))
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, prefix)
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch method {
+	case "getMe":
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"Test","username":"TestBot"}}`))
+	case "getUpdates":
+		b.Lock()
+		if len(b.updates) > 0 {
+			update := b.updates[0]
+			b.updates = b.updates[1:]
+			b.Unlock()
+			w.Write([]byte(`{"ok":true,"result":[` + update + `]}`))
+			return
+		}
+		b.Unlock()
+
+		// Long polling with nothing to return.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(20 * time.Millisecond):
+		}
+		w.Write([]byte(`{"ok":true,"result":[]}`))
+	case "sendMessage":
+		b.Lock()
+		b.calls[method] = append(b.calls[method], string(body))
+		b.Unlock()
+		w.Write([]byte(`{"ok":true,"result":{"message_id":5,"chat":{"id":-100,"type":"group"},"date":0,"text":"sent"}}`))
+	default:
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests","parameters":{"retry_after":3}}`))
+	}
+}
+
+func TestTelegram(t *testing.T) {
+	api := &telegramBotAPI{
+		updates: []string{`{"update_id":7,"message":{"message_id":1,"from":{"id":42,"is_bot":false,"first_name":"Bob","username":"bob"},"chat":{"id":-100,"type":"group"},"date":0,"text":"/comic@TestBot 3"}}`},
+		calls:   map[string][]string{},
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	telegram := NewTelegram(telegramTestToken)
+	telegram.BaseURL = server.URL
+	messages, err := telegram.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer telegram.Close()
+
+	select {
+	case message := <-messages:
+		if message.Message() != "/comic 3" || message.Channel() != "-100" || message.UserName() != "bob" {
+			t.Errorf("message = %q in %s from %s, want /comic 3 in -100 from bob", message.Message(), message.Channel(), message.UserName())
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the update")
+	}
+
+	id, err := telegram.SendMessageID("-100", "hello")
+	if err != nil || id != "5" {
+		t.Fatalf("SendMessageID = %s, %v, want 5", id, err)
+	}
+	api.Lock()
+	calls := api.calls["sendMessage"]
+	api.Unlock()
+	params := map[string]string{}
+	if len(calls) != 1 || json.Unmarshal([]byte(calls[0]), &params) != nil || params["chat_id"] != "-100" || params["text"] != "hello" {
+		t.Errorf("sendMessage = %v, want hello sent to -100", calls)
+	}
+}
+
+func TestTelegramErrors(t *testing.T) {
+	api := &telegramBotAPI{calls: map[string][]string{}}
+	server := httptest.NewServer(api)
+
+	telegram := NewTelegram(telegramTestToken)
+	telegram.BaseURL = server.URL
+	defer telegram.Close()
+
+	err := telegram.call("sendChatAction", struct{}{}, nil)
+	if retry, ok := telegramRetryAfter(err); !ok || retry != 3*time.Second {
+		t.Errorf("error = %v, want a rate limit of 3s", err)
+	}
+
+	// Request errors include the url, which must not contain the token.
+	server.Close()
+	err = telegram.call("getMe", struct{}{}, nil)
+	if err == nil || strings.Contains(err.Error(), telegramTestToken) {
+		t.Errorf("error = %v, want an error without the token", err)
+	}
+}
@@ -0,0 +1,371 @@
+package comicjerk
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TestServiceName is the service name for the Test service.
+const TestServiceName string = "Test"
+
+// TestMessage is a Message that can be injected into a TestService.
+type TestMessage struct {
+	ChannelID    string
+	Author       string
+	AuthorID     string
+	AuthorAvatar string
+	Content      string
+	ID           string
+	MessageType  MessageType
+	Bot          bool
+}
+
+// Channel returns the channel id for this message.
+func (m *TestMessage) Channel() string {
+	return m.ChannelID
+}
+
+// UserName returns the user name for this message.
+func (m *TestMessage) UserName() string {
+	return m.Author
+}
+
+// UserID returns the user id for this message.
+func (m *TestMessage) UserID() string {
+	if m.AuthorID == "" {
+		return m.Author
+	}
+	return m.AuthorID
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *TestMessage) UserAvatar() string {
+	return m.AuthorAvatar
+}
+
+// Message returns the message content for this message.
+func (m *TestMessage) Message() string {
+	return m.Content
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *TestMessage) RawMessage() string {
+	return m.Content
+}
+
+// MessageID returns the message ID for this message.
+func (m *TestMessage) MessageID() string {
+	return m.ID
+}
+
+// Type returns the type of message.
+func (m *TestMessage) Type() MessageType {
+	if m.MessageType == "" {
+		return MessageTypeCreate
+	}
+	return m.MessageType
+}
+
+// IsBot returns whether the message was sent by a bot.
+func (m *TestMessage) IsBot() bool {
+	return m.Bot
+}
+
+// TestCall is a record of a single call made on a TestService.
+type TestCall struct {
+	// Method is the name of the Service method that was called, eg. "SendMessage".
+	Method string
+	// Target is the channel or user id the call was made against.
+	Target string
+	// Message is the message, message id or file name of the call.
+	Message string
+	// MessageID is the id of a message sent with SendMessageID, or edited with EditMessage.
+	MessageID string
+	// Data holds the contents of a file sent with SendFile.
+	Data []byte
+	// Duration is the ban duration for BanUser.
+	Duration int
+}
+
+// TestService is an in-memory Service provider, used to exercise plugins without a live connection.
+// Messages are injected with Inject, and every outgoing call is recorded for inspection with Calls.
+type TestService struct {
+	sync.Mutex
+	messageChan chan Message
+	calls       []*TestCall
+	sent        int
+	history     map[string][]Message
+
+	// ServiceName is the name of the service, it defaults to TestServiceName.
+	// Set it to register several test services on one bot.
+	ServiceName string
+
+	BotName string
+	BotID   string
+	Prefix  string
+
+	Private         bool
+	Moderator       bool
+	BotOwner        bool
+	Multiline       bool
+	PrivateMessages bool
+	Channels        int
+
+	// The func fields, if set, take precedence over the matching bool fields.
+	IsPrivateFunc   func(Message) bool
+	IsModeratorFunc func(Message) bool
+	IsBotOwnerFunc  func(Message) bool
+
+	// Err, if set, is returned from every recorded call.
+	Err error
+
+	// History is whether the service supports message history, messages are added to it with AddHistory.
+	History bool
+
+	// NativeFiles is whether the service can send files itself, see NativeFileService.
+	NativeFiles bool
+}
+
+// NewTestService creates a new Test service.
+func NewTestService() *TestService {
+	return &TestService{
+		messageChan:     make(chan Message, 200),
+		BotName:         "comicjerk",
+		BotID:           "comicjerk",
+		Prefix:          "!",
+		Multiline:       true,
+		PrivateMessages: true,
+		Channels:        1,
+		History:         true,
+		history:         make(map[string][]Message),
+	}
+}
+
+// Inject sends a message to the channel returned by Open, as if it had been received by the service.
+func (t *TestService) Inject(message Message) {
+	t.messageChan <- message
+}
+
+// InjectString is a helper that injects a new message from the provided user into a channel.
+func (t *TestService) InjectString(channel, user, message string) {
+	t.Inject(&TestMessage{
+		ChannelID: channel,
+		Author:    user,
+		Content:   message,
+	})
+}
+
+func (t *TestService) record(call *TestCall) error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.calls = append(t.calls, call)
+	return t.Err
+}
+
+// Calls returns the recorded calls, filtered by method if one is provided.
+func (t *TestService) Calls(method string) []*TestCall {
+	t.Lock()
+	defer t.Unlock()
+
+	calls := []*TestCall{}
+	for _, c := range t.calls {
+		if method == "" || c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// WaitForCalls blocks until at least count calls matching method have been recorded, or the timeout expires.
+// Plugins often reply from their own goroutines, so this should be used before asserting on Calls.
+func (t *TestService) WaitForCalls(method string, count int, timeout time.Duration) []*TestCall {
+	deadline := time.Now().Add(timeout)
+	for {
+		calls := t.Calls(method)
+		if len(calls) >= count || time.Now().After(deadline) {
+			return calls
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// AddHistory appends messages to the message history of a channel.
+func (t *TestService) AddHistory(channel string, messages ...Message) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.history[channel] = append(t.history[channel], messages...)
+}
+
+// Reset clears all recorded calls.
+func (t *TestService) Reset() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.calls = nil
+}
+
+// Name returns the name of the service.
+func (t *TestService) Name() string {
+	if t.ServiceName != "" {
+		return t.ServiceName
+	}
+	return TestServiceName
+}
+
+// Open opens the service and returns a channel which all messages will be sent on.
+func (t *TestService) Open() (<-chan Message, error) {
+	return t.messageChan, nil
+}
+
+// Close closes the service.
+func (t *TestService) Close() error {
+	return t.record(&TestCall{Method: "Close"})
+}
+
+// IsMe returns whether or not a message was sent by the bot.
+func (t *TestService) IsMe(message Message) bool {
+	return message.UserID() == t.BotID
+}
+
+// SendMessage sends a message.
+func (t *TestService) SendMessage(channel, message string) error {
+	return t.record(&TestCall{Method: "SendMessage", Target: channel, Message: message})
+}
+
+// SendMessageID sends a message and returns its id, ids are numbered from 1.
+func (t *TestService) SendMessageID(channel, message string) (string, error) {
+	t.Lock()
+	t.sent++
+	id := strconv.Itoa(t.sent)
+	t.Unlock()
+
+	if err := t.record(&TestCall{Method: "SendMessage", Target: channel, Message: message, MessageID: id}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// EditMessage edits a message.
+func (t *TestService) EditMessage(channel, messageID, message string) error {
+	return t.record(&TestCall{Method: "EditMessage", Target: channel, Message: message, MessageID: messageID})
+}
+
+// DeleteMessage deletes a message.
+func (t *TestService) DeleteMessage(channel, messageID string) error {
+	return t.record(&TestCall{Method: "DeleteMessage", Target: channel, Message: messageID})
+}
+
+// CanSendFile returns whether NativeFiles is set.
+func (t *TestService) CanSendFile(message Message) bool {
+	return t.NativeFiles
+}
+
+// SendFile sends a file.
+func (t *TestService) SendFile(channel, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return t.record(&TestCall{Method: "SendFile", Target: channel, Message: name, Data: data})
+}
+
+// BanUser bans a user.
+func (t *TestService) BanUser(channel, userID string, duration int) error {
+	return t.record(&TestCall{Method: "BanUser", Target: channel, Message: userID, Duration: duration})
+}
+
+// UnbanUser unbans a user.
+func (t *TestService) UnbanUser(channel, userID string) error {
+	return t.record(&TestCall{Method: "UnbanUser", Target: channel, Message: userID})
+}
+
+// UserName returns the bots name.
+func (t *TestService) UserName() string {
+	return t.BotName
+}
+
+// UserID returns the bots user id.
+func (t *TestService) UserID() string {
+	return t.BotID
+}
+
+// Join will join a channel.
+func (t *TestService) Join(join string) error {
+	return t.record(&TestCall{Method: "Join", Target: join})
+}
+
+// Typing sets that the bot is typing.
+func (t *TestService) Typing(channel string) error {
+	return t.record(&TestCall{Method: "Typing", Target: channel})
+}
+
+// PrivateMessage will send a private message to a user.
+func (t *TestService) PrivateMessage(userID, message string) error {
+	if !t.PrivateMessages {
+		return errors.New("Private messages not supported.")
+	}
+	return t.record(&TestCall{Method: "PrivateMessage", Target: userID, Message: message})
+}
+
+// SupportsPrivateMessages returns whether the service supports private messages.
+func (t *TestService) SupportsPrivateMessages() bool {
+	return t.PrivateMessages
+}
+
+// SupportsMultiline returns whether the service supports multiline messages.
+func (t *TestService) SupportsMultiline() bool {
+	return t.Multiline
+}
+
+// CommandPrefix returns the command prefix for the service.
+func (t *TestService) CommandPrefix() string {
+	return t.Prefix
+}
+
+// IsBotOwner returns whether or not a message sender was the owner of the bot.
+func (t *TestService) IsBotOwner(message Message) bool {
+	if t.IsBotOwnerFunc != nil {
+		return t.IsBotOwnerFunc(message)
+	}
+	return t.BotOwner
+}
+
+// IsPrivate returns whether or not a message was private.
+func (t *TestService) IsPrivate(message Message) bool {
+	if t.IsPrivateFunc != nil {
+		return t.IsPrivateFunc(message)
+	}
+	return t.Private
+}
+
+// IsModerator returns whether or not the sender of a message is a moderator.
+func (t *TestService) IsModerator(message Message) bool {
+	if t.IsModeratorFunc != nil {
+		return t.IsModeratorFunc(message)
+	}
+	return t.Moderator
+}
+
+// ChannelCount returns the number of channels the bot is in.
+func (t *TestService) ChannelCount() int {
+	return t.Channels
+}
+
+// SupportsMessageHistory returns if the service supports message history.
+func (t *TestService) SupportsMessageHistory() bool {
+	return t.History
+}
+
+// MessageHistory returns the message history for a channel.
+func (t *TestService) MessageHistory(channel string) []Message {
+	t.Lock()
+	defer t.Unlock()
+
+	return append([]Message(nil), t.history[channel]...)
+}
@@ -0,0 +1,108 @@
+package comicjerk
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long tests wait for plugins to reply.
+const testTimeout = time.Second
+
+// newTestBot returns a bot with a TestService and a CommandPlugin registered, with plugin state in a temporary directory.
+// The returned func closes the bot and removes its state, the bot must be opened before it is called.
+func newTestBot(t *testing.T) (*Bot, *TestService, *CommandPlugin, func()) {
+	dir, err := ioutil.TempDir("", "comicjerk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bot := NewBot()
+	bot.Store = NewFileStore(dir)
+	service := NewTestService()
+	bot.RegisterService(service)
+	cp := NewCommandPlugin()
+	bot.RegisterPlugin(service, cp)
+
+	return bot, service, cp, func() {
+		bot.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// send injects a message and waits for the next message the bot sends, it returns "" if no message was sent.
+func send(service *TestService, user, message string) string {
+	n := len(service.Calls("SendMessage"))
+	service.InjectString("#channel", user, message)
+	calls := service.WaitForCalls("SendMessage", n+1, testTimeout)
+	if len(calls) <= n {
+		return ""
+	}
+	return calls[n].Message
+}
+
+func TestTestServiceCommand(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {
+		service.SendMessage(message.Channel(), "pong "+args)
+	}, NewCommandHelp("", "Replies with pong."))
+	bot.Open()
+
+	if got := send(service, "bob", "!ping hello"); got != "pong hello" {
+		t.Errorf("ping = %q, want %q", got, "pong hello")
+	}
+	if got := send(service, "bob", "ping"); got != "" {
+		t.Errorf("unprefixed ping = %q, want no reply", got)
+	}
+
+	calls := service.Calls("SendMessage")
+	if len(calls) != 1 || calls[0].Target != "#channel" {
+		t.Errorf("calls = %v, want one message to #channel", calls)
+	}
+}
+
+func TestTestServiceHelp(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {}, NewCommandHelp("", "Replies with pong."))
+	bot.Open()
+
+	if got := send(service, "bob", "!help"); !strings.Contains(got, "!ping - Replies with pong.") {
+		t.Errorf("help = %q, want it to list ping", got)
+	}
+}
+
+func TestTestServiceIgnoresSelf(t *testing.T) {
+	bot, service, cp, closer := newTestBot(t)
+	defer closer()
+
+	cp.AddCommand("ping", func(bot *Bot, service Service, message Message, args string, parts []string) {
+		service.SendMessage(message.Channel(), "pong")
+	}, nil)
+	bot.Open()
+
+	if got := send(service, service.BotID, "!ping"); got != "" {
+		t.Errorf("ping from the bot = %q, want no reply", got)
+	}
+}
+
+func TestTestServiceHistory(t *testing.T) {
+	service := NewTestService()
+	service.AddHistory("#channel", &TestMessage{ChannelID: "#channel", Author: "bob", Content: "hello"})
+
+	history := service.MessageHistory("#channel")
+	if len(history) != 1 || history[0].Message() != "hello" {
+		t.Fatalf("history = %v, want one message", history)
+	}
+
+	// Changing the returned history does not change the service's history.
+	history[0] = nil
+	if service.MessageHistory("#channel")[0] == nil {
+		t.Error("history was changed through the returned slice")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build go1.8
+// +build go1.8
+
+package comicjerk
+
+import "crypto/tls"
+
+// cloneTLSConfig returns a copy of a TLS config.
+func cloneTLSConfig(c *tls.Config) *tls.Config {
+	return c.Clone()
+}
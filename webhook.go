@@ -0,0 +1,682 @@
+package comicjerk
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookServiceName is the service name for the Webhook service.
+const WebhookServiceName string = "Webhook"
+
+// WebhookSignatureHeader is the header with the HMAC-SHA256 signature of a request, eg. sha256=<hex>.
+// The signature is of the timestamp header, a dot and the body.
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+// WebhookTimestampHeader is the header with the unix time a request was signed at.
+const WebhookTimestampHeader = "X-Webhook-Timestamp"
+
+// webhookMaxSkew is how old a signed request can be, so that captured requests can not be replayed later.
+const webhookMaxSkew = 5 * time.Minute
+
+// maxWebhookBody is the largest request body that is accepted.
+const maxWebhookBody = 1 << 20
+
+// maxWebhookHistory is the number of messages kept for each channel.
+const maxWebhookHistory = 100
+
+// WebhookMessage is a message posted to the webhook endpoint, as JSON.
+type WebhookMessage struct {
+	ID        string      `json:"id"`
+	ChannelID string      `json:"channel"`
+	User      string      `json:"user_id"`
+	Name      string      `json:"user_name"`
+	Avatar    string      `json:"user_avatar"`
+	Text      string      `json:"text"`
+	Kind      MessageType `json:"type"`
+	// Private and Bot are trusted as sent. Moderator, and the owner's user_id, are only trusted on signed requests.
+	Private   bool `json:"private"`
+	Moderator bool `json:"moderator"`
+	Bot       bool `json:"bot"`
+
+	// signed is whether the request was signed with the Secret.
+	signed bool
+	// request is the request waiting for replies to the message, if replies are returned in the response.
+	request *webhookRequest
+}
+
+// Channel returns the channel id for this message.
+func (m *WebhookMessage) Channel() string {
+	return m.ChannelID
+}
+
+// UserName returns the user name for this message.
+func (m *WebhookMessage) UserName() string {
+	if m.Name == "" {
+		return m.User
+	}
+	return m.Name
+}
+
+// UserID returns the user id for this message.
+func (m *WebhookMessage) UserID() string {
+	return m.User
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *WebhookMessage) UserAvatar() string {
+	return m.Avatar
+}
+
+// Message returns the message content for this message.
+func (m *WebhookMessage) Message() string {
+	return m.Text
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *WebhookMessage) RawMessage() string {
+	return m.Text
+}
+
+// MessageID returns the message ID for this message.
+func (m *WebhookMessage) MessageID() string {
+	return m.ID
+}
+
+// Type returns the type of message.
+func (m *WebhookMessage) Type() MessageType {
+	return m.Kind
+}
+
+// IsBot returns whether the message was sent by a bot.
+func (m *WebhookMessage) IsBot() bool {
+	return m.Bot
+}
+
+// WebhookReply is a message sent by the bot, as JSON.
+type WebhookReply struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel,omitempty"`
+	// UserID is set instead of Channel for private messages.
+	UserID   string `json:"user_id,omitempty"`
+	Text     string `json:"text,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	File     []byte `json:"file,omitempty"`
+}
+
+// WebhookError is an error response from the callback url.
+type WebhookError struct {
+	StatusCode int
+	RetryAfter int
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("Webhook callback error %d", e.StatusCode)
+}
+
+// webhookRetryAfter returns how long to wait if err is a rate limit response.
+func webhookRetryAfter(err error) (time.Duration, bool) {
+	webhookErr, ok := err.(*WebhookError)
+	if !ok || webhookErr.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if webhookErr.RetryAfter > 0 {
+		return time.Duration(webhookErr.RetryAfter) * time.Second, true
+	}
+	return time.Second, true
+}
+
+// webhookRequest is a request waiting for the replies to its message.
+type webhookRequest struct {
+	replies []*WebhookReply
+	notify  chan struct{}
+}
+
+// Webhook is a Service provider that receives messages as JSON POSTs, for using plugins from CI systems and other tools.
+// If CallbackURL is set replies are POSTed to it, otherwise they are returned in the response to the request they reply to.
+type Webhook struct {
+	sync.RWMutex
+	addr        string
+	listener    net.Listener
+	messageChan chan Message
+	ctx         context.Context
+	cancel      context.CancelFunc
+	outbox      *Outbox
+	closeOnce   sync.Once
+	lastID      int
+
+	pending    []*webhookRequest
+	private    map[string]bool
+	moderators map[string]bool
+	history    map[string][]Message
+
+	// Secret is the shared secret requests and callbacks are signed with, requests are not checked if it is empty.
+	// Without it the service only listens on loopback addresses, and no request is trusted as the owner or a moderator.
+	Secret string
+	// CallbackURL is the url replies are POSTed to.
+	CallbackURL string
+	// ResponseTimeout is the longest a command waits for replies, when there is no CallbackURL.
+	ResponseTimeout time.Duration
+	// ResponseDelay is how long a request waits after a reply for more replies.
+	ResponseDelay time.Duration
+	// Client is the HTTP client used for callbacks.
+	Client *http.Client
+	// Prefix is the command prefix, it defaults to !.
+	Prefix      string
+	BotName     string
+	OwnerUserID string
+}
+
+// NewWebhook creates a new Webhook service that listens on addr, eg. :8080.
+// If addr is empty the service does not listen, and it can be used as a http.Handler instead.
+func NewWebhook(addr string) *Webhook {
+	ctx, cancel := context.WithCancel(context.Background())
+	outbox := NewOutbox(5, time.Second, 100)
+	outbox.RetryAfter = webhookRetryAfter
+	return &Webhook{
+		addr:            addr,
+		messageChan:     make(chan Message, 200),
+		ctx:             ctx,
+		cancel:          cancel,
+		outbox:          outbox,
+		private:         make(map[string]bool),
+		moderators:      make(map[string]bool),
+		history:         make(map[string][]Message),
+		ResponseTimeout: 30 * time.Second,
+		ResponseDelay:   time.Second,
+		Client:          http.DefaultClient,
+		Prefix:          "!",
+		BotName:         "comicjerk",
+	}
+}
+
+// sign returns the signature of a body signed at a time.
+func (w *Webhook) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of a request.
+func (w *Webhook) verify(r *http.Request, body []byte) error {
+	if w.Secret == "" {
+		return nil
+	}
+
+	timestamp := r.Header.Get(WebhookTimestampHeader)
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Missing or invalid timestamp.")
+	}
+	if skew := time.Since(time.Unix(t, 0)); skew > webhookMaxSkew || skew < -webhookMaxSkew {
+		return errors.New("Request timestamp is too old.")
+	}
+	if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(w.sign(timestamp, body))) {
+		return errors.New("Invalid signature.")
+	}
+	return nil
+}
+
+func webhookHTTPError(rw http.ResponseWriter, message string, code int) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]string{"error": message})
+}
+
+// ServeHTTP receives a message.
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		webhookHTTPError(rw, "Only POST is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		webhookHTTPError(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxWebhookBody {
+		webhookHTTPError(rw, "Request is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := w.verify(r, body); err != nil {
+		webhookHTTPError(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	m := &WebhookMessage{}
+	if err := json.Unmarshal(body, m); err != nil {
+		webhookHTTPError(rw, "Invalid JSON.", http.StatusBadRequest)
+		return
+	}
+	if m.Kind == "" {
+		m.Kind = MessageTypeCreate
+	}
+	switch {
+	case m.Kind != MessageTypeCreate && m.Kind != MessageTypeUpdate && m.Kind != MessageTypeDelete:
+		webhookHTTPError(rw, "Type must be create, update or delete.", http.StatusBadRequest)
+		return
+	case m.ChannelID == "" || m.User == "":
+		webhookHTTPError(rw, "A channel and user_id are required.", http.StatusBadRequest)
+		return
+	case m.Kind != MessageTypeCreate && m.ID == "":
+		webhookHTTPError(rw, "An id is required for updates and deletes.", http.StatusBadRequest)
+		return
+	}
+
+	// verify only accepts requests without a signature when there is no Secret.
+	m.signed = w.Secret != ""
+
+	w.Lock()
+	if m.ID == "" {
+		w.lastID++
+		m.ID = fmt.Sprintf("m%d", w.lastID)
+	}
+	w.private[m.ChannelID] = m.Private
+	w.moderators[m.ChannelID+":"+m.User] = m.Moderator && m.signed
+	w.addHistory(m)
+
+	var request *webhookRequest
+	if w.CallbackURL == "" {
+		request = &webhookRequest{notify: make(chan struct{}, 1)}
+		m.request = request
+		w.pending = append(w.pending, request)
+	}
+	w.Unlock()
+
+	select {
+	case w.messageChan <- m:
+	case <-w.ctx.Done():
+		webhookHTTPError(rw, "The webhook is closed.", http.StatusServiceUnavailable)
+		return
+	}
+
+	if request == nil {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(rw).Encode(map[string]string{"id": m.ID})
+		return
+	}
+
+	// Only commands are expected to have replies, so other messages are answered sooner.
+	timeout := w.ResponseDelay
+	if m.Private || strings.HasPrefix(m.Text, w.Prefix) {
+		timeout = w.ResponseTimeout
+	}
+	w.wait(r.Context(), request, timeout)
+
+	w.Lock()
+	for i, p := range w.pending {
+		if p == request {
+			w.pending = append(w.pending[:i:i], w.pending[i+1:]...)
+			break
+		}
+	}
+	replies := request.replies
+	w.Unlock()
+
+	if replies == nil {
+		replies = []*WebhookReply{}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{"id": m.ID, "replies": replies})
+}
+
+// wait waits until there have been no replies to a request for ResponseDelay, or until timeout.
+func (w *Webhook) wait(ctx context.Context, request *webhookRequest, d time.Duration) {
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+
+	var quiet <-chan time.Time
+	for {
+		select {
+		case <-request.notify:
+			quiet = time.After(w.ResponseDelay)
+		case <-quiet:
+			return
+		case <-timeout.C:
+			return
+		case <-ctx.Done():
+			return
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// addHistory adds a message to the history of its channel, the lock must be held.
+func (w *Webhook) addHistory(m *WebhookMessage) {
+	history := w.history[m.ChannelID]
+	switch m.Kind {
+	case MessageTypeCreate:
+		if history = append(history, m); len(history) > maxWebhookHistory {
+			history = history[1:]
+		}
+	default:
+		for i, h := range history {
+			if h.MessageID() != m.MessageID() {
+				continue
+			}
+			if m.Kind == MessageTypeDelete {
+				history = append(history[:i:i], history[i+1:]...)
+			} else {
+				edited := *m
+				edited.Kind = MessageTypeCreate
+				history[i] = &edited
+			}
+			break
+		}
+	}
+	w.history[m.ChannelID] = history
+}
+
+// deliver adds a reply to the request of the message it answers, or POSTs it to the callback url.
+// Replies that are not sent while a plugin handles a message, or that are sent after its request has been answered,
+// can only be sent to the callback url.
+func (w *Webhook) deliver(reply *WebhookReply, request *webhookRequest) error {
+	if request != nil {
+		w.Lock()
+		for _, p := range w.pending {
+			if p == request {
+				p.replies = append(p.replies, reply)
+				select {
+				case p.notify <- struct{}{}:
+				default:
+				}
+				w.Unlock()
+				return nil
+			}
+		}
+		w.Unlock()
+	}
+
+	if w.CallbackURL == "" {
+		return errors.New("No request to reply to and no callback url.")
+	}
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, w.sign(timestamp, body))
+	}
+
+	resp, err := w.Client.Do(req.WithContext(w.ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &WebhookError{resp.StatusCode, retryAfter}
+	}
+	return nil
+}
+
+func (w *Webhook) send(reply *WebhookReply, private bool, request *webhookRequest) (string, error) {
+	w.Lock()
+	w.lastID++
+	reply.ID = fmt.Sprintf("r%d", w.lastID)
+	w.Unlock()
+
+	err := w.outbox.Send(private, func() error {
+		return w.deliver(reply, request)
+	})
+	if err != nil {
+		log.Println("Error sending webhook message: ", err)
+		return "", err
+	}
+	return reply.ID, nil
+}
+
+// Name returns the name of the service.
+func (w *Webhook) Name() string {
+	return WebhookServiceName
+}
+
+// isLoopback returns whether an address only listens on the loopback interface, eg. 127.0.0.1:8080 or localhost:8080.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Open starts listening for messages and returns a channel which all messages will be sent on.
+// Without a Secret anyone who can reach the address could send messages, so only loopback addresses are allowed.
+func (w *Webhook) Open() (<-chan Message, error) {
+	if w.addr != "" {
+		if w.Secret == "" && !isLoopback(w.addr) {
+			return nil, fmt.Errorf("A webhook secret is required to listen on %s, only loopback addresses can be used without one.", w.addr)
+		}
+
+		listener, err := net.Listen("tcp", w.addr)
+		if err != nil {
+			return nil, err
+		}
+		w.listener = listener
+
+		go func() {
+			if err := http.Serve(listener, w); err != nil && w.ctx.Err() == nil {
+				log.Printf("Error serving webhook. %v", err)
+			}
+		}()
+	}
+	return w.messageChan, nil
+}
+
+// Close stops listening for messages.
+func (w *Webhook) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		w.cancel()
+		w.outbox.Close()
+		if w.listener != nil {
+			err = w.listener.Close()
+		}
+	})
+	return err
+}
+
+// IsMe returns whether or not a message was sent by the bot.
+func (w *Webhook) IsMe(message Message) bool {
+	return message.UserID() == w.BotName
+}
+
+// ForMessage returns the service for the plugins handling a message, so that their replies are returned in the response
+// to the request the message was sent in.
+func (w *Webhook) ForMessage(message Message) Service {
+	m, ok := UnwrapMessage(message).(*WebhookMessage)
+	if !ok || m.request == nil {
+		return w
+	}
+	return &webhookReplier{Webhook: w, request: m.request}
+}
+
+// SendMessage sends a message.
+func (w *Webhook) SendMessage(channel, message string) error {
+	_, err := w.send(&WebhookReply{Channel: channel, Text: message}, false, nil)
+	return err
+}
+
+// DeleteMessage deletes a message.
+func (w *Webhook) DeleteMessage(channel, messageID string) error {
+	return errors.New("Deleting messages not supported on webhooks.")
+}
+
+// CanSendFile returns true, files are sent in the JSON reply.
+func (w *Webhook) CanSendFile(message Message) bool {
+	return true
+}
+
+// SendFile sends a file, its contents are base64 encoded in the JSON reply.
+func (w *Webhook) SendFile(channel, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.send(&WebhookReply{Channel: channel, FileName: name, File: data}, false, nil)
+	return err
+}
+
+// BanUser bans a user.
+func (w *Webhook) BanUser(channel, userID string, duration int) error {
+	return errors.New("Banning users not supported on webhooks.")
+}
+
+// UnbanUser unbans a user.
+func (w *Webhook) UnbanUser(channel, userID string) error {
+	return errors.New("Unbanning users not supported on webhooks.")
+}
+
+// UserName returns the bots name.
+func (w *Webhook) UserName() string {
+	return w.BotName
+}
+
+// UserID returns the bots user id.
+func (w *Webhook) UserID() string {
+	return w.BotName
+}
+
+// Join does nothing, channels are whatever messages are sent with.
+func (w *Webhook) Join(join string) error {
+	return nil
+}
+
+// Typing sets that the bot is typing.
+func (w *Webhook) Typing(channel string) error {
+	return nil
+}
+
+// PrivateMessage will send a private message to a user.
+func (w *Webhook) PrivateMessage(userID, message string) error {
+	_, err := w.send(&WebhookReply{UserID: userID, Text: message}, true, nil)
+	return err
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (w *Webhook) Outbox() *Outbox {
+	return w.outbox
+}
+
+// SupportsPrivateMessages returns whether the service supports private messages.
+func (w *Webhook) SupportsPrivateMessages() bool {
+	return true
+}
+
+// SupportsMultiline returns whether the service supports multiline messages.
+func (w *Webhook) SupportsMultiline() bool {
+	return true
+}
+
+// CommandPrefix returns the command prefix for the service.
+func (w *Webhook) CommandPrefix() string {
+	return w.Prefix
+}
+
+// IsBotOwner returns whether or not a message sender was the owner of the bot, which needs a signed request.
+func (w *Webhook) IsBotOwner(message Message) bool {
+	m, ok := UnwrapMessage(message).(*WebhookMessage)
+	return ok && m.signed && w.OwnerUserID != "" && m.UserID() == w.OwnerUserID
+}
+
+// IsPrivate returns whether or not a message was marked as private. For other messages, it returns whether the last
+// message in their channel was.
+func (w *Webhook) IsPrivate(message Message) bool {
+	if m, ok := UnwrapMessage(message).(*WebhookMessage); ok {
+		return m.Private
+	}
+
+	w.RLock()
+	defer w.RUnlock()
+
+	return w.private[message.Channel()]
+}
+
+// IsModerator returns whether or not the sender of a message was marked as a moderator in their last signed message in the channel.
+func (w *Webhook) IsModerator(message Message) bool {
+	w.RLock()
+	defer w.RUnlock()
+
+	return w.moderators[message.Channel()+":"+message.UserID()]
+}
+
+// ChannelCount returns the number of channels messages have been sent in.
+func (w *Webhook) ChannelCount() int {
+	w.RLock()
+	defer w.RUnlock()
+
+	return len(w.private)
+}
+
+// SupportsMessageHistory returns if the service supports message history.
+func (w *Webhook) SupportsMessageHistory() bool {
+	return true
+}
+
+// MessageHistory returns the message history for a channel.
+func (w *Webhook) MessageHistory(channel string) []Message {
+	w.RLock()
+	defer w.RUnlock()
+
+	return append([]Message{}, w.history[channel]...)
+}
+
+// webhookReplier is the service plugins are given while they handle a message, it returns their replies in the response
+// to the message's request.
+type webhookReplier struct {
+	*Webhook
+	request *webhookRequest
+}
+
+// SendMessage sends a message in reply to the request.
+func (r *webhookReplier) SendMessage(channel, message string) error {
+	_, err := r.send(&WebhookReply{Channel: channel, Text: message}, false, r.request)
+	return err
+}
+
+// SendFile sends a file in reply to the request.
+func (r *webhookReplier) SendFile(channel, name string, reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	_, err = r.send(&WebhookReply{Channel: channel, FileName: name, File: data}, false, r.request)
+	return err
+}
+
+// PrivateMessage sends a private message in reply to the request.
+func (r *webhookReplier) PrivateMessage(userID, message string) error {
+	_, err := r.send(&WebhookReply{UserID: userID, Text: message}, true, r.request)
+	return err
+}
@@ -0,0 +1,133 @@
+package comicjerk
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postWebhook posts a message to a webhook, signing it if secret is set, and returns the decoded response.
+func postWebhook(t *testing.T, w *Webhook, url, secret, body string) map[string]json.RawMessage {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, w.sign(timestamp, []byte(body)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	result := map[string]json.RawMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestWebhookOpenRequiresSecret(t *testing.T) {
+	w := NewWebhook(":0")
+	if _, err := w.Open(); err == nil {
+		w.Close()
+		t.Error("Open on every interface without a secret succeeded")
+	}
+
+	w = NewWebhook("127.0.0.1:0")
+	if _, err := w.Open(); err != nil {
+		t.Errorf("Open on loopback without a secret failed: %v", err)
+	}
+	w.Close()
+}
+
+func TestWebhookRepliesToTheirRequest(t *testing.T) {
+	bot := NewBot()
+	bot.Workers = 2
+	w := NewWebhook("")
+	w.ResponseDelay = 50 * time.Millisecond
+	w.ResponseTimeout = 2 * time.Second
+	bot.RegisterService(w)
+
+	cp := NewCommandPlugin()
+	cp.AddCommand("echo", func(bot *Bot, service Service, message Message, args string, parts []string) {
+		// The first request is answered last, so replies can not be matched by order.
+		if args == "first" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		service.SendMessage(message.Channel(), args)
+	}, nil)
+	bot.RegisterPlugin(w, cp)
+	bot.Open()
+	defer bot.Close()
+
+	server := httptest.NewServer(w)
+	defer server.Close()
+
+	wg := sync.WaitGroup{}
+	for _, text := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(text string) {
+			defer wg.Done()
+			resp := postWebhook(t, w, server.URL, "", `{"channel":"ci","user_id":"build","text":"!echo `+text+`"}`)
+			replies := []*WebhookReply{}
+			json.Unmarshal(resp["replies"], &replies)
+			if len(replies) != 1 || replies[0].Text != text {
+				t.Errorf("replies to %s = %s, want only %s", text, resp["replies"], text)
+			}
+		}(text)
+	}
+	wg.Wait()
+}
+
+func TestWebhookTrust(t *testing.T) {
+	for _, secret := range []string{"", "secret"} {
+		w := NewWebhook("")
+		w.Secret = secret
+		w.OwnerUserID = "owner"
+		w.ResponseDelay = time.Millisecond
+		messages, _ := w.Open()
+
+		server := httptest.NewServer(w)
+		postWebhook(t, w, server.URL, secret, `{"channel":"ci","user_id":"owner","moderator":true,"text":"hi"}`)
+		server.Close()
+
+		message := <-messages
+		// Only signed requests can claim to be the owner or a moderator.
+		signed := secret != ""
+		if w.IsBotOwner(message) != signed || w.IsModerator(message) != signed {
+			t.Errorf("secret %q: owner %v moderator %v, want %v", secret, w.IsBotOwner(message), w.IsModerator(message), signed)
+		}
+		w.Close()
+	}
+}
+
+func TestWebhookPrivatePerMessage(t *testing.T) {
+	w := NewWebhook("")
+	w.ResponseDelay = time.Millisecond
+	w.ResponseTimeout = time.Millisecond
+	messages, _ := w.Open()
+	defer w.Close()
+
+	server := httptest.NewServer(w)
+	defer server.Close()
+
+	postWebhook(t, w, server.URL, "", `{"channel":"ci","user_id":"build","text":"secret","private":true}`)
+	private := <-messages
+	// A later request to the same channel must not change whether the earlier message is private.
+	postWebhook(t, w, server.URL, "", `{"channel":"ci","user_id":"build","text":"public"}`)
+	public := <-messages
+
+	if !w.IsPrivate(private) || w.IsPrivate(public) {
+		t.Errorf("private %v public %v, want only the first message to be private", w.IsPrivate(private), w.IsPrivate(public))
+	}
+}
@@ -0,0 +1,1185 @@
+package comicjerk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XMPPServiceName is the service name for the XMPP service.
+const XMPPServiceName string = "XMPP"
+
+// XML namespaces used by the XMPP service.
+const (
+	xmppNSClient      = "jabber:client"
+	xmppNSStream      = "http://etherx.jabber.org/streams"
+	xmppNSTLS         = "urn:ietf:params:xml:ns:xmpp-tls"
+	xmppNSSASL        = "urn:ietf:params:xml:ns:xmpp-sasl"
+	xmppNSDiscoInfo   = "http://jabber.org/protocol/disco#info"
+	xmppNSPing        = "urn:xmpp:ping"
+	xmppNSCorrect     = "urn:xmpp:message-correct:0"
+	xmppNSUpload      = "urn:xmpp:http:upload:0"
+	xmppNSChatStates  = "http://jabber.org/protocol/chatstates"
+	xmppNSStanzaError = "urn:ietf:params:xml:ns:xmpp-stanzas"
+)
+
+// xmppMaxBackoff is the longest the service waits before retrying a failed connection.
+const xmppMaxBackoff = time.Minute
+
+// xmppIQTimeout is how long the service waits for the response to a request.
+const xmppIQTimeout = 30 * time.Second
+
+// maxXMPPHistory is the number of messages kept for each chat.
+const maxXMPPHistory = 100
+
+// XMPPStanza is a message stanza.
+type XMPPStanza struct {
+	XMLName   xml.Name     `xml:"jabber:client message"`
+	ID        string       `xml:"id,attr,omitempty"`
+	From      string       `xml:"from,attr,omitempty"`
+	To        string       `xml:"to,attr,omitempty"`
+	Type      string       `xml:"type,attr,omitempty"`
+	Body      string       `xml:"body,omitempty"`
+	Replace   *xmppReplace `xml:"urn:xmpp:message-correct:0 replace,omitempty"`
+	OOB       *xmppOOB     `xml:"jabber:x:oob x,omitempty"`
+	Delay     *xmppDelay   `xml:"urn:xmpp:delay delay,omitempty"`
+	Composing *struct{}    `xml:"http://jabber.org/protocol/chatstates composing,omitempty"`
+	Error     *XMPPError   `xml:"error,omitempty"`
+}
+
+// xmppReplace marks a message as a correction of an earlier message, as described in XEP-0308.
+type xmppReplace struct {
+	ID string `xml:"id,attr"`
+}
+
+type xmppOOB struct {
+	URL string `xml:"url"`
+}
+
+type xmppDelay struct {
+	Stamp string `xml:"stamp,attr"`
+}
+
+type xmppPresence struct {
+	XMLName xml.Name     `xml:"jabber:client presence"`
+	ID      string       `xml:"id,attr,omitempty"`
+	From    string       `xml:"from,attr,omitempty"`
+	To      string       `xml:"to,attr,omitempty"`
+	Type    string       `xml:"type,attr,omitempty"`
+	MUC     *xmppMUC     `xml:"http://jabber.org/protocol/muc x,omitempty"`
+	MUCUser *xmppMUCUser `xml:"http://jabber.org/protocol/muc#user x,omitempty"`
+	Error   *XMPPError   `xml:"error,omitempty"`
+}
+
+type xmppMUC struct {
+	History *struct {
+		MaxStanzas int `xml:"maxstanzas,attr"`
+	} `xml:"history,omitempty"`
+}
+
+type xmppMUCUser struct {
+	Items    []*xmppMUCItem `xml:"item"`
+	Statuses []struct {
+		Code int `xml:"code,attr"`
+	} `xml:"status"`
+}
+
+// xmppMUCItem is an occupant of a room, in presence and in muc#admin requests.
+type xmppMUCItem struct {
+	Affiliation string `xml:"affiliation,attr,omitempty"`
+	Role        string `xml:"role,attr,omitempty"`
+	JID         string `xml:"jid,attr,omitempty"`
+	Nick        string `xml:"nick,attr,omitempty"`
+}
+
+type xmppIQ struct {
+	XMLName xml.Name   `xml:"jabber:client iq"`
+	ID      string     `xml:"id,attr"`
+	From    string     `xml:"from,attr,omitempty"`
+	To      string     `xml:"to,attr,omitempty"`
+	Type    string     `xml:"type,attr"`
+	Payload []byte     `xml:",innerxml"`
+	Error   *XMPPError `xml:"error,omitempty"`
+}
+
+type xmppFeatures struct {
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms *struct {
+		Mechanism []string `xml:"mechanism"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
+	Session *struct {
+		Optional *struct{} `xml:"optional"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+}
+
+type xmppBind struct {
+	XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Resource string   `xml:"resource,omitempty"`
+	JID      string   `xml:"jid,omitempty"`
+}
+
+type xmppDiscoItems struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/disco#items query"`
+	Items   []struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"item"`
+}
+
+type xmppDiscoInfo struct {
+	XMLName    xml.Name `xml:"http://jabber.org/protocol/disco#info query"`
+	Identities []struct {
+		Category string `xml:"category,attr"`
+		Type     string `xml:"type,attr"`
+	} `xml:"identity"`
+	Features []struct {
+		Var string `xml:"var,attr"`
+	} `xml:"feature"`
+}
+
+type xmppMUCAdmin struct {
+	XMLName xml.Name       `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []*xmppMUCItem `xml:"item"`
+}
+
+type xmppUploadRequest struct {
+	XMLName     xml.Name `xml:"urn:xmpp:http:upload:0 request"`
+	Filename    string   `xml:"filename,attr"`
+	Size        int      `xml:"size,attr"`
+	ContentType string   `xml:"content-type,attr"`
+}
+
+type xmppUploadSlot struct {
+	XMLName xml.Name `xml:"urn:xmpp:http:upload:0 slot"`
+	Put     struct {
+		URL     string `xml:"url,attr"`
+		Headers []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"header"`
+	} `xml:"put"`
+	Get struct {
+		URL string `xml:"url,attr"`
+	} `xml:"get"`
+}
+
+// XMPPError is a stream or stanza error.
+type XMPPError struct {
+	Type       string `xml:"type,attr"`
+	Text       string `xml:"text"`
+	Conditions []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// Condition returns the defined condition of the error, eg. forbidden.
+func (e *XMPPError) Condition() string {
+	if len(e.Conditions) == 0 {
+		return ""
+	}
+	return e.Conditions[0].XMLName.Local
+}
+
+func (e *XMPPError) Error() string {
+	if e.Text != "" {
+		return fmt.Sprintf("XMPP error %s: %s", e.Condition(), e.Text)
+	}
+	return fmt.Sprintf("XMPP error %s", e.Condition())
+}
+
+// splitJID splits a JID into its bare JID and resource.
+func splitJID(jid string) (string, string) {
+	if i := strings.Index(jid, "/"); i != -1 {
+		return jid[:i], jid[i+1:]
+	}
+	return jid, ""
+}
+
+// XMPPMessage is a Message wrapper around XMPPStanza.
+type XMPPMessage struct {
+	Stanza      *XMPPStanza
+	MessageType MessageType
+	// ChannelID is the room for room messages, the bare JID of the sender for direct messages, or the occupant JID for private messages from a room.
+	ChannelID string
+	Nick      string
+	// JID is the bare JID of the sender, or their occupant JID in rooms that do not show real JIDs.
+	JID string
+}
+
+// Channel returns the channel id for this message.
+func (m *XMPPMessage) Channel() string {
+	return m.ChannelID
+}
+
+// UserName returns the user name for this message.
+func (m *XMPPMessage) UserName() string {
+	return m.Nick
+}
+
+// UserID returns the user id for this message.
+func (m *XMPPMessage) UserID() string {
+	return m.JID
+}
+
+// UserAvatar returns the avatar url for this message.
+func (m *XMPPMessage) UserAvatar() string {
+	return ""
+}
+
+// Message returns the message content for this message.
+func (m *XMPPMessage) Message() string {
+	return m.Stanza.Body
+}
+
+// RawMessage returns the raw message content for this message.
+func (m *XMPPMessage) RawMessage() string {
+	return m.Stanza.Body
+}
+
+// MessageID returns the message ID for this message, for a correction this is the ID of the corrected message.
+func (m *XMPPMessage) MessageID() string {
+	if m.Stanza.Replace != nil {
+		return m.Stanza.Replace.ID
+	}
+	return m.Stanza.ID
+}
+
+// Type returns the type of message.
+func (m *XMPPMessage) Type() MessageType {
+	return m.MessageType
+}
+
+type xmppRoom struct {
+	nick      string
+	occupants map[string]*xmppMUCItem
+}
+
+// XMPP is a Service provider for XMPP.
+// Rooms are multi-user chats (XEP-0045), any other JID is a direct chat.
+type XMPP struct {
+	sync.RWMutex
+	jid         string
+	password    string
+	joins       []string
+	messageChan chan Message
+	ctx         context.Context
+	cancel      context.CancelFunc
+	outbox      *Outbox
+	closeOnce   sync.Once
+
+	writeLock sync.Mutex
+	conn      net.Conn
+	fullJID   string
+	lastID    int64
+	pending   map[string]chan *xmppIQ
+	rooms     map[string]*xmppRoom
+	history   map[string][]Message
+
+	// Server is the address of the server, it defaults to the server found with an SRV lookup of the JID's domain.
+	Server string
+	// Nick is the nick used in rooms, it defaults to the local part of the JID.
+	Nick string
+	// Resource is the resource that is bound for the connection.
+	Resource string
+	// TLSConfig is used for STARTTLS, its ServerName must be set, it defaults to verifying the JID's domain.
+	TLSConfig *tls.Config
+	// InsecureAllowPlaintext allows logging in to a server that does not offer STARTTLS, it should only be used with a local test server.
+	InsecureAllowPlaintext bool
+	// UploadService is the JID of the HTTP upload service, if it is empty the service is discovered from the server.
+	UploadService string
+	// Client is the HTTP client used for file uploads.
+	Client      *http.Client
+	OwnerUserID string
+}
+
+// NewXMPP creates a new XMPP service for an account, eg. comicjerk@example.com.
+// The bot joins rooms, given by their bare JID, when it is opened.
+func NewXMPP(jid, password string, rooms []string) *XMPP {
+	ctx, cancel := context.WithCancel(context.Background())
+	local := jid
+	if i := strings.Index(jid, "@"); i != -1 {
+		local = jid[:i]
+	}
+	return &XMPP{
+		jid:         jid,
+		password:    password,
+		joins:       rooms,
+		messageChan: make(chan Message, 200),
+		ctx:         ctx,
+		cancel:      cancel,
+		outbox:      NewOutbox(5, time.Second, 100),
+		pending:     make(map[string]chan *xmppIQ),
+		rooms:       make(map[string]*xmppRoom),
+		history:     make(map[string][]Message),
+		Nick:        local,
+		Resource:    "comicjerk",
+		Client:      http.DefaultClient,
+	}
+}
+
+func (x *XMPP) domain() string {
+	bare, _ := splitJID(x.jid)
+	return bare[strings.Index(bare, "@")+1:]
+}
+
+func (x *XMPP) nextID() string {
+	x.Lock()
+	defer x.Unlock()
+
+	x.lastID++
+	return fmt.Sprintf("comicjerk%d.%d", time.Now().UnixNano(), x.lastID)
+}
+
+// write writes a stanza to the current connection.
+func (x *XMPP) write(v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	x.writeLock.Lock()
+	defer x.writeLock.Unlock()
+
+	if x.conn == nil {
+		return errors.New("Not connected to XMPP.")
+	}
+	_, err = x.conn.Write(data)
+	return err
+}
+
+// writeRaw writes to a connection during stream negotiation.
+func writeRaw(conn net.Conn, format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(conn, format, a...)
+	return err
+}
+
+// nextElement returns the next element of a stream.
+func nextElement(decoder *xml.Decoder) (*xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space == xmppNSStream && t.Name.Local == "error" {
+				e := &XMPPError{}
+				if err := decoder.DecodeElement(e, &t); err != nil {
+					return nil, err
+				}
+				return nil, e
+			}
+			return &t, nil
+		case xml.EndElement:
+			return nil, errors.New("XMPP stream closed.")
+		}
+	}
+}
+
+// openStream opens a stream on a connection and returns the features the server offers.
+func (x *XMPP) openStream(conn net.Conn, reader *bufio.Reader) (*xml.Decoder, *xmppFeatures, error) {
+	err := writeRaw(conn, "<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'>", x.domain(), xmppNSClient, xmppNSStream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		if t, ok := token.(xml.StartElement); ok {
+			if t.Name.Space != xmppNSStream || t.Name.Local != "stream" {
+				return nil, nil, fmt.Errorf("Expected XMPP stream, got %s.", t.Name.Local)
+			}
+			break
+		}
+	}
+
+	start, err := nextElement(decoder)
+	if err != nil {
+		return nil, nil, err
+	}
+	features := &xmppFeatures{}
+	if err := decoder.DecodeElement(features, start); err != nil {
+		return nil, nil, err
+	}
+	return decoder, features, nil
+}
+
+// connect connects and logs in to the server, binding a resource.
+func (x *XMPP) connect() (*xml.Decoder, error) {
+	addr := x.Server
+	if addr == "" {
+		addr = net.JoinHostPort(x.domain(), "5222")
+		if _, srvs, err := net.LookupSRV("xmpp-client", "tcp", x.domain()); err == nil && len(srvs) > 0 {
+			addr = net.JoinHostPort(strings.TrimSuffix(srvs[0].Target, "."), strconv.Itoa(int(srvs[0].Port)))
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(x.ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := x.negotiate(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return decoder, nil
+}
+
+func (x *XMPP) negotiate(conn net.Conn) (*xml.Decoder, error) {
+	reader := bufio.NewReader(conn)
+	decoder, features, err := x.openStream(conn, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if features.StartTLS != nil {
+		if err := writeRaw(conn, "<starttls xmlns='%s'/>", xmppNSTLS); err != nil {
+			return nil, err
+		}
+		start, err := nextElement(decoder)
+		if err != nil {
+			return nil, err
+		}
+		if start.Name.Local != "proceed" {
+			return nil, errors.New("XMPP server refused STARTTLS.")
+		}
+
+		config := x.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: x.domain()}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+
+		reader = bufio.NewReader(conn)
+		if decoder, features, err = x.openStream(conn, reader); err != nil {
+			return nil, err
+		}
+	} else if !x.InsecureAllowPlaintext {
+		return nil, errors.New("XMPP server does not support STARTTLS.")
+	}
+
+	plain := false
+	if features.Mechanisms != nil {
+		for _, m := range features.Mechanisms.Mechanism {
+			plain = plain || m == "PLAIN"
+		}
+	}
+	if !plain {
+		return nil, errors.New("XMPP server does not support PLAIN authentication.")
+	}
+
+	bare, _ := splitJID(x.jid)
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00" + bare[:strings.Index(bare+"@", "@")] + "\x00" + x.password))
+	if err := writeRaw(conn, "<auth xmlns='%s' mechanism='PLAIN'>%s</auth>", xmppNSSASL, auth); err != nil {
+		return nil, err
+	}
+	start, err := nextElement(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "success" {
+		failure := &XMPPError{}
+		decoder.DecodeElement(failure, start)
+		return nil, fmt.Errorf("XMPP authentication failed: %s", failure.Condition())
+	}
+	if err := decoder.Skip(); err != nil {
+		return nil, err
+	}
+
+	if decoder, features, err = x.openStream(conn, reader); err != nil {
+		return nil, err
+	}
+
+	bind := &xmppBind{}
+	if err := x.negotiateIQ(conn, decoder, &xmppBind{Resource: x.Resource}, bind); err != nil {
+		return nil, err
+	}
+	if features.Session != nil && features.Session.Optional == nil {
+		session := &struct {
+			XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+		}{}
+		if err := x.negotiateIQ(conn, decoder, session, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	x.writeLock.Lock()
+	x.conn = conn
+	x.writeLock.Unlock()
+
+	x.Lock()
+	x.fullJID = bind.JID
+	x.Unlock()
+
+	return decoder, nil
+}
+
+// negotiateIQ sends a request during stream negotiation, before messages are being read.
+func (x *XMPP) negotiateIQ(conn net.Conn, decoder *xml.Decoder, payload, result interface{}) error {
+	data, err := xml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	id := x.nextID()
+	data, err = xml.Marshal(&xmppIQ{ID: id, Type: "set", Payload: data})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+
+	for {
+		start, err := nextElement(decoder)
+		if err != nil {
+			return err
+		}
+		if start.Name.Local != "iq" {
+			if err := decoder.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		iq := &xmppIQ{}
+		if err := decoder.DecodeElement(iq, start); err != nil {
+			return err
+		}
+		if iq.ID == id {
+			return iq.result(result)
+		}
+	}
+}
+
+// result returns the error of a response, or decodes its payload into result.
+func (iq *xmppIQ) result(result interface{}) error {
+	if iq.Type == "error" {
+		if iq.Error == nil {
+			return &XMPPError{}
+		}
+		return iq.Error
+	}
+	if result != nil {
+		return xml.Unmarshal(iq.Payload, result)
+	}
+	return nil
+}
+
+// sendIQ sends a request and waits for its response.
+func (x *XMPP) sendIQ(iqType, to string, payload, result interface{}) error {
+	data, err := xml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	id := x.nextID()
+	response := make(chan *xmppIQ, 1)
+	x.Lock()
+	x.pending[id] = response
+	x.Unlock()
+
+	defer func() {
+		x.Lock()
+		delete(x.pending, id)
+		x.Unlock()
+	}()
+
+	if err := x.write(&xmppIQ{ID: id, To: to, Type: iqType, Payload: data}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(x.ctx, xmppIQTimeout)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case iq := <-response:
+		if iq == nil {
+			return errors.New("XMPP connection closed.")
+		}
+		return iq.result(result)
+	}
+}
+
+// online sends the bot's presence and joins its rooms.
+func (x *XMPP) online() {
+	x.write(&xmppPresence{})
+
+	x.Lock()
+	rooms := make([]string, 0, len(x.rooms))
+	for room := range x.rooms {
+		rooms = append(rooms, room)
+	}
+	x.Unlock()
+
+	for _, room := range rooms {
+		if err := x.join(room); err != nil {
+			log.Printf("Error joining xmpp room %s. %v", room, err)
+		}
+	}
+}
+
+// join sends presence to a room, without requesting any of its history.
+func (x *XMPP) join(room string) error {
+	x.Lock()
+	r := x.rooms[room]
+	r.occupants = make(map[string]*xmppMUCItem)
+	nick := r.nick
+	x.Unlock()
+
+	muc := &xmppMUC{}
+	muc.History = &struct {
+		MaxStanzas int `xml:"maxstanzas,attr"`
+	}{}
+	return x.write(&xmppPresence{To: room + "/" + nick, MUC: muc})
+}
+
+// read reads stanzas from the stream until the connection fails.
+func (x *XMPP) read(decoder *xml.Decoder) error {
+	for {
+		start, err := nextElement(decoder)
+		if err != nil {
+			return err
+		}
+
+		switch start.Name.Local {
+		case "message":
+			stanza := &XMPPStanza{}
+			if err := decoder.DecodeElement(stanza, start); err != nil {
+				return err
+			}
+			x.onMessage(stanza)
+		case "presence":
+			presence := &xmppPresence{}
+			if err := decoder.DecodeElement(presence, start); err != nil {
+				return err
+			}
+			x.onPresence(presence)
+		case "iq":
+			iq := &xmppIQ{}
+			if err := decoder.DecodeElement(iq, start); err != nil {
+				return err
+			}
+			x.onIQ(iq)
+		default:
+			if err := decoder.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// disconnected closes the current connection and fails any requests waiting for a response.
+func (x *XMPP) disconnected() {
+	x.writeLock.Lock()
+	if x.conn != nil {
+		x.conn.Close()
+		x.conn = nil
+	}
+	x.writeLock.Unlock()
+
+	x.Lock()
+	defer x.Unlock()
+
+	for id, response := range x.pending {
+		close(response)
+		delete(x.pending, id)
+	}
+}
+
+func (x *XMPP) run(decoder *xml.Decoder) {
+	for {
+		err := x.read(decoder)
+		x.disconnected()
+		if x.ctx.Err() != nil {
+			return
+		}
+
+		backoff := time.Second
+		log.Printf("Error reading from xmpp, reconnecting in %v. %v", backoff, err)
+		for {
+			select {
+			case <-x.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			if decoder, err = x.connect(); err == nil {
+				break
+			}
+			if x.ctx.Err() != nil {
+				return
+			}
+			if backoff *= 2; backoff > xmppMaxBackoff {
+				backoff = xmppMaxBackoff
+			}
+			log.Printf("Error connecting to xmpp, retrying in %v. %v", backoff, err)
+		}
+		x.online()
+	}
+}
+
+func (x *XMPP) onIQ(iq *xmppIQ) {
+	switch iq.Type {
+	case "result", "error":
+		x.Lock()
+		response := x.pending[iq.ID]
+		delete(x.pending, iq.ID)
+		x.Unlock()
+
+		if response != nil {
+			response <- iq
+		}
+		return
+	}
+
+	reply := &xmppIQ{ID: iq.ID, To: iq.From, Type: "result"}
+	payload := &struct {
+		XMLName xml.Name
+	}{}
+	xml.Unmarshal(iq.Payload, payload)
+
+	switch {
+	case iq.Type == "get" && payload.XMLName.Space == xmppNSPing:
+	case iq.Type == "get" && payload.XMLName.Space == xmppNSDiscoInfo:
+		features := ""
+		for _, f := range []string{xmppNSDiscoInfo, xmppNSPing, xmppNSCorrect, xmppNSChatStates, "jabber:x:oob"} {
+			features += fmt.Sprintf("<feature var='%s'/>", f)
+		}
+		reply.Payload = []byte(fmt.Sprintf("<query xmlns='%s'><identity category='client' type='bot' name='comicjerk'/>%s</query>", xmppNSDiscoInfo, features))
+	default:
+		reply.Type = "error"
+		reply.Payload = []byte(fmt.Sprintf("<error type='cancel'><service-unavailable xmlns='%s'/></error>", xmppNSStanzaError))
+	}
+	x.write(reply)
+}
+
+func (x *XMPP) onPresence(presence *xmppPresence) {
+	roomJID, nick := splitJID(presence.From)
+
+	x.Lock()
+	defer x.Unlock()
+
+	room := x.rooms[roomJID]
+	if room == nil || room.occupants == nil {
+		return
+	}
+
+	switch presence.Type {
+	case "error":
+		log.Printf("Error joining xmpp room %s. %v", roomJID, presence.Error)
+		delete(x.rooms, roomJID)
+		return
+	case "unavailable":
+		delete(room.occupants, nick)
+		return
+	}
+
+	item := &xmppMUCItem{}
+	if presence.MUCUser != nil && len(presence.MUCUser.Items) > 0 {
+		item = presence.MUCUser.Items[0]
+	}
+	if presence.MUCUser != nil {
+		for _, status := range presence.MUCUser.Statuses {
+			// Status 110 is the bot's own presence, the room may have changed its nick.
+			if status.Code == 110 {
+				room.nick = nick
+			}
+		}
+	}
+	room.occupants[nick] = item
+}
+
+func (x *XMPP) onMessage(stanza *XMPPStanza) {
+	// Messages without a body are chat states and receipts, delayed messages are history and offline messages.
+	if stanza.Body == "" || stanza.Delay != nil || stanza.Type == "error" {
+		return
+	}
+
+	messageType := MessageTypeCreate
+	if stanza.Replace != nil {
+		messageType = MessageTypeUpdate
+	}
+
+	bare, resource := splitJID(stanza.From)
+	m := &XMPPMessage{Stanza: stanza, MessageType: messageType}
+
+	x.Lock()
+	room := x.rooms[bare]
+	switch {
+	case room != nil && stanza.Type == "groupchat":
+		if resource == "" {
+			x.Unlock()
+			return
+		}
+		m.ChannelID, m.Nick, m.JID = bare, resource, stanza.From
+	case room != nil:
+		m.ChannelID, m.Nick, m.JID = stanza.From, resource, stanza.From
+	default:
+		m.ChannelID, m.Nick, m.JID = bare, bare, bare
+		if i := strings.Index(bare, "@"); i != -1 {
+			m.Nick = bare[:i]
+		}
+	}
+	if room != nil {
+		if item := room.occupants[resource]; item != nil && item.JID != "" {
+			m.JID, _ = splitJID(item.JID)
+		}
+	}
+
+	history := x.history[m.ChannelID]
+	if messageType == MessageTypeCreate {
+		if history = append(history, m); len(history) > maxXMPPHistory {
+			history = history[1:]
+		}
+	} else {
+		for i, h := range history {
+			if h.MessageID() == m.MessageID() {
+				history[i] = &XMPPMessage{stanza, MessageTypeCreate, m.ChannelID, m.Nick, m.JID}
+				break
+			}
+		}
+	}
+	x.history[m.ChannelID] = history
+	x.Unlock()
+
+	select {
+	case x.messageChan <- m:
+	case <-x.ctx.Done():
+	}
+}
+
+// Name returns the name of the service.
+func (x *XMPP) Name() string {
+	return XMPPServiceName
+}
+
+// Open opens the service and returns a channel which all messages will be sent on.
+func (x *XMPP) Open() (<-chan Message, error) {
+	x.Lock()
+	for _, room := range x.joins {
+		x.rooms[room] = &xmppRoom{nick: x.Nick}
+	}
+	x.Unlock()
+
+	decoder, err := x.connect()
+	if err != nil {
+		return nil, err
+	}
+	x.online()
+
+	go x.run(decoder)
+	return x.messageChan, nil
+}
+
+// Close leaves the bot's rooms and closes the connection, it will not be reopened.
+func (x *XMPP) Close() error {
+	x.closeOnce.Do(func() {
+		x.cancel()
+		x.outbox.Close()
+
+		x.writeLock.Lock()
+		defer x.writeLock.Unlock()
+
+		if x.conn != nil {
+			io.WriteString(x.conn, "<presence type='unavailable'/></stream:stream>")
+			x.conn.Close()
+			x.conn = nil
+		}
+	})
+	return nil
+}
+
+// IsMe returns whether or not a message was sent by the bot.
+func (x *XMPP) IsMe(message Message) bool {
+	x.RLock()
+	defer x.RUnlock()
+
+	if room := x.rooms[message.Channel()]; room != nil && message.UserName() == room.nick {
+		return true
+	}
+	bare, _ := splitJID(x.jid)
+	return message.UserID() == bare
+}
+
+// messageType returns the type of message sent to a JID.
+func (x *XMPP) messageType(to string) string {
+	x.RLock()
+	defer x.RUnlock()
+
+	if x.rooms[to] != nil {
+		return "groupchat"
+	}
+	return "chat"
+}
+
+func (x *XMPP) send(ctx context.Context, to, message, replace string, private bool) (string, error) {
+	stanza := &XMPPStanza{ID: x.nextID(), To: to, Type: x.messageType(to), Body: message}
+	if replace != "" {
+		stanza.Replace = &xmppReplace{replace}
+	}
+
+	err := x.outbox.SendContext(ctx, private, func() error {
+		return x.write(stanza)
+	})
+	if err != nil {
+		log.Println("Error sending xmpp message: ", err)
+		return "", err
+	}
+	return stanza.ID, nil
+}
+
+// SendMessage sends a message.
+func (x *XMPP) SendMessage(channel, message string) error {
+	_, err := x.send(context.Background(), channel, message, "", false)
+	return err
+}
+
+// SendMessageContext sends a message, giving up if the context is done before it leaves the outbox.
+func (x *XMPP) SendMessageContext(ctx context.Context, channel, message string) error {
+	_, err := x.send(ctx, channel, message, "", false)
+	return err
+}
+
+// SendMessageID sends a message and returns its id.
+func (x *XMPP) SendMessageID(channel, message string) (string, error) {
+	return x.send(context.Background(), channel, message, "", false)
+}
+
+// EditMessage sends a correction of a message.
+func (x *XMPP) EditMessage(channel, messageID, message string) error {
+	_, err := x.send(context.Background(), channel, message, messageID, false)
+	return err
+}
+
+// DeleteMessage deletes a message.
+func (x *XMPP) DeleteMessage(channel, messageID string) error {
+	return errors.New("Deleting messages not supported on XMPP.")
+}
+
+// uploadService returns the JID of the server's HTTP upload service.
+func (x *XMPP) uploadService() (string, error) {
+	x.RLock()
+	service := x.UploadService
+	x.RUnlock()
+	if service != "" {
+		return service, nil
+	}
+
+	items := &xmppDiscoItems{}
+	if err := x.sendIQ("get", x.domain(), &xmppDiscoItems{}, items); err != nil {
+		return "", err
+	}
+	for _, item := range items.Items {
+		info := &xmppDiscoInfo{}
+		if err := x.sendIQ("get", item.JID, &xmppDiscoInfo{}, info); err != nil {
+			continue
+		}
+		for _, feature := range info.Features {
+			if feature.Var == xmppNSUpload {
+				x.Lock()
+				x.UploadService = item.JID
+				x.Unlock()
+				return item.JID, nil
+			}
+		}
+	}
+	return "", errors.New("XMPP server does not support HTTP upload.")
+}
+
+// CanSendFile returns whether the server has an HTTP upload service.
+func (x *XMPP) CanSendFile(message Message) bool {
+	_, err := x.uploadService()
+	return err == nil
+}
+
+// SendFile uploads a file with HTTP upload (XEP-0363) and sends a message with its url.
+func (x *XMPP) SendFile(channel, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	service, err := x.uploadService()
+	if err != nil {
+		return err
+	}
+
+	contentType := http.DetectContentType(data)
+	slot := &xmppUploadSlot{}
+	if err := x.sendIQ("get", service, &xmppUploadRequest{Filename: name, Size: len(data), ContentType: contentType}, slot); err != nil {
+		log.Println("Error requesting xmpp upload slot: ", err)
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", slot.Put.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for _, header := range slot.Put.Headers {
+		// Only these headers are allowed by XEP-0363.
+		switch http.CanonicalHeaderKey(header.Name) {
+		case "Authorization", "Cookie", "Expires":
+			req.Header.Set(header.Name, strings.TrimSpace(header.Value))
+		}
+	}
+
+	resp, err := x.Client.Do(req.WithContext(x.ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("XMPP upload failed: %s", resp.Status)
+	}
+
+	stanza := &XMPPStanza{ID: x.nextID(), To: channel, Type: x.messageType(channel), Body: slot.Get.URL, OOB: &xmppOOB{slot.Get.URL}}
+	return x.outbox.Send(false, func() error {
+		return x.write(stanza)
+	})
+}
+
+// setMUCItem changes the affiliation or role of an occupant of a room.
+func (x *XMPP) setMUCItem(room string, item *xmppMUCItem) error {
+	return x.sendIQ("set", room, &xmppMUCAdmin{Items: []*xmppMUCItem{item}}, nil)
+}
+
+// BanUser bans a user from a room, users in rooms that do not show real JIDs can only be kicked.
+func (x *XMPP) BanUser(channel, userID string, duration int) error {
+	if strings.HasPrefix(userID, channel+"/") {
+		return x.setMUCItem(channel, &xmppMUCItem{Role: "none", Nick: strings.TrimPrefix(userID, channel+"/")})
+	}
+	return x.setMUCItem(channel, &xmppMUCItem{Affiliation: "outcast", JID: userID})
+}
+
+// UnbanUser unbans a user from a room.
+func (x *XMPP) UnbanUser(channel, userID string) error {
+	return x.setMUCItem(channel, &xmppMUCItem{Affiliation: "none", JID: userID})
+}
+
+// UserName returns the bots name.
+func (x *XMPP) UserName() string {
+	return x.Nick
+}
+
+// UserID returns the bots user id.
+func (x *XMPP) UserID() string {
+	bare, _ := splitJID(x.jid)
+	return bare
+}
+
+// Join joins a room.
+func (x *XMPP) Join(join string) error {
+	x.Lock()
+	if x.rooms[join] != nil {
+		x.Unlock()
+		return ErrAlreadyJoined
+	}
+	x.rooms[join] = &xmppRoom{nick: x.Nick}
+	x.Unlock()
+
+	return x.join(join)
+}
+
+// Typing sets that the bot is typing.
+func (x *XMPP) Typing(channel string) error {
+	return x.write(&XMPPStanza{To: channel, Type: x.messageType(channel), Composing: &struct{}{}})
+}
+
+// PrivateMessage will send a private message to a user.
+func (x *XMPP) PrivateMessage(userID, message string) error {
+	_, err := x.send(context.Background(), userID, message, "", true)
+	return err
+}
+
+// Outbox returns the queue of outgoing messages, its rate can be configured before Open.
+func (x *XMPP) Outbox() *Outbox {
+	return x.outbox
+}
+
+// SupportsPrivateMessages returns whether the service supports private messages.
+func (x *XMPP) SupportsPrivateMessages() bool {
+	return true
+}
+
+// SupportsMultiline returns whether the service supports multiline messages.
+func (x *XMPP) SupportsMultiline() bool {
+	return true
+}
+
+// CommandPrefix returns the command prefix for the service.
+func (x *XMPP) CommandPrefix() string {
+	return "!"
+}
+
+// IsBotOwner returns whether or not a message sender was the owner of the bot.
+func (x *XMPP) IsBotOwner(message Message) bool {
+	return message.UserID() == x.OwnerUserID
+}
+
+// IsPrivate returns whether or not a message was a direct message, or a private message from a room.
+func (x *XMPP) IsPrivate(message Message) bool {
+	x.RLock()
+	defer x.RUnlock()
+
+	return x.rooms[message.Channel()] == nil
+}
+
+// IsModerator returns whether or not the sender of a message is an owner or admin of the room.
+func (x *XMPP) IsModerator(message Message) bool {
+	x.RLock()
+	defer x.RUnlock()
+
+	room := x.rooms[message.Channel()]
+	if room == nil {
+		return false
+	}
+	item := room.occupants[message.UserName()]
+	return item != nil && (item.Affiliation == "owner" || item.Affiliation == "admin")
+}
+
+// ChannelCount returns the number of rooms the bot is in.
+func (x *XMPP) ChannelCount() int {
+	x.RLock()
+	defer x.RUnlock()
+
+	return len(x.rooms)
+}
+
+// SupportsMessageHistory returns if the service supports message history.
+func (x *XMPP) SupportsMessageHistory() bool {
+	return true
+}
+
+// MessageHistory returns the message history for a channel.
+func (x *XMPP) MessageHistory(channel string) []Message {
+	x.RLock()
+	defer x.RUnlock()
+
+	return append([]Message{}, x.history[channel]...)
+}
@@ -0,0 +1,192 @@
+package comicjerk
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matannoam/comicjerk/xmpptest"
+)
+
+// xmppJoinWait is how long to wait for room joins to reach the test server, which has no way to report them.
+const xmppJoinWait = 200 * time.Millisecond
+
+func newXMPPTestServer(t *testing.T) (*xmpptest.Server, string) {
+	server, err := xmpptest.NewServer("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddUser("bot", "password")
+	server.AddUser("alice", "password")
+	server.AddUser("bob", "password")
+	return server, server.RoomJID("chat")
+}
+
+func openXMPP(t *testing.T, server *xmpptest.Server, user string, rooms ...string) (*XMPP, <-chan Message) {
+	x := NewXMPP(user+"@example.com", "password", rooms)
+	x.Server = server.Addr
+	x.InsecureAllowPlaintext = true
+	messages, err := x.Open()
+	if err != nil {
+		t.Fatalf("Open %s: %v", user, err)
+	}
+	return x, messages
+}
+
+// waitForXMPPMessage returns the first message that matches, skipping the others.
+func waitForXMPPMessage(t *testing.T, messages <-chan Message, timeout time.Duration, match func(Message) bool) Message {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case message := <-messages:
+			if match(message) {
+				return message
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for an xmpp message")
+			return nil
+		}
+	}
+}
+
+func TestXMPPConnect(t *testing.T) {
+	server, room := newXMPPTestServer(t)
+	defer server.Close()
+
+	bad := NewXMPP("bot@example.com", "wrong", nil)
+	bad.Server = server.Addr
+	bad.InsecureAllowPlaintext = true
+	if _, err := bad.Open(); err == nil {
+		bad.Close()
+		t.Error("Open with a wrong password succeeded")
+	}
+
+	// The test server has no STARTTLS, which is required unless plaintext is allowed.
+	plain := NewXMPP("bot@example.com", "password", nil)
+	plain.Server = server.Addr
+	if _, err := plain.Open(); err == nil {
+		plain.Close()
+		t.Error("Open without STARTTLS succeeded")
+	}
+
+	bot, messages := openXMPP(t, server, "bot", room)
+	defer bot.Close()
+	alice, _ := openXMPP(t, server, "alice", room)
+	defer alice.Close()
+	time.Sleep(xmppJoinWait)
+
+	alice.SendMessage(room, "hello")
+	message := waitForXMPPMessage(t, messages, testTimeout, func(m Message) bool { return m.Message() == "hello" })
+	if message.Channel() != room || message.UserName() != "alice" || !strings.HasPrefix(message.UserID(), "alice@example.com") {
+		t.Errorf("message from %s (%s) in %s, want alice in %s", message.UserName(), message.UserID(), message.Channel(), room)
+	}
+	if bot.IsPrivate(message) {
+		t.Error("room message is private")
+	}
+
+	alice.PrivateMessage("bot@example.com", "psst")
+	message = waitForXMPPMessage(t, messages, testTimeout, func(m Message) bool { return m.Message() == "psst" })
+	if !bot.IsPrivate(message) {
+		t.Error("direct message is not private")
+	}
+}
+
+func TestXMPPModerators(t *testing.T) {
+	server, room := newXMPPTestServer(t)
+	defer server.Close()
+	server.SetAffiliation(room, "alice@example.com", "admin")
+
+	bot, messages := openXMPP(t, server, "bot", room)
+	defer bot.Close()
+	alice, _ := openXMPP(t, server, "alice", room)
+	defer alice.Close()
+	bob, _ := openXMPP(t, server, "bob", room)
+	defer bob.Close()
+	time.Sleep(xmppJoinWait)
+
+	alice.SendMessage(room, "from alice")
+	message := waitForXMPPMessage(t, messages, testTimeout, func(m Message) bool { return m.Message() == "from alice" })
+	if !bot.IsModerator(message) {
+		t.Error("room admin is not a moderator")
+	}
+
+	bob.SendMessage(room, "from bob")
+	message = waitForXMPPMessage(t, messages, testTimeout, func(m Message) bool { return m.Message() == "from bob" })
+	if bot.IsModerator(message) {
+		t.Error("room participant is a moderator")
+	}
+}
+
+func TestXMPPUpload(t *testing.T) {
+	server, room := newXMPPTestServer(t)
+	defer server.Close()
+
+	bot, _ := openXMPP(t, server, "bot", room)
+	defer bot.Close()
+	alice, messages := openXMPP(t, server, "alice", room)
+	defer alice.Close()
+	time.Sleep(xmppJoinWait)
+
+	if !bot.CanSendFile(nil) {
+		t.Fatal("the test server's upload service was not found")
+	}
+	data := "\x89PNG\r\n\x1a\nimage"
+	if err := bot.SendFile(room, "chart.png", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	message := waitForXMPPMessage(t, messages, testTimeout, func(m Message) bool { return strings.HasPrefix(m.Message(), "http") })
+	if uploaded, ok := server.Upload(message.Message()); !ok || string(uploaded) != data {
+		t.Errorf("upload of %s = %q, want %q", message.Message(), uploaded, data)
+	}
+}
+
+func TestXMPPReconnect(t *testing.T) {
+	server, room := newXMPPTestServer(t)
+	defer server.Close()
+
+	bot, messages := openXMPP(t, server, "bot", room)
+	defer bot.Close()
+	bob, _ := openXMPP(t, server, "bob", room)
+	defer bob.Close()
+	time.Sleep(xmppJoinWait)
+
+	server.Disconnect("bot@example.com")
+
+	// The bot reconnects after a second and joins its rooms again, messages sent before then are not in the room.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bob.SendMessage(room, "after reconnect")
+		select {
+		case message := <-messages:
+			if message.Message() == "after reconnect" {
+				return
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no message received after reconnecting")
+		}
+	}
+}
+
+func TestXMPPMessageClose(t *testing.T) {
+	x := NewXMPP("bot@example.com", "password", nil)
+	// Nothing reads the messages, so the message blocks until the service is closed.
+	x.messageChan = make(chan Message)
+
+	done := make(chan struct{})
+	go func() {
+		x.onMessage(&XMPPStanza{ID: "1", From: "alice@example.com/phone", Type: "chat", Body: "hello"})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	x.Close()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("onMessage did not return after close")
+	}
+}
@@ -0,0 +1,676 @@
+// Package xmpptest provides a local XMPP server for testing the XMPP service.
+//
+// The server supports just enough of XMPP for the service: PLAIN authentication without TLS, resource binding,
+// message routing, multi-user chat rooms on conference.<domain> and HTTP upload on upload.<domain>.
+// Rooms are created when they are first joined and always show the real JIDs of their occupants.
+package xmpptest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	nsClient     = "jabber:client"
+	nsStream     = "http://etherx.jabber.org/streams"
+	nsSASL       = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind       = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+	nsMUC        = "http://jabber.org/protocol/muc"
+	nsMUCUser    = "http://jabber.org/protocol/muc#user"
+	nsMUCAdmin   = "http://jabber.org/protocol/muc#admin"
+	nsPing       = "urn:xmpp:ping"
+	nsUpload     = "urn:xmpp:http:upload:0"
+	nsStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+)
+
+// stanza is any message, presence or iq, its children are kept as they were sent.
+type stanza struct {
+	XMLName xml.Name
+	ID      string `xml:"id,attr,omitempty"`
+	From    string `xml:"from,attr,omitempty"`
+	To      string `xml:"to,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Inner   []byte `xml:",innerxml"`
+}
+
+// payload returns the name of the first child of a stanza.
+func (s *stanza) payload() xml.Name {
+	p := &struct {
+		XMLName xml.Name
+	}{}
+	xml.Unmarshal(s.Inner, p)
+	return p.XMLName
+}
+
+func splitJID(jid string) (string, string) {
+	if i := strings.Index(jid, "/"); i != -1 {
+		return jid[:i], jid[i+1:]
+	}
+	return jid, ""
+}
+
+type client struct {
+	sync.Mutex
+	conn net.Conn
+	jid  string
+}
+
+func (c *client) send(s *stanza) {
+	data, err := xml.Marshal(s)
+	if err != nil {
+		log.Println("Error encoding xmpptest stanza: ", err)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.conn.Write(data)
+}
+
+type room struct {
+	// occupants maps nicks to full JIDs.
+	occupants    map[string]string
+	affiliations map[string]string
+}
+
+// Server is a local XMPP server.
+type Server struct {
+	sync.Mutex
+	// Domain is the domain of the server, users are user@Domain.
+	Domain string
+	// Addr is the address the server listens on.
+	Addr string
+
+	listener  net.Listener
+	upload    *httptest.Server
+	passwords map[string]string
+	clients   map[string]*client
+	rooms     map[string]*room
+	uploads   map[string][]byte
+	lastID    int
+}
+
+// NewServer starts a server for a domain, listening on a random local port.
+func NewServer(domain string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Domain:    domain,
+		Addr:      listener.Addr().String(),
+		listener:  listener,
+		passwords: make(map[string]string),
+		clients:   make(map[string]*client),
+		rooms:     make(map[string]*room),
+		uploads:   make(map[string][]byte),
+	}
+	s.upload = httptest.NewServer(http.HandlerFunc(s.serveUpload))
+
+	go s.accept()
+	return s, nil
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.upload.Close()
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range s.clients {
+		c.conn.Close()
+	}
+	return err
+}
+
+// AddUser adds a user that can log in, user is the local part of their JID.
+func (s *Server) AddUser(user, password string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.passwords[user] = password
+}
+
+// RoomJID returns the JID of a room on the server's conference service.
+func (s *Server) RoomJID(name string) string {
+	return name + "@conference." + s.Domain
+}
+
+// SetAffiliation sets the affiliation of a bare JID in a room, eg. owner, admin, member or outcast.
+func (s *Server) SetAffiliation(roomJID, jid, affiliation string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.room(roomJID).affiliations[jid] = affiliation
+	s.broadcastOccupant(roomJID, jid)
+}
+
+// Upload returns a file that has been uploaded, by the url it can be downloaded from.
+func (s *Server) Upload(url string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	data, ok := s.uploads[strings.TrimPrefix(url, s.upload.URL)]
+	return data, ok
+}
+
+// Disconnect closes the connections of a user, to test reconnecting.
+func (s *Server) Disconnect(jid string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for full, c := range s.clients {
+		if bare, _ := splitJID(full); bare == jid || full == jid {
+			c.conn.Close()
+		}
+	}
+}
+
+func (s *Server) nextID() string {
+	s.lastID++
+	return strconv.Itoa(s.lastID)
+}
+
+// room returns a room, creating it if needed, the lock must be held.
+func (s *Server) room(roomJID string) *room {
+	r := s.rooms[roomJID]
+	if r == nil {
+		r = &room{occupants: make(map[string]string), affiliations: make(map[string]string)}
+		s.rooms[roomJID] = r
+	}
+	return r
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// openStream reads the header of a stream from a client and replies with the server's features.
+func (s *Server) openStream(conn net.Conn, reader *bufio.Reader, features string) (*xml.Decoder, error) {
+	decoder := xml.NewDecoder(reader)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := token.(xml.StartElement); ok && t.Name.Local == "stream" {
+			break
+		}
+	}
+
+	s.Lock()
+	id := s.nextID()
+	s.Unlock()
+
+	_, err := fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream from='%s' id='%s' xmlns='%s' xmlns:stream='%s' version='1.0'><stream:features>%s</stream:features>", s.Domain, id, nsClient, nsStream, features)
+	return decoder, err
+}
+
+// next returns the next element of a stream, or nil when the stream is closed.
+func next(decoder *xml.Decoder) *xml.StartElement {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			return &t
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// authenticate checks a PLAIN authentication request, and returns the user that logged in.
+func (s *Server) authenticate(decoder *xml.Decoder) (string, bool) {
+	start := next(decoder)
+	if start == nil || start.Name.Space != nsSASL || start.Name.Local != "auth" {
+		return "", false
+	}
+	auth := &struct {
+		Mechanism string `xml:"mechanism,attr"`
+		Data      string `xml:",chardata"`
+	}{}
+	if err := decoder.DecodeElement(auth, start); err != nil || auth.Mechanism != "PLAIN" {
+		return "", false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth.Data))
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(string(data), "\x00")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	password, ok := s.passwords[parts[1]]
+	return parts[1], ok && password == parts[2]
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	decoder, err := s.openStream(conn, reader, fmt.Sprintf("<mechanisms xmlns='%s'><mechanism>PLAIN</mechanism></mechanisms>", nsSASL))
+	if err != nil {
+		return
+	}
+
+	user, ok := s.authenticate(decoder)
+	if !ok {
+		fmt.Fprintf(conn, "<failure xmlns='%s'><not-authorized/></failure></stream:stream>", nsSASL)
+		return
+	}
+	fmt.Fprintf(conn, "<success xmlns='%s'/>", nsSASL)
+
+	if decoder, err = s.openStream(conn, reader, fmt.Sprintf("<bind xmlns='%s'/>", nsBind)); err != nil {
+		return
+	}
+
+	c := &client{conn: conn}
+	defer s.disconnect(c)
+
+	for {
+		start := next(decoder)
+		if start == nil {
+			return
+		}
+		st := &stanza{}
+		if err := decoder.DecodeElement(st, start); err != nil {
+			return
+		}
+
+		if c.jid == "" {
+			s.bind(c, user, st)
+			continue
+		}
+
+		st.From = c.jid
+		s.route(c, st)
+	}
+}
+
+// bind binds a resource for a client, it is the only request allowed before a resource is bound.
+func (s *Server) bind(c *client, user string, st *stanza) {
+	bind := &struct {
+		XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+		Resource string   `xml:"resource"`
+	}{}
+	if st.XMLName.Local != "iq" || xml.Unmarshal(st.Inner, bind) != nil {
+		c.send(errorReply(st, "not-authorized"))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if bind.Resource == "" {
+		bind.Resource = s.nextID()
+	}
+	c.jid = fmt.Sprintf("%s@%s/%s", user, s.Domain, bind.Resource)
+	if old := s.clients[c.jid]; old != nil {
+		old.conn.Close()
+	}
+	s.clients[c.jid] = c
+
+	c.send(&stanza{XMLName: xml.Name{Space: nsClient, Local: "iq"}, ID: st.ID, Type: "result", Inner: []byte(fmt.Sprintf("<bind xmlns='%s'><jid>%s</jid></bind>", nsBind, c.jid))})
+}
+
+// disconnect removes a client and its occupants from rooms.
+func (s *Server) disconnect(c *client) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.clients[c.jid] == c {
+		delete(s.clients, c.jid)
+	}
+	for roomJID, r := range s.rooms {
+		for nick, jid := range r.occupants {
+			if jid == c.jid {
+				s.leave(roomJID, nick)
+			}
+		}
+	}
+}
+
+func errorReply(st *stanza, condition string) *stanza {
+	return &stanza{
+		XMLName: xml.Name{Space: nsClient, Local: st.XMLName.Local},
+		ID:      st.ID,
+		From:    st.To,
+		To:      st.From,
+		Type:    "error",
+		Inner:   []byte(fmt.Sprintf("<error type='cancel'><%s xmlns='%s'/></error>", condition, nsStanzas)),
+	}
+}
+
+// deliver sends a stanza to a full JID, or to every resource of a bare JID, the lock must be held.
+func (s *Server) deliver(to string, st *stanza) bool {
+	bare, resource := splitJID(to)
+	delivered := false
+	for jid, c := range s.clients {
+		if jid == to || (resource == "" && strings.HasPrefix(jid, bare+"/")) {
+			c.send(st)
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+func (s *Server) route(c *client, st *stanza) {
+	s.Lock()
+	defer s.Unlock()
+
+	to, nick := splitJID(st.To)
+	switch {
+	case strings.HasSuffix(to, "@conference."+s.Domain):
+		s.routeRoom(c, st, to, nick)
+	case st.To == "" || st.To == s.Domain || to == "upload."+s.Domain || to == "conference."+s.Domain:
+		if st.XMLName.Local == "iq" && (st.Type == "get" || st.Type == "set") {
+			c.send(s.serverIQ(st, to))
+		}
+	default:
+		if !s.deliver(st.To, st) && st.XMLName.Local != "presence" && st.Type != "error" && st.Type != "result" {
+			c.send(errorReply(st, "service-unavailable"))
+		}
+	}
+}
+
+// serverIQ answers disco, ping and upload slot requests to the server and its services.
+func (s *Server) serverIQ(st *stanza, to string) *stanza {
+	reply := &stanza{XMLName: st.XMLName, ID: st.ID, From: st.To, To: st.From, Type: "result"}
+	payload := st.payload()
+
+	switch {
+	case payload.Space == nsPing:
+	case payload.Space == nsDiscoItems && to != "upload."+s.Domain && to != "conference."+s.Domain:
+		reply.Inner = []byte(fmt.Sprintf("<query xmlns='%s'><item jid='conference.%s'/><item jid='upload.%s'/></query>", nsDiscoItems, s.Domain, s.Domain))
+	case payload.Space == nsDiscoInfo && to == "upload."+s.Domain:
+		reply.Inner = []byte(fmt.Sprintf("<query xmlns='%s'><identity category='store' type='file'/><feature var='%s'/></query>", nsDiscoInfo, nsUpload))
+	case payload.Space == nsDiscoInfo && to == "conference."+s.Domain:
+		reply.Inner = []byte(fmt.Sprintf("<query xmlns='%s'><identity category='conference' type='text'/><feature var='%s'/></query>", nsDiscoInfo, nsMUC))
+	case payload.Space == nsDiscoInfo:
+		reply.Inner = []byte(fmt.Sprintf("<query xmlns='%s'><identity category='server' type='im'/></query>", nsDiscoInfo))
+	case payload.Space == nsUpload && to == "upload."+s.Domain:
+		request := &struct {
+			XMLName  xml.Name `xml:"urn:xmpp:http:upload:0 request"`
+			Filename string   `xml:"filename,attr"`
+		}{}
+		if err := xml.Unmarshal(st.Inner, request); err != nil || request.Filename == "" {
+			return errorReply(st, "bad-request")
+		}
+		path := fmt.Sprintf("/%s/%s", s.nextID(), strings.Replace(request.Filename, "/", "_", -1))
+		s.uploads[path] = nil
+		url := s.upload.URL + path
+		reply.Inner = []byte(fmt.Sprintf("<slot xmlns='%s'><put url='%s'><header name='Authorization'>Bearer %s</header></put><get url='%s'/></slot>", nsUpload, url, uploadToken(path), url))
+	default:
+		return errorReply(st, "service-unavailable")
+	}
+	return reply
+}
+
+func uploadToken(path string) string {
+	return base64.URLEncoding.EncodeToString([]byte(path))
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	data, ok := s.uploads[r.URL.Path]
+	s.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Write(data)
+	case "PUT":
+		if r.Header.Get("Authorization") != "Bearer "+uploadToken(r.URL.Path) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if data != nil {
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.uploads[r.URL.Path] = body
+		s.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// presence returns the presence of an occupant of a room, the lock must be held.
+func (s *Server) presence(roomJID, nick, to, presenceType string, statuses ...int) *stanza {
+	r := s.rooms[roomJID]
+	jid := r.occupants[nick]
+	bare, _ := splitJID(jid)
+
+	affiliation := r.affiliations[bare]
+	if affiliation == "" {
+		affiliation = "none"
+	}
+	role := "participant"
+	switch {
+	case presenceType == "unavailable":
+		role = "none"
+	case affiliation == "owner" || affiliation == "admin":
+		role = "moderator"
+	}
+
+	inner := fmt.Sprintf("<x xmlns='%s'><item affiliation='%s' role='%s' jid='%s'/>", nsMUCUser, affiliation, role, jid)
+	for _, status := range statuses {
+		inner += fmt.Sprintf("<status code='%d'/>", status)
+	}
+	inner += "</x>"
+
+	return &stanza{XMLName: xml.Name{Space: nsClient, Local: "presence"}, From: roomJID + "/" + nick, To: to, Type: presenceType, Inner: []byte(inner)}
+}
+
+// broadcastOccupant sends the presence of the occupants of a room with a bare JID to everyone in the room, after their affiliation changed.
+func (s *Server) broadcastOccupant(roomJID, jid string) {
+	r := s.rooms[roomJID]
+	for nick, full := range r.occupants {
+		if bare, _ := splitJID(full); bare != jid {
+			continue
+		}
+		if r.affiliations[jid] == "outcast" {
+			s.leave(roomJID, nick, 301)
+			continue
+		}
+		for _, to := range r.occupants {
+			s.deliver(to, s.presence(roomJID, nick, to, ""))
+		}
+	}
+}
+
+// leave removes an occupant from a room and tells everyone in it, the lock must be held.
+func (s *Server) leave(roomJID, nick string, statuses ...int) {
+	r := s.rooms[roomJID]
+	jid := r.occupants[nick]
+	for _, to := range r.occupants {
+		st := statuses
+		if to == jid {
+			st = append(st, 110)
+		}
+		s.deliver(to, s.presence(roomJID, nick, to, "unavailable", st...))
+	}
+	delete(r.occupants, nick)
+}
+
+// join adds an occupant to a room, sending them the room's occupants and everyone their presence, the lock must be held.
+func (s *Server) join(c *client, st *stanza, roomJID, nick string) {
+	r := s.room(roomJID)
+	bare, _ := splitJID(c.jid)
+
+	if nick == "" {
+		c.send(errorReply(st, "jid-malformed"))
+		return
+	}
+	if r.affiliations[bare] == "outcast" {
+		c.send(errorReply(st, "forbidden"))
+		return
+	}
+	if jid, ok := r.occupants[nick]; ok && jid != c.jid {
+		c.send(errorReply(st, "conflict"))
+		return
+	}
+	for n, jid := range r.occupants {
+		if jid == c.jid && n != nick {
+			delete(r.occupants, n)
+		}
+	}
+	r.occupants[nick] = c.jid
+
+	for n := range r.occupants {
+		if n != nick {
+			c.send(s.presence(roomJID, n, c.jid, ""))
+		}
+	}
+	for n, to := range r.occupants {
+		if n == nick {
+			c.send(s.presence(roomJID, nick, to, "", 110))
+		} else {
+			s.deliver(to, s.presence(roomJID, nick, to, ""))
+		}
+	}
+}
+
+// admin changes the affiliation or role of occupants of a room, it can only be used by owners and admins.
+func (s *Server) admin(c *client, st *stanza, roomJID string) *stanza {
+	r := s.room(roomJID)
+	bare, _ := splitJID(c.jid)
+	if affiliation := r.affiliations[bare]; affiliation != "owner" && affiliation != "admin" {
+		return errorReply(st, "forbidden")
+	}
+
+	query := &struct {
+		XMLName xml.Name `xml:"http://jabber.org/protocol/muc#admin query"`
+		Items   []struct {
+			Affiliation string `xml:"affiliation,attr"`
+			Role        string `xml:"role,attr"`
+			JID         string `xml:"jid,attr"`
+			Nick        string `xml:"nick,attr"`
+		} `xml:"item"`
+	}{}
+	if err := xml.Unmarshal(st.Inner, query); err != nil {
+		return errorReply(st, "bad-request")
+	}
+
+	for _, item := range query.Items {
+		switch {
+		case item.Role == "none" && item.Nick != "":
+			if _, ok := r.occupants[item.Nick]; !ok {
+				return errorReply(st, "item-not-found")
+			}
+			s.leave(roomJID, item.Nick, 307)
+		case item.Affiliation != "" && item.JID != "":
+			jid, _ := splitJID(item.JID)
+			if item.Affiliation == "none" {
+				delete(r.affiliations, jid)
+			} else {
+				r.affiliations[jid] = item.Affiliation
+			}
+			s.broadcastOccupant(roomJID, jid)
+		default:
+			return errorReply(st, "bad-request")
+		}
+	}
+	return &stanza{XMLName: st.XMLName, ID: st.ID, From: st.To, To: st.From, Type: "result"}
+}
+
+// routeRoom handles a stanza sent to a room or one of its occupants, the lock must be held.
+func (s *Server) routeRoom(c *client, st *stanza, roomJID, nick string) {
+	switch st.XMLName.Local {
+	case "presence":
+		if st.Type == "unavailable" {
+			if s.rooms[roomJID] != nil && s.rooms[roomJID].occupants[nick] == c.jid {
+				s.leave(roomJID, nick)
+			}
+			return
+		}
+		s.join(c, st, roomJID, nick)
+		return
+	case "iq":
+		if st.Type != "get" && st.Type != "set" {
+			return
+		}
+		if nick == "" && st.payload().Space == nsMUCAdmin {
+			c.send(s.admin(c, st, roomJID))
+			return
+		}
+		if nick == "" && st.payload().Space == nsDiscoInfo {
+			c.send(&stanza{XMLName: st.XMLName, ID: st.ID, From: st.To, To: st.From, Type: "result", Inner: []byte(fmt.Sprintf("<query xmlns='%s'><identity category='conference' type='text'/><feature var='%s'/><feature var='muc_nonanonymous'/></query>", nsDiscoInfo, nsMUC))})
+			return
+		}
+	}
+
+	r := s.rooms[roomJID]
+	sender := ""
+	if r != nil {
+		for n, jid := range r.occupants {
+			if jid == c.jid {
+				sender = n
+			}
+		}
+	}
+	if sender == "" {
+		if st.Type != "error" && st.Type != "result" {
+			c.send(errorReply(st, "not-acceptable"))
+		}
+		return
+	}
+
+	if nick == "" {
+		if st.XMLName.Local != "message" || st.Type != "groupchat" {
+			c.send(errorReply(st, "bad-request"))
+			return
+		}
+		// Messages are reflected to the sender too, with their id unchanged.
+		for _, to := range r.occupants {
+			s.deliver(to, &stanza{XMLName: st.XMLName, ID: st.ID, From: roomJID + "/" + sender, To: to, Type: st.Type, Inner: st.Inner})
+		}
+		return
+	}
+
+	to, ok := r.occupants[nick]
+	if !ok {
+		c.send(errorReply(st, "item-not-found"))
+		return
+	}
+	s.deliver(to, &stanza{XMLName: st.XMLName, ID: st.ID, From: roomJID + "/" + sender, To: to, Type: st.Type, Inner: st.Inner})
+}